@@ -1,13 +1,17 @@
 package main
 
 import (
+	"context"
 	"crypto/ecdsa"
 	"crypto/x509"
+	"database/sql"
+	"encoding/json"
 	"encoding/pem"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
 	"strings"
@@ -17,6 +21,8 @@ import (
 	"github.com/aws/aws-sdk-go/service/ses"
 	"github.com/kelseyhightower/envconfig"
 	"github.com/weberc2/auth/pkg/auth"
+	"github.com/weberc2/auth/pkg/auth/client"
+	"github.com/weberc2/auth/pkg/auth/types"
 	"github.com/weberc2/auth/pkg/pgtokenstore"
 	"github.com/weberc2/auth/pkg/pguserstore"
 	pz "github.com/weberc2/httpeasy"
@@ -29,18 +35,150 @@ const (
 )
 
 type Config struct {
-	Addr                    string     `envconfig:"AUTH_ADDR"                      default:"127.0.0.1:8080" yaml:"addr"`
-	HostName                string     `envconfig:"AUTH_HOST_NAME"                                          yaml:"hostName"`
-	Issuer                  string     `envconfig:"AUTH_ISSUER"                                             yaml:"issuer"`
-	Audience                string     `envconfig:"AUTH_AUDIENCE"                                           yaml:"audience"`
-	CodeSigningKey          PrivateKey `envconfig:"AUTH_CODE_SIGNING_KEY"                                   yaml:"codeSigningKey"`
-	AccessSigningKey        PrivateKey `envconfig:"AUTH_ACCESS_SIGNING_KEY"                                 yaml:"accessSigningKey"`
-	RefreshSigningKey       PrivateKey `envconfig:"AUTH_REFRESH_SIGNING_KEY"                                yaml:"refreshSigningKey"`
-	ResetSigningKey         PrivateKey `envconfig:"AUTH_RESET_SIGNING_KEY"                                  yaml:"resetSigningKey"`
-	NotificationSender      string     `envconfig:"AUTH_NOTIFICATION_SENDER"                                yaml:"notificationSender"`
-	DefaultRedirectLocation string     `envconfig:"AUTH_DEFAULT_REDIRECT_LOCATION"                          yaml:"defaultRedirectLocation"`
-	RedirectDomain          string     `envconfig:"AUTH_REDIRECT_DOMAIN"                                    yaml:"redirectDomain"`
-	BaseURL                 BaseURL    `envconfig:"AUTH_BASE_URL"                                           yaml:"baseURL"`
+	Addr                    string  `envconfig:"AUTH_ADDR"                      default:"127.0.0.1:8080" yaml:"addr"`
+	HostName                string  `envconfig:"AUTH_HOST_NAME"                                          yaml:"hostName"`
+	Issuer                  string  `envconfig:"AUTH_ISSUER"                                             yaml:"issuer"`
+	Audience                string  `envconfig:"AUTH_AUDIENCE"                                           yaml:"audience"`
+	CodeSigningKey          KeyRing `envconfig:"AUTH_CODE_SIGNING_KEY"                                   yaml:"codeSigningKey"`
+	AccessSigningKey        KeyRing `envconfig:"AUTH_ACCESS_SIGNING_KEY"                                 yaml:"accessSigningKey"`
+	RefreshSigningKey       KeyRing `envconfig:"AUTH_REFRESH_SIGNING_KEY"                                yaml:"refreshSigningKey"`
+	ResetSigningKey         KeyRing `envconfig:"AUTH_RESET_SIGNING_KEY"                                  yaml:"resetSigningKey"`
+	NotificationSender      string  `envconfig:"AUTH_NOTIFICATION_SENDER"                                yaml:"notificationSender"`
+	DefaultRedirectLocation string  `envconfig:"AUTH_DEFAULT_REDIRECT_LOCATION"                          yaml:"defaultRedirectLocation"`
+	RedirectDomain          string  `envconfig:"AUTH_REDIRECT_DOMAIN"                                    yaml:"redirectDomain"`
+	BaseURL                 BaseURL `envconfig:"AUTH_BASE_URL"                                           yaml:"baseURL"`
+
+	// TOTPEncryptionKey encrypts users' TOTP secrets at rest. If it's unset,
+	// two-factor authentication is unavailable.
+	TOTPEncryptionKey string `envconfig:"AUTH_TOTP_ENCRYPTION_KEY" yaml:"totpEncryptionKey"`
+
+	// ThrottleStore selects where failed logins and sent notifications are
+	// tracked for throttling: `postgres` (the default) or `memory`, which is
+	// only suitable for a single instance.
+	ThrottleStore string `envconfig:"AUTH_THROTTLE_STORE" default:"postgres" yaml:"throttleStore"`
+
+	// TrustedProxies are the CIDR networks or IP addresses of the reverse
+	// proxies in front of the service. Logins are throttled by the client IP
+	// address which they report in `X-Forwarded-For`; without any, they're
+	// throttled by the remote address.
+	TrustedProxies []string `envconfig:"AUTH_TRUSTED_PROXIES" yaml:"trustedProxies"`
+
+	// RefreshGracePeriod is how long a rotated refresh token can be presented
+	// again (e.g., by parallel requests from the same browser) and get the
+	// tokens which replaced it rather than revoking its session. Rotations
+	// are remembered in memory, so this only covers requests handled by the
+	// same instance.
+	RefreshGracePeriod time.Duration `envconfig:"AUTH_REFRESH_GRACE_PERIOD" default:"10s" yaml:"refreshGracePeriod"`
+
+	// LoginFreeAttempts is the number of failed logins allowed before
+	// further attempts are delayed by `LoginBaseDelay`, doubling with each
+	// failure up to `LoginMaxDelay`.
+	LoginFreeAttempts int           `envconfig:"AUTH_LOGIN_FREE_ATTEMPTS" default:"5"  yaml:"loginFreeAttempts"`
+	LoginBaseDelay    time.Duration `envconfig:"AUTH_LOGIN_BASE_DELAY"    default:"1s" yaml:"loginBaseDelay"`
+	LoginMaxDelay     time.Duration `envconfig:"AUTH_LOGIN_MAX_DELAY"     default:"5m" yaml:"loginMaxDelay"`
+
+	// LoginLockoutThreshold is the number of failed logins after which a
+	// user is locked out for `LoginLockoutDuration` and notified. If it's
+	// zero, users aren't locked out.
+	LoginLockoutThreshold int           `envconfig:"AUTH_LOGIN_LOCKOUT_THRESHOLD"                 yaml:"loginLockoutThreshold"`
+	LoginLockoutDuration  time.Duration `envconfig:"AUTH_LOGIN_LOCKOUT_DURATION"  default:"15m" yaml:"loginLockoutDuration"`
+
+	// NotificationAddressCooldown and NotificationUserCooldown are the
+	// minimum times between registration or forgot-password emails to the
+	// same address or for the same user. At most `NotificationBudget` such
+	// emails are sent per `NotificationBudgetPeriod`; if the budget is zero,
+	// it's unlimited.
+	NotificationAddressCooldown time.Duration `envconfig:"AUTH_NOTIFICATION_ADDRESS_COOLDOWN" default:"5m"  yaml:"notificationAddressCooldown"`
+	NotificationUserCooldown    time.Duration `envconfig:"AUTH_NOTIFICATION_USER_COOLDOWN"    default:"5m"  yaml:"notificationUserCooldown"`
+	NotificationBudget          int           `envconfig:"AUTH_NOTIFICATION_BUDGET"           default:"500" yaml:"notificationBudget"`
+	NotificationBudgetPeriod    time.Duration `envconfig:"AUTH_NOTIFICATION_BUDGET_PERIOD"    default:"24h" yaml:"notificationBudgetPeriod"`
+
+	// PasswordMinScore is the minimum zxcvbn strength score (0-4) for new
+	// passwords. PasswordMinLength and PasswordMaxLength bound the number of
+	// characters; zero means unbounded.
+	PasswordMinScore  int `envconfig:"AUTH_PASSWORD_MIN_SCORE"  default:"3" yaml:"passwordMinScore"`
+	PasswordMinLength int `envconfig:"AUTH_PASSWORD_MIN_LENGTH"             yaml:"passwordMinLength"`
+	PasswordMaxLength int `envconfig:"AUTH_PASSWORD_MAX_LENGTH"             yaml:"passwordMaxLength"`
+
+	// BreachedPasswordsDir is a directory of breached password hashes split
+	// into files by hash prefix (see `auth.BreachedPasswordPolicy`). If it's
+	// empty, passwords aren't checked against breaches.
+	BreachedPasswordsDir string `envconfig:"AUTH_BREACHED_PASSWORDS_DIR" yaml:"breachedPasswordsDir"`
+
+	// PasswordHistory is the number of previous passwords which a user may
+	// not reuse. If it's zero, only the current password is blocked from
+	// being reused.
+	PasswordHistory int `envconfig:"AUTH_PASSWORD_HISTORY" yaml:"passwordHistory"`
+
+	// PasswordHashAlgorithm is the algorithm for new password hashes:
+	// `argon2id` or `bcrypt`. Existing hashes made with a different
+	// algorithm or with weaker parameters are rehashed on login.
+	PasswordHashAlgorithm string `envconfig:"AUTH_PASSWORD_HASH_ALGORITHM" default:"argon2id" yaml:"passwordHashAlgorithm"`
+	PasswordBcryptCost    int    `envconfig:"AUTH_PASSWORD_BCRYPT_COST"    default:"10"       yaml:"passwordBcryptCost"`
+
+	// PasswordArgon2Memory is in KiB.
+	PasswordArgon2Memory      uint32 `envconfig:"AUTH_PASSWORD_ARGON2_MEMORY"      default:"65536" yaml:"passwordArgon2Memory"`
+	PasswordArgon2Iterations  uint32 `envconfig:"AUTH_PASSWORD_ARGON2_ITERATIONS"  default:"3"     yaml:"passwordArgon2Iterations"`
+	PasswordArgon2Parallelism uint8  `envconfig:"AUTH_PASSWORD_ARGON2_PARALLELISM" default:"4"     yaml:"passwordArgon2Parallelism"`
+
+	// NotificationService selects how notification emails are sent: `ses`
+	// (the default), `smtp`, `webhook` or `console`. `console` writes them
+	// to ConsoleNotificationFile (or stdout, if it's empty) for local
+	// development.
+	NotificationService     string `envconfig:"AUTH_NOTIFICATION_SERVICE" default:"ses" yaml:"notificationService"`
+	ConsoleNotificationFile string `envconfig:"AUTH_CONSOLE_NOTIFICATION_FILE"          yaml:"consoleNotificationFile"`
+
+	// NotificationTemplatesDir holds localized notification templates (see
+	// `auth.LoadNotificationTemplates`). Notifications whose locale has no
+	// templates fall back to DefaultLocale and then to the built-in English
+	// templates. Preview them with `auth preview-templates`.
+	NotificationTemplatesDir string `envconfig:"AUTH_NOTIFICATION_TEMPLATES_DIR"              yaml:"notificationTemplatesDir"`
+	DefaultLocale            string `envconfig:"AUTH_DEFAULT_LOCALE"             default:"en" yaml:"defaultLocale"`
+
+	// SMTPAddr is the SMTP server's `host:port`. SMTPSecurity is one of
+	// `starttls` (the default), `tls` (implicit TLS) or `none`. If
+	// SMTPUsername is empty, no authentication is attempted.
+	SMTPAddr     string `envconfig:"AUTH_SMTP_ADDR"                         yaml:"smtpAddr"`
+	SMTPSecurity string `envconfig:"AUTH_SMTP_SECURITY" default:"starttls" yaml:"smtpSecurity"`
+	SMTPUsername string `envconfig:"AUTH_SMTP_USERNAME"                     yaml:"smtpUsername"`
+	SMTPPassword string `envconfig:"AUTH_SMTP_PASSWORD"                     yaml:"smtpPassword"`
+
+	// WebhookEndpoints receive the notifications as signed JSON POSTs when
+	// the `webhook` notification service is selected. In the environment,
+	// these are given as a JSON list of `{"url": ..., "secret": ...}`
+	// objects, which may also list the notification `types` which the
+	// endpoint receives (all of them by default) and set `includeToken` to
+	// send it the notifications' tokens (which are left out by default).
+	// Each request times out after WebhookTimeout and is attempted up to
+	// WebhookMaxAttempts times. The retries happen during the request which
+	// caused the notification unless NotificationOutbox is enabled, so an
+	// unreachable endpoint delays it by about half a minute by default.
+	WebhookEndpoints   WebhookEndpoints `envconfig:"AUTH_WEBHOOK_ENDPOINTS"                   yaml:"webhookEndpoints"`
+	WebhookTimeout     time.Duration    `envconfig:"AUTH_WEBHOOK_TIMEOUT"      default:"10s" yaml:"webhookTimeout"`
+	WebhookMaxAttempts int              `envconfig:"AUTH_WEBHOOK_MAX_ATTEMPTS" default:"3"   yaml:"webhookMaxAttempts"`
+
+	// NotificationOutbox enables the durable notification outbox:
+	// notifications are written to postgres and delivered by a background
+	// worker, so requests succeed even if the notification service is down.
+	// Failed deliveries are retried with exponential backoff from
+	// OutboxBaseDelay up to OutboxMaxDelay; after OutboxMaxAttempts, the
+	// notification is dead-lettered (see `cmd/outbox`). The outbox is polled
+	// every OutboxInterval.
+	//
+	// The outbox is opt-in. Enabling it creates the outbox table on startup,
+	// and notification failures are no longer reported to the requests
+	// which caused them. The table holds the notifications' tokens in
+	// plaintext until they're delivered (or indefinitely, once they're
+	// dead-lettered), so restrict access to it and to its backups.
+	NotificationOutbox bool          `envconfig:"AUTH_NOTIFICATION_OUTBOX"  default:"false" yaml:"notificationOutbox"`
+	OutboxMaxAttempts  int           `envconfig:"AUTH_OUTBOX_MAX_ATTEMPTS"  default:"10"    yaml:"outboxMaxAttempts"`
+	OutboxBaseDelay    time.Duration `envconfig:"AUTH_OUTBOX_BASE_DELAY"    default:"30s"   yaml:"outboxBaseDelay"`
+	OutboxMaxDelay     time.Duration `envconfig:"AUTH_OUTBOX_MAX_DELAY"     default:"1h"    yaml:"outboxMaxDelay"`
+	OutboxInterval     time.Duration `envconfig:"AUTH_OUTBOX_INTERVAL"      default:"5s"    yaml:"outboxInterval"`
+
+	// OIDCClients are the OpenID Connect relying parties. In the
+	// environment, these are given as a JSON list.
+	OIDCClients OIDCClients `envconfig:"AUTH_OIDC_CLIENTS" yaml:"oidcClients"`
 }
 
 func LoadConfig() (*Config, error) {
@@ -59,10 +197,8 @@ func LoadConfig() (*Config, error) {
 		if !os.IsNotExist(err) {
 			return nil, fmt.Errorf("reading config file: %w", err)
 		}
-
-		if err := yaml.UnmarshalStrict(data, &c); err != nil {
-			return nil, fmt.Errorf("unmarshaling config file: %w", err)
-		}
+	} else if err := yaml.UnmarshalStrict(data, &c); err != nil {
+		return nil, fmt.Errorf("unmarshaling config file: %w", err)
 	}
 
 	if err := envconfig.Process(envVarPrefix, &c); err != nil {
@@ -86,19 +222,20 @@ func (c *Config) Validate() error {
 		if c.Audience == "" {
 			return "audience", "AUDIENCE"
 		}
-		if c.CodeSigningKey == (PrivateKey{}) {
+		if c.CodeSigningKey.Active == (PrivateKey{}) {
 			return "codeSigningKey", "CODE_SIGNING_KEY"
 		}
-		if c.AccessSigningKey == (PrivateKey{}) {
+		if c.AccessSigningKey.Active == (PrivateKey{}) {
 			return "accessSigningKey", "ACCESS_SIGNING_KEY"
 		}
-		if c.RefreshSigningKey == (PrivateKey{}) {
+		if c.RefreshSigningKey.Active == (PrivateKey{}) {
 			return "refreshSigningKey", "REFRESH_SIGNING_KEY"
 		}
-		if c.ResetSigningKey == (PrivateKey{}) {
+		if c.ResetSigningKey.Active == (PrivateKey{}) {
 			return "resetSigningKey", "RESET_SIGNING_KEY"
 		}
-		if c.NotificationSender == "" {
+		if c.NotificationSender == "" && (c.NotificationService == "ses" ||
+			c.NotificationService == "smtp") {
 			return "notificationSender", "NOTIFICATION_SENDER"
 		}
 		if c.RedirectDomain == "" {
@@ -107,6 +244,12 @@ func (c *Config) Validate() error {
 		if c.BaseURL == "" {
 			return "baseURL", "BASE_URL"
 		}
+		if c.NotificationService == "smtp" && c.SMTPAddr == "" {
+			return "smtpAddr", "SMTP_ADDR"
+		}
+		if c.NotificationService == "webhook" && len(c.WebhookEndpoints) < 1 {
+			return "webhookEndpoints", "WEBHOOK_ENDPOINTS"
+		}
 		return "", ""
 	}(); y != "" {
 		return fmt.Errorf(
@@ -123,11 +266,10 @@ func (c *Config) Run() error {
 	if err := c.Validate(); err != nil {
 		return err
 	}
-	sess, err := session.NewSession()
+	trustedProxies, err := auth.ParseTrustedProxies(c.TrustedProxies)
 	if err != nil {
-		return fmt.Errorf("creating AWS session: %w", err)
+		return fmt.Errorf("parsing trusted proxies: %w", err)
 	}
-
 	tokenStore, err := pgtokenstore.OpenEnv()
 	if err != nil {
 		return fmt.Errorf("opening token store database connection: %w", err)
@@ -136,6 +278,39 @@ func (c *Config) Run() error {
 		return fmt.Errorf("ensuring tokens table exists: %w", err)
 	}
 
+	codeStore := (*pgtokenstore.PGCodeStore)((*sql.DB)(tokenStore))
+	if err := codeStore.EnsureTable(); err != nil {
+		return fmt.Errorf("ensuring codes table exists: %w", err)
+	}
+
+	var (
+		loginAttempts types.LoginAttemptStore
+		rateLimits    types.RateLimitStore
+	)
+	switch c.ThrottleStore {
+	case "memory":
+		loginAttempts = &auth.MemLoginAttemptStore{}
+		rateLimits = &auth.MemRateLimitStore{}
+	case "postgres":
+		attemptStore := (*pgtokenstore.PGLoginAttemptStore)(
+			(*sql.DB)(tokenStore),
+		)
+		if err := attemptStore.EnsureTable(); err != nil {
+			return fmt.Errorf("ensuring login attempts table exists: %w", err)
+		}
+		loginAttempts = attemptStore
+
+		rateLimitStore := (*pgtokenstore.PGRateLimitStore)(
+			(*sql.DB)(tokenStore),
+		)
+		if err := rateLimitStore.EnsureTable(); err != nil {
+			return fmt.Errorf("ensuring rate limits table exists: %w", err)
+		}
+		rateLimits = rateLimitStore
+	default:
+		return fmt.Errorf("unsupported throttle store: `%s`", c.ThrottleStore)
+	}
+
 	userStore, err := pguserstore.OpenEnv()
 	if err != nil {
 		return fmt.Errorf("opening user store database connection: %w", err)
@@ -144,47 +319,205 @@ func (c *Config) Run() error {
 		return fmt.Errorf("ensuring users table exists: %w", err)
 	}
 
+	credentialStore := (*pguserstore.PGWebAuthnCredentialStore)(
+		(*sql.DB)(userStore),
+	)
+	if err := credentialStore.EnsureTable(); err != nil {
+		return fmt.Errorf(
+			"ensuring webauthn credentials table exists: %w",
+			err,
+		)
+	}
+
+	// Passkeys are scoped to the host which serves the login page.
+	baseURL, err := url.Parse(c.BaseURL.Std())
+	if err != nil {
+		return fmt.Errorf("parsing base URL: %w", err)
+	}
+
+	passwordPolicy := auth.PasswordPolicies{
+		auth.ZxcvbnPolicy{MinScore: c.PasswordMinScore},
+		auth.LengthPolicy{Min: c.PasswordMinLength, Max: c.PasswordMaxLength},
+		auth.PasswordHistoryPolicy{},
+	}
+	if c.BreachedPasswordsDir != "" {
+		passwordPolicy = append(
+			passwordPolicy,
+			auth.BreachedPasswordPolicy{Dir: c.BreachedPasswordsDir},
+		)
+	}
+
+	tokenURL := auth.TokenURL("https://" + c.HostName)
+	templates, err := c.notificationTemplates()
+	if err != nil {
+		return err
+	}
+	emailSettings := auth.DefaultEmailSettings
+	emailSettings.Templates = templates
+	var notifications types.NotificationService
+	switch c.NotificationService {
+	case "ses":
+		sess, err := session.NewSession()
+		if err != nil {
+			return fmt.Errorf("creating AWS session: %w", err)
+		}
+		notifications = &auth.SESNotificationService{
+			Client:        ses.New(sess),
+			Sender:        c.NotificationSender,
+			TokenURL:      tokenURL,
+			EmailSettings: emailSettings,
+		}
+	case "smtp":
+		notifications = &auth.SMTPNotificationService{
+			Addr:          c.SMTPAddr,
+			Security:      auth.SMTPSecurity(c.SMTPSecurity),
+			Username:      c.SMTPUsername,
+			Password:      c.SMTPPassword,
+			Sender:        c.NotificationSender,
+			TokenURL:      tokenURL,
+			EmailSettings: emailSettings,
+		}
+	case "console":
+		console := auth.ConsoleNotificationService{
+			// Locally, the server is typically served over plain HTTP, so
+			// the links use the base URL rather than `https`.
+			TokenURL:      auth.TokenURL(c.BaseURL.Std()),
+			EmailSettings: emailSettings,
+		}
+		if c.ConsoleNotificationFile != "" {
+			file, err := os.OpenFile(
+				c.ConsoleNotificationFile,
+				os.O_WRONLY|os.O_CREATE|os.O_APPEND,
+				0600,
+			)
+			if err != nil {
+				return fmt.Errorf("opening console notification file: %w", err)
+			}
+			defer file.Close()
+			console.Writer = file
+		}
+		notifications = &console
+	case "webhook":
+		notifications = &auth.WebhookNotificationService{
+			Endpoints:   c.WebhookEndpoints,
+			Timeout:     c.WebhookTimeout,
+			MaxAttempts: c.WebhookMaxAttempts,
+			TimeFunc:    time.Now,
+		}
+	default:
+		return fmt.Errorf(
+			"unsupported notification service: `%s`",
+			c.NotificationService,
+		)
+	}
+
+	var outboxWorker *auth.OutboxWorker
+	if c.NotificationOutbox {
+		outbox := (*pgtokenstore.PGOutboxStore)((*sql.DB)(tokenStore))
+		if err := outbox.EnsureTable(); err != nil {
+			return fmt.Errorf("ensuring outbox table exists: %w", err)
+		}
+		outboxWorker = &auth.OutboxWorker{
+			Outbox:        outbox,
+			Notifications: notifications,
+			BaseDelay:     c.OutboxBaseDelay,
+			MaxDelay:      c.OutboxMaxDelay,
+			MaxAttempts:   c.OutboxMaxAttempts,
+			Interval:      c.OutboxInterval,
+			BatchSize:     100,
+			Lease:         5 * time.Minute,
+			TimeFunc:      time.Now,
+		}
+		notifications = &auth.OutboxNotificationService{
+			Outbox:   outbox,
+			TimeFunc: time.Now,
+		}
+	}
+
+	var passwordHasher auth.PasswordHasher
+	switch c.PasswordHashAlgorithm {
+	case "argon2id":
+		passwordHasher = auth.Argon2idHasher{
+			Memory:      c.PasswordArgon2Memory,
+			Iterations:  c.PasswordArgon2Iterations,
+			Parallelism: c.PasswordArgon2Parallelism,
+		}
+	case "bcrypt":
+		passwordHasher = auth.BcryptHasher{Cost: c.PasswordBcryptCost}
+	default:
+		return fmt.Errorf(
+			"unsupported password hash algorithm: `%s`",
+			c.PasswordHashAlgorithm,
+		)
+	}
+
 	authService := auth.AuthHTTPService{
 		AuthService: auth.AuthService{
 			Tokens: tokenStore,
-			Creds:  auth.CredStore{Users: userStore},
+			Creds: auth.CredStore{
+				Users:           userStore,
+				Policy:          passwordPolicy,
+				PasswordHistory: c.PasswordHistory,
+				Hasher:          passwordHasher,
+			},
 			Codes: auth.TokenFactory{
 				Issuer:        c.Issuer,
 				Audience:      c.Audience,
 				TokenValidity: time.Minute,
-				SigningKey:    c.CodeSigningKey.Std(),
+				SigningKey:    c.CodeSigningKey.Active.Std(),
+				RetiredKeys:   c.CodeSigningKey.Retired,
+			},
+			RedeemedCodes: codeStore,
+			TOTP: auth.TOTP{
+				Issuer:        c.HostName,
+				EncryptionKey: c.TOTPEncryptionKey,
+			},
+			WebAuthn: auth.WebAuthn{
+				RPID:        baseURL.Hostname(),
+				RPName:      c.HostName,
+				Origin:      baseURL.Scheme + "://" + baseURL.Host,
+				Credentials: credentialStore,
+			},
+			Throttle: auth.LoginThrottle{
+				Attempts:         loginAttempts,
+				FreeAttempts:     c.LoginFreeAttempts,
+				BaseDelay:        c.LoginBaseDelay,
+				MaxDelay:         c.LoginMaxDelay,
+				LockoutThreshold: c.LoginLockoutThreshold,
+				LockoutDuration:  c.LoginLockoutDuration,
+				Window:           24 * time.Hour,
+			},
+			TrustedProxies: trustedProxies,
+			RefreshGrace:   &auth.RefreshGrace{Period: c.RefreshGracePeriod},
+			NotificationLimits: auth.NotificationLimiter{
+				Windows:         rateLimits,
+				AddressCooldown: c.NotificationAddressCooldown,
+				UserCooldown:    c.NotificationUserCooldown,
+				Budget:          c.NotificationBudget,
+				BudgetPeriod:    c.NotificationBudgetPeriod,
 			},
 			ResetTokens: auth.ResetTokenFactory{
 				Issuer:        c.Issuer,
 				Audience:      c.Audience,
 				TokenValidity: 1 * time.Hour,
-				SigningKey:    c.ResetSigningKey.Std(),
-			},
-			Notifications: &auth.SESNotificationService{
-				Client: ses.New(sess),
-				Sender: c.NotificationSender,
-				TokenURL: func(tok string) string {
-					return fmt.Sprintf(
-						"https://%s/confirm?t=%s",
-						c.HostName,
-						tok,
-					)
-				},
-				RegistrationSettings:   auth.DefaultRegistrationSettings,
-				ForgotPasswordSettings: auth.DefaultForgotPasswordSettings,
+				SigningKey:    c.ResetSigningKey.Active.Std(),
+				RetiredKeys:   c.ResetSigningKey.Retired,
 			},
+			Notifications: notifications,
 			TokenDetails: auth.TokenDetailsFactory{
 				AccessTokens: auth.TokenFactory{
 					Issuer:        c.Issuer,
 					Audience:      c.Audience,
 					TokenValidity: 15 * time.Minute,
-					SigningKey:    c.AccessSigningKey.Std(),
+					SigningKey:    c.AccessSigningKey.Active.Std(),
+					RetiredKeys:   c.AccessSigningKey.Retired,
 				},
 				RefreshTokens: auth.TokenFactory{
 					Issuer:        c.Issuer,
 					Audience:      c.Audience,
 					TokenValidity: 7 * 24 * time.Hour,
-					SigningKey:    c.RefreshSigningKey.Std(),
+					SigningKey:    c.RefreshSigningKey.Active.Std(),
+					RetiredKeys:   c.RefreshSigningKey.Retired,
 				},
 				TimeFunc: time.Now,
 			},
@@ -192,6 +525,15 @@ func (c *Config) Run() error {
 		},
 	}
 
+	// Access tokens signed by a retired key remain valid until they expire,
+	// so the sessions routes verify them against the whole key ring.
+	authenticator := client.Authenticator{
+		KeyFunc: authService.TokenDetails.AccessTokens.VerificationKey,
+	}
+	authService.Authenticate = func(h pz.Handler) pz.Handler {
+		return authenticator.Auth(client.AuthTypeClientProgram{}, h)
+	}
+
 	webServer := auth.WebServer{
 		AuthService:             authService.AuthService,
 		BaseURL:                 c.BaseURL.Std(),
@@ -199,10 +541,25 @@ func (c *Config) Run() error {
 		DefaultRedirectLocation: c.DefaultRedirectLocation,
 	}
 
+	oidcProvider := auth.OIDCProvider{
+		AuthService: authService.AuthService,
+		BaseURL:     c.BaseURL.Std(),
+		Clients:     c.OIDCClients,
+		IDTokens: auth.TokenFactory{
+			TokenValidity: 15 * time.Minute,
+			SigningKey:    c.AccessSigningKey.Active.Std(),
+			RetiredKeys:   c.AccessSigningKey.Retired,
+		},
+	}
+
+	if outboxWorker != nil {
+		go outboxWorker.Run(context.Background())
+	}
+
 	log.Printf(`{"message": "listening on %s"}`, c.Addr)
 	if err := http.ListenAndServe(
 		c.Addr,
-		pz.Register(
+		auth.RemoteAddr(pz.Register(
 			pz.JSONLog(os.Stderr),
 			append(
 				authService.Routes(),
@@ -216,12 +573,30 @@ func (c *Config) Run() error {
 					Method:  "POST",
 					Handler: webServer.LoginHandler,
 				},
+				webServer.WebAuthnLoginRoute(),
+				webServer.WebAuthnLoginFinishRoute(),
 				webServer.RegistrationFormRoute(),
 				webServer.RegistrationHandlerRoute(),
 				webServer.RegistrationConfirmationFormRoute(),
 				webServer.RegistrationConfirmationHandlerRoute(),
+				webServer.EmailChangeConfirmationFormRoute(),
+				webServer.EmailChangeConfirmationHandlerRoute(),
+				webServer.MagicLinkFormRoute(),
+				webServer.MagicLinkHandlerRoute(),
+				webServer.MagicLinkConfirmationFormRoute(),
+				webServer.MagicLinkConfirmationHandlerRoute(),
+				webServer.PasswordResetFormRoute(),
+				webServer.PasswordResetHandlerRoute(),
+				webServer.ForgotPasswordFormRoute(),
+				webServer.ForgotPasswordHandlerRoute(),
+				webServer.PasswordChangeFormRoute(),
+				webServer.PasswordChangeHandlerRoute(),
+				oidcProvider.DiscoveryRoute(),
+				oidcProvider.AuthorizeFormRoute(),
+				oidcProvider.AuthorizeHandlerRoute(),
+				oidcProvider.TokenRoute(),
 			)...,
-		),
+		)),
 	); err != nil {
 		return fmt.Errorf("starting server: %w", err)
 	}
@@ -250,6 +625,36 @@ func (burl BaseURL) Std() string {
 	return string(burl)
 }
 
+// notificationTemplates loads the localized notification templates, if
+// there are any.
+func (c *Config) notificationTemplates() (*auth.NotificationTemplates, error) {
+	if c.NotificationTemplatesDir == "" {
+		return nil, nil
+	}
+	return auth.LoadNotificationTemplates(
+		c.NotificationTemplatesDir,
+		c.DefaultLocale,
+	)
+}
+
+type OIDCClients []auth.OIDCClient
+
+func (clients *OIDCClients) Decode(value string) error {
+	if err := json.Unmarshal([]byte(value), clients); err != nil {
+		return fmt.Errorf("decoding OIDC clients: %w", err)
+	}
+	return nil
+}
+
+type WebhookEndpoints []auth.WebhookEndpoint
+
+func (endpoints *WebhookEndpoints) Decode(value string) error {
+	if err := json.Unmarshal([]byte(value), endpoints); err != nil {
+		return fmt.Errorf("decoding webhook endpoints: %w", err)
+	}
+	return nil
+}
+
 type PrivateKey ecdsa.PrivateKey
 
 func (pk *PrivateKey) Decode(value string) error {
@@ -297,3 +702,94 @@ func (pk *PrivateKey) UnmarshalYAML(unmarshal func(interface{}) error) error {
 func (pk *PrivateKey) Std() *ecdsa.PrivateKey {
 	return (*ecdsa.PrivateKey)(pk)
 }
+
+// KeyRing is an ordered set of keys for a single signing purpose (e.g., access
+// tokens). The first private key is the active signing key. Any keys after it
+// are retired: they are no longer used for signing, but tokens they signed are
+// still accepted until the key is removed from the ring. Retired keys may be
+// given as either private or public keys.
+//
+// A key ring is configured as PEM data with one block per key, or in YAML as a
+// list of PEM strings. A single private key is a valid key ring.
+type KeyRing struct {
+	Active  PrivateKey
+	Retired []*ecdsa.PublicKey
+}
+
+func (kr *KeyRing) Decode(value string) error {
+	data := []byte(value)
+	var (
+		ring  KeyRing
+		found = map[string]struct{}{}
+	)
+	for {
+		block, rest := pem.Decode(data)
+		if block == nil {
+			break
+		}
+		data = rest
+
+		var key *ecdsa.PublicKey
+		switch {
+		// See `PrivateKey.Decode()` for why this isn't an exact match.
+		case strings.Contains(block.Type, "PRIVATE KEY"):
+			privateKey, err := x509.ParseECPrivateKey(block.Bytes)
+			if err != nil {
+				return fmt.Errorf("parsing ecdsa private key: %w", err)
+			}
+			if ring.Active == (PrivateKey{}) {
+				ring.Active = PrivateKey(*privateKey)
+				found[auth.KeyID(&privateKey.PublicKey)] = struct{}{}
+				continue
+			}
+			key = &privateKey.PublicKey
+		case block.Type == "PUBLIC KEY":
+			publicKey, err := x509.ParsePKIXPublicKey(block.Bytes)
+			if err != nil {
+				return fmt.Errorf("parsing public key: %w", err)
+			}
+			ecdsaKey, ok := publicKey.(*ecdsa.PublicKey)
+			if !ok {
+				return fmt.Errorf(
+					"wanted ecdsa public key; found `%T`",
+					publicKey,
+				)
+			}
+			key = ecdsaKey
+		default:
+			continue
+		}
+
+		// Skip duplicates (e.g., the public half of the active key, which
+		// `es512keygen` prints after the private key).
+		kid := auth.KeyID(key)
+		if _, exists := found[kid]; exists {
+			continue
+		}
+		found[kid] = struct{}{}
+		ring.Retired = append(ring.Retired, key)
+	}
+
+	if ring.Active == (PrivateKey{}) {
+		return fmt.Errorf("PEM data is missing a 'PRIVATE KEY' block")
+	}
+	*kr = ring
+	return nil
+}
+
+func (kr *KeyRing) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err != nil {
+		var keys []string
+		if err := unmarshal(&keys); err != nil {
+			return fmt.Errorf("yaml-unmarshaling *KeyRing: %w", err)
+		}
+		s = strings.Join(keys, "\n")
+	}
+
+	if err := kr.Decode(s); err != nil {
+		return fmt.Errorf("yaml-unmarshaling *KeyRing: %w", err)
+	}
+
+	return nil
+}
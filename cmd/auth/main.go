@@ -2,6 +2,7 @@ package main
 
 import (
 	"log"
+	"os"
 )
 
 func main() {
@@ -10,6 +11,15 @@ func main() {
 		log.Fatalf("loading config: %v", err)
 	}
 
+	// `auth preview-templates` renders the notification templates with
+	// sample data instead of running the server.
+	if len(os.Args) > 1 && os.Args[1] == "preview-templates" {
+		if err := c.previewTemplates(os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
 	if err := c.Run(); err != nil {
 		log.Fatal(err)
 	}
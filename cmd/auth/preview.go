@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/weberc2/auth/pkg/auth"
+	"github.com/weberc2/auth/pkg/auth/types"
+)
+
+// previewTemplates renders every notification template--the built-in ones
+// and each locale's--with sample data so that they can be reviewed without
+// sending any notifications.
+func (c *Config) previewTemplates(w io.Writer) error {
+	templates, err := c.notificationTemplates()
+	if err != nil {
+		return err
+	}
+	if templates == nil {
+		templates = &auth.NotificationTemplates{}
+	}
+
+	for _, builtin := range []struct {
+		typ      types.NotificationType
+		settings *auth.NotificationSettings
+	}{
+		{types.NotificationTypeRegister, &auth.DefaultRegistrationSettings},
+		{
+			types.NotificationTypeForgotPassword,
+			&auth.DefaultForgotPasswordSettings,
+		},
+		{types.NotificationTypeLockout, &auth.DefaultLockoutSettings},
+		{
+			types.NotificationTypeEmailChange,
+			&auth.DefaultEmailChangeSettings,
+		},
+		{
+			types.NotificationTypeEmailChangeNotice,
+			&auth.DefaultEmailChangeNoticeSettings,
+		},
+		{types.NotificationTypeMagicLink, &auth.DefaultMagicLinkSettings},
+	} {
+		if err := previewTemplate(
+			w,
+			builtin.typ,
+			"",
+			builtin.settings,
+		); err != nil {
+			return err
+		}
+		for _, locale := range templates.Locales(builtin.typ) {
+			if err := previewTemplate(
+				w,
+				builtin.typ,
+				locale,
+				templates.Lookup(builtin.typ, locale),
+			); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// previewTemplate renders a template. The locale is empty for the built-in
+// templates.
+func previewTemplate(
+	w io.Writer,
+	typ types.NotificationType,
+	locale string,
+	settings *auth.NotificationSettings,
+) error {
+	n := types.Notification{
+		Type:   typ,
+		User:   "alice",
+		Email:  "alice@example.org",
+		Locale: locale,
+	}
+	if typ != types.NotificationTypeLockout &&
+		typ != types.NotificationTypeEmailChangeNotice {
+		n.Token = "sample-token"
+	}
+	subject, text, html, err := settings.Render(
+		&n,
+		func(n *types.Notification) string {
+			return "https://auth.example.org/confirm?t=" + n.Token
+		},
+	)
+	label := locale
+	if label == "" {
+		label = "built-in"
+	}
+	if err != nil {
+		return fmt.Errorf(
+			"rendering `%s` template for `%s`: %w",
+			typ,
+			label,
+			err,
+		)
+	}
+	_, err = fmt.Fprintf(
+		w,
+		"===== %s (%s) =====\nSubject: %s\n\n--- text ---\n%s\n\n"+
+			"--- html ---\n%s\n\n",
+		typ,
+		label,
+		subject,
+		text,
+		html,
+	)
+	return err
+}
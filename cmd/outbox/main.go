@@ -0,0 +1,120 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/urfave/cli/v2"
+	"github.com/weberc2/auth/pkg/auth/types"
+	"github.com/weberc2/auth/pkg/pgtokenstore"
+	"github.com/weberc2/auth/pkg/pgutil"
+	pgcli "github.com/weberc2/auth/pkg/pgutil/cli"
+)
+
+func main() {
+	app, err := pgcli.New(&pgtokenstore.OutboxTable)
+	if err != nil {
+		log.Fatal(err)
+	}
+	app.Description += "; note that the table holds plaintext tokens, " +
+		"which the generic `get` and `list` commands print"
+	app.Commands = append(
+		app.Commands,
+		&cli.Command{
+			Name: "dead",
+			Description: "list the dead-lettered notifications (with " +
+				"their tokens redacted)",
+			Usage: "list the dead-lettered notifications",
+			Action: withOutbox(func(
+				outbox *pgtokenstore.PGOutboxStore,
+				ctx *cli.Context,
+			) error {
+				entries, err := outbox.Dead()
+				if err != nil {
+					return err
+				}
+				redact(entries)
+				data, err := json.MarshalIndent(entries, "", "  ")
+				if err != nil {
+					return err
+				}
+				_, err = fmt.Printf("%s\n", data)
+				return err
+			}),
+		},
+		&cli.Command{
+			Name: "replay",
+			Description: "make dead-lettered notifications pending again " +
+				"so that they're redelivered (note that their tokens may " +
+				"have expired)",
+			Usage: "redeliver dead-lettered notifications",
+			Flags: []cli.Flag{
+				&cli.StringSliceFlag{
+					Name:  "id",
+					Usage: "the ID of a notification to replay",
+				},
+				&cli.BoolFlag{
+					Name:  "all",
+					Usage: "replay all dead-lettered notifications",
+				},
+			},
+			Action: withOutbox(func(
+				outbox *pgtokenstore.PGOutboxStore,
+				ctx *cli.Context,
+			) error {
+				ids := ctx.StringSlice("id")
+				if ctx.Bool("all") {
+					entries, err := outbox.Dead()
+					if err != nil {
+						return err
+					}
+					for _, entry := range entries {
+						ids = append(ids, entry.ID)
+					}
+				}
+				if len(ids) < 1 {
+					return fmt.Errorf("either `--id` or `--all` is required")
+				}
+
+				now := time.Now()
+				for _, id := range ids {
+					if err := outbox.Replay(id, now); err != nil {
+						return fmt.Errorf("replaying `%s`: %w", id, err)
+					}
+					log.Printf("replayed `%s`", id)
+				}
+				return nil
+			}),
+		},
+	)
+	if err := app.Run(os.Args); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// redact hides the entries' tokens. They're live secrets (e.g., a
+// forgot-password token lets its holder reset the user's password), so they
+// don't belong in terminals or logs.
+func redact(entries []*types.OutboxEntry) {
+	for _, entry := range entries {
+		if entry.Notification.Token != "" {
+			entry.Notification.Token = "REDACTED"
+		}
+	}
+}
+
+func withOutbox(
+	f func(*pgtokenstore.PGOutboxStore, *cli.Context) error,
+) cli.ActionFunc {
+	return func(ctx *cli.Context) error {
+		db, err := pgutil.OpenEnvPing()
+		if err != nil {
+			return err
+		}
+		return f((*pgtokenstore.PGOutboxStore)((*sql.DB)(db)), ctx)
+	}
+}
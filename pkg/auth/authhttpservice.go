@@ -20,6 +20,13 @@ var (
 
 type AuthHTTPService struct {
 	AuthService
+
+	// Authenticate protects the routes which act on behalf of a logged-in
+	// user (e.g., the sessions routes). It must reject unauthenticated
+	// requests and set the `User` header on authenticated ones, e.g.,
+	// `client.Authenticator.Auth` with `client.AuthTypeClientProgram`. If it's
+	// `nil`, those routes aren't served.
+	Authenticate func(pz.Handler) pz.Handler
 }
 
 func (ahs *AuthHTTPService) LoginRoute() pz.Route {
@@ -35,8 +42,30 @@ func (ahs *AuthHTTPService) LoginRoute() pz.Route {
 				})
 			}
 
-			tokens, err := ahs.Login(&creds)
+			tokens, err := ahs.Login(&creds, ahs.clientInfo(r))
 			if err != nil {
+				var required *SecondFactorRequired
+				if errors.As(err, &required) {
+					return pz.Unauthorized(
+						pz.JSON(required),
+						&logging{
+							Message: "second factor required",
+							User:    creds.User,
+						},
+					)
+				}
+				var throttled *ThrottledError
+				if errors.As(err, &throttled) {
+					return retryAfter(pz.HandleError(
+						"logging in",
+						err,
+						&logging{
+							Message: "login throttled",
+							User:    creds.User,
+							Error:   err.Error(),
+						},
+					), err)
+				}
 				if errors.Is(err, ErrCredentials) {
 					return pz.Unauthorized(
 						pz.String("Invalid username or password"),
@@ -69,6 +98,49 @@ func (ahs *AuthHTTPService) LoginRoute() pz.Route {
 	}
 }
 
+// LoginSecondFactorRoute completes a login for a user who has enabled
+// two-factor authentication. The request provides the second-factor token
+// from the `LoginRoute` response and a TOTP or recovery code.
+func (ahs *AuthHTTPService) LoginSecondFactorRoute() pz.Route {
+	return pz.Route{
+		Path:   "/api/login/totp",
+		Method: "POST",
+		Handler: func(r pz.Request) pz.Response {
+			var payload struct {
+				SecondFactorToken string `json:"secondFactorToken"`
+				Code              string `json:"code"`
+			}
+			if err := r.JSON(&payload); err != nil {
+				return pz.BadRequest(nil, &logging{
+					Message: "failed to parse second-factor login JSON",
+					Error:   err.Error(),
+				})
+			}
+
+			tokens, err := ahs.LoginSecondFactor(
+				payload.SecondFactorToken,
+				payload.Code,
+			)
+			if err != nil {
+				return retryAfter(pz.HandleError(
+					"logging in with second factor",
+					err,
+					&logging{
+						Message:   "logging in with second factor",
+						ErrorType: fmt.Sprintf("%T", err),
+						Error:     err.Error(),
+					},
+				), err)
+			}
+
+			return pz.Ok(
+				pz.JSON(tokens),
+				&logging{Message: "two-factor authentication succeeded"},
+			)
+		},
+	}
+}
+
 func (ahs *AuthHTTPService) LogoutRoute() pz.Route {
 	return pz.Route{
 		Path:   "/api/logout",
@@ -151,7 +223,7 @@ func (ahs *AuthHTTPService) RefreshRoute() pz.Route {
 				})
 			}
 
-			accessToken, err := ahs.Refresh(payload.RefreshToken)
+			tokens, err := ahs.Refresh(payload.RefreshToken)
 			if err != nil {
 				var verr *jwt.ValidationError
 				if errors.As(err, &verr) {
@@ -174,7 +246,10 @@ func (ahs *AuthHTTPService) RefreshRoute() pz.Route {
 				)
 			}
 
-			return pz.Ok(pz.JSON(&RefreshResponse{accessToken}))
+			return pz.Ok(pz.JSON(&RefreshResponse{
+				AccessToken:  tokens.AccessToken.Token,
+				RefreshToken: tokens.RefreshToken.Token,
+			}))
 		},
 	}
 }
@@ -205,6 +280,18 @@ func (ahs *AuthHTTPService) ForgotPasswordRoute() pz.Route {
 					})
 				}
 
+				// Likewise, reporting that the email was throttled would
+				// reveal that the user exists.
+				var throttled *NotificationThrottledError
+				if errors.As(err, &throttled) {
+					return pz.Ok(nil, struct{ Message, User, Error string }{
+						Message: "notification throttled; silently " +
+							"succeeding",
+						User:  string(payload.User),
+						Error: err.Error(),
+					})
+				}
+
 				return pz.InternalServerError(&logging{
 					Message:   "triggering forget-password notification",
 					User:      payload.User,
@@ -227,8 +314,9 @@ func (ahs *AuthHTTPService) RegisterRoute() pz.Route {
 		Method: "POST",
 		Handler: func(r pz.Request) pz.Response {
 			var payload struct {
-				User  types.UserID `json:"user"`
-				Email string       `json:"email"`
+				User   types.UserID `json:"user"`
+				Email  string       `json:"email"`
+				Locale string       `json:"locale"`
 			}
 			if err := r.JSON(&payload); err != nil {
 				return pz.BadRequest(nil, struct{ Message, Error string }{
@@ -237,7 +325,14 @@ func (ahs *AuthHTTPService) RegisterRoute() pz.Route {
 				})
 			}
 
-			if err := ahs.Register(payload.User, payload.Email); err != nil {
+			if payload.Locale == "" {
+				payload.Locale = acceptLanguage(r.Headers)
+			}
+			if err := ahs.Register(
+				payload.User,
+				payload.Email,
+				payload.Locale,
+			); err != nil {
 				if errors.Is(err, ErrInvalidEmail) {
 					return pz.BadRequest(
 						pz.String("Invalid email address"),
@@ -248,6 +343,18 @@ func (ahs *AuthHTTPService) RegisterRoute() pz.Route {
 						},
 					)
 				}
+				var throttled *NotificationThrottledError
+				if errors.As(err, &throttled) {
+					return retryAfter(pz.HandleError(
+						"registering user",
+						err,
+						&logging{
+							Message: "registering user",
+							Error:   err.Error(),
+							User:    payload.User,
+						},
+					), err)
+				}
 				if errors.Is(err, ErrUserExists) {
 					return pz.Conflict(
 						pz.String("User already exists"),
@@ -290,7 +397,6 @@ func (ahs *AuthHTTPService) UpdatePasswordRoute() pz.Route {
 				return pz.BadRequest(nil, &logging{
 					Message: "updating password",
 					Error:   err.Error(),
-					User:    payload.User,
 				})
 			}
 
@@ -299,20 +405,16 @@ func (ahs *AuthHTTPService) UpdatePasswordRoute() pz.Route {
 					Message:   "updating password",
 					Error:     err.Error(),
 					ErrorType: fmt.Sprintf("%T", err),
-					User:      payload.User,
 				}
-				if errors.Is(err, ErrInvalidResetToken) {
-					return pz.NotFound(
-						pz.String(ErrInvalidResetToken.Error()),
-						&l,
-					)
+				var rejected *PasswordPolicyError
+				if errors.As(err, &rejected) {
+					return pz.BadRequest(pz.JSON(rejected), &l)
 				}
-				return pz.InternalServerError(&l)
+				return pz.HandleError("updating password", err, &l)
 			}
 
 			return pz.Ok(pz.String("Password updated"), &logging{
 				Message: "updated password",
-				User:    payload.User,
 			})
 		},
 	}
@@ -331,7 +433,7 @@ func (ahs *AuthHTTPService) ExchangeRoute() pz.Route {
 				})
 			}
 
-			tokens, err := ahs.Exchange(code.Code)
+			tokens, err := ahs.Exchange(code.Code, code.CodeVerifier)
 			if err != nil {
 				return pz.HandleError("processing auth code exchange", err)
 			}
@@ -344,16 +446,421 @@ func (ahs *AuthHTTPService) ExchangeRoute() pz.Route {
 	}
 }
 
+// JWKSRoute serves the public halves of the access, refresh, and code signing
+// keys as a JWK Set so that downstream services can discover the keys needed
+// to verify our tokens (matching on the tokens' `kid` header).
+func (ahs *AuthHTTPService) JWKSRoute() pz.Route {
+	return pz.Route{
+		Path:   "/.well-known/jwks.json",
+		Method: "GET",
+		Handler: func(r pz.Request) pz.Response {
+			return pz.Ok(
+				pz.JSON(ahs.JWKS()),
+				&logging{Message: "serving JWK set"},
+			)
+		},
+	}
+}
+
+// JWKS returns the JWK Set for the access, refresh, and code signing keys,
+// including any retired keys which are still accepted for verification.
+func (ahs *AuthHTTPService) JWKS() *JWKSet {
+	set := JWKSet{Keys: []JWK{}}
+	for _, factory := range []*TokenFactory{
+		&ahs.TokenDetails.AccessTokens,
+		&ahs.TokenDetails.RefreshTokens,
+		&ahs.Codes,
+	} {
+		for _, key := range factory.VerificationKeys() {
+			set.Keys = append(set.Keys, NewJWK(key))
+		}
+	}
+	return &set
+}
+
+// SessionsRoute lists the caller's sessions.
+func (ahs *AuthHTTPService) SessionsRoute() pz.Route {
+	return pz.Route{
+		Path:   "/api/sessions",
+		Method: "GET",
+		Handler: ahs.Authenticate(func(r pz.Request) pz.Response {
+			user := types.UserID(r.Headers.Get("User"))
+			sessions, err := ahs.Sessions(user)
+			if err != nil {
+				return pz.InternalServerError(&logging{
+					Message:   "listing sessions",
+					ErrorType: fmt.Sprintf("%T", err),
+					Error:     err.Error(),
+					User:      user,
+				})
+			}
+
+			return pz.Ok(pz.JSON(sessions), &logging{
+				Message: "listed sessions",
+				User:    user,
+			})
+		}),
+	}
+}
+
+// RevokeSessionRoute logs out one of the caller's sessions.
+func (ahs *AuthHTTPService) RevokeSessionRoute() pz.Route {
+	return pz.Route{
+		Path:   "/api/sessions/{session}",
+		Method: "DELETE",
+		Handler: ahs.Authenticate(func(r pz.Request) pz.Response {
+			user := types.UserID(r.Headers.Get("User"))
+			if err := ahs.RevokeSession(
+				user,
+				r.Vars["session"],
+			); err != nil {
+				return pz.HandleError(
+					"revoking session",
+					err,
+					&logging{
+						Message:   "revoking session",
+						ErrorType: fmt.Sprintf("%T", err),
+						Error:     err.Error(),
+						User:      user,
+					},
+				)
+			}
+
+			return pz.Ok(pz.String("Session revoked"), &logging{
+				Message: "revoked session",
+				User:    user,
+			})
+		}),
+	}
+}
+
+// RevokeSessionsRoute logs out all of the caller's sessions.
+func (ahs *AuthHTTPService) RevokeSessionsRoute() pz.Route {
+	return pz.Route{
+		Path:   "/api/sessions",
+		Method: "DELETE",
+		Handler: ahs.Authenticate(func(r pz.Request) pz.Response {
+			user := types.UserID(r.Headers.Get("User"))
+			if err := ahs.RevokeSessions(user); err != nil {
+				return pz.InternalServerError(&logging{
+					Message:   "revoking sessions",
+					ErrorType: fmt.Sprintf("%T", err),
+					Error:     err.Error(),
+					User:      user,
+				})
+			}
+
+			return pz.Ok(pz.String("Sessions revoked"), &logging{
+				Message: "revoked all sessions",
+				User:    user,
+			})
+		}),
+	}
+}
+
+// EnrollTOTPRoute starts enrolling the caller in two-factor authentication,
+// returning the new TOTP secret.
+func (ahs *AuthHTTPService) EnrollTOTPRoute() pz.Route {
+	return pz.Route{
+		Path:   "/api/totp",
+		Method: "POST",
+		Handler: ahs.Authenticate(func(r pz.Request) pz.Response {
+			user := types.UserID(r.Headers.Get("User"))
+			enrollment, err := ahs.EnrollTOTP(user)
+			if err != nil {
+				return pz.HandleError(
+					"enrolling in two-factor authentication",
+					err,
+					&logging{
+						Message:   "enrolling in two-factor authentication",
+						ErrorType: fmt.Sprintf("%T", err),
+						Error:     err.Error(),
+						User:      user,
+					},
+				)
+			}
+
+			return pz.Ok(pz.JSON(enrollment), &logging{
+				Message: "started two-factor enrollment",
+				User:    user,
+			})
+		}),
+	}
+}
+
+// totpCodeRoute handles requests which must be confirmed with a TOTP or
+// recovery code, responding with the caller's recovery codes if `f` returns
+// any.
+func (ahs *AuthHTTPService) totpCodeRoute(
+	path string,
+	method string,
+	message string,
+	f func(
+		user types.UserID,
+		code string,
+		client *types.ClientInfo,
+	) ([]string, error),
+) pz.Route {
+	return pz.Route{
+		Path:   path,
+		Method: method,
+		Handler: ahs.Authenticate(func(r pz.Request) pz.Response {
+			user := types.UserID(r.Headers.Get("User"))
+			var payload struct {
+				Code string `json:"code"`
+			}
+			if err := r.JSON(&payload); err != nil {
+				return pz.BadRequest(nil, &logging{
+					Message: "failed to parse two-factor code JSON",
+					Error:   err.Error(),
+					User:    user,
+				})
+			}
+
+			codes, err := f(user, payload.Code, ahs.clientInfo(r))
+			if err != nil {
+				return retryAfter(pz.HandleError(message, err, &logging{
+					Message:   message,
+					ErrorType: fmt.Sprintf("%T", err),
+					Error:     err.Error(),
+					User:      user,
+				}), err)
+			}
+
+			var data pz.Serializer
+			if codes != nil {
+				data = pz.JSON(&RecoveryCodesResponse{RecoveryCodes: codes})
+			}
+			return pz.Ok(data, &logging{Message: message, User: user})
+		}),
+	}
+}
+
+// ConfirmTOTPRoute enables two-factor authentication for the caller once
+// they've provided a valid code for the secret from `EnrollTOTPRoute`.
+func (ahs *AuthHTTPService) ConfirmTOTPRoute() pz.Route {
+	return ahs.totpCodeRoute(
+		"/api/totp/confirm",
+		"POST",
+		"confirming two-factor enrollment",
+		ahs.ConfirmTOTP,
+	)
+}
+
+// RecoveryCodesRoute replaces the caller's recovery codes.
+func (ahs *AuthHTTPService) RecoveryCodesRoute() pz.Route {
+	return ahs.totpCodeRoute(
+		"/api/totp/recovery-codes",
+		"POST",
+		"regenerating recovery codes",
+		ahs.RegenerateRecoveryCodes,
+	)
+}
+
+// DisableTOTPRoute turns off two-factor authentication for the caller.
+func (ahs *AuthHTTPService) DisableTOTPRoute() pz.Route {
+	return ahs.totpCodeRoute(
+		"/api/totp",
+		"DELETE",
+		"disabling two-factor authentication",
+		func(
+			user types.UserID,
+			code string,
+			client *types.ClientInfo,
+		) ([]string, error) {
+			return nil, ahs.DisableTOTP(user, code, client)
+		},
+	)
+}
+
+// RecoveryCodesResponse holds a user's new recovery codes. They're only ever
+// shown once.
+type RecoveryCodesResponse struct {
+	RecoveryCodes []string `json:"recoveryCodes"`
+}
+
+// WebAuthnRegistrationRoute starts registering a passkey for the caller.
+func (ahs *AuthHTTPService) WebAuthnRegistrationRoute() pz.Route {
+	return pz.Route{
+		Path:   "/api/webauthn/registration",
+		Method: "POST",
+		Handler: ahs.Authenticate(func(r pz.Request) pz.Response {
+			user := types.UserID(r.Headers.Get("User"))
+			registration, err := ahs.BeginWebAuthnRegistration(user)
+			if err != nil {
+				return pz.HandleError(
+					"beginning passkey registration",
+					err,
+					&logging{
+						Message:   "beginning passkey registration",
+						ErrorType: fmt.Sprintf("%T", err),
+						Error:     err.Error(),
+						User:      user,
+					},
+				)
+			}
+
+			return pz.Ok(pz.JSON(registration), &logging{
+				Message: "began passkey registration",
+				User:    user,
+			})
+		}),
+	}
+}
+
+// WebAuthnRegistrationFinishRoute stores the caller's new passkey. The request
+// provides the token from `WebAuthnRegistrationRoute` and the credential from
+// `navigator.credentials.create()`.
+func (ahs *AuthHTTPService) WebAuthnRegistrationFinishRoute() pz.Route {
+	return pz.Route{
+		Path:   "/api/webauthn/registration/finish",
+		Method: "POST",
+		Handler: ahs.Authenticate(func(r pz.Request) pz.Response {
+			user := types.UserID(r.Headers.Get("User"))
+			var payload struct {
+				Token      string              `json:"token"`
+				Credential WebAuthnAttestation `json:"credential"`
+			}
+			if err := r.JSON(&payload); err != nil {
+				return pz.BadRequest(nil, &logging{
+					Message: "failed to parse passkey registration JSON",
+					Error:   err.Error(),
+					User:    user,
+				})
+			}
+
+			if err := ahs.FinishWebAuthnRegistration(
+				user,
+				payload.Token,
+				&payload.Credential,
+			); err != nil {
+				return pz.HandleError(
+					"finishing passkey registration",
+					err,
+					&logging{
+						Message:   "finishing passkey registration",
+						ErrorType: fmt.Sprintf("%T", err),
+						Error:     err.Error(),
+						User:      user,
+					},
+				)
+			}
+
+			return pz.Created(pz.String("Passkey registered"), &logging{
+				Message: "registered passkey",
+				User:    user,
+			})
+		}),
+	}
+}
+
+// EmailChangeRoute starts changing the caller's email address. The change
+// applies once it's confirmed via the link sent to the new address.
+func (ahs *AuthHTTPService) EmailChangeRoute() pz.Route {
+	return pz.Route{
+		Path:   "/api/email",
+		Method: "POST",
+		Handler: ahs.Authenticate(func(r pz.Request) pz.Response {
+			user := types.UserID(r.Headers.Get("User"))
+			var payload struct {
+				Email string `json:"email"`
+			}
+			if err := r.JSON(&payload); err != nil {
+				return pz.BadRequest(nil, &logging{
+					Message: "failed to parse email change JSON",
+					Error:   err.Error(),
+					User:    user,
+				})
+			}
+
+			if err := ahs.RequestEmailChange(user, payload.Email); err != nil {
+				return retryAfter(pz.HandleError(
+					"requesting email change",
+					err,
+					&logging{
+						Message:   "requesting email change",
+						ErrorType: fmt.Sprintf("%T", err),
+						Error:     err.Error(),
+						User:      user,
+					},
+				), err)
+			}
+
+			return pz.Ok(
+				pz.String("Confirmation email sent"),
+				&logging{Message: "requested email change", User: user},
+			)
+		}),
+	}
+}
+
+// ConfirmEmailChangeRoute applies an email change given the token from the
+// confirmation email. The token identifies the user, so the caller needn't
+// be logged in (e.g., if they open the link on another device).
+func (ahs *AuthHTTPService) ConfirmEmailChangeRoute() pz.Route {
+	return pz.Route{
+		Path:   "/api/email/confirm",
+		Method: "POST",
+		Handler: func(r pz.Request) pz.Response {
+			var payload struct {
+				Token string `json:"token"`
+			}
+			if err := r.JSON(&payload); err != nil {
+				return pz.BadRequest(nil, &logging{
+					Message: "failed to parse email change confirmation JSON",
+					Error:   err.Error(),
+				})
+			}
+
+			if err := ahs.ConfirmEmailChange(payload.Token); err != nil {
+				return pz.HandleError(
+					"confirming email change",
+					err,
+					&logging{
+						Message:   "confirming email change",
+						ErrorType: fmt.Sprintf("%T", err),
+						Error:     err.Error(),
+					},
+				)
+			}
+
+			return pz.Ok(
+				pz.String("Email address changed"),
+				&logging{Message: "changed email address"},
+			)
+		},
+	}
+}
+
 func (ahs *AuthHTTPService) Routes() []pz.Route {
-	return []pz.Route{
+	routes := []pz.Route{
 		ahs.LoginRoute(),
+		ahs.LoginSecondFactorRoute(),
 		ahs.LogoutRoute(),
 		ahs.RefreshRoute(),
 		ahs.RegisterRoute(),
 		ahs.ForgotPasswordRoute(),
 		ahs.UpdatePasswordRoute(),
 		ahs.ExchangeRoute(),
+		ahs.JWKSRoute(),
+		ahs.ConfirmEmailChangeRoute(),
 	}
+	if ahs.Authenticate != nil {
+		routes = append(
+			routes,
+			ahs.SessionsRoute(),
+			ahs.RevokeSessionRoute(),
+			ahs.RevokeSessionsRoute(),
+			ahs.EnrollTOTPRoute(),
+			ahs.ConfirmTOTPRoute(),
+			ahs.RecoveryCodesRoute(),
+			ahs.DisableTOTPRoute(),
+			ahs.WebAuthnRegistrationRoute(),
+			ahs.WebAuthnRegistrationFinishRoute(),
+			ahs.EmailChangeRoute(),
+		)
+	}
+	return routes
 }
 
 type logging struct {
@@ -365,4 +872,8 @@ type logging struct {
 
 type RefreshResponse struct {
 	AccessToken string `json:"accessToken"`
+
+	// RefreshToken replaces the refresh token which was used for the
+	// request, which is no longer valid.
+	RefreshToken string `json:"refreshToken"`
 }
@@ -2,14 +2,17 @@ package auth
 
 import (
 	"crypto/ecdsa"
+	"crypto/subtle"
 	"errors"
 	"fmt"
 	"log"
 	"net/http"
 	"net/mail"
+	"strings"
 	"time"
 
 	"github.com/dgrijalva/jwt-go"
+	"github.com/google/uuid"
 	"github.com/weberc2/auth/pkg/auth/types"
 	pz "github.com/weberc2/httpeasy"
 )
@@ -50,29 +53,101 @@ type TokenFactory struct {
 	Audience      string
 	TokenValidity time.Duration
 	SigningKey    *ecdsa.PrivateKey
+
+	// RetiredKeys are the public halves of keys which were previously used to
+	// sign tokens. They are no longer used for signing, but tokens signed by
+	// them remain valid (until they expire or the key is removed from this
+	// list) so that rotating the signing key doesn't invalidate every
+	// outstanding token.
+	RetiredKeys []*ecdsa.PublicKey
+}
+
+// VerificationKeys returns the public keys which tokens from this factory may
+// be verified against: the signing key followed by any retired keys.
+func (tf *TokenFactory) VerificationKeys() []*ecdsa.PublicKey {
+	return append(
+		[]*ecdsa.PublicKey{&tf.SigningKey.PublicKey},
+		tf.RetiredKeys...,
+	)
+}
+
+// VerificationKey is a `jwt.Keyfunc` which selects the public key matching
+// the token's `kid` header from among the factory's verification keys. Tokens
+// without a `kid` header predate key IDs, so they may have been signed by any
+// of the keys; the first key whose signature checks out is selected.
+func (tf *TokenFactory) VerificationKey(
+	token *jwt.Token,
+) (interface{}, error) {
+	kid, ok := token.Header["kid"].(string)
+	if !ok {
+		return tf.legacyVerificationKey(token)
+	}
+	for _, key := range tf.VerificationKeys() {
+		if KeyID(key) == kid {
+			return key, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown signing key: `%s`", kid)
+}
+
+// legacyVerificationKey finds the verification key which signed a token
+// without a `kid` header by checking the signature against each key.
+func (tf *TokenFactory) legacyVerificationKey(
+	token *jwt.Token,
+) (interface{}, error) {
+	i := strings.LastIndexByte(token.Raw, '.')
+	if i < 0 {
+		return nil, fmt.Errorf("malformed token")
+	}
+	for _, key := range tf.VerificationKeys() {
+		if err := token.Method.Verify(
+			token.Raw[:i],
+			token.Raw[i+1:],
+			key,
+		); err == nil {
+			return key, nil
+		}
+	}
+	return nil, fmt.Errorf("token without key ID matches no signing key")
 }
 
 func (tf *TokenFactory) Create(
 	now time.Time,
 	subject string,
 ) (*types.Token, error) {
-	expires := now.Add(tf.TokenValidity)
-	token := jwt.NewWithClaims(
-		jwt.SigningMethodES512,
-		jwt.StandardClaims{
-			Subject:   subject,
-			Audience:  tf.Audience,
-			Issuer:    tf.Issuer,
-			IssuedAt:  now.Unix(),
-			ExpiresAt: expires.Unix(),
-			NotBefore: now.Unix(),
-		},
-	)
+	t, err := tf.Sign(tf.StandardClaims(now, subject))
+	if err != nil {
+		return nil, err
+	}
+	return &types.Token{Token: t, Expires: now.Add(tf.TokenValidity)}, nil
+}
+
+// StandardClaims returns the registered claims for a token issued by this
+// factory at `now` for `subject`.
+func (tf *TokenFactory) StandardClaims(
+	now time.Time,
+	subject string,
+) jwt.StandardClaims {
+	return jwt.StandardClaims{
+		Subject:   subject,
+		Audience:  tf.Audience,
+		Issuer:    tf.Issuer,
+		IssuedAt:  now.Unix(),
+		ExpiresAt: now.Add(tf.TokenValidity).Unix(),
+		NotBefore: now.Unix(),
+	}
+}
+
+// Sign signs the provided claims with the factory's signing key and sets the
+// token's `kid` header so verifiers can find the corresponding public key.
+func (tf *TokenFactory) Sign(claims jwt.Claims) (string, error) {
+	token := jwt.NewWithClaims(jwt.SigningMethodES512, claims)
+	token.Header["kid"] = KeyID(&tf.SigningKey.PublicKey)
 	t, err := token.SignedString(tf.SigningKey)
 	if err != nil {
-		return nil, fmt.Errorf("signing token: %w", err)
+		return "", fmt.Errorf("signing token: %w", err)
 	}
-	return &types.Token{Token: t, Expires: expires}, nil
+	return t, nil
 }
 
 type AuthService struct {
@@ -82,21 +157,71 @@ type AuthService struct {
 	ResetTokens   ResetTokenFactory
 	TokenDetails  TokenDetailsFactory
 	Codes         TokenFactory
-	TimeFunc      func() time.Time
+	RedeemedCodes types.CodeStore
+	TOTP          TOTP
+	WebAuthn      WebAuthn
+	Throttle      LoginThrottle
+
+	// TrustedProxies are the reverse proxies whose `X-Forwarded-For` entries
+	// identify the clients which logins are throttled by (see `RemoteAddr`).
+	TrustedProxies TrustedProxies
+
+	// RefreshGrace lets concurrent requests refresh with the same token. If
+	// it's `nil`, there's no grace period.
+	RefreshGrace *RefreshGrace
+
+	// NotificationLimits limits the emails which users can trigger (e.g.,
+	// registration, forgot-password and magic link emails).
+	NotificationLimits NotificationLimiter
+
+	TimeFunc func() time.Time
 }
 
-func (as *AuthService) Login(c *types.Credentials) (*TokenDetails, error) {
-	if err := as.Creds.Validate(c); err != nil {
+// Login validates the credentials and starts a new session. The client info
+// (if any) is recorded with the session. If the user has enabled two-factor
+// authentication, a `*SecondFactorRequired` error is returned instead. If
+// there have been too many failed logins for the user or the client, a
+// `*ThrottledError` is returned.
+func (as *AuthService) Login(
+	c *types.Credentials,
+	client *types.ClientInfo,
+) (*TokenDetails, error) {
+	entry, err := as.checkCredentials(c, client)
+	if err != nil {
 		return nil, fmt.Errorf("validating credentials: %w", err)
 	}
 
-	tokenDetails, err := as.TokenDetails.Create(string(c.User))
+	if entry.TOTPEnabled {
+		return nil, as.secondFactorRequired(entry.User, false, nil, client)
+	}
+
+	return as.issueTokens(string(entry.User), client)
+}
+
+// issueTokens creates an access/refresh token pair for the subject and stores
+// the refresh token so that it can be used with `Refresh()`. The refresh token
+// starts a new session.
+func (as *AuthService) issueTokens(
+	subject string,
+	client *types.ClientInfo,
+) (*TokenDetails, error) {
+	tokenDetails, err := as.TokenDetails.Create(subject)
 	if err != nil {
 		return nil, fmt.Errorf("creating token details: %w", err)
 	}
 
+	session := types.Session{
+		ID:       tokenDetails.RefreshToken.Family,
+		Subject:  subject,
+		IssuedAt: as.TokenDetails.TimeFunc(),
+	}
+	if client != nil {
+		session.ClientInfo = *client
+	}
+
 	if err := as.Tokens.Put(
 		tokenDetails.RefreshToken.Token,
+		&session,
 		tokenDetails.RefreshToken.Expires,
 	); err != nil {
 		return nil, fmt.Errorf("storing refresh token: %w", err)
@@ -116,43 +241,323 @@ func (as *AuthService) Logout(refreshToken string) error {
 	return nil
 }
 
-func (as *AuthService) LoginAuthCode(c *types.Credentials) (string, error) {
-	if err := as.Creds.Validate(c); err != nil {
+// CodeParams are authorization request parameters which are bound into an
+// auth code's claims so that they can be checked when the code is exchanged.
+// Codes for the first-party `/login` flow don't have a client ID; codes for
+// OpenID Connect clients do.
+type CodeParams struct {
+	ClientID    string `json:"client_id,omitempty"`
+	RedirectURI string `json:"redirect_uri,omitempty"`
+	Nonce       string `json:"nonce,omitempty"`
+	Scope       string `json:"scope,omitempty"`
+
+	// CodeChallenge and CodeChallengeMethod bind the code to a PKCE code
+	// verifier (RFC 7636) which must be provided when the code is exchanged.
+	CodeChallenge       string `json:"code_challenge,omitempty"`
+	CodeChallengeMethod string `json:"code_challenge_method,omitempty"`
+}
+
+// CodeClaims are the claims carried by auth codes. The client info describes
+// the client which logged in (rather than the one which exchanges the code)
+// so that it can be recorded with the session.
+type CodeClaims struct {
+	CodeParams
+	types.ClientInfo
+	jwt.StandardClaims
+}
+
+// LoginAuthCode validates the credentials and mints an auth code. If the user
+// has enabled two-factor authentication, a `*SecondFactorRequired` error is
+// returned instead. Logins are throttled as with `Login`.
+func (as *AuthService) LoginAuthCode(
+	c *types.Credentials,
+	params *CodeParams,
+	client *types.ClientInfo,
+) (string, error) {
+	if params != nil {
+		method, err := codeChallenge(
+			params.CodeChallenge,
+			params.CodeChallengeMethod,
+		)
+		if err != nil {
+			return "", err
+		}
+		params.CodeChallengeMethod = method
+	}
+
+	entry, err := as.checkCredentials(c, client)
+	if err != nil {
 		return "", fmt.Errorf("validating credentials: %w", err)
 	}
 
-	code, err := as.Codes.Create(as.TimeFunc(), string(c.User))
+	if entry.TOTPEnabled {
+		return "", as.secondFactorRequired(
+			entry.User,
+			true,
+			params,
+			client,
+		)
+	}
+
+	return as.authCode(entry.User, params, client)
+}
+
+// authCode mints an auth code for a user who has already been authenticated.
+func (as *AuthService) authCode(
+	user types.UserID,
+	params *CodeParams,
+	client *types.ClientInfo,
+) (string, error) {
+	claims := CodeClaims{
+		StandardClaims: as.Codes.StandardClaims(as.TimeFunc(), string(user)),
+	}
+	claims.Id = uuid.NewString()
+	if params != nil {
+		claims.CodeParams = *params
+	}
+	if client != nil {
+		claims.ClientInfo = *client
+	}
+
+	code, err := as.Codes.Sign(&claims)
 	if err != nil {
 		return "", fmt.Errorf("creating auth code: %w", err)
 	}
 
-	return code.Token, nil
+	return code, nil
+}
+
+// codeClaims parses and validates an auth code. Any failure results in
+// `ErrUnauthorized` so as to not give attackers unnecessary information.
+func (as *AuthService) codeClaims(code string) (*CodeClaims, error) {
+	var claims CodeClaims
+	if _, err := jwt.ParseWithClaims(
+		code,
+		&claims,
+		as.Codes.VerificationKey,
+	); err != nil {
+		log.Printf("jwt.ParseWithClaims(): %v", err)
+		return nil, ErrUnauthorized
+	}
+
+	if err := claims.Valid(); err != nil {
+		log.Printf("Claims.Valid(): %v", err)
+		return nil, ErrUnauthorized
+	}
+
+	// Second-factor tokens are signed with the same key, but they're not
+	// codes.
+	if !claims.VerifyAudience(as.Codes.Audience, false) {
+		log.Printf("code has the wrong audience: `%s`", claims.Audience)
+		return nil, ErrUnauthorized
+	}
+
+	// Without an ID, we can't guarantee the code is only exchanged once.
+	if claims.Id == "" {
+		log.Printf("code is missing `jti` claim")
+		return nil, ErrUnauthorized
+	}
+
+	return &claims, nil
+}
+
+// redeemCode issues tokens in exchange for a validated auth code. Each code
+// may only be redeemed once: if the code is replayed, the request is rejected
+// and the refresh token issued for the original exchange is revoked (RFC 6749
+// section 4.1.2) since either the original exchange or the replay came from
+// an attacker.
+func (as *AuthService) redeemCode(claims *CodeClaims) (*TokenDetails, error) {
+	tokens, err := as.issueTokens(claims.Subject, &claims.ClientInfo)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := as.RedeemedCodes.Redeem(&types.RedeemedCode{
+		ID:      claims.Id,
+		Family:  tokens.RefreshToken.Family,
+		Expires: time.Unix(claims.ExpiresAt, 0),
+	}); err != nil {
+		// We've already stored the new refresh token, so make sure it's
+		// revoked before bailing.
+		if err := as.revoke(tokens.RefreshToken.Token); err != nil {
+			return nil, err
+		}
+
+		if !errors.Is(err, types.ErrCodeRedeemed) {
+			return nil, fmt.Errorf("redeeming code: %w", err)
+		}
+
+		original, err := as.RedeemedCodes.Get(claims.Id)
+		if err != nil {
+			return nil, fmt.Errorf("fetching redeemed code: %w", err)
+		}
+		// Revoke the whole family in case the original refresh token was
+		// already rotated.
+		if err := as.Tokens.DeleteFamily(original.Family); err != nil {
+			return nil, fmt.Errorf("revoking refresh token family: %w", err)
+		}
+
+		log.Printf(
+			"code `%s` replayed; revoked refresh tokens for subject `%s`",
+			claims.Id,
+			claims.Subject,
+		)
+		return nil, ErrUnauthorized
+	}
+
+	return tokens, nil
+}
+
+// revoke deletes a refresh token from the token store. Tokens which are
+// already gone are ignored.
+func (as *AuthService) revoke(refreshToken string) error {
+	if err := as.Tokens.Delete(refreshToken); err != nil &&
+		!errors.Is(err, types.ErrTokenNotFound) {
+		return fmt.Errorf("revoking refresh token: %w", err)
+	}
+	return nil
 }
 
-func (as *AuthService) Refresh(refreshToken string) (string, error) {
-	var claims jwt.StandardClaims
+// Refresh rotates a refresh token: the token is revoked and a new access token
+// and a new refresh token in the same family are returned. If the token was
+// already rotated, then either the legitimate client or an attacker is
+// holding a stolen copy, so the whole family is revoked, unless it was
+// rotated within the `RefreshGrace` period (e.g., by a concurrent request
+// from the same browser), in which case the tokens which replaced it are
+// returned.
+func (as *AuthService) Refresh(refreshToken string) (*TokenDetails, error) {
+	var claims RefreshClaims
 	if _, err := jwt.ParseWithClaims(
 		refreshToken,
 		&claims,
-		func(*jwt.Token) (interface{}, error) {
-			return &as.TokenDetails.RefreshTokens.SigningKey.PublicKey, nil
-		},
+		as.TokenDetails.RefreshTokens.VerificationKey,
 	); err != nil {
-		return "", fmt.Errorf("parsing refresh token: %w", err)
+		return nil, fmt.Errorf("parsing refresh token: %w", err)
 	}
 
 	if err := claims.Valid(); err != nil {
-		return "", fmt.Errorf("validating refresh token: %w", err)
+		return nil, fmt.Errorf("validating refresh token: %w", err)
+	}
+
+	// The new token continues the token's session, so look the session up
+	// before the token is deleted. Tokens from before refresh tokens were
+	// rotated don't have a family, so they start a new one.
+	session := types.Session{ID: claims.Family}
+	if claims.Family == "" {
+		session.ID = uuid.NewString()
+	} else if found, err := as.Tokens.GetSession(claims.Family); err == nil {
+		session = *found
+	} else if !errors.Is(err, types.ErrSessionNotFound) {
+		return nil, fmt.Errorf("fetching session: %w", err)
+	}
+
+	// Tokens from before sessions were tracked don't have a subject, so
+	// their sessions start now.
+	if session.Subject == "" {
+		session.Subject = claims.Subject
+		session.IssuedAt = as.TokenDetails.TimeFunc()
+	}
+
+	return as.RefreshGrace.rotate(
+		refreshToken,
+		as.TokenDetails.TimeFunc(),
+		func() (*TokenDetails, error) {
+			return as.rotate(refreshToken, &claims, &session)
+		},
+	)
+}
+
+// rotate replaces a refresh token with a new one in the same session.
+func (as *AuthService) rotate(
+	refreshToken string,
+	claims *RefreshClaims,
+	session *types.Session,
+) (*TokenDetails, error) {
+	// Deleting the token (rather than checking that it exists) ensures that
+	// concurrent requests can't rotate the same token twice.
+	if err := as.Tokens.Delete(refreshToken); err != nil {
+		if errors.Is(err, types.ErrTokenNotFound) && claims.Family != "" {
+			if err := as.Tokens.DeleteFamily(claims.Family); err != nil {
+				return nil, fmt.Errorf(
+					"revoking refresh token family: %w",
+					err,
+				)
+			}
+			log.Printf(
+				"refresh token reused; revoked family `%s` for subject `%s`",
+				claims.Family,
+				claims.Subject,
+			)
+		}
+		return nil, fmt.Errorf("rotating refresh token: %w", err)
+	}
+
+	tokens, err := as.TokenDetails.CreateInFamily(claims.Subject, session.ID)
+	if err != nil {
+		return nil, fmt.Errorf("creating token details: %w", err)
+	}
+
+	if err := as.Tokens.Put(
+		tokens.RefreshToken.Token,
+		session,
+		tokens.RefreshToken.Expires,
+	); err != nil {
+		return nil, fmt.Errorf("storing refresh token: %w", err)
+	}
+
+	return tokens, nil
+}
+
+// Sessions lists the user's sessions.
+func (as *AuthService) Sessions(user types.UserID) ([]types.Session, error) {
+	sessions, err := as.Tokens.ListSessions(string(user))
+	if err != nil {
+		return nil, fmt.Errorf("listing sessions: %w", err)
+	}
+	return sessions, nil
+}
+
+// RevokeSession logs out one of the user's sessions by revoking its refresh
+// tokens. Returns `types.ErrSessionNotFound` if the user has no such session.
+// Access tokens which were already issued remain valid until they expire.
+func (as *AuthService) RevokeSession(user types.UserID, id string) error {
+	if id == "" {
+		return fmt.Errorf("revoking session: %w", types.ErrSessionNotFound)
+	}
+
+	session, err := as.Tokens.GetSession(id)
+	if err != nil {
+		return fmt.Errorf("revoking session: %w", err)
+	}
+
+	// Other users' sessions are reported as not found so as to not give
+	// away information to potential attackers.
+	if session.Subject != string(user) {
+		return fmt.Errorf("revoking session: %w", types.ErrSessionNotFound)
 	}
 
-	if err := as.Tokens.Exists(refreshToken); err != nil {
-		return "", fmt.Errorf("fetching refresh token expiry: %w", err)
+	if err := as.Tokens.DeleteFamily(id); err != nil {
+		return fmt.Errorf("revoking session: %w", err)
 	}
+	return nil
+}
 
-	return as.TokenDetails.AccessToken(claims.Subject)
+// RevokeSessions logs out all of the user's sessions ("log out everywhere").
+func (as *AuthService) RevokeSessions(user types.UserID) error {
+	if err := as.Tokens.DeleteSessions(string(user)); err != nil {
+		return fmt.Errorf("revoking sessions: %w", err)
+	}
+	return nil
 }
 
-func (as *AuthService) Register(user types.UserID, email string) error {
+// Register sends a registration notification to the email address. The
+// locale is the user's preferred locale, if known (e.g., from the request's
+// `Accept-Language` header).
+func (as *AuthService) Register(
+	user types.UserID,
+	email string,
+	locale string,
+) error {
 	parser := mail.AddressParser{}
 	if _, err := parser.Parse(email); err != nil {
 		return fmt.Errorf("registering user: %w", ErrInvalidEmail)
@@ -168,17 +573,22 @@ func (as *AuthService) Register(user types.UserID, email string) error {
 		return fmt.Errorf("registering user: %w", ErrUserExists)
 	}
 
+	// The locale comes from the client, so ignore it if it's malformed
+	// rather than failing the registration.
+	locale = validLocale(locale)
+
 	// TODO: Error if email already exists
-	token, err := as.ResetTokens.Create(as.TimeFunc(), user, email)
+	token, err := as.ResetTokens.Create(as.TimeFunc(), user, email, locale)
 	if err != nil {
 		return fmt.Errorf("registering user: %w", err)
 	}
 
-	if err := as.Notifications.Notify(&types.Notification{
-		Type:  types.NotificationTypeRegister,
-		User:  user,
-		Email: email,
-		Token: token,
+	if err := as.notify(&types.Notification{
+		Type:   types.NotificationTypeRegister,
+		User:   user,
+		Email:  email,
+		Token:  token,
+		Locale: locale,
 	}); err != nil {
 		return fmt.Errorf("notifying registration reset token: %w", err)
 	}
@@ -186,22 +596,26 @@ func (as *AuthService) Register(user types.UserID, email string) error {
 	return nil
 }
 
-func (as *AuthService) ForgotPassword(user types.UserID) error {
-	u, err := as.Creds.Users.Get(user)
+// ForgotPassword sends a password reset notification to the user, who may
+// be identified by their user ID or their email address.
+func (as *AuthService) ForgotPassword(identifier types.UserID) error {
+	u, err := as.Creds.lookup(identifier)
 	if err != nil {
 		return fmt.Errorf("fetching user: %w", err)
 	}
+	user := u.User
 
-	token, err := as.ResetTokens.Create(as.TimeFunc(), user, u.Email)
+	token, err := as.ResetTokens.CreatePasswordReset(as.TimeFunc(), u)
 	if err != nil {
 		return fmt.Errorf("preparing forgot-password notification: %w", err)
 	}
 
-	if err := as.Notifications.Notify(&types.Notification{
-		Type:  types.NotificationTypeForgotPassword,
-		User:  user,
-		Email: u.Email,
-		Token: token,
+	if err := as.notify(&types.Notification{
+		Type:   types.NotificationTypeForgotPassword,
+		User:   user,
+		Email:  u.Email,
+		Token:  token,
+		Locale: u.Locale,
 	}); err != nil {
 		return fmt.Errorf("notifying forgot-password reset token: %w", err)
 	}
@@ -209,83 +623,175 @@ func (as *AuthService) ForgotPassword(user types.UserID) error {
 	return nil
 }
 
+// UpdatePassword is a request to reset a password. The user whose password
+// is reset is the reset token's subject.
 type UpdatePassword struct {
-	User     types.UserID `json:"user"`
-	Password string       `json:"password"`
-	Token    string       `json:"token"`
+	Password string `json:"password"`
+	Token    string `json:"token"`
 }
 
+// UpdatePassword sets the password of the user to whom the reset token (from
+// `ForgotPassword`) was issued and revokes all of their sessions. Invalid,
+// expired and used tokens result in `ErrInvalidResetToken`.
 func (as *AuthService) UpdatePassword(up *UpdatePassword) error {
+	// We deliberately want to return `ErrInvalidResetToken` for malformed,
+	// expired and forged tokens alike so as not to give attackers
+	// unnecessary information. See OWASP link above.
 	claims, err := as.ResetTokens.Claims(up.Token)
 	if err != nil {
-		return fmt.Errorf("updating password: %w", err)
+		log.Printf("updating password: %v", err)
+		return fmt.Errorf("updating password: %w", ErrInvalidResetToken)
+	}
+	if err := claims.Valid(); err != nil || claims.NewEmail != "" ||
+		claims.PasswordHash == "" {
+		return fmt.Errorf("updating password: %w", ErrInvalidResetToken)
 	}
 
-	// We deliberately want to return `ErrInvalidResetToken` in this case so
-	// as not to give attackers unnecessary information. See OWASP link above.
-	if err := claims.Valid(); err != nil {
+	// The token is bound to the password hash when it was issued, so it's
+	// used up once the password changes.
+	entry, err := as.Creds.Users.Get(claims.User)
+	if err != nil {
+		if errors.Is(err, types.ErrUserNotFound) {
+			err = ErrInvalidResetToken
+		}
+		return fmt.Errorf("updating password: %w", err)
+	}
+	if subtle.ConstantTimeCompare(
+		[]byte(passwordHashDigest(entry.PasswordHash)),
+		[]byte(claims.PasswordHash),
+	) != 1 {
 		return fmt.Errorf("updating password: %w", ErrInvalidResetToken)
 	}
 
+	// The email address may have changed since the token was issued, so
+	// keep the current one.
 	if err := as.Creds.Upsert(&types.Credentials{
-		User:     up.User,
-		Email:    claims.Email,
+		User:     entry.User,
+		Email:    entry.Email,
 		Password: up.Password,
 	}); err != nil {
 		return fmt.Errorf("updating password: %w", err)
 	}
 
+	// Resets often follow a compromise, so log out everyone who was logged
+	// in, as with `ChangePassword`.
+	if err := as.RevokeSessions(entry.User); err != nil {
+		return fmt.Errorf("updating password: %w", err)
+	}
+	return nil
+}
+
+// ChangePassword sets a user's password given their current credentials and,
+// if they've enabled two-factor authentication, a TOTP code or recovery code.
+// Both are checked under the login throttle like `Login`. `c.User` may be a
+// user ID or an email address. On success, all of the user's sessions are
+// revoked so that anyone else who was logged in has to log in again.
+func (as *AuthService) ChangePassword(
+	c *types.Credentials,
+	code string,
+	password string,
+	client *types.ClientInfo,
+) error {
+	entry, err := as.checkCredentials(c, client)
+	if err != nil {
+		return fmt.Errorf("changing password: %w", err)
+	}
+
+	creds := types.Credentials{
+		User:     entry.User,
+		Email:    entry.Email,
+		Password: password,
+	}
+
+	// Check the new password before the second factor so that a rejected
+	// password doesn't use up the code.
+	if err := as.Creds.validatePassword(&creds, entry); err != nil {
+		return fmt.Errorf("changing password: %w", err)
+	}
+
+	if entry.TOTPEnabled {
+		updated := *entry
+		if err := as.throttled(
+			entry.User,
+			client,
+			ErrSecondFactor,
+			func() error { return as.checkSecondFactor(&updated, code) },
+		); err != nil {
+			return fmt.Errorf("changing password: %w", err)
+		}
+		if err := as.Creds.Users.Upsert(&updated); err != nil {
+			return fmt.Errorf("changing password: %w", err)
+		}
+		if err := as.Throttle.succeed(entry.User); err != nil {
+			return fmt.Errorf("changing password: %w", err)
+		}
+	}
+
+	if err := as.Creds.Upsert(&creds); err != nil {
+		return fmt.Errorf("changing password: %w", err)
+	}
+	if err := as.RevokeSessions(entry.User); err != nil {
+		return fmt.Errorf("changing password: %w", err)
+	}
 	return nil
 }
 
 func (as *AuthService) ConfirmRegistration(token, password string) error {
+	// We deliberately want to return `ErrInvalidResetToken` for malformed,
+	// expired and forged tokens alike so as not to give attackers
+	// unnecessary information. See OWASP link above.
 	claims, err := as.ResetTokens.Claims(token)
 	if err != nil {
-		return fmt.Errorf(
-			"confirming registration: %w",
-			TokenClaimsParseErr(err),
-		)
+		log.Printf("confirming registration: %v", err)
+		return fmt.Errorf("confirming registration: %w", ErrInvalidResetToken)
+	}
+	if err := claims.Valid(); err != nil || claims.NewEmail != "" ||
+		claims.PasswordHash != "" {
+		return fmt.Errorf("confirming registration: %w", ErrInvalidResetToken)
 	}
 
-	// We deliberately want to return `ErrInvalidResetToken` in this case so
-	// as not to give attackers unnecessary information. See OWASP link above.
-	if err := claims.Valid(); err != nil {
+	// The token is used up once the user exists.
+	if _, err := as.Creds.Users.Get(claims.User); err == nil {
 		return fmt.Errorf("confirming registration: %w", ErrInvalidResetToken)
+	} else if !errors.Is(err, types.ErrUserNotFound) {
+		return fmt.Errorf("confirming registration: %w", err)
 	}
 
 	if err := as.Creds.Create(&types.Credentials{
 		User:     claims.User,
 		Email:    claims.Email,
 		Password: password,
+		Locale:   claims.Locale,
 	}); err != nil {
+		// Someone else may have used the token in the meantime.
+		if errors.Is(err, types.ErrUserExists) {
+			err = ErrInvalidResetToken
+		}
 		return fmt.Errorf("confirming registration: %w", err)
 	}
 
 	return nil
 }
 
-func (as *AuthService) Exchange(code string) (*TokenDetails, error) {
-	var claims Claims
-	if _, err := jwt.ParseWithClaims(
-		code,
-		&claims,
-		func(*jwt.Token) (interface{}, error) {
-			return &as.Codes.SigningKey.PublicKey, nil
-		},
-	); err != nil {
-		log.Printf("jwt.ParseWithClaims(): %v", err)
-		return nil, ErrUnauthorized
+func (as *AuthService) Exchange(
+	code string,
+	codeVerifier string,
+) (*TokenDetails, error) {
+	claims, err := as.codeClaims(code)
+	if err != nil {
+		return nil, err
 	}
 
-	if err := claims.Valid(); err != nil {
-		log.Printf("Claims.Valid(): %v", err)
-		return nil, ErrUnauthorized
+	if err := claims.verifyCodeVerifier(codeVerifier); err != nil {
+		return nil, err
 	}
 
-	tokens, err := as.TokenDetails.Create(claims.Subject)
-	if err != nil {
-		return nil, fmt.Errorf("creating access and refresh tokens: %w", err)
+	// Codes minted for OpenID Connect clients must be redeemed at the token
+	// endpoint, which authenticates the client.
+	if claims.ClientID != "" {
+		log.Printf("code was issued to OIDC client `%s`", claims.ClientID)
+		return nil, ErrUnauthorized
 	}
 
-	return tokens, nil
+	return as.redeemCode(claims)
 }
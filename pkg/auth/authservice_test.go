@@ -16,9 +16,10 @@ import (
 )
 
 type userStoreMock struct {
-	get    func(types.UserID) (*types.UserEntry, error)
-	upsert func(*types.UserEntry) error
-	insert func(*types.UserEntry) error
+	get        func(types.UserID) (*types.UserEntry, error)
+	getByEmail func(string) (*types.UserEntry, error)
+	upsert     func(*types.UserEntry) error
+	insert     func(*types.UserEntry) error
 }
 
 func (usm *userStoreMock) Get(u types.UserID) (*types.UserEntry, error) {
@@ -28,6 +29,13 @@ func (usm *userStoreMock) Get(u types.UserID) (*types.UserEntry, error) {
 	return usm.get(u)
 }
 
+func (usm *userStoreMock) GetByEmail(email string) (*types.UserEntry, error) {
+	if usm.getByEmail == nil {
+		panic("userStoreMock: missing `getByEmail` hook")
+	}
+	return usm.getByEmail(email)
+}
+
 func (usm *userStoreMock) Upsert(entry *types.UserEntry) error {
 	if usm.upsert == nil {
 		panic("userStoreMock: missing `upsert` hook")
@@ -65,19 +73,26 @@ func TestAuthService_ConfirmRegistration(t *testing.T) {
 			},
 		},
 		{
-			name:     "token parse err",
-			subject:  "user",
-			token:    "",
-			email:    "user@example.org",
-			password: goodPassword,
-			wanted:   nil,
-			wantedErr: TokenClaimsParseErr(fmt.Errorf(
-				"parsing claims from token: %v",
-				jwt.NewValidationError(
-					"token contains an invalid number of segments",
-					jwt.ValidationErrorMalformed,
-				),
-			)),
+			name:      "token parse err",
+			subject:   "user",
+			token:     "",
+			email:     "user@example.org",
+			password:  goodPassword,
+			wanted:    nil,
+			wantedErr: ErrInvalidResetToken,
+		},
+		{
+			name:    "expired token",
+			subject: "user",
+			token: mustResetToken(
+				now.Add(-2*time.Hour),
+				"user",
+				"user@example.org",
+			),
+			email:     "user@example.org",
+			password:  goodPassword,
+			wanted:    nil,
+			wantedErr: ErrInvalidResetToken,
 		},
 		{
 			name:      "password validation err",
@@ -86,7 +101,7 @@ func TestAuthService_ConfirmRegistration(t *testing.T) {
 			email:     "user@example.org",
 			password:  "", // invalid
 			wanted:    nil,
-			wantedErr: ErrPasswordTooSimple,
+			wantedErr: ErrPasswordRejected,
 		},
 	} {
 		t.Run(testCase.name, func(t *testing.T) {
@@ -95,7 +110,7 @@ func TestAuthService_ConfirmRegistration(t *testing.T) {
 
 			userStore := testsupport.UserStoreFake{}
 			authService := AuthService{
-				Creds:  CredStore{userStore},
+				Creds:  CredStore{Users: userStore},
 				Tokens: testsupport.TokenStoreFake{},
 				TokenDetails: TokenDetailsFactory{
 					AccessTokens:  accessTokenFactory,
@@ -141,7 +156,7 @@ func TestAuthService_ConfirmRegistration(t *testing.T) {
 }
 
 func mustResetToken(now time.Time, user types.UserID, email string) string {
-	t, err := resetTokenFactory.Create(now, user, email)
+	t, err := resetTokenFactory.Create(now, user, email, "")
 	if err != nil {
 		panic(fmt.Sprintf("creating reset token: %v", err))
 	}
@@ -167,7 +182,7 @@ func TestAuthService_Login(t *testing.T) {
 	jwt.TimeFunc = func() time.Time { return now.Add(1 * time.Second) }
 	tokenStore := testsupport.TokenStoreFake{}
 	authService := AuthService{
-		Creds: CredStore{&userStoreMock{
+		Creds: CredStore{Users: &userStoreMock{
 			get: func(u types.UserID) (*types.UserEntry, error) {
 				if u != "user" {
 					return nil, types.ErrUserNotFound
@@ -194,12 +209,14 @@ func TestAuthService_Login(t *testing.T) {
 			},
 			TimeFunc: func() time.Time { return now },
 		},
+		TimeFunc: func() time.Time { return now },
 	}
 
-	tokens, err := authService.Login(&types.Credentials{
-		User:     "user",
-		Password: password,
-	})
+	client := types.ClientInfo{UserAgent: "agent", IP: "192.0.2.1"}
+	tokens, err := authService.Login(
+		&types.Credentials{User: "user", Password: password},
+		&client,
+	)
 
 	if err != nil {
 		t.Fatalf("Unexpected err: %v", err)
@@ -226,6 +243,12 @@ func TestAuthService_Login(t *testing.T) {
 		t.Fatalf("Unexpected err: %v", err)
 	}
 
+	// refresh token IDs are random
+	if claims.Id == "" {
+		t.Fatal("refresh token is missing `jti` claim")
+	}
+	claims.Id = ""
+
 	if wanted := (jwt.StandardClaims{
 		ExpiresAt: now.Add(7 * 24 * time.Hour).Unix(),
 		IssuedAt:  now.Unix(),
@@ -242,6 +265,7 @@ func TestAuthService_Login(t *testing.T) {
 	if err := types.CompareTokens(
 		[]types.Token{{
 			Token:   tokens.RefreshToken.Token,
+			Family:  tokens.RefreshToken.Family,
 			Expires: tokens.RefreshToken.Expires,
 		}},
 		entries,
@@ -249,6 +273,378 @@ func TestAuthService_Login(t *testing.T) {
 		t.Fatal(err)
 	}
 
+	// make sure the session was recorded
+	sessions, _ := tokenStore.ListSessions("user")
+	if err := types.CompareSessions(
+		[]types.Session{{
+			ID:         tokens.RefreshToken.Family,
+			Subject:    "user",
+			IssuedAt:   now,
+			ClientInfo: client,
+		}},
+		sessions,
+	); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAuthService_EmailIdentifier(t *testing.T) {
+	jwt.TimeFunc = nowTimeFunc
+	defer func() { jwt.TimeFunc = time.Now }()
+
+	notifications := testsupport.NotificationServiceFake{}
+	authService := AuthService{
+		Creds: CredStore{Users: testsupport.UserStoreFake{
+			"user": {
+				User:         "user",
+				Email:        "user@example.org",
+				PasswordHash: hashBcrypt(goodPassword),
+			},
+		}},
+		Tokens:        testsupport.TokenStoreFake{},
+		Notifications: &notifications,
+		ResetTokens:   resetTokenFactory,
+		TokenDetails: TokenDetailsFactory{
+			AccessTokens:  accessTokenFactory,
+			RefreshTokens: refreshTokenFactory,
+			TimeFunc:      nowTimeFunc,
+		},
+		TimeFunc: nowTimeFunc,
+	}
+
+	tokens, err := authService.Login(
+		&types.Credentials{User: "user@example.org", Password: goodPassword},
+		nil,
+	)
+	if err != nil {
+		t.Fatalf("Login(): unexpected err: %v", err)
+	}
+	claims, err := parseToken(
+		tokens.AccessToken.Token,
+		accessTokenFactory.SigningKey,
+	)
+	if err != nil {
+		t.Fatalf("parsing access token: %v", err)
+	}
+	if claims.Subject != "user" {
+		t.Fatalf("Subject: wanted `user`; found `%s`", claims.Subject)
+	}
+
+	// Unknown email addresses and wrong passwords fail alike.
+	for _, creds := range []types.Credentials{
+		{User: "user@example.org", Password: "wrong"},
+		{User: "nobody@example.org", Password: goodPassword},
+	} {
+		if _, err := authService.Login(
+			&creds,
+			nil,
+		); !errors.Is(err, ErrCredentials) {
+			t.Fatalf(
+				"Login(`%s`): wanted `%v`; found `%v`",
+				creds.User,
+				ErrCredentials,
+				err,
+			)
+		}
+	}
+
+	if err := authService.ForgotPassword("user@example.org"); err != nil {
+		t.Fatalf("ForgotPassword(): unexpected err: %v", err)
+	}
+	if err := (&types.Notification{
+		Type:  types.NotificationTypeForgotPassword,
+		User:  "user",
+		Email: "user@example.org",
+		Token: notifications.Notifications[0].Token,
+	}).Compare(notifications.Notifications[0]); err != nil {
+		t.Fatal(err)
+	}
+	if err := authService.ForgotPassword(
+		"nobody@example.org",
+	); !errors.Is(err, types.ErrUserNotFound) {
+		t.Fatalf(
+			"ForgotPassword(): wanted `%v`; found `%v`",
+			types.ErrUserNotFound,
+			err,
+		)
+	}
+}
+
+func TestTokenFactory_VerificationKey(t *testing.T) {
+	retiredKey, err := ecdsa.GenerateKey(elliptic.P521(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Unexpected err: %v", err)
+	}
+	unknownKey, err := ecdsa.GenerateKey(elliptic.P521(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Unexpected err: %v", err)
+	}
+	retiredFactory := refreshTokenFactory
+	retiredFactory.SigningKey = retiredKey
+	unknownFactory := refreshTokenFactory
+	unknownFactory.SigningKey = unknownKey
+
+	// tokens which were signed before we started setting `kid` headers
+	legacy := func(key *ecdsa.PrivateKey) string {
+		token, err := jwt.NewWithClaims(
+			jwt.SigningMethodES512,
+			jwt.StandardClaims{Subject: "user"},
+		).SignedString(key)
+		if err != nil {
+			t.Fatalf("Unexpected err: %v", err)
+		}
+		return token
+	}
+
+	factory := refreshTokenFactory
+	factory.RetiredKeys = []*ecdsa.PublicKey{&retiredKey.PublicKey}
+
+	for _, testCase := range []struct {
+		name      string
+		token     string
+		wantedErr bool
+	}{
+		{
+			name:  "active key",
+			token: must(refreshTokenFactory.Create(now, "user")).Token,
+		},
+		{
+			name:  "retired key",
+			token: must(retiredFactory.Create(now, "user")).Token,
+		},
+		{
+			name:      "unknown key",
+			token:     must(unknownFactory.Create(now, "user")).Token,
+			wantedErr: true,
+		},
+		{
+			name:  "no key ID",
+			token: legacy(refreshSigningKey),
+		},
+		{
+			name:  "no key ID, retired key",
+			token: legacy(retiredKey),
+		},
+		{
+			name:      "no key ID, unknown key",
+			token:     legacy(unknownKey),
+			wantedErr: true,
+		},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			jwt.TimeFunc = nowTimeFunc
+			defer func() { jwt.TimeFunc = time.Now }()
+
+			_, err := jwt.Parse(testCase.token, factory.VerificationKey)
+			if testCase.wantedErr && err == nil {
+				t.Fatal("wanted error; found `nil`")
+			}
+			if !testCase.wantedErr && err != nil {
+				t.Fatalf("Unexpected err: %v", err)
+			}
+		})
+	}
+}
+
+func TestAuthService_Refresh_RetiredKey(t *testing.T) {
+	jwt.TimeFunc = nowTimeFunc
+	defer func() { jwt.TimeFunc = time.Now }()
+
+	// the refresh token was signed with the previous refresh key, which has
+	// since been rotated out for a new one.
+	rotatedFactory := refreshTokenFactory
+	rotatedFactory.SigningKey = codesSigningKey
+	rotatedFactory.RetiredKeys = []*ecdsa.PublicKey{
+		&refreshSigningKey.PublicKey,
+	}
+
+	tokens := testsupport.TokenStoreFake{
+		refreshToken.Token: {
+			Token:   refreshToken.Token,
+			Expires: refreshToken.Expires,
+		},
+	}
+	authService := AuthService{
+		Tokens: tokens,
+		TokenDetails: TokenDetailsFactory{
+			AccessTokens:  accessTokenFactory,
+			RefreshTokens: rotatedFactory,
+			TimeFunc:      nowTimeFunc,
+		},
+	}
+
+	if _, err := authService.Refresh(refreshToken.Token); err != nil {
+		t.Fatalf("Unexpected err: %v", err)
+	}
+
+	// once the key is removed from the ring, tokens it signed are rejected.
+	rotatedFactory.RetiredKeys = nil
+	authService.TokenDetails.RefreshTokens = rotatedFactory
+	if _, err := authService.Refresh(refreshToken.Token); err == nil {
+		t.Fatal("wanted error; found `nil`")
+	}
+}
+
+func TestAuthService_Refresh_Reuse(t *testing.T) {
+	jwt.TimeFunc = nowTimeFunc
+	defer func() { jwt.TimeFunc = time.Now }()
+
+	tokens := testsupport.TokenStoreFake{}
+	authService := AuthService{
+		Tokens: tokens,
+		TokenDetails: TokenDetailsFactory{
+			AccessTokens:  accessTokenFactory,
+			RefreshTokens: refreshTokenFactory,
+			TimeFunc:      nowTimeFunc,
+		},
+		TimeFunc: nowTimeFunc,
+	}
+
+	client := types.ClientInfo{UserAgent: "agent", IP: "192.0.2.1"}
+	original, err := authService.issueTokens(string(user), &client)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	rotated, err := authService.Refresh(original.RefreshToken.Token)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if rotated.RefreshToken.Family != original.RefreshToken.Family {
+		t.Fatalf(
+			"rotated token family: wanted `%s`; found `%s`",
+			original.RefreshToken.Family,
+			rotated.RefreshToken.Family,
+		)
+	}
+	if err := tokens.Exists(original.RefreshToken.Token); err == nil {
+		t.Fatal("original refresh token wasn't revoked")
+	}
+
+	// the rotated token continues the original session
+	session, err := tokens.GetSession(rotated.RefreshToken.Family)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := (&types.Session{
+		ID:         original.RefreshToken.Family,
+		Subject:    string(user),
+		IssuedAt:   now,
+		ClientInfo: client,
+	}).Compare(session); err != nil {
+		t.Fatal(err)
+	}
+
+	// an unrelated login shouldn't be affected by reuse in another family.
+	other, err := authService.issueTokens(string(user), nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	_, err = authService.Refresh(original.RefreshToken.Token)
+	if err := types.ErrTokenNotFound.CompareErr(err); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := tokens.Exists(rotated.RefreshToken.Token); err == nil {
+		t.Fatal("reusing a rotated token didn't revoke its family")
+	}
+	if err := tokens.Exists(other.RefreshToken.Token); err != nil {
+		t.Fatalf("unrelated family was revoked: %v", err)
+	}
+}
+
+func TestAuthService_Refresh_Grace(t *testing.T) {
+	jwt.TimeFunc = nowTimeFunc
+	defer func() { jwt.TimeFunc = time.Now }()
+
+	current := now
+	tokens := testsupport.TokenStoreFake{}
+	authService := AuthService{
+		Tokens: tokens,
+		TokenDetails: TokenDetailsFactory{
+			AccessTokens:  accessTokenFactory,
+			RefreshTokens: refreshTokenFactory,
+			TimeFunc:      func() time.Time { return current },
+		},
+		RefreshGrace: &RefreshGrace{Period: 10 * time.Second},
+		TimeFunc:     nowTimeFunc,
+	}
+
+	original, err := authService.issueTokens(string(user), nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// A second request with the same token (e.g., a parallel request from
+	// the same browser) gets the same successor without revoking the
+	// session.
+	first, err := authService.Refresh(original.RefreshToken.Token)
+	if err != nil {
+		t.Fatalf("Refresh() #0: unexpected error: %v", err)
+	}
+	current = current.Add(time.Second)
+	second, err := authService.Refresh(original.RefreshToken.Token)
+	if err != nil {
+		t.Fatalf("Refresh() #1: unexpected error: %v", err)
+	}
+	if err := first.RefreshToken.Compare(&second.RefreshToken); err != nil {
+		t.Fatal(err)
+	}
+	if err := tokens.Exists(first.RefreshToken.Token); err != nil {
+		t.Fatalf("successor was revoked: %v", err)
+	}
+
+	// After the grace period, reuse revokes the family as usual.
+	current = current.Add(10 * time.Second)
+	_, err = authService.Refresh(original.RefreshToken.Token)
+	if err := types.ErrTokenNotFound.CompareErr(err); err != nil {
+		t.Fatal(err)
+	}
+	if err := tokens.Exists(first.RefreshToken.Token); err == nil {
+		t.Fatal("reusing a rotated token didn't revoke its family")
+	}
+}
+
+func TestAuthService_Exchange_Replay(t *testing.T) {
+	jwt.TimeFunc = nowTimeFunc
+	defer func() { jwt.TimeFunc = time.Now }()
+
+	tokens := testsupport.TokenStoreFake{}
+	authService := AuthService{
+		Tokens:        tokens,
+		Codes:         codesTokenFactory,
+		RedeemedCodes: testsupport.CodeStoreFake{},
+		TokenDetails: TokenDetailsFactory{
+			AccessTokens:  accessTokenFactory,
+			RefreshTokens: refreshTokenFactory,
+			TimeFunc:      nowTimeFunc,
+		},
+		TimeFunc: nowTimeFunc,
+	}
+
+	code, err := authService.authCode(user, nil, nil)
+	if err != nil {
+		t.Fatalf("creating auth code: %v", err)
+	}
+
+	original, err := authService.Exchange(code, "")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := tokens.Exists(original.RefreshToken.Token); err != nil {
+		t.Fatalf("refresh token wasn't stored: %v", err)
+	}
+
+	if _, err := authService.Exchange(code, ""); err != ErrUnauthorized {
+		t.Fatalf("wanted `%v`; found `%v`", ErrUnauthorized, err)
+	}
+
+	// The refresh token issued for the original exchange must be revoked
+	// since we can't tell whether it went to the user or to an attacker.
+	if len(tokens) != 0 {
+		t.Fatalf("wanted all refresh tokens revoked; found `%d`", len(tokens))
+	}
 }
 
 func parseToken(
@@ -300,7 +696,7 @@ func TestAuthService_Register(t *testing.T) {
 		t.Fatalf("Unexpected err: %v", err)
 	}
 	authService := AuthService{
-		Creds: CredStore{&userStoreMock{
+		Creds: CredStore{Users: &userStoreMock{
 			get: func(u types.UserID) (*types.UserEntry, error) {
 				return nil, types.ErrUserNotFound
 			},
@@ -320,7 +716,11 @@ func TestAuthService_Register(t *testing.T) {
 		TimeFunc: func() time.Time { return now },
 	}
 
-	if err := authService.Register("user", "user@example.org"); err != nil {
+	if err := authService.Register(
+		"user",
+		"user@example.org",
+		"",
+	); err != nil {
 		t.Fatalf("Unexpected err: %v", err)
 	}
 
@@ -338,7 +738,7 @@ func TestAuthService_Register(t *testing.T) {
 
 func TestAuthService_Register_UserNameExists(t *testing.T) {
 	authService := AuthService{
-		Creds: CredStore{&userStoreMock{
+		Creds: CredStore{Users: &userStoreMock{
 			get: func(u types.UserID) (*types.UserEntry, error) {
 				return &types.UserEntry{
 					User:         u,
@@ -349,7 +749,11 @@ func TestAuthService_Register_UserNameExists(t *testing.T) {
 		}},
 	}
 
-	if err := authService.Register("user", "user@example.org"); err != nil {
+	if err := authService.Register(
+		"user",
+		"user@example.org",
+		"",
+	); err != nil {
 		if !errors.Is(err, ErrUserExists) {
 			t.Fatalf(
 				"Wanted error '%s'; found '%s'",
@@ -365,7 +769,7 @@ func TestAuthService_Register_UserNameExists(t *testing.T) {
 func TestAuthService_Register_InvalidEmailAddress(t *testing.T) {
 	authService := AuthService{}
 	for _, email := range []string{"", "nodomain@", "noatsign"} {
-		if err := authService.Register("user", email); err != nil {
+		if err := authService.Register("user", email, ""); err != nil {
 			if errors.Is(err, ErrInvalidEmail) {
 				continue
 			}
@@ -440,21 +844,24 @@ func TestAuthService_UpdatePassword(t *testing.T) {
 	var (
 		now      = time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
 		password = "osakldflhkjewadfkjsfduIHUHKJGFU"
-		entry    *types.UserEntry
+		entry    = &types.UserEntry{
+			User:         "user",
+			Email:        "user@example.org",
+			PasswordHash: hashBcrypt(password),
+		}
 	)
+	jwt.TimeFunc = func() time.Time { return now }
+	defer func() { jwt.TimeFunc = time.Now }()
 	resetKey, err := ecdsa.GenerateKey(elliptic.P521(), rand.Reader)
 	if err != nil {
 		t.Fatalf("Unexpected err: %v", err)
 	}
+	tokens := testsupport.TokenStoreFake{}
 	authService := AuthService{
 		Creds: CredStore{
 			Users: &userStoreMock{
 				get: func(types.UserID) (*types.UserEntry, error) {
-					return &types.UserEntry{
-						User:         "user",
-						Email:        "user@example.org",
-						PasswordHash: hashBcrypt(password),
-					}, nil
+					return entry, nil
 				},
 				upsert: func(e *types.UserEntry) error { entry = e; return nil },
 			},
@@ -462,6 +869,7 @@ func TestAuthService_UpdatePassword(t *testing.T) {
 		Notifications: &notificationServiceMock{
 			notify: func(n *types.Notification) error { return nil },
 		},
+		Tokens: tokens,
 		ResetTokens: ResetTokenFactory{
 			Issuer:        "issuer",
 			Audience:      "audience",
@@ -471,13 +879,20 @@ func TestAuthService_UpdatePassword(t *testing.T) {
 		TimeFunc: func() time.Time { return now },
 	}
 
-	tok, err := authService.ResetTokens.Create(now, "user", "user@example.org")
+	if err := tokens.Put(
+		"refresh-token",
+		&types.Session{ID: "session", Subject: "user"},
+		now.Add(time.Hour),
+	); err != nil {
+		t.Fatalf("storing session: %v", err)
+	}
+
+	tok, err := authService.ResetTokens.CreatePasswordReset(now, entry)
 	if err != nil {
 		t.Fatalf("Unexpected err: %v", err)
 	}
 
 	if err := authService.UpdatePassword(&UpdatePassword{
-		User:     "user",
 		Password: password,
 		Token:    tok,
 	}); err != nil {
@@ -493,6 +908,87 @@ func TestAuthService_UpdatePassword(t *testing.T) {
 	if err := wantedCredentials.CompareUserEntry(entry); err != nil {
 		t.Fatalf("UserStore.Upsert(*Credentials): %v", err)
 	}
+	if len(tokens) != 0 {
+		t.Fatalf("wanted all sessions revoked; found %d tokens", len(tokens))
+	}
+
+	// The password changed, so the token is used up.
+	if err := authService.UpdatePassword(&UpdatePassword{
+		Password: password,
+		Token:    tok,
+	}); !errors.Is(err, ErrInvalidResetToken) {
+		t.Fatalf("Wanted `%v`; found `%v`", ErrInvalidResetToken, err)
+	}
+}
+
+func TestAuthService_SingleUseTokens(t *testing.T) {
+	jwt.TimeFunc = nowTimeFunc
+	defer func() { jwt.TimeFunc = time.Now }()
+
+	users := testsupport.UserStoreFake{}
+	authService := AuthService{
+		Creds:         CredStore{Users: users},
+		ResetTokens:   resetTokenFactory,
+		TimeFunc:      nowTimeFunc,
+		Notifications: &testsupport.NotificationServiceFake{},
+	}
+	wantInvalid := func(err error) {
+		t.Helper()
+		if !errors.Is(err, ErrInvalidResetToken) {
+			t.Fatalf("wanted `%v`; found `%v`", ErrInvalidResetToken, err)
+		}
+	}
+
+	registration := mustResetToken(now, "user", "user@example.org")
+	if err := authService.ConfirmRegistration(
+		registration,
+		goodPassword,
+	); err != nil {
+		t.Fatalf("ConfirmRegistration(): unexpected err: %v", err)
+	}
+	wantInvalid(authService.ConfirmRegistration(registration, goodPassword))
+
+	// Registration tokens can't reset passwords.
+	wantInvalid(authService.UpdatePassword(&UpdatePassword{
+		Password: goodPassword + "!",
+		Token:    registration,
+	}))
+
+	// Reset tokens can't register users, and a token issued before the
+	// password changed (e.g., by another reset) is used up.
+	reset, err := resetTokenFactory.CreatePasswordReset(now, users["user"])
+	if err != nil {
+		t.Fatalf("creating reset token: %v", err)
+	}
+	stale, err := resetTokenFactory.CreatePasswordReset(now, users["user"])
+	if err != nil {
+		t.Fatalf("creating reset token: %v", err)
+	}
+	delete(users, "user")
+	wantInvalid(authService.ConfirmRegistration(reset, goodPassword))
+	if err := authService.ConfirmRegistration(
+		mustResetToken(now, "user", "user@example.org"),
+		goodPassword,
+	); err != nil {
+		t.Fatalf("ConfirmRegistration(): unexpected err: %v", err)
+	}
+	wantInvalid(authService.UpdatePassword(&UpdatePassword{
+		Password: goodPassword,
+		Token:    stale,
+	}))
+
+	// Expired tokens are invalid too.
+	expired, err := resetTokenFactory.CreatePasswordReset(
+		now.Add(-2*time.Hour),
+		users["user"],
+	)
+	if err != nil {
+		t.Fatalf("creating reset token: %v", err)
+	}
+	wantInvalid(authService.UpdatePassword(&UpdatePassword{
+		Password: goodPassword + "!",
+		Token:    expired,
+	}))
 }
 
 func TestAuthService_Logout(t *testing.T) {
@@ -504,8 +1000,10 @@ func TestAuthService_Logout(t *testing.T) {
 		wantedState  []types.Token
 	}{
 		{
-			name:         "simple",
-			state:        testsupport.TokenStoreFake{"token": now},
+			name: "simple",
+			state: testsupport.TokenStoreFake{
+				"token": {Token: "token", Expires: now},
+			},
 			refreshToken: "token",
 		},
 		{
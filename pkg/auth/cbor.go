@@ -0,0 +1,141 @@
+package auth
+
+import "fmt"
+
+// cborDecoder decodes the subset of CBOR (RFC 8949) which WebAuthn uses for
+// attestation objects and COSE keys: integers, byte and text strings, arrays,
+// maps, and simple values. Indefinite-length items, tags, and floats aren't
+// supported. Integers are decoded as `int64`, byte strings as `[]byte`, text
+// strings as `string`, arrays as `[]interface{}`, and maps as
+// `map[interface{}]interface{}`.
+type cborDecoder struct {
+	data []byte
+	pos  int
+}
+
+// cborMaxDepth bounds the nesting of arrays and maps so that malicious input
+// can't exhaust the stack.
+const cborMaxDepth = 16
+
+func (d *cborDecoder) decode() (interface{}, error) {
+	return d.decodeDepth(0)
+}
+
+func (d *cborDecoder) decodeDepth(depth int) (interface{}, error) {
+	if depth > cborMaxDepth {
+		return nil, fmt.Errorf("decoding CBOR: maximum depth exceeded")
+	}
+
+	major, arg, err := d.head()
+	if err != nil {
+		return nil, err
+	}
+
+	switch major {
+	case 0:
+		if arg > 1<<63-1 {
+			return nil, fmt.Errorf("decoding CBOR: integer overflow")
+		}
+		return int64(arg), nil
+	case 1:
+		if arg > 1<<63-1 {
+			return nil, fmt.Errorf("decoding CBOR: integer overflow")
+		}
+		return -1 - int64(arg), nil
+	case 2, 3:
+		data, err := d.read(arg)
+		if err != nil {
+			return nil, err
+		}
+		if major == 3 {
+			return string(data), nil
+		}
+		return append([]byte(nil), data...), nil
+	case 4:
+		// Each item takes at least one byte, which bounds the allocation.
+		if arg > uint64(len(d.data)-d.pos) {
+			return nil, fmt.Errorf("decoding CBOR: unexpected end of data")
+		}
+		items := make([]interface{}, arg)
+		for i := range items {
+			if items[i], err = d.decodeDepth(depth + 1); err != nil {
+				return nil, err
+			}
+		}
+		return items, nil
+	case 5:
+		if arg > uint64(len(d.data)-d.pos) {
+			return nil, fmt.Errorf("decoding CBOR: unexpected end of data")
+		}
+		items := make(map[interface{}]interface{}, arg)
+		for i := uint64(0); i < arg; i++ {
+			key, err := d.decodeDepth(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			switch key.(type) {
+			case int64, string:
+			default:
+				return nil, fmt.Errorf(
+					"decoding CBOR: unsupported map key type `%T`",
+					key,
+				)
+			}
+			if items[key], err = d.decodeDepth(depth + 1); err != nil {
+				return nil, err
+			}
+		}
+		return items, nil
+	case 7:
+		switch arg {
+		case 20:
+			return false, nil
+		case 21:
+			return true, nil
+		case 22, 23:
+			return nil, nil
+		}
+	}
+
+	return nil, fmt.Errorf(
+		"decoding CBOR: unsupported item (major type %d)",
+		major,
+	)
+}
+
+// head reads an item's initial byte and argument.
+func (d *cborDecoder) head() (byte, uint64, error) {
+	b, err := d.read(1)
+	if err != nil {
+		return 0, 0, err
+	}
+	major, info := b[0]>>5, b[0]&0x1f
+
+	switch {
+	case info < 24:
+		return major, uint64(info), nil
+	case info <= 27:
+		data, err := d.read(1 << (info - 24))
+		if err != nil {
+			return 0, 0, err
+		}
+		var arg uint64
+		for _, b := range data {
+			arg = arg<<8 | uint64(b)
+		}
+		return major, arg, nil
+	}
+	return 0, 0, fmt.Errorf(
+		"decoding CBOR: unsupported additional information `%d`",
+		info,
+	)
+}
+
+func (d *cborDecoder) read(n uint64) ([]byte, error) {
+	if n > uint64(len(d.data)-d.pos) {
+		return nil, fmt.Errorf("decoding CBOR: unexpected end of data")
+	}
+	data := d.data[d.pos : d.pos+int(n)]
+	d.pos += int(n)
+	return data, nil
+}
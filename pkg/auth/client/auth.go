@@ -3,6 +3,7 @@ package client
 import (
 	"crypto/ecdsa"
 	"fmt"
+	"net/http"
 	"strings"
 
 	"github.com/dgrijalva/jwt-go"
@@ -10,38 +11,53 @@ import (
 )
 
 type Authenticator struct {
+	// Key verifies access tokens. It's ignored if `KeyFunc` is set.
 	Key *ecdsa.PublicKey
+
+	// KeyFunc selects the key which verifies an access token, e.g., by its
+	// `kid` header so that tokens signed by a retired key remain valid after
+	// the signing key is rotated (see `auth.TokenFactory.VerificationKey`).
+	KeyFunc jwt.Keyfunc
+}
+
+// keyFunc returns `KeyFunc` or, if it's `nil`, a key func which always
+// returns `Key`.
+func (a *Authenticator) keyFunc() jwt.Keyfunc {
+	if a.KeyFunc != nil {
+		return a.KeyFunc
+	}
+	return func(*jwt.Token) (interface{}, error) { return a.Key, nil }
 }
 
 func (a *Authenticator) Auth(authType AuthType, h pz.Handler) pz.Handler {
 	return func(r pz.Request) pz.Response {
-		result := authType.validate(a.Key, r)
+		result := authType.validate(a.keyFunc(), r)
 		if result.User == "" {
 			return pz.Unauthorized(nil, result)
 		}
 		r.Headers.Add("User", result.User)
-		return h(r).WithLogging(result)
+		return h(r).WithLogging(result).WithCookies(result.Cookies...)
 	}
 }
 
 func (a *Authenticator) Optional(authType AuthType, h pz.Handler) pz.Handler {
 	return func(r pz.Request) pz.Response {
-		result := authType.validate(a.Key, r)
+		result := authType.validate(a.keyFunc(), r)
 		if result.User != "" {
 			r.Headers.Add("User", result.User)
 		}
-		return h(r).WithLogging(result)
+		return h(r).WithLogging(result).WithCookies(result.Cookies...)
 	}
 }
 
 type AuthType interface {
-	validate(key *ecdsa.PublicKey, r pz.Request) *Result
+	validate(keyFunc jwt.Keyfunc, r pz.Request) *Result
 }
 
 type AuthTypeClientProgram struct{}
 
 func (atcp AuthTypeClientProgram) validate(
-	key *ecdsa.PublicKey,
+	keyFunc jwt.Keyfunc,
 	r pz.Request,
 ) *Result {
 	authorization := r.Headers.Get("Authorization")
@@ -52,7 +68,10 @@ func (atcp AuthTypeClientProgram) validate(
 		)
 	}
 
-	user, err := validateAccessToken(authorization[len("Bearer "):], key)
+	user, err := validateAccessToken(
+		authorization[len("Bearer "):],
+		keyFunc,
+	)
 	if err != nil {
 		return ResultErr("invalid access token", err)
 	}
@@ -64,6 +83,10 @@ type Result struct {
 	Message string `json:"message"`
 	Error   string `json:"error,omitempty"`
 	User    string `json:"user,omitempty"`
+
+	// Cookies are set on the response, e.g., when the auth type refreshed
+	// the caller's tokens.
+	Cookies []*http.Cookie `json:"-"`
 }
 
 func ResultErr(message string, err error) *Result {
@@ -76,13 +99,13 @@ func ResultOK(message string, user string) *Result {
 
 func ConstantAuthType(r *Result) AuthType {
 	return AuthTypeFunc(
-		func(*ecdsa.PublicKey, pz.Request) *Result { return r },
+		func(jwt.Keyfunc, pz.Request) *Result { return r },
 	)
 }
 
-type AuthTypeFunc func(*ecdsa.PublicKey, pz.Request) *Result
+type AuthTypeFunc func(jwt.Keyfunc, pz.Request) *Result
 
-func (atf AuthTypeFunc) validate(k *ecdsa.PublicKey, r pz.Request) *Result {
+func (atf AuthTypeFunc) validate(k jwt.Keyfunc, r pz.Request) *Result {
 	return atf(k, r)
 }
 
@@ -91,7 +114,7 @@ type AuthTypeWebServer struct {
 }
 
 func (atws *AuthTypeWebServer) validate(
-	key *ecdsa.PublicKey,
+	keyFunc jwt.Keyfunc,
 	r pz.Request,
 ) *Result {
 	accessCookie, err := r.Cookie("Access-Token")
@@ -114,7 +137,7 @@ func (atws *AuthTypeWebServer) validate(
 		return ResultErr("decrypting `Refresh-Token` cookie", err)
 	}
 
-	user, err := validateAccessToken(accessToken, key)
+	user, err := validateAccessToken(accessToken, keyFunc)
 	if err != nil {
 		if err, ok := err.(*jwt.ValidationError); ok {
 			masked := err.Errors & jwt.ValidationErrorExpired
@@ -128,17 +151,28 @@ func (atws *AuthTypeWebServer) validate(
 				// it's coming directly from the auth service, but we need its
 				// user. If we got here, the previous access token's user
 				// failed to parse because the token was expired.
-				user, err := validateAccessToken(rsp.AccessToken, key)
+				user, err := validateAccessToken(rsp.AccessToken, keyFunc)
 				if err != nil {
 					return ResultErr("parsing `sub` (user) claim", err)
 				}
 
-				encrypted, err := atws.Encrypt(rsp.AccessToken)
+				// The refresh token was rotated, so the old one is no longer
+				// valid and both cookies need to be replaced.
+				encryptedAccess, err := atws.Encrypt(rsp.AccessToken)
 				if err != nil {
 					return ResultErr("encrypting access token", err)
 				}
-				accessCookie.Value = encrypted
-				return ResultOK("successfully refreshed access token", user)
+				encryptedRefresh, err := atws.Encrypt(rsp.RefreshToken)
+				if err != nil {
+					return ResultErr("encrypting refresh token", err)
+				}
+				domain := atws.cookieDomain()
+				result := ResultOK("successfully refreshed access token", user)
+				result.Cookies = []*http.Cookie{
+					cookie("Access-Token", domain, encryptedAccess),
+					cookie("Refresh-Token", domain, encryptedRefresh),
+				}
+				return result
 			}
 			return ResultErr("validating access token", err)
 		}
@@ -148,15 +182,12 @@ func (atws *AuthTypeWebServer) validate(
 	return ResultOK("successfully validated access token", user)
 }
 
-func validateAccessToken(token string, key *ecdsa.PublicKey) (string, error) {
+func validateAccessToken(
+	token string,
+	keyFunc jwt.Keyfunc,
+) (string, error) {
 	var claims jwt.StandardClaims
-	if _, err := jwt.ParseWithClaims(
-		token,
-		&claims,
-		func(*jwt.Token) (interface{}, error) {
-			return key, nil
-		},
-	); err != nil {
+	if _, err := jwt.ParseWithClaims(token, &claims, keyFunc); err != nil {
 		return "", err
 	}
 	return claims.Subject, nil
@@ -2,10 +2,13 @@ package client
 
 import (
 	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
 	"errors"
 	"net/http"
 	"testing"
 
+	"github.com/dgrijalva/jwt-go"
 	pz "github.com/weberc2/httpeasy"
 )
 
@@ -16,6 +19,7 @@ func TestAuthenticator(t *testing.T) {
 		authResult    *Result
 		wantedUser    string
 		wantedInvoked bool
+		wantedCookies []string
 	}{
 		{
 			name:          "auth success",
@@ -24,6 +28,22 @@ func TestAuthenticator(t *testing.T) {
 			wantedUser:    "user",
 			wantedInvoked: true,
 		},
+		{
+			// E.g., refreshed tokens must be passed back to the caller.
+			name:   "auth success with cookies",
+			method: (*Authenticator).Auth,
+			authResult: &Result{
+				Message: "success",
+				User:    "user",
+				Cookies: []*http.Cookie{
+					{Name: "Access-Token", Value: "access-token"},
+					{Name: "Refresh-Token", Value: "refresh-token"},
+				},
+			},
+			wantedUser:    "user",
+			wantedInvoked: true,
+			wantedCookies: []string{"Access-Token", "Refresh-Token"},
+		},
 		{
 			name:          "auth failure",
 			method:        (*Authenticator).Auth,
@@ -48,9 +68,9 @@ func TestAuthenticator(t *testing.T) {
 	} {
 		var user string
 		var invoked bool
-		testCase.method(
+		rsp := testCase.method(
 			new(Authenticator),
-			AuthTypeFunc(func(_ *ecdsa.PublicKey, r pz.Request) *Result {
+			AuthTypeFunc(func(_ jwt.Keyfunc, r pz.Request) *Result {
 				return testCase.authResult
 			}),
 			func(r pz.Request) pz.Response {
@@ -69,5 +89,83 @@ func TestAuthenticator(t *testing.T) {
 				invoked,
 			)
 		}
+		if len(rsp.Cookies) != len(testCase.wantedCookies) {
+			t.Fatalf(
+				"wanted `%d` cookies; found `%d`",
+				len(testCase.wantedCookies),
+				len(rsp.Cookies),
+			)
+		}
+		for i, name := range testCase.wantedCookies {
+			if rsp.Cookies[i].Name != name {
+				t.Fatalf(
+					"Cookies[%d]: wanted `%s`; found `%s`",
+					i,
+					name,
+					rsp.Cookies[i].Name,
+				)
+			}
+		}
+	}
+}
+
+func TestAuthenticator_KeyFunc(t *testing.T) {
+	active, err := ecdsa.GenerateKey(elliptic.P521(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generating key: %v", err)
+	}
+	retired, err := ecdsa.GenerateKey(elliptic.P521(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generating key: %v", err)
+	}
+	token := jwt.NewWithClaims(
+		jwt.SigningMethodES512,
+		jwt.StandardClaims{Subject: "user"},
+	)
+	token.Header["kid"] = "retired"
+	accessToken, err := token.SignedString(retired)
+	if err != nil {
+		t.Fatalf("signing token: %v", err)
+	}
+
+	for _, testCase := range []struct {
+		name          string
+		authenticator Authenticator
+		wantedStatus  int
+	}{
+		{
+			name:          "active key only",
+			authenticator: Authenticator{Key: &active.PublicKey},
+			wantedStatus:  http.StatusUnauthorized,
+		},
+		{
+			name: "key ring",
+			authenticator: Authenticator{
+				Key: &active.PublicKey,
+				KeyFunc: func(t *jwt.Token) (interface{}, error) {
+					if t.Header["kid"] == "retired" {
+						return &retired.PublicKey, nil
+					}
+					return &active.PublicKey, nil
+				},
+			},
+			wantedStatus: http.StatusOK,
+		},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			rsp := testCase.authenticator.Auth(
+				AuthTypeClientProgram{},
+				func(pz.Request) pz.Response { return pz.Ok(nil, nil) },
+			)(pz.Request{Headers: http.Header{
+				"Authorization": []string{"Bearer " + accessToken},
+			}})
+			if rsp.Status != testCase.wantedStatus {
+				t.Fatalf(
+					"Response.Status: wanted `%d`; found `%d`",
+					testCase.wantedStatus,
+					rsp.Status,
+				)
+			}
+		})
 	}
 }
@@ -93,8 +93,17 @@ func (r *refresh) marshal() ([]byte, error) {
 	return data, nil
 }
 
-func (c *Client) Exchange(code string) (*auth.TokenDetails, error) {
-	data, err := json.Marshal(&auth.Code{Code: code})
+// Exchange exchanges an auth code for tokens. If a PKCE code challenge was
+// sent when the code was requested, the corresponding code verifier must be
+// provided; otherwise `codeVerifier` should be empty.
+func (c *Client) Exchange(
+	code string,
+	codeVerifier string,
+) (*auth.TokenDetails, error) {
+	data, err := json.Marshal(&auth.Code{
+		Code:         code,
+		CodeVerifier: codeVerifier,
+	})
 	if err != nil {
 		return nil, fmt.Errorf("marshaling code: %w", err)
 	}
@@ -133,3 +142,30 @@ func (c *Client) Exchange(code string) (*auth.TokenDetails, error) {
 
 	return &tokens, nil
 }
+
+// JWKS fetches the auth service's JWK Set. Callers can use the set to look up
+// the public key for a token by its `kid` header.
+func (c *Client) JWKS() (*auth.JWKSet, error) {
+	rsp, err := c.HTTP.Get(c.BaseURL + "/.well-known/jwks.json")
+	if err != nil {
+		return nil, fmt.Errorf("fetching JWK set: %w", err)
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf(
+			"JWK set response status: wanted `200`; found `%d`",
+			rsp.StatusCode,
+		)
+	}
+
+	data, err := ioutil.ReadAll(rsp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("reading JWK set response body: %w", err)
+	}
+
+	var set auth.JWKSet
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, fmt.Errorf("unmarshaling JWK set: %w", err)
+	}
+	return &set, nil
+}
@@ -6,6 +6,7 @@ import (
 	"crypto/rand"
 	"fmt"
 	"net/http/httptest"
+	"strings"
 	"testing"
 	"time"
 
@@ -44,11 +45,14 @@ func TestClient_Logout(t *testing.T) {
 	if err != nil {
 		t.Fatalf("creating test `auth.AuthService`: %v", err)
 	}
-	tokens, err := authService.Login(&types.Credentials{
-		User:     "user",
-		Email:    "user@example.org",
-		Password: "password",
-	})
+	tokens, err := authService.Login(
+		&types.Credentials{
+			User:     "user",
+			Email:    "user@example.org",
+			Password: "password",
+		},
+		nil,
+	)
 	if err != nil {
 		t.Fatalf("unexpected error logging in: %v", err)
 	}
@@ -66,29 +70,32 @@ func TestClient_Logout(t *testing.T) {
 	client := testClient(srv)
 
 	// make sure we can refresh
-	_, err = client.Refresh(tokens.RefreshToken.Token)
+	refreshed, err := client.Refresh(tokens.RefreshToken.Token)
 	if err != nil {
 		t.Fatalf("unexpected error refreshing token: %v", err)
 	}
 
-	// logout; make sure there's no error
-	if err := client.Logout(tokens.RefreshToken.Token); err != nil {
+	// logout with the rotated refresh token; make sure there's no error
+	if err := client.Logout(refreshed.RefreshToken); err != nil {
 		t.Fatalf("logout error: expected `nil`; found `%v`", err)
 	}
 
 	// make sure we CANNOT refresh
-	_, err = client.Refresh(tokens.RefreshToken.Token)
+	_, err = client.Refresh(refreshed.RefreshToken)
 	if err := auth.ErrUnauthorized.CompareErr(err); err != nil {
 		t.Fatal(err)
 	}
 }
 
 func TestClient_Exchange(t *testing.T) {
+	const verifier = "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"
 	for _, testCase := range []struct {
-		name         string
-		tokenCreated time.Time
-		wantedErr    types.WantedError
-		wantedTokens bool
+		name          string
+		tokenCreated  time.Time
+		codeChallenge string
+		codeVerifier  string
+		wantedErr     types.WantedError
+		wantedTokens  bool
 	}{
 		{
 			name:         "simple",
@@ -101,6 +108,28 @@ func TestClient_Exchange(t *testing.T) {
 			wantedErr:    auth.ErrUnauthorized,
 			wantedTokens: false,
 		},
+		{
+			name:          "pkce",
+			tokenCreated:  now,
+			codeChallenge: auth.CodeChallengeS256(verifier),
+			codeVerifier:  verifier,
+			wantedTokens:  true,
+		},
+		{
+			name:          "pkce: wrong verifier",
+			tokenCreated:  now,
+			codeChallenge: auth.CodeChallengeS256(verifier),
+			codeVerifier:  strings.Repeat("a", len(verifier)),
+			wantedErr:     auth.ErrUnauthorized,
+			wantedTokens:  false,
+		},
+		{
+			name:          "pkce: missing verifier",
+			tokenCreated:  now,
+			codeChallenge: auth.CodeChallengeS256(verifier),
+			wantedErr:     auth.ErrUnauthorized,
+			wantedTokens:  false,
+		},
 	} {
 		t.Run(testCase.name, func(t *testing.T) {
 			jwt.TimeFunc = func() time.Time { return now }
@@ -122,10 +151,18 @@ func TestClient_Exchange(t *testing.T) {
 
 			client := testClient(srv)
 
-			code, err := authService.Codes.Create(
-				testCase.tokenCreated,
-				"adam",
-			)
+			claims := auth.CodeClaims{
+				StandardClaims: authService.Codes.StandardClaims(
+					testCase.tokenCreated,
+					"adam",
+				),
+			}
+			claims.Id = "code"
+			if testCase.codeChallenge != "" {
+				claims.CodeChallenge = testCase.codeChallenge
+				claims.CodeChallengeMethod = auth.CodeChallengeMethodS256
+			}
+			code, err := authService.Codes.Sign(&claims)
 			if err != nil {
 				t.Fatalf("unexpected error creating auth code: %v", err)
 			}
@@ -133,7 +170,7 @@ func TestClient_Exchange(t *testing.T) {
 			if testCase.wantedErr == nil {
 				testCase.wantedErr = types.NilError{}
 			}
-			tokens, err := client.Exchange(code.Token)
+			tokens, err := client.Exchange(code, testCase.codeVerifier)
 			if err := testCase.wantedErr.CompareErr(err); err != nil {
 				t.Fatal(err)
 			}
@@ -148,6 +185,35 @@ func TestClient_Exchange(t *testing.T) {
 	}
 }
 
+func TestClient_JWKS(t *testing.T) {
+	authService, err := testAuthService(nil)
+	if err != nil {
+		t.Fatalf("creating test `auth.AuthService`: %v", err)
+	}
+
+	api := auth.AuthHTTPService{AuthService: authService}
+	srv := httptest.NewServer(pz.Register(
+		pztest.TestLog(t),
+		api.JWKSRoute(),
+	))
+	defer srv.Close()
+
+	client := testClient(srv)
+	set, err := client.JWKS()
+	if err != nil {
+		t.Fatalf("unexpected error fetching JWK set: %v", err)
+	}
+
+	wanted := &authService.TokenDetails.AccessTokens.SigningKey.PublicKey
+	found, err := set.Key(auth.KeyID(wanted))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !wanted.Equal(found) {
+		t.Fatal("access key: JWK doesn't match signing key")
+	}
+}
+
 func testClient(srv *httptest.Server) Client {
 	return Client{HTTP: *testHTTPClient(srv), BaseURL: srv.URL}
 }
@@ -186,6 +252,7 @@ func testAuthService(options *authServiceOptions) (auth.AuthService, error) {
 		Creds:         auth.CredStore{Users: options.userStore},
 		Notifications: &testsupport.NotificationServiceFake{},
 		Codes:         *options.authCodeFactory,
+		RedeemedCodes: testsupport.CodeStoreFake{},
 		TokenDetails: auth.TokenDetailsFactory{
 			AccessTokens: auth.TokenFactory{
 				Issuer:        "issuer",
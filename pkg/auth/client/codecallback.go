@@ -79,7 +79,10 @@ func codeCallback(
 		return &result
 	}
 
-	tokens, err := client.Exchange(params.codeParam)
+	// Web server apps don't start the login flow themselves (users are sent
+	// straight to the auth service's login page), so there's no code
+	// verifier to send.
+	tokens, err := client.Exchange(params.codeParam, "")
 	if err != nil {
 		result.ExchangeError = err
 		return &result
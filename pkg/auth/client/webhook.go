@@ -0,0 +1,95 @@
+package client
+
+import (
+	"crypto/hmac"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/weberc2/auth/pkg/auth"
+	"github.com/weberc2/auth/pkg/auth/types"
+)
+
+var (
+	// ErrInvalidWebhookSignature is returned when a webhook's signature is
+	// missing or doesn't match its contents.
+	ErrInvalidWebhookSignature = errors.New("invalid webhook signature")
+
+	// ErrStaleWebhook is returned when a webhook's timestamp is outside of
+	// the verifier's tolerance, e.g., because it's being replayed.
+	ErrStaleWebhook = errors.New("stale webhook")
+)
+
+// Webhook is a verified webhook from `auth.WebhookNotificationService`.
+type Webhook struct {
+	// ID is the webhook's idempotency key. It's the same for every delivery
+	// of a given notification.
+	ID           string
+	Timestamp    time.Time
+	Notification types.Notification
+}
+
+// WebhookVerifier verifies the webhooks sent by
+// `auth.WebhookNotificationService`.
+type WebhookVerifier struct {
+	// Secret is the endpoint's secret.
+	Secret string
+
+	// Tolerance is how far a webhook's timestamp may be from the current
+	// time. If it's zero, 5 minutes is used.
+	Tolerance time.Duration
+
+	// TimeFunc returns the current time. If it's `nil`, `time.Now` is used.
+	TimeFunc func() time.Time
+}
+
+// Verify checks a webhook's signature and timestamp given its request
+// headers and body. If the signature doesn't match,
+// `ErrInvalidWebhookSignature` is returned; if the timestamp is out of
+// tolerance, `ErrStaleWebhook` is returned.
+func (wv *WebhookVerifier) Verify(
+	header http.Header,
+	body []byte,
+) (*Webhook, error) {
+	id := header.Get(auth.WebhookIDHeader)
+	seconds, err := strconv.ParseInt(
+		header.Get(auth.WebhookTimestampHeader),
+		10,
+		64,
+	)
+	if err != nil {
+		return nil, fmt.Errorf(
+			"%w: parsing timestamp: %v",
+			ErrInvalidWebhookSignature,
+			err,
+		)
+	}
+	timestamp := time.Unix(seconds, 0)
+
+	if !hmac.Equal(
+		[]byte(header.Get(auth.WebhookSignatureHeader)),
+		[]byte(auth.SignWebhook(wv.Secret, id, timestamp, body)),
+	) {
+		return nil, ErrInvalidWebhookSignature
+	}
+
+	timeFunc, tolerance := wv.TimeFunc, wv.Tolerance
+	if timeFunc == nil {
+		timeFunc = time.Now
+	}
+	if tolerance == 0 {
+		tolerance = 5 * time.Minute
+	}
+	if age := timeFunc().Sub(timestamp); age > tolerance || age < -tolerance {
+		return nil, ErrStaleWebhook
+	}
+
+	webhook := Webhook{ID: id, Timestamp: timestamp}
+	if err := json.Unmarshal(body, &webhook.Notification); err != nil {
+		return nil, fmt.Errorf("unmarshaling notification: %w", err)
+	}
+	return &webhook, nil
+}
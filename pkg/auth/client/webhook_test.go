@@ -0,0 +1,102 @@
+package client
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/weberc2/auth/pkg/auth"
+	"github.com/weberc2/auth/pkg/auth/types"
+)
+
+func TestWebhookVerifier(t *testing.T) {
+	body := []byte(
+		`{"type":"LOCKOUT","user":"adam","email":"adam@example.org"}`,
+	)
+	header := func(secret string, timestamp time.Time) http.Header {
+		return http.Header{
+			auth.WebhookIDHeader: []string{"id"},
+			auth.WebhookTimestampHeader: []string{
+				strconv.FormatInt(timestamp.Unix(), 10),
+			},
+			auth.WebhookSignatureHeader: []string{
+				auth.SignWebhook(secret, "id", timestamp, body),
+			},
+		}
+	}
+
+	for _, testCase := range []struct {
+		name      string
+		header    http.Header
+		body      []byte
+		wantedErr error
+	}{
+		{
+			name:   "valid",
+			header: header("secret", now),
+			body:   body,
+		},
+		{
+			name:   "within tolerance",
+			header: header("secret", now.Add(-4*time.Minute)),
+			body:   body,
+		},
+		{
+			name:      "wrong secret",
+			header:    header("other", now),
+			body:      body,
+			wantedErr: ErrInvalidWebhookSignature,
+		},
+		{
+			name:      "tampered body",
+			header:    header("secret", now),
+			body:      []byte(`{"type":"LOCKOUT","user":"beth"}`),
+			wantedErr: ErrInvalidWebhookSignature,
+		},
+		{
+			name:      "missing headers",
+			header:    http.Header{},
+			body:      body,
+			wantedErr: ErrInvalidWebhookSignature,
+		},
+		{
+			name:      "stale",
+			header:    header("secret", now.Add(-6*time.Minute)),
+			body:      body,
+			wantedErr: ErrStaleWebhook,
+		},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			verifier := WebhookVerifier{
+				Secret:   "secret",
+				TimeFunc: func() time.Time { return now },
+			}
+			webhook, err := verifier.Verify(testCase.header, testCase.body)
+			if testCase.wantedErr != nil {
+				if !errors.Is(err, testCase.wantedErr) {
+					t.Fatalf(
+						"Verify(): wanted `%v`; found `%v`",
+						testCase.wantedErr,
+						err,
+					)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Verify(): unexpected err: %v", err)
+			}
+			if webhook.ID != "id" {
+				t.Fatalf("Webhook.ID: wanted `id`; found `%s`", webhook.ID)
+			}
+			if err := (&types.Notification{
+				Type:  types.NotificationTypeLockout,
+				User:  "adam",
+				Email: "adam@example.org",
+			}).Compare(&webhook.Notification); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
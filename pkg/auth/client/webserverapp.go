@@ -91,11 +91,7 @@ func (app *WebServerApp) LogoutRoute(path string) pz.Route {
 				return pz.InternalServerError(&context)
 			}
 
-			portStart := strings.Index(app.BaseURL.Host, ":")
-			if portStart < 0 {
-				portStart = len(app.BaseURL.Host)
-			}
-			cookieDomain := app.BaseURL.Host[:portStart]
+			cookieDomain := app.cookieDomain()
 			context.Message = "successfully logged out"
 			return pz.SeeOther(context.Redirect, &context).WithCookies(
 				expireCookie(cookie("Access-Token", cookieDomain, "")),
@@ -105,6 +101,15 @@ func (app *WebServerApp) LogoutRoute(path string) pz.Route {
 	}
 }
 
+// cookieDomain returns the app's host name without the port.
+func (app *WebServerApp) cookieDomain() string {
+	portStart := strings.Index(app.BaseURL.Host, ":")
+	if portStart < 0 {
+		portStart = len(app.BaseURL.Host)
+	}
+	return app.BaseURL.Host[:portStart]
+}
+
 func expireCookie(c *http.Cookie) *http.Cookie {
 	c.MaxAge = -1
 	c.Expires = time.Unix(0, 0)
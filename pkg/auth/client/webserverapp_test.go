@@ -28,8 +28,10 @@ func TestWebServerApp_Logout(t *testing.T) {
 		wantedTokens    bool
 	}{
 		{
-			name:            "simple",
-			tokenStore:      testsupport.TokenStoreFake{"refresh-token": now},
+			name: "simple",
+			tokenStore: testsupport.TokenStoreFake{
+				"refresh-token": {Token: "refresh-token", Expires: now},
+			},
 			redirectDefault: "default",
 			cookies: map[string]string{
 				"Refresh-Token": "refresh-token",
@@ -63,8 +65,10 @@ func TestWebServerApp_Logout(t *testing.T) {
 			wantedTokens:   false,
 		},
 		{
-			name:            "redirect",
-			tokenStore:      testsupport.TokenStoreFake{"redirect-token": now},
+			name: "redirect",
+			tokenStore: testsupport.TokenStoreFake{
+				"redirect-token": {Token: "redirect-token", Expires: now},
+			},
 			redirectDefault: "default",
 			referer:         "redirect",
 			cookies: map[string]string{
@@ -279,14 +283,21 @@ func TestWebServerApp_AuthCodeCallback(t *testing.T) {
 
 			appClient := testHTTPClient(appSrv)
 
-			code, err := authCodeFactory.Create(testCase.tokenCreated, subject)
+			claims := auth.CodeClaims{
+				StandardClaims: authCodeFactory.StandardClaims(
+					testCase.tokenCreated,
+					subject,
+				),
+			}
+			claims.Id = "code"
+			code, err := authCodeFactory.Sign(&claims)
 			if err != nil {
 				t.Fatalf("creating auth code token: %v", err)
 			}
 
 			values := url.Values{}
 			if !testCase.omitCodeParam {
-				values.Add("code", code.Token)
+				values.Add("code", code)
 			}
 			if testCase.redirect != "" {
 				values.Add("redirect", testCase.redirect)
@@ -0,0 +1,108 @@
+package auth
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/weberc2/auth/pkg/auth/types"
+	pz "github.com/weberc2/httpeasy"
+)
+
+// remoteAddrHeader carries the request's remote address from `RemoteAddr`
+// to the handlers, since `pz.Request` doesn't expose it.
+const remoteAddrHeader = "X-Auth-Remote-Addr"
+
+// RemoteAddr wraps the service's handler so that the client IP addresses used
+// for throttling can be determined. It must wrap the handler whenever the
+// service is exposed; any value the client sent in its place is replaced.
+func RemoteAddr(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.Header.Set(remoteAddrHeader, r.RemoteAddr)
+		h.ServeHTTP(w, r)
+	})
+}
+
+// TrustedProxies are the networks of the reverse proxies in front of the
+// service. `X-Forwarded-For` entries are only believed if they were added by
+// one of them; otherwise anyone could pick the IP address they're throttled
+// by.
+type TrustedProxies []*net.IPNet
+
+// ParseTrustedProxies parses CIDR networks (e.g., `10.0.0.0/8`) and single IP
+// addresses.
+func ParseTrustedProxies(proxies []string) (TrustedProxies, error) {
+	var networks TrustedProxies
+	for _, proxy := range proxies {
+		proxy = strings.TrimSpace(proxy)
+		if !strings.Contains(proxy, "/") {
+			ip := net.ParseIP(proxy)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid trusted proxy: `%s`", proxy)
+			}
+			bits := 8 * len(ip.To4())
+			if bits == 0 {
+				bits = 8 * net.IPv6len
+			}
+			networks = append(networks, &net.IPNet{
+				IP:   ip,
+				Mask: net.CIDRMask(bits, bits),
+			})
+			continue
+		}
+		_, network, err := net.ParseCIDR(proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy: %w", err)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+func (tp TrustedProxies) contains(ip net.IP) bool {
+	for _, network := range tp {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientInfo returns the user agent and IP address of the request's client.
+// The IP address is the remote address unless that's a trusted proxy, in
+// which case `X-Forwarded-For` is followed from the right (the entries
+// appended by the proxies) to the first address which isn't a trusted proxy.
+func (as *AuthService) clientInfo(r pz.Request) *types.ClientInfo {
+	client := types.ClientInfo{UserAgent: r.Headers.Get("User-Agent")}
+	ip := remoteIP(r.Headers.Get(remoteAddrHeader))
+	if ip == nil {
+		return &client
+	}
+	client.IP = ip.String()
+
+	forwarded := strings.Split(
+		strings.Join(r.Headers.Values("X-Forwarded-For"), ","),
+		",",
+	)
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		if !as.TrustedProxies.contains(ip) {
+			break
+		}
+		ip = net.ParseIP(strings.TrimSpace(forwarded[i]))
+		if ip == nil {
+			break
+		}
+		client.IP = ip.String()
+	}
+	return &client
+}
+
+// remoteIP parses the IP address from a remote address (`host:port`).
+func remoteIP(addr string) net.IP {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	return net.ParseIP(host)
+}
@@ -0,0 +1,68 @@
+package auth
+
+import (
+	"net/http"
+	"testing"
+
+	pz "github.com/weberc2/httpeasy"
+)
+
+func TestAuthService_ClientInfo(t *testing.T) {
+	proxies, err := ParseTrustedProxies([]string{"10.0.0.0/8", "192.0.2.1"})
+	if err != nil {
+		t.Fatalf("ParseTrustedProxies(): unexpected err: %v", err)
+	}
+	authService := AuthService{TrustedProxies: proxies}
+
+	for _, testCase := range []struct {
+		name       string
+		remoteAddr string
+		forwarded  []string
+		wanted     string
+	}{
+		{
+			name:       "no proxy",
+			remoteAddr: "203.0.113.7:1234",
+			wanted:     "203.0.113.7",
+		},
+		{
+			// Only trusted proxies may say who the client is.
+			name:       "untrusted forwarded-for",
+			remoteAddr: "203.0.113.7:1234",
+			forwarded:  []string{"198.51.100.1"},
+			wanted:     "203.0.113.7",
+		},
+		{
+			name:       "trusted proxy",
+			remoteAddr: "10.1.2.3:1234",
+			forwarded:  []string{"198.51.100.1, 203.0.113.7"},
+			wanted:     "203.0.113.7",
+		},
+		{
+			name:       "trusted proxy chain",
+			remoteAddr: "10.1.2.3:1234",
+			forwarded:  []string{"198.51.100.1, 203.0.113.7", "192.0.2.1"},
+			wanted:     "203.0.113.7",
+		},
+		{
+			name:      "missing remote address",
+			forwarded: []string{"198.51.100.1"},
+			wanted:    "",
+		},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			headers := http.Header{"X-Forwarded-For": testCase.forwarded}
+			if testCase.remoteAddr != "" {
+				headers.Set(remoteAddrHeader, testCase.remoteAddr)
+			}
+			client := authService.clientInfo(pz.Request{Headers: headers})
+			if client.IP != testCase.wanted {
+				t.Fatalf(
+					"ClientInfo.IP: wanted `%s`; found `%s`",
+					testCase.wanted,
+					client.IP,
+				)
+			}
+		})
+	}
+}
@@ -1,29 +1,71 @@
 package auth
 
 import (
-	"encoding/json"
 	"fmt"
+	"io"
+	"os"
+	"sync"
 
-	"github.com/google/uuid"
 	"github.com/weberc2/auth/pkg/auth/types"
 )
 
-type ConsoleNotificationService struct{}
-
-func (cns ConsoleNotificationService) Notify(
-	u types.UserID,
-	t uuid.UUID,
-) error {
-	data, err := json.Marshal(struct {
-		User  types.UserID `json:"user"`
-		Token string       `json:"token"`
-	}{
-		User:  u,
-		Token: t.String(),
-	})
+// ConsoleNotificationService writes notifications to a writer (stdout by
+// default) instead of sending them, so that the registration and
+// forgot-password flows can be exercised locally. It renders the same
+// templates as `SESNotificationService` and includes the token URL so it
+// can be clicked or copied from a terminal.
+type ConsoleNotificationService struct {
+	// Writer receives the notifications. If it's `nil`, `os.Stdout` is used.
+	Writer io.Writer
+
+	TokenURL func(*types.Notification) string
+	EmailSettings
+
+	lock sync.Mutex
+}
+
+func (cns *ConsoleNotificationService) Notify(n *types.Notification) error {
+	settings, err := cns.settingsFor(n.Type, n.Locale)
+	if err != nil {
+		return err
+	}
+
+	rendered, err := settings.render(n, cns.TokenURL)
 	if err != nil {
 		return err
 	}
-	_, err = fmt.Printf("%s\n", data)
-	return err
+
+	// Keep concurrent notifications from interleaving.
+	cns.lock.Lock()
+	defer cns.lock.Unlock()
+
+	w := cns.Writer
+	if w == nil {
+		w = os.Stdout
+	}
+	if _, err := fmt.Fprintf(
+		w,
+		"----- %s notification -----\nTo: %s\nUser: %s\nSubject: %s\n",
+		n.Type,
+		n.Email,
+		n.User,
+		rendered.Subject,
+	); err != nil {
+		return fmt.Errorf("writing notification: %w", err)
+	}
+	if n.Token != "" {
+		if _, err := fmt.Fprintf(
+			w,
+			"URL: %s\n",
+			cns.TokenURL(n),
+		); err != nil {
+			return fmt.Errorf("writing notification: %w", err)
+		}
+	}
+	if _, err := fmt.Fprintf(w, "\n%s\n\n", rendered.Text); err != nil {
+		return fmt.Errorf("writing notification: %w", err)
+	}
+	return nil
 }
+
+var _ types.NotificationService = &ConsoleNotificationService{}
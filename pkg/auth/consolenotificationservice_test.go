@@ -0,0 +1,132 @@
+package auth
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/weberc2/auth/pkg/auth/types"
+)
+
+func TestConsoleNotificationService(t *testing.T) {
+	for _, testCase := range []struct {
+		name         string
+		notification types.Notification
+		wanted       []string
+		unwanted     []string
+	}{
+		{
+			name: "registration",
+			notification: types.Notification{
+				Type:  types.NotificationTypeRegister,
+				User:  "adam",
+				Email: "adam@example.org",
+				Token: "token",
+			},
+			wanted: []string{
+				"To: adam@example.org\n",
+				"Subject: " + DefaultRegistrationSettings.Subject + "\n",
+				"URL: https://auth.example.org/confirm?t=token\n",
+				"finish creating your account",
+			},
+		},
+		{
+			name: "forgot password",
+			notification: types.Notification{
+				Type:  types.NotificationTypeForgotPassword,
+				User:  "adam",
+				Email: "adam@example.org",
+				Token: "token",
+			},
+			wanted: []string{
+				"Subject: " + DefaultForgotPasswordSettings.Subject + "\n",
+				"URL: https://auth.example.org/confirm?t=token\n",
+			},
+		},
+		{
+			name: "lockout",
+			notification: types.Notification{
+				Type:  types.NotificationTypeLockout,
+				User:  "adam",
+				Email: "adam@example.org",
+			},
+			wanted: []string{
+				"Subject: " + DefaultLockoutSettings.Subject + "\n",
+			},
+			unwanted: []string{"URL: "},
+		},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			var sb strings.Builder
+			console := ConsoleNotificationService{
+				Writer: &sb,
+				TokenURL: func(n *types.Notification) string {
+					return "https://auth.example.org/confirm?t=" + n.Token
+				},
+				EmailSettings: DefaultEmailSettings,
+			}
+			if err := console.Notify(&testCase.notification); err != nil {
+				t.Fatalf("Notify(): unexpected err: %v", err)
+			}
+			output := sb.String()
+			for _, wanted := range testCase.wanted {
+				if !strings.Contains(output, wanted) {
+					t.Fatalf(
+						"wanted output to contain `%s`; found:\n%s",
+						wanted,
+						output,
+					)
+				}
+			}
+			for _, unwanted := range testCase.unwanted {
+				if strings.Contains(output, unwanted) {
+					t.Fatalf(
+						"wanted output not to contain `%s`; found:\n%s",
+						unwanted,
+						output,
+					)
+				}
+			}
+		})
+	}
+}
+
+func TestConsoleNotificationService_UnknownType(t *testing.T) {
+	for _, testCase := range []struct {
+		name     string
+		settings EmailSettings
+		typ      types.NotificationType
+	}{
+		{
+			name:     "unknown type",
+			settings: DefaultEmailSettings,
+			typ:      "UNKNOWN",
+		},
+		{
+			name:     "type without settings",
+			settings: EmailSettings{LockoutSettings: DefaultLockoutSettings},
+			typ:      types.NotificationTypeMagicLink,
+		},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			var sb strings.Builder
+			console := ConsoleNotificationService{
+				Writer: &sb,
+				TokenURL: func(n *types.Notification) string {
+					return "https://auth.example.org/confirm?t=" + n.Token
+				},
+				EmailSettings: testCase.settings,
+			}
+			if err := console.Notify(&types.Notification{
+				Type:  testCase.typ,
+				User:  "adam",
+				Email: "adam@example.org",
+				Token: "token",
+			}); err == nil {
+				t.Fatal("Notify(): wanted error; found `nil`")
+			}
+			if output := sb.String(); output != "" {
+				t.Fatalf("wanted no output; found:\n%s", output)
+			}
+		})
+	}
+}
@@ -5,12 +5,12 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"reflect"
+	"strings"
+	"sync"
 
-	"github.com/nbutton23/zxcvbn-go"
 	"github.com/weberc2/auth/pkg/auth/types"
 	pz "github.com/weberc2/httpeasy"
-
-	"golang.org/x/crypto/bcrypt"
 )
 
 var ErrPasswordTooSimple = &pz.HTTPError{
@@ -20,48 +20,193 @@ var ErrPasswordTooSimple = &pz.HTTPError{
 
 type CredStore struct {
 	Users types.UserStore
+
+	// Policy decides which new passwords are acceptable. If it's `nil`,
+	// `DefaultPasswordPolicy` is used.
+	Policy PasswordPolicy
+
+	// PasswordHistory is the number of previous password hashes kept for each
+	// user so that `PasswordHistoryPolicy` can block their reuse.
+	PasswordHistory int
+
+	// Hasher hashes new passwords. Existing hashes made with a different
+	// algorithm or weaker parameters are rehashed when the user next logs in
+	// so that the parameters can be raised without resetting passwords. If
+	// it's `nil`, `DefaultPasswordHasher` is used.
+	Hasher PasswordHasher
+}
+
+func (cs *CredStore) hasher() PasswordHasher {
+	if cs.Hasher == nil {
+		return DefaultPasswordHasher
+	}
+	return cs.Hasher
+}
+
+// lookup returns the entry of the user identified by a user ID or an email
+// address. IDs take precedence so that a user whose ID looks like someone
+// else's email address can't be shadowed.
+func (cs *CredStore) lookup(
+	identifier types.UserID,
+) (*types.UserEntry, error) {
+	entry, err := cs.Users.Get(identifier)
+	if errors.Is(err, types.ErrUserNotFound) &&
+		strings.Contains(string(identifier), "@") {
+		return cs.Users.GetByEmail(string(identifier))
+	}
+	return entry, err
+}
+
+// userID returns the ID of the user identified by a user ID or an email
+// address. If there is no such user, the identifier is returned as-is so
+// that callers behave the same either way.
+func (cs *CredStore) userID(identifier types.UserID) types.UserID {
+	entry, err := cs.lookup(identifier)
+	if err != nil {
+		if !errors.Is(err, types.ErrUserNotFound) {
+			log.Printf("error looking up user `%s`: %v", identifier, err)
+		}
+		return identifier
+	}
+	return entry.User
 }
 
+// Validate checks the credentials. `creds.User` may be a user ID or an email
+// address.
 func (cs *CredStore) Validate(creds *types.Credentials) error {
-	entry, err := cs.Users.Get(creds.User)
+	_, err := cs.check(creds)
+	return err
+}
+
+// check validates the credentials and returns the user's entry.
+func (cs *CredStore) check(
+	creds *types.Credentials,
+) (*types.UserEntry, error) {
+	entry, err := cs.lookup(creds.User)
 	if err != nil {
 		log.Printf("error fetching user `%s`: %v", creds.User, err)
 		// If the user doesn't exist, we want to return ErrCredentials in order
-		// to minimize the information we give to potential attackers.
+		// to minimize the information we give to potential attackers. That
+		// includes taking as long as checking a password would, or else the
+		// response time would tell which users exist.
 		if errors.Is(err, types.ErrUserNotFound) {
-			return ErrCredentials
+			if hash := cs.dummyHash(); hash != nil {
+				_ = ComparePasswordHash(hash, creds.Password)
+			}
+			return nil, ErrCredentials
 		}
-		return fmt.Errorf("validating credentials: %w", err)
+		return nil, fmt.Errorf("validating credentials: %w", err)
 	}
 
-	if err := bcrypt.CompareHashAndPassword(
+	if err := ComparePasswordHash(
 		entry.PasswordHash,
-		[]byte(creds.Password),
+		creds.Password,
 	); err != nil {
-		return ErrCredentials
+		if !errors.Is(err, ErrPasswordMismatch) {
+			log.Printf(
+				"error comparing password hash for user `%s`: %v",
+				creds.User,
+				err,
+			)
+		}
+		return nil, ErrCredentials
 	}
-	return nil
+	return cs.rehash(entry, creds.Password), nil
 }
 
-func validatePassword(creds *types.Credentials) error {
-	minEntropyMatch := zxcvbn.PasswordStrength(
-		creds.Password,
-		[]string{string(creds.User), creds.Email},
-	)
-	if minEntropyMatch.Score < 3 {
-		return fmt.Errorf("validating password: %w", ErrPasswordTooSimple)
+// dummyPassword is hashed by `dummyHash`. It doesn't matter what it is,
+// since nobody can log in with it.
+const dummyPassword = "dummy password"
+
+// dummyHashes caches the hash of `dummyPassword` for each hasher so that it's
+// only made once.
+var dummyHashes sync.Map
+
+// dummyHash returns a hash of `dummyPassword` made with the configured hasher
+// (and thus its parameters) for checking passwords of users who don't exist.
+// It returns `nil` if hashing fails.
+func (cs *CredStore) dummyHash() []byte {
+	hasher := cs.hasher()
+	// Hashers whose types can't be map keys aren't cached.
+	cacheable := reflect.TypeOf(hasher).Comparable()
+	if cacheable {
+		if hash, found := dummyHashes.Load(hasher); found {
+			return hash.([]byte)
+		}
+	}
+	hash, err := hasher.Hash(dummyPassword)
+	if err != nil {
+		log.Printf("error making dummy password hash: %v", err)
+		return nil
+	}
+	if cacheable {
+		dummyHashes.Store(hasher, hash)
+	}
+	return hash
+}
+
+// rehash rehashes the user's password with the configured hasher if the
+// stored hash is outdated. This is the only time the password is available,
+// so it's done as part of a successful login. Failing to rehash shouldn't
+// fail the login, so errors are logged and the hash is retried next time.
+func (cs *CredStore) rehash(
+	entry *types.UserEntry,
+	password string,
+) *types.UserEntry {
+	hasher := cs.hasher()
+	if !hasher.NeedsRehash(entry.PasswordHash) {
+		return entry
+	}
+
+	hash, err := hasher.Hash(password)
+	if err != nil {
+		log.Printf("error rehashing password for `%s`: %v", entry.User, err)
+		return entry
+	}
+	rehashed := *entry
+	rehashed.PasswordHash = hash
+	if err := cs.Users.Upsert(&rehashed); err != nil {
+		log.Printf(
+			"error storing rehashed password for `%s`: %v",
+			entry.User,
+			err,
+		)
+		return entry
+	}
+	return &rehashed
+}
+
+// validatePassword checks the new password against the policy. `existing` is
+// the user's current entry or `nil` if the user is new.
+func (cs *CredStore) validatePassword(
+	creds *types.Credentials,
+	existing *types.UserEntry,
+) error {
+	policy := cs.Policy
+	if policy == nil {
+		policy = DefaultPasswordPolicy
+	}
+	rejections, err := policy.Check(creds, existing)
+	if err != nil {
+		return fmt.Errorf("validating password: %w", err)
+	}
+	if len(rejections) > 0 {
+		return fmt.Errorf(
+			"validating password: %w",
+			&PasswordPolicyError{Rejections: rejections},
+		)
 	}
 	return nil
 }
 
-func makeUserEntry(creds *types.Credentials) (*types.UserEntry, error) {
-	if err := validatePassword(creds); err != nil {
+func (cs *CredStore) makeUserEntry(
+	creds *types.Credentials,
+	existing *types.UserEntry,
+) (*types.UserEntry, error) {
+	if err := cs.validatePassword(creds, existing); err != nil {
 		return nil, err
 	}
-	hashedPassword, err := bcrypt.GenerateFromPassword(
-		[]byte(creds.Password),
-		bcrypt.DefaultCost,
-	)
+	hashedPassword, err := cs.hasher().Hash(creds.Password)
 	if err != nil {
 		return nil, err
 	}
@@ -69,11 +214,12 @@ func makeUserEntry(creds *types.Credentials) (*types.UserEntry, error) {
 		User:         creds.User,
 		Email:        creds.Email,
 		PasswordHash: hashedPassword,
+		Locale:       creds.Locale,
 	}, nil
 }
 
 func (cs *CredStore) Create(creds *types.Credentials) error {
-	entry, err := makeUserEntry(creds)
+	entry, err := cs.makeUserEntry(creds, nil)
 	if err != nil {
 		return fmt.Errorf("creating credentials: %w", err)
 	}
@@ -85,14 +231,49 @@ func (cs *CredStore) Create(creds *types.Credentials) error {
 }
 
 func (cs *CredStore) Upsert(creds *types.Credentials) error {
-	entry, err := makeUserEntry(creds)
+	existing, err := cs.Users.Get(creds.User)
+	if errors.Is(err, types.ErrUserNotFound) {
+		existing = nil
+	} else if err != nil {
+		return fmt.Errorf("fetching user entry: %w", err)
+	}
+
+	entry, err := cs.makeUserEntry(creds, existing)
 	if err != nil {
 		return fmt.Errorf("creating user entry: %w", err)
 	}
 
+	if existing != nil {
+		// Changing the password mustn't turn off two-factor authentication.
+		entry.TOTPSecret = existing.TOTPSecret
+		entry.TOTPEnabled = existing.TOTPEnabled
+		entry.TOTPCounter = existing.TOTPCounter
+		entry.RecoveryCodes = existing.RecoveryCodes
+		entry.PasswordHistory = cs.passwordHistory(existing)
+		if entry.Locale == "" {
+			entry.Locale = existing.Locale
+		}
+	}
+
 	if err := cs.Users.Upsert(entry); err != nil {
 		return fmt.Errorf("upserting user store: %w", err)
 	}
 
 	return nil
 }
+
+// passwordHistory returns the hashes of the most recent `PasswordHistory`
+// passwords which the user had before the current change, newest first.
+func (cs *CredStore) passwordHistory(existing *types.UserEntry) [][]byte {
+	if cs.PasswordHistory < 1 {
+		return nil
+	}
+	history := append(
+		[][]byte{existing.PasswordHash},
+		existing.PasswordHistory...,
+	)
+	if len(history) > cs.PasswordHistory {
+		history = history[:cs.PasswordHistory]
+	}
+	return history
+}
@@ -11,7 +11,7 @@ func TestCreate(t *testing.T) {
 	const password = "oiusdpafohwerkljsfkljads;fweqr"
 
 	var entry *types.UserEntry
-	if err := (&CredStore{&userStoreMock{
+	if err := (&CredStore{Users: &userStoreMock{
 		insert: func(e *types.UserEntry) error { entry = e; return nil },
 	}}).Create(&types.Credentials{
 		User:     "user",
@@ -51,7 +51,18 @@ func TestUpsert(t *testing.T) {
 	const password = "oiusdpafohwerkljsfkljads;fweqr"
 
 	var entry *types.UserEntry
-	if err := (&CredStore{&userStoreMock{
+	if err := (&CredStore{Users: &userStoreMock{
+		get: func(u types.UserID) (*types.UserEntry, error) {
+			return &types.UserEntry{
+				User:          u,
+				Email:         "user@example.org",
+				PasswordHash:  hashBcrypt("old password"),
+				TOTPSecret:    "secret",
+				TOTPEnabled:   true,
+				TOTPCounter:   1,
+				RecoveryCodes: []string{"recovery code"},
+			}, nil
+		},
 		upsert: func(e *types.UserEntry) error { entry = e; return nil },
 	}}).Upsert(&types.Credentials{
 		User:     "user",
@@ -85,4 +96,10 @@ func TestUpsert(t *testing.T) {
 			password,
 		)
 	}
+
+	// Changing the password must leave two-factor authentication alone.
+	if !entry.TOTPEnabled || entry.TOTPSecret != "secret" ||
+		entry.TOTPCounter != 1 || len(entry.RecoveryCodes) != 1 {
+		t.Fatalf("UserStore: two-factor settings not preserved: %+v", entry)
+	}
 }
@@ -0,0 +1,111 @@
+package auth
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/mail"
+	"strings"
+
+	"github.com/weberc2/auth/pkg/auth/types"
+	pz "github.com/weberc2/httpeasy"
+)
+
+var ErrEmailUnchanged = &pz.HTTPError{
+	Status:  http.StatusBadRequest,
+	Message: "new email address is the same as the current one",
+}
+
+// RequestEmailChange starts changing a user's email address. A confirmation
+// link is sent to the new address, and the old address is told about the
+// request. The change only applies once it's confirmed (see
+// `ConfirmEmailChange`).
+func (as *AuthService) RequestEmailChange(
+	user types.UserID,
+	email string,
+) error {
+	parser := mail.AddressParser{}
+	if _, err := parser.Parse(email); err != nil {
+		return fmt.Errorf("requesting email change: %w", ErrInvalidEmail)
+	}
+
+	entry, err := as.Creds.Users.Get(user)
+	if err != nil {
+		return fmt.Errorf("requesting email change: %w", err)
+	}
+	if strings.EqualFold(entry.Email, email) {
+		return fmt.Errorf("requesting email change: %w", ErrEmailUnchanged)
+	}
+
+	// Whether another user already has the new address isn't checked until
+	// the change is confirmed, so that this doesn't reveal which addresses
+	// are registered.
+	token, err := as.ResetTokens.CreateEmailChange(
+		as.TimeFunc(),
+		user,
+		entry.Email,
+		email,
+		entry.Locale,
+	)
+	if err != nil {
+		return fmt.Errorf("requesting email change: %w", err)
+	}
+
+	// The confirmation is subject to the notification limits so that users
+	// can't spam arbitrary addresses. The notice accompanies it, so it isn't
+	// limited separately (the user's cooldown would drop it), and failing
+	// to send it doesn't fail the request.
+	if err := as.notify(&types.Notification{
+		Type:   types.NotificationTypeEmailChange,
+		User:   user,
+		Email:  email,
+		Token:  token,
+		Locale: entry.Locale,
+	}); err != nil {
+		return fmt.Errorf("notifying email change token: %w", err)
+	}
+	if err := as.Notifications.Notify(&types.Notification{
+		Type:   types.NotificationTypeEmailChangeNotice,
+		User:   user,
+		Email:  entry.Email,
+		Locale: entry.Locale,
+	}); err != nil {
+		log.Printf("notifying user `%s` of email change: %v", user, err)
+	}
+	return nil
+}
+
+// ConfirmEmailChange applies the email change for a token from
+// `RequestEmailChange`. If the user's email address changed since the token
+// was issued, the token is invalid. If another user has the new address,
+// `types.ErrEmailExists` is returned.
+func (as *AuthService) ConfirmEmailChange(token string) error {
+	claims, err := as.ResetTokens.Claims(token)
+	if err != nil {
+		return fmt.Errorf(
+			"confirming email change: %w",
+			TokenClaimsParseErr(err),
+		)
+	}
+
+	// As with password resets, don't tell attackers why the token is
+	// invalid.
+	if err := claims.Valid(); err != nil || claims.NewEmail == "" {
+		return fmt.Errorf("confirming email change: %w", ErrInvalidResetToken)
+	}
+
+	entry, err := as.Creds.Users.Get(claims.User)
+	if err != nil {
+		return fmt.Errorf("confirming email change: %w", err)
+	}
+	if entry.Email != claims.Email {
+		return fmt.Errorf("confirming email change: %w", ErrInvalidResetToken)
+	}
+
+	updated := *entry
+	updated.Email = claims.NewEmail
+	if err := as.Creds.Users.Upsert(&updated); err != nil {
+		return fmt.Errorf("confirming email change: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,252 @@
+package auth
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/weberc2/auth/pkg/auth/testsupport"
+	"github.com/weberc2/auth/pkg/auth/types"
+	pz "github.com/weberc2/httpeasy"
+)
+
+func TestAuthService_EmailChange(t *testing.T) {
+	jwt.TimeFunc = nowTimeFunc
+	defer func() { jwt.TimeFunc = time.Now }()
+
+	users := testsupport.UserStoreFake{
+		"adam": &types.UserEntry{
+			User:         "adam",
+			Email:        "adam@example.org",
+			PasswordHash: hashBcrypt(goodPassword),
+			Locale:       "de",
+		},
+	}
+	notifications := testsupport.NotificationServiceFake{}
+	authService := AuthService{
+		Creds:         CredStore{Users: users},
+		ResetTokens:   resetTokenFactory,
+		Notifications: &notifications,
+		TimeFunc:      nowTimeFunc,
+	}
+
+	for _, testCase := range []struct {
+		email  string
+		wanted error
+	}{
+		{email: "not an email", wanted: ErrInvalidEmail},
+		{email: "ADAM@example.org", wanted: ErrEmailUnchanged},
+	} {
+		if err := authService.RequestEmailChange(
+			"adam",
+			testCase.email,
+		); !errors.Is(err, testCase.wanted) {
+			t.Fatalf(
+				"RequestEmailChange(`%s`): wanted `%v`; found `%v`",
+				testCase.email,
+				testCase.wanted,
+				err,
+			)
+		}
+	}
+	if err := authService.RequestEmailChange(
+		"beth",
+		"beth@example.org",
+	); !errors.Is(err, types.ErrUserNotFound) {
+		t.Fatalf(
+			"RequestEmailChange(): wanted `%v`; found `%v`",
+			types.ErrUserNotFound,
+			err,
+		)
+	}
+
+	if err := authService.RequestEmailChange(
+		"adam",
+		"adam@example.com",
+	); err != nil {
+		t.Fatalf("RequestEmailChange(): unexpected err: %v", err)
+	}
+	if len(notifications.Notifications) != 2 {
+		t.Fatalf(
+			"wanted 2 notifications; found %d",
+			len(notifications.Notifications),
+		)
+	}
+	token := notifications.Notifications[0].Token
+	for i, wanted := range []types.Notification{
+		{
+			Type:   types.NotificationTypeEmailChange,
+			User:   "adam",
+			Email:  "adam@example.com",
+			Token:  token,
+			Locale: "de",
+		},
+		{
+			Type:   types.NotificationTypeEmailChangeNotice,
+			User:   "adam",
+			Email:  "adam@example.org",
+			Locale: "de",
+		},
+	} {
+		if err := wanted.Compare(notifications.Notifications[i]); err != nil {
+			t.Fatalf("Notifications[%d]: %v", i, err)
+		}
+	}
+
+	// The email address doesn't change until the change is confirmed.
+	if email := users["adam"].Email; email != "adam@example.org" {
+		t.Fatalf("wanted `adam@example.org`; found `%s`", email)
+	}
+
+	// Email change tokens can't register users or reset passwords.
+	if err := authService.ConfirmRegistration(
+		token,
+		goodPassword,
+	); !errors.Is(err, ErrInvalidResetToken) {
+		t.Fatalf(
+			"ConfirmRegistration(): wanted `%v`; found `%v`",
+			ErrInvalidResetToken,
+			err,
+		)
+	}
+	if err := authService.UpdatePassword(&UpdatePassword{
+		Password: goodPassword,
+		Token:    token,
+	}); !errors.Is(err, ErrInvalidResetToken) {
+		t.Fatalf(
+			"UpdatePassword(): wanted `%v`; found `%v`",
+			ErrInvalidResetToken,
+			err,
+		)
+	}
+
+	// Nor can other tokens change email addresses.
+	resetToken, err := resetTokenFactory.Create(
+		now,
+		"adam",
+		"adam@example.org",
+		"",
+	)
+	if err != nil {
+		t.Fatalf("creating reset token: %v", err)
+	}
+	if err := authService.ConfirmEmailChange(
+		resetToken,
+	); !errors.Is(err, ErrInvalidResetToken) {
+		t.Fatalf(
+			"ConfirmEmailChange(): wanted `%v`; found `%v`",
+			ErrInvalidResetToken,
+			err,
+		)
+	}
+
+	if err := authService.ConfirmEmailChange(token); err != nil {
+		t.Fatalf("ConfirmEmailChange(): unexpected err: %v", err)
+	}
+	if err := (&types.UserEntry{
+		User:         "adam",
+		Email:        "adam@example.com",
+		PasswordHash: users["adam"].PasswordHash,
+		Locale:       "de",
+	}).Compare(users["adam"]); err != nil {
+		t.Fatal(err)
+	}
+
+	// The token is spent once the email address has changed.
+	if err := authService.ConfirmEmailChange(
+		token,
+	); !errors.Is(err, ErrInvalidResetToken) {
+		t.Fatalf(
+			"ConfirmEmailChange(): wanted `%v`; found `%v`",
+			ErrInvalidResetToken,
+			err,
+		)
+	}
+}
+
+func TestAuthService_ConfirmEmailChange_EmailExists(t *testing.T) {
+	jwt.TimeFunc = nowTimeFunc
+	defer func() { jwt.TimeFunc = time.Now }()
+
+	authService := AuthService{
+		Creds: CredStore{Users: &userStoreMock{
+			get: func(user types.UserID) (*types.UserEntry, error) {
+				return &types.UserEntry{
+					User:  user,
+					Email: "adam@example.org",
+				}, nil
+			},
+			upsert: func(*types.UserEntry) error {
+				return types.ErrEmailExists
+			},
+		}},
+		ResetTokens: resetTokenFactory,
+	}
+	token, err := resetTokenFactory.CreateEmailChange(
+		now,
+		"adam",
+		"adam@example.org",
+		"beth@example.org",
+		"",
+	)
+	if err != nil {
+		t.Fatalf("creating email change token: %v", err)
+	}
+	if err := authService.ConfirmEmailChange(
+		token,
+	); !errors.Is(err, types.ErrEmailExists) {
+		t.Fatalf(
+			"ConfirmEmailChange(): wanted `%v`; found `%v`",
+			types.ErrEmailExists,
+			err,
+		)
+	}
+}
+
+func TestEmailChangeRoute(t *testing.T) {
+	service := AuthHTTPService{
+		AuthService: AuthService{
+			Creds: CredStore{Users: testsupport.UserStoreFake{
+				"adam": &types.UserEntry{
+					User:  "adam",
+					Email: "adam@example.org",
+				},
+			}},
+			ResetTokens:   resetTokenFactory,
+			Notifications: &testsupport.NotificationServiceFake{},
+			TimeFunc:      nowTimeFunc,
+		},
+		Authenticate: func(h pz.Handler) pz.Handler {
+			return func(r pz.Request) pz.Response {
+				r.Headers.Set("User", "adam")
+				return h(r)
+			}
+		},
+	}
+
+	for _, testCase := range []struct {
+		body   string
+		wanted int
+	}{
+		{body: `{"email": "adam@example.com"}`, wanted: http.StatusOK},
+		{body: `{"email": "adam"}`, wanted: http.StatusBadRequest},
+		{body: `{"email": "adam@example.org"}`, wanted: http.StatusBadRequest},
+		{body: `{`, wanted: http.StatusBadRequest},
+	} {
+		rsp := service.EmailChangeRoute().Handler(pz.Request{
+			Headers: http.Header{},
+			Body:    strings.NewReader(testCase.body),
+		})
+		if rsp.Status != testCase.wanted {
+			t.Fatalf(
+				"`%s`: Response.Status: wanted `%d`; found `%d`",
+				testCase.body,
+				testCase.wanted,
+				rsp.Status,
+			)
+		}
+	}
+}
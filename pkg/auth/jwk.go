@@ -0,0 +1,124 @@
+package auth
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"math/big"
+)
+
+// JWK is the JSON Web Key (RFC 7517) representation of an ECDSA public key.
+type JWK struct {
+	KeyType   string `json:"kty"`
+	Curve     string `json:"crv"`
+	X         string `json:"x"`
+	Y         string `json:"y"`
+	KeyID     string `json:"kid"`
+	Use       string `json:"use"`
+	Algorithm string `json:"alg"`
+}
+
+// JWKSet is a JSON Web Key Set (RFC 7517 section 5).
+type JWKSet struct {
+	Keys []JWK `json:"keys"`
+}
+
+// NewJWK converts an ECDSA public key into a signature-verification JWK whose
+// `kid` is the key's RFC 7638 thumbprint (see `KeyID`).
+func NewJWK(key *ecdsa.PublicKey) JWK {
+	x, y := coordinates(key)
+	return JWK{
+		KeyType:   "EC",
+		Curve:     key.Curve.Params().Name,
+		X:         x,
+		Y:         y,
+		KeyID:     KeyID(key),
+		Use:       "sig",
+		Algorithm: "ES512",
+	}
+}
+
+// KeyID returns the RFC 7638 JWK thumbprint for the provided public key. This
+// is used as the `kid` header for tokens signed by the corresponding private
+// key.
+func KeyID(key *ecdsa.PublicKey) string {
+	x, y := coordinates(key)
+
+	// RFC 7638 requires the required members in lexicographic order with no
+	// whitespace.
+	sum := sha256.Sum256([]byte(fmt.Sprintf(
+		`{"crv":"%s","kty":"EC","x":"%s","y":"%s"}`,
+		key.Curve.Params().Name,
+		x,
+		y,
+	)))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// PublicKey converts the JWK back into an ECDSA public key. Only the `P-521`
+// curve is supported since that's what all of our tokens are signed with.
+func (jwk *JWK) PublicKey() (*ecdsa.PublicKey, error) {
+	if jwk.KeyType != "EC" {
+		return nil, fmt.Errorf(
+			"JWK.KeyType: wanted `EC`; found `%s`",
+			jwk.KeyType,
+		)
+	}
+
+	curve := elliptic.P521()
+	if jwk.Curve != curve.Params().Name {
+		return nil, fmt.Errorf(
+			"JWK.Curve: wanted `%s`; found `%s`",
+			curve.Params().Name,
+			jwk.Curve,
+		)
+	}
+
+	x, err := base64.RawURLEncoding.DecodeString(jwk.X)
+	if err != nil {
+		return nil, fmt.Errorf("decoding JWK x-coordinate: %w", err)
+	}
+
+	y, err := base64.RawURLEncoding.DecodeString(jwk.Y)
+	if err != nil {
+		return nil, fmt.Errorf("decoding JWK y-coordinate: %w", err)
+	}
+
+	key := ecdsa.PublicKey{
+		Curve: curve,
+		X:     new(big.Int).SetBytes(x),
+		Y:     new(big.Int).SetBytes(y),
+	}
+	if !curve.IsOnCurve(key.X, key.Y) {
+		return nil, fmt.Errorf(
+			"JWK coordinates aren't on curve `%s`",
+			jwk.Curve,
+		)
+	}
+
+	return &key, nil
+}
+
+// Key returns the key from the set with the provided key ID. If no such key
+// is found, an error is returned.
+func (set *JWKSet) Key(kid string) (*ecdsa.PublicKey, error) {
+	for i := range set.Keys {
+		if set.Keys[i].KeyID == kid {
+			return set.Keys[i].PublicKey()
+		}
+	}
+	return nil, fmt.Errorf("key `%s` not found in JWK set", kid)
+}
+
+// coordinates returns the base64url-encoded coordinates of the public key,
+// each left-padded to the curve's byte size per RFC 7518 section 6.2.1.
+func coordinates(key *ecdsa.PublicKey) (string, string) {
+	size := (key.Curve.Params().BitSize + 7) / 8
+	x, y := make([]byte, size), make([]byte, size)
+	key.X.FillBytes(x)
+	key.Y.FillBytes(y)
+	return base64.RawURLEncoding.EncodeToString(x),
+		base64.RawURLEncoding.EncodeToString(y)
+}
@@ -0,0 +1,174 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/google/uuid"
+	"github.com/weberc2/auth/pkg/auth/types"
+)
+
+const (
+	// magicLinkValidity is how long a user has to use a magic link.
+	magicLinkValidity = 15 * time.Minute
+
+	// magicLinkAudience distinguishes magic link tokens from auth codes,
+	// which are signed with the same key.
+	magicLinkAudience = "magic-link"
+)
+
+// magicLinkClaims are the claims carried by magic link tokens. `Email` is
+// the address the link was sent to; if the user's address has changed since,
+// the link is invalid.
+type magicLinkClaims struct {
+	Email  string      `json:"email"`
+	Params *CodeParams `json:"params,omitempty"`
+	State  string      `json:"state,omitempty"`
+	jwt.StandardClaims
+}
+
+// RequestMagicLink emails the user a link which logs them in without their
+// password. The user may be identified by their user ID or their email
+// address. Like `LoginAuthCode`, the code params are bound into the auth code
+// which the link results in. The state is opaque to the auth service; it's
+// returned by `LoginMagicLink` so that the caller can resume the login (e.g.,
+// the web server keeps the login page's query string in it).
+func (as *AuthService) RequestMagicLink(
+	identifier types.UserID,
+	params *CodeParams,
+	state string,
+) error {
+	if params != nil {
+		method, err := codeChallenge(
+			params.CodeChallenge,
+			params.CodeChallengeMethod,
+		)
+		if err != nil {
+			return err
+		}
+		params.CodeChallengeMethod = method
+	}
+
+	entry, err := as.Creds.lookup(identifier)
+	if err != nil {
+		return fmt.Errorf("requesting magic link: %w", err)
+	}
+
+	now := as.TimeFunc()
+	claims := magicLinkClaims{
+		Email:          entry.Email,
+		Params:         params,
+		State:          state,
+		StandardClaims: as.Codes.StandardClaims(now, string(entry.User)),
+	}
+	claims.Id = uuid.NewString()
+	claims.Audience = magicLinkAudience
+	claims.ExpiresAt = now.Add(magicLinkValidity).Unix()
+
+	token, err := as.Codes.Sign(&claims)
+	if err != nil {
+		return fmt.Errorf("creating magic link token: %w", err)
+	}
+
+	if err := as.notify(&types.Notification{
+		Type:   types.NotificationTypeMagicLink,
+		User:   entry.User,
+		Email:  entry.Email,
+		Token:  token,
+		Locale: entry.Locale,
+	}); err != nil {
+		return fmt.Errorf("notifying magic link: %w", err)
+	}
+	return nil
+}
+
+// LoginMagicLink mints an auth code for a magic link token exactly like
+// `LoginAuthCode` does for a password login, including requiring a second
+// factor (via a `*SecondFactorRequired` error) if the user has enabled it.
+// Each token may only be used once. Invalid, expired and used tokens result
+// in `ErrUnauthorized`. The state from `RequestMagicLink` is returned
+// whenever the token is valid, even if a second factor is required.
+func (as *AuthService) LoginMagicLink(
+	token string,
+	client *types.ClientInfo,
+) (code string, state string, err error) {
+	claims, err := as.magicLinkClaims(token)
+	if err != nil {
+		return "", "", fmt.Errorf("logging in with magic link: %w", err)
+	}
+
+	user := types.UserID(claims.Subject)
+	entry, err := as.Creds.Users.Get(user)
+	if err != nil {
+		if errors.Is(err, types.ErrUserNotFound) {
+			log.Printf("magic link for missing user `%s`", user)
+			err = ErrUnauthorized
+		}
+		return "", "", fmt.Errorf("logging in with magic link: %w", err)
+	}
+	if entry.Email != claims.Email {
+		log.Printf("magic link for user `%s` sent to old address", user)
+		return "", "", fmt.Errorf(
+			"logging in with magic link: %w",
+			ErrUnauthorized,
+		)
+	}
+
+	if err := as.RedeemedCodes.Redeem(&types.RedeemedCode{
+		ID:      claims.Id,
+		Expires: time.Unix(claims.ExpiresAt, 0),
+	}); err != nil {
+		if errors.Is(err, types.ErrCodeRedeemed) {
+			log.Printf("magic link `%s` reused", claims.Id)
+			err = ErrUnauthorized
+		}
+		return "", "", fmt.Errorf("logging in with magic link: %w", err)
+	}
+
+	// The link stands in for the password, not for the second factor.
+	if entry.TOTPEnabled {
+		return "", claims.State, as.secondFactorRequired(
+			user,
+			true,
+			claims.Params,
+			client,
+		)
+	}
+
+	code, err = as.authCode(user, claims.Params, client)
+	if err != nil {
+		return "", "", fmt.Errorf("logging in with magic link: %w", err)
+	}
+	return code, claims.State, nil
+}
+
+// magicLinkClaims parses and validates a magic link token. Any failure
+// results in `ErrUnauthorized` so as to not give attackers unnecessary
+// information.
+func (as *AuthService) magicLinkClaims(
+	token string,
+) (*magicLinkClaims, error) {
+	var claims magicLinkClaims
+	if _, err := jwt.ParseWithClaims(
+		token,
+		&claims,
+		as.Codes.VerificationKey,
+	); err != nil {
+		log.Printf("jwt.ParseWithClaims(): %v", err)
+		return nil, ErrUnauthorized
+	}
+	if !claims.VerifyAudience(magicLinkAudience, true) {
+		log.Printf("token isn't a magic link token")
+		return nil, ErrUnauthorized
+	}
+
+	// Without an ID, we can't guarantee the link is only used once.
+	if claims.Id == "" {
+		log.Printf("magic link token is missing `jti` claim")
+		return nil, ErrUnauthorized
+	}
+	return &claims, nil
+}
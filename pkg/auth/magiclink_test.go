@@ -0,0 +1,230 @@
+package auth
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/weberc2/auth/pkg/auth/testsupport"
+	"github.com/weberc2/auth/pkg/auth/types"
+	pz "github.com/weberc2/httpeasy"
+)
+
+func TestAuthService_MagicLink(t *testing.T) {
+	jwt.TimeFunc = nowTimeFunc
+	defer func() { jwt.TimeFunc = time.Now }()
+
+	users := testsupport.UserStoreFake{
+		"adam": {
+			User:   "adam",
+			Email:  "adam@example.org",
+			Locale: "de",
+		},
+		"beth": {
+			User:        "beth",
+			Email:       "beth@example.org",
+			TOTPEnabled: true,
+		},
+	}
+	notifications := testsupport.NotificationServiceFake{}
+	authService := AuthService{
+		Creds:         CredStore{Users: users},
+		Notifications: &notifications,
+		Codes:         codesTokenFactory,
+		RedeemedCodes: testsupport.CodeStoreFake{},
+		TimeFunc:      nowTimeFunc,
+	}
+	requestMagicLink := func(identifier types.UserID) string {
+		t.Helper()
+		if err := authService.RequestMagicLink(
+			identifier,
+			nil,
+			"state",
+		); err != nil {
+			t.Fatalf("RequestMagicLink(): unexpected err: %v", err)
+		}
+		return notifications.Notifications[len(
+			notifications.Notifications,
+		)-1].Token
+	}
+	wantUnauthorized := func(token string) {
+		t.Helper()
+		if _, _, err := authService.LoginMagicLink(
+			token,
+			nil,
+		); !errors.Is(err, ErrUnauthorized) {
+			t.Fatalf(
+				"LoginMagicLink(): wanted `%v`; found `%v`",
+				ErrUnauthorized,
+				err,
+			)
+		}
+	}
+
+	token := requestMagicLink("adam@example.org")
+	if err := (&types.Notification{
+		Type:   types.NotificationTypeMagicLink,
+		User:   "adam",
+		Email:  "adam@example.org",
+		Token:  token,
+		Locale: "de",
+	}).Compare(notifications.Notifications[0]); err != nil {
+		t.Fatal(err)
+	}
+
+	code, state, err := authService.LoginMagicLink(token, nil)
+	if err != nil {
+		t.Fatalf("LoginMagicLink(): unexpected err: %v", err)
+	}
+	if state != "state" {
+		t.Fatalf("state: wanted `state`; found `%s`", state)
+	}
+	claims, err := authService.codeClaims(code)
+	if err != nil {
+		t.Fatalf("parsing auth code: %v", err)
+	}
+	if claims.Subject != "adam" {
+		t.Fatalf("Subject: wanted `adam`; found `%s`", claims.Subject)
+	}
+
+	// Links only work once, and they aren't auth codes (nor vice versa).
+	wantUnauthorized(token)
+	wantUnauthorized(code)
+	if _, err := authService.Exchange(token, ""); !errors.Is(
+		err,
+		ErrUnauthorized,
+	) {
+		t.Fatalf("Exchange(): wanted `%v`; found `%v`", ErrUnauthorized, err)
+	}
+
+	// Links stop working if the email address changes.
+	token = requestMagicLink("adam")
+	users["adam"].Email = "adam@example.com"
+	wantUnauthorized(token)
+
+	// The link doesn't replace the second factor.
+	_, state, err = authService.LoginMagicLink(requestMagicLink("beth"), nil)
+	var required *SecondFactorRequired
+	if !errors.As(err, &required) {
+		t.Fatalf("LoginMagicLink(): wanted second factor; found `%v`", err)
+	}
+	if state != "state" {
+		t.Fatalf("state: wanted `state`; found `%s`", state)
+	}
+
+	if err := authService.RequestMagicLink(
+		"carl@example.org",
+		nil,
+		"",
+	); !errors.Is(err, types.ErrUserNotFound) {
+		t.Fatalf(
+			"RequestMagicLink(): wanted `%v`; found `%v`",
+			types.ErrUserNotFound,
+			err,
+		)
+	}
+}
+
+func TestWebServer_MagicLink(t *testing.T) {
+	jwt.TimeFunc = nowTimeFunc
+	defer func() { jwt.TimeFunc = time.Now }()
+
+	notifications := testsupport.NotificationServiceFake{}
+	webServer := WebServer{
+		AuthService: AuthService{
+			Creds: CredStore{Users: testsupport.UserStoreFake{
+				"adam": {User: "adam", Email: "adam@example.org"},
+			}},
+			Notifications: &notifications,
+			Codes:         codesTokenFactory,
+			RedeemedCodes: testsupport.CodeStoreFake{},
+			TimeFunc:      nowTimeFunc,
+		},
+		BaseURL:                 "https://auth.example.org/",
+		RedirectDomain:          "app.example.org",
+		DefaultRedirectLocation: "https://app.example.org/default/",
+	}
+	query := url.Values{
+		"callback": []string{"https://app.example.org/auth/callback"},
+		"redirect": []string{"https://app.example.org/settings"},
+	}
+	wantStatus := func(rsp pz.Response, wanted int) {
+		t.Helper()
+		if rsp.Status != wanted {
+			data, err := json.Marshal(rsp.Logging)
+			if err != nil {
+				t.Logf("marshaling response logs: %v", err)
+			}
+			t.Logf("response logs: %s", data)
+			t.Fatalf(
+				"Response.Status: wanted `%d`; found `%d`",
+				wanted,
+				rsp.Status,
+			)
+		}
+	}
+
+	// Unknown users get the same response as everyone else.
+	for _, username := range []string{"adam", "beth"} {
+		wantStatus(
+			webServer.MagicLinkHandlerRoute().Handler(pz.Request{
+				Body: strings.NewReader(url.Values{
+					"username": []string{username},
+				}.Encode()),
+				URL: &url.URL{RawQuery: query.Encode()},
+			}),
+			http.StatusOK,
+		)
+	}
+	if len(notifications.Notifications) != 1 {
+		t.Fatalf(
+			"wanted 1 notification; found %d",
+			len(notifications.Notifications),
+		)
+	}
+
+	link, err := url.Parse(TokenURL(webServer.BaseURL)(
+		notifications.Notifications[0],
+	))
+	if err != nil {
+		t.Fatalf("parsing magic link: %v", err)
+	}
+	if link.Path != pathMagicLinkConfirmationForm {
+		t.Fatalf(
+			"link path: wanted `%s`; found `%s`",
+			pathMagicLinkConfirmationForm,
+			link.Path,
+		)
+	}
+
+	confirm := func() pz.Response {
+		return webServer.MagicLinkConfirmationHandlerRoute().Handler(
+			pz.Request{
+				Body: strings.NewReader(url.Values{
+					"token": []string{link.Query().Get("t")},
+				}.Encode()),
+				URL:     &url.URL{},
+				Headers: http.Header{},
+			},
+		)
+	}
+	rsp := confirm()
+	wantStatus(rsp, http.StatusSeeOther)
+	if err := (&wantedLocation{
+		key:      &codesSigningKey.PublicKey,
+		scheme:   "https",
+		host:     "app.example.org",
+		path:     "/auth/callback",
+		callback: "https://app.example.org/auth/callback",
+		redirect: "https://app.example.org/settings",
+	}).compare(rsp.Headers.Get("Location")); err != nil {
+		t.Fatalf("Response.Headers[\"Location\"]: %v", err)
+	}
+
+	wantStatus(confirm(), http.StatusUnauthorized)
+}
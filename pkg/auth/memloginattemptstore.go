@@ -0,0 +1,87 @@
+package auth
+
+import (
+	"sync"
+	"time"
+
+	"github.com/weberc2/auth/pkg/auth/types"
+)
+
+// MemLoginAttemptStore is an in-memory `types.LoginAttemptStore`. It's only
+// suitable for a single auth server instance, since the attempts aren't
+// shared. The zero value is ready to use.
+type MemLoginAttemptStore struct {
+	lock     sync.Mutex
+	attempts map[string]types.LoginAttempts
+}
+
+func (mlas *MemLoginAttemptStore) Get(
+	key string,
+) (*types.LoginAttempts, error) {
+	mlas.lock.Lock()
+	defer mlas.lock.Unlock()
+
+	attempts, found := mlas.attempts[key]
+	if !found {
+		return nil, types.ErrLoginAttemptsNotFound
+	}
+	return &attempts, nil
+}
+
+func (mlas *MemLoginAttemptStore) Fail(
+	key string,
+	now time.Time,
+	window time.Duration,
+) (*types.LoginAttempts, error) {
+	mlas.lock.Lock()
+	defer mlas.lock.Unlock()
+
+	if mlas.attempts == nil {
+		mlas.attempts = map[string]types.LoginAttempts{}
+	}
+	attempts, found := mlas.attempts[key]
+	if !found || now.Sub(attempts.LastFailure) > window {
+		attempts.Key = key
+		attempts.Failures = 0
+	}
+	attempts.Failures++
+	attempts.LastFailure = now
+	mlas.attempts[key] = attempts
+	return &attempts, nil
+}
+
+func (mlas *MemLoginAttemptStore) Refund(key string) error {
+	mlas.lock.Lock()
+	defer mlas.lock.Unlock()
+
+	attempts, found := mlas.attempts[key]
+	if found && attempts.Failures > 0 {
+		attempts.Failures--
+		mlas.attempts[key] = attempts
+	}
+	return nil
+}
+
+func (mlas *MemLoginAttemptStore) Lock(key string, until time.Time) error {
+	mlas.lock.Lock()
+	defer mlas.lock.Unlock()
+
+	if mlas.attempts == nil {
+		mlas.attempts = map[string]types.LoginAttempts{}
+	}
+	attempts := mlas.attempts[key]
+	attempts.Key = key
+	attempts.LockedUntil = until
+	mlas.attempts[key] = attempts
+	return nil
+}
+
+func (mlas *MemLoginAttemptStore) Reset(key string) error {
+	mlas.lock.Lock()
+	defer mlas.lock.Unlock()
+
+	delete(mlas.attempts, key)
+	return nil
+}
+
+var _ types.LoginAttemptStore = &MemLoginAttemptStore{}
@@ -0,0 +1,123 @@
+package auth
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/weberc2/auth/pkg/auth/types"
+)
+
+// MemOutboxStore is an in-memory `types.OutboxStore`. Entries don't survive
+// a restart, so it's mostly useful for testing. The zero value is ready to
+// use.
+type MemOutboxStore struct {
+	lock    sync.Mutex
+	entries map[string]types.OutboxEntry
+}
+
+func (mos *MemOutboxStore) Enqueue(entry *types.OutboxEntry) error {
+	mos.lock.Lock()
+	defer mos.lock.Unlock()
+
+	if mos.entries == nil {
+		mos.entries = map[string]types.OutboxEntry{}
+	}
+	if _, found := mos.entries[entry.ID]; found {
+		return types.ErrOutboxEntryExists
+	}
+	mos.entries[entry.ID] = *entry
+	return nil
+}
+
+func (mos *MemOutboxStore) Claim(
+	now time.Time,
+	lease time.Duration,
+	limit int,
+) ([]*types.OutboxEntry, error) {
+	mos.lock.Lock()
+	defer mos.lock.Unlock()
+
+	claimed := mos.filter(func(entry *types.OutboxEntry) bool {
+		return entry.Status == types.OutboxStatusPending &&
+			!entry.NextAttempt.After(now)
+	})
+	if len(claimed) > limit {
+		claimed = claimed[:limit]
+	}
+	for _, entry := range claimed {
+		stored := mos.entries[entry.ID]
+		stored.NextAttempt = now.Add(lease)
+		mos.entries[entry.ID] = stored
+	}
+	return claimed, nil
+}
+
+func (mos *MemOutboxStore) Update(entry *types.OutboxEntry) error {
+	mos.lock.Lock()
+	defer mos.lock.Unlock()
+
+	if _, found := mos.entries[entry.ID]; !found {
+		return types.ErrOutboxEntryNotFound
+	}
+	mos.entries[entry.ID] = *entry
+	return nil
+}
+
+func (mos *MemOutboxStore) Delete(id string) error {
+	mos.lock.Lock()
+	defer mos.lock.Unlock()
+
+	if _, found := mos.entries[id]; !found {
+		return types.ErrOutboxEntryNotFound
+	}
+	delete(mos.entries, id)
+	return nil
+}
+
+func (mos *MemOutboxStore) Dead() ([]*types.OutboxEntry, error) {
+	mos.lock.Lock()
+	defer mos.lock.Unlock()
+
+	return mos.filter(func(entry *types.OutboxEntry) bool {
+		return entry.Status == types.OutboxStatusDead
+	}), nil
+}
+
+func (mos *MemOutboxStore) Replay(id string, now time.Time) error {
+	mos.lock.Lock()
+	defer mos.lock.Unlock()
+
+	entry, found := mos.entries[id]
+	if !found || entry.Status != types.OutboxStatusDead {
+		return types.ErrOutboxEntryNotFound
+	}
+	entry.Status = types.OutboxStatusPending
+	entry.Attempts = 0
+	entry.NextAttempt = now
+	mos.entries[id] = entry
+	return nil
+}
+
+// filter returns copies of the entries which satisfy the predicate in the
+// order they were created. The caller must hold the lock.
+func (mos *MemOutboxStore) filter(
+	predicate func(*types.OutboxEntry) bool,
+) []*types.OutboxEntry {
+	var entries []*types.OutboxEntry
+	for _, entry := range mos.entries {
+		entry := entry
+		if predicate(&entry) {
+			entries = append(entries, &entry)
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Created.Equal(entries[j].Created) {
+			return entries[i].ID < entries[j].ID
+		}
+		return entries[i].Created.Before(entries[j].Created)
+	})
+	return entries
+}
+
+var _ types.OutboxStore = &MemOutboxStore{}
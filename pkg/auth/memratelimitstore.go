@@ -0,0 +1,38 @@
+package auth
+
+import (
+	"sync"
+	"time"
+
+	"github.com/weberc2/auth/pkg/auth/types"
+)
+
+// MemRateLimitStore is an in-memory `types.RateLimitStore`. Like
+// `MemLoginAttemptStore`, it's only suitable for a single auth server
+// instance. The zero value is ready to use.
+type MemRateLimitStore struct {
+	lock    sync.Mutex
+	windows map[string]types.RateLimitWindow
+}
+
+func (mrls *MemRateLimitStore) Increment(
+	key string,
+	now time.Time,
+	window time.Duration,
+) (*types.RateLimitWindow, error) {
+	mrls.lock.Lock()
+	defer mrls.lock.Unlock()
+
+	if mrls.windows == nil {
+		mrls.windows = map[string]types.RateLimitWindow{}
+	}
+	w, found := mrls.windows[key]
+	if !found || now.Sub(w.Start) >= window {
+		w = types.RateLimitWindow{Key: key, Start: now}
+	}
+	w.Count++
+	mrls.windows[key] = w
+	return &w, nil
+}
+
+var _ types.RateLimitStore = &MemRateLimitStore{}
@@ -0,0 +1,110 @@
+package auth
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/weberc2/auth/pkg/auth/types"
+	pz "github.com/weberc2/httpeasy"
+)
+
+// NotificationThrottledError is returned when a notification isn't sent
+// because its address or user is in a cooldown or the global budget is
+// spent.
+type NotificationThrottledError struct {
+	RetryAfter time.Duration
+}
+
+func (err *NotificationThrottledError) Error() string {
+	return fmt.Sprintf(
+		"too many notifications; retry after %s",
+		err.RetryAfter,
+	)
+}
+
+// HTTPError implements `pz.Error` so that `pz.HandleError()` responds with
+// `429 Too Many Requests`.
+func (err *NotificationThrottledError) HTTPError() *pz.HTTPError {
+	return &pz.HTTPError{
+		Status:  http.StatusTooManyRequests,
+		Message: "too many emails requested; please try again later",
+	}
+}
+
+func (err *NotificationThrottledError) retryAfter() time.Duration {
+	return err.RetryAfter
+}
+
+// NotificationLimiter limits the emails which anonymous requests (e.g.,
+// registration and forgot-password) can trigger so that they can't be used to
+// spam someone's inbox or run up the email bill. After a notification is sent
+// to an address or a user, no other notification is sent to the same address
+// or user until the cooldown passes. At most `Budget` notifications are sent
+// in total per `BudgetPeriod`. The zero value doesn't limit anything.
+type NotificationLimiter struct {
+	Windows         types.RateLimitStore
+	AddressCooldown time.Duration
+	UserCooldown    time.Duration
+	Budget          int
+	BudgetPeriod    time.Duration
+}
+
+// allow counts the notification against each of the limits and returns a
+// `*NotificationThrottledError` if any of them is exceeded. The global budget
+// is checked last so that it isn't spent by notifications which are
+// throttled anyway.
+func (nl *NotificationLimiter) allow(
+	n *types.Notification,
+	now time.Time,
+) error {
+	if nl.Windows == nil {
+		return nil
+	}
+
+	for _, limit := range []struct {
+		key    string
+		max    int
+		window time.Duration
+	}{
+		{
+			key:    "address:" + strings.ToLower(strings.TrimSpace(n.Email)),
+			max:    1,
+			window: nl.AddressCooldown,
+		},
+		{key: "user:" + string(n.User), max: 1, window: nl.UserCooldown},
+		{key: "global", max: nl.Budget, window: nl.BudgetPeriod},
+	} {
+		if limit.window <= 0 || limit.max < 1 {
+			continue
+		}
+
+		w, err := nl.Windows.Increment(limit.key, now, limit.window)
+		if err != nil {
+			return fmt.Errorf("counting notification: %w", err)
+		}
+		if w.Count > limit.max {
+			log.Printf(
+				"throttled `%s` notification for user `%s`: `%s` exceeded",
+				n.Type,
+				n.User,
+				limit.key,
+			)
+			return &NotificationThrottledError{
+				RetryAfter: w.Start.Add(limit.window).Sub(now),
+			}
+		}
+	}
+	return nil
+}
+
+// notify sends a notification which was triggered by an anonymous request,
+// subject to the notification limits.
+func (as *AuthService) notify(n *types.Notification) error {
+	if err := as.NotificationLimits.allow(n, as.TimeFunc()); err != nil {
+		return err
+	}
+	return as.Notifications.Notify(n)
+}
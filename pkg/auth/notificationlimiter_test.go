@@ -0,0 +1,171 @@
+package auth
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/weberc2/auth/pkg/auth/testsupport"
+	pz "github.com/weberc2/httpeasy"
+)
+
+func TestAuthService_NotificationLimits(t *testing.T) {
+	current := now
+	notifications := testsupport.NotificationServiceFake{}
+	authService := AuthService{
+		Creds: CredStore{Users: testsupport.UserStoreFake{
+			"adam": {User: "adam", Email: "adam@example.org"},
+			"beth": {User: "beth", Email: "beth@example.org"},
+		}},
+		ResetTokens:   resetTokenFactory,
+		Notifications: &notifications,
+		NotificationLimits: NotificationLimiter{
+			Windows:         &MemRateLimitStore{},
+			AddressCooldown: 10 * time.Minute,
+			UserCooldown:    5 * time.Minute,
+			Budget:          3,
+			BudgetPeriod:    time.Hour,
+		},
+		TimeFunc: func() time.Time { return current },
+	}
+	wantThrottled := func(err error, retryAfter time.Duration) {
+		t.Helper()
+		var throttled *NotificationThrottledError
+		if !errors.As(err, &throttled) {
+			t.Fatalf("wanted throttled error; found `%v`", err)
+		}
+		if throttled.RetryAfter != retryAfter {
+			t.Fatalf(
+				"NotificationThrottledError.RetryAfter: wanted `%s`; "+
+					"found `%s`",
+				retryAfter,
+				throttled.RetryAfter,
+			)
+		}
+	}
+
+	if err := authService.ForgotPassword("adam"); err != nil {
+		t.Fatalf("ForgotPassword(): unexpected error: %v", err)
+	}
+	wantThrottled(authService.ForgotPassword("adam"), 10*time.Minute)
+
+	// The user's cooldown has passed, but the address's hasn't. Addresses
+	// are compared case-insensitively.
+	current = current.Add(5 * time.Minute)
+	wantThrottled(
+		authService.Register("carl", " ADAM@example.org", ""),
+		5*time.Minute,
+	)
+
+	if err := authService.Register(
+		"carl",
+		"carl@example.org",
+		"",
+	); err != nil {
+		t.Fatalf("Register(): unexpected error: %v", err)
+	}
+	if err := authService.ForgotPassword("beth"); err != nil {
+		t.Fatalf("ForgotPassword(): unexpected error: %v", err)
+	}
+
+	// The global budget is spent.
+	wantThrottled(
+		authService.Register("dana", "dana@example.org", ""),
+		55*time.Minute,
+	)
+
+	current = current.Add(55 * time.Minute)
+	if err := authService.Register(
+		"dana",
+		"dana@example.org",
+		"",
+	); err != nil {
+		t.Fatalf("Register(): unexpected error: %v", err)
+	}
+
+	var sent []string
+	for _, n := range notifications.Notifications {
+		sent = append(sent, n.Email)
+	}
+	if wanted := strings.Join([]string{
+		"adam@example.org",
+		"carl@example.org",
+		"beth@example.org",
+		"dana@example.org",
+	}, ", "); strings.Join(sent, ", ") != wanted {
+		t.Fatalf(
+			"wanted notifications to `%s`; found `%s`",
+			wanted,
+			strings.Join(sent, ", "),
+		)
+	}
+}
+
+func TestNotificationLimitsRoutes(t *testing.T) {
+	authService := AuthHTTPService{AuthService: AuthService{
+		Creds: CredStore{Users: testsupport.UserStoreFake{
+			"adam": {User: "adam", Email: "adam@example.org"},
+		}},
+		ResetTokens:   resetTokenFactory,
+		Notifications: &testsupport.NotificationServiceFake{},
+		NotificationLimits: NotificationLimiter{
+			Windows:         &MemRateLimitStore{},
+			AddressCooldown: time.Minute,
+		},
+		TimeFunc: nowTimeFunc,
+	}}
+
+	for _, testCase := range []struct {
+		name         string
+		route        pz.Route
+		body         string
+		wantedStatus int
+		retryAfter   string
+	}{
+		{
+			name:         "forgot password",
+			route:        authService.ForgotPasswordRoute(),
+			body:         `{"user": "adam"}`,
+			wantedStatus: http.StatusOK,
+		},
+		{
+			// Throttled forgot-password requests silently succeed so as to
+			// not reveal that the user exists.
+			name:         "forgot password throttled",
+			route:        authService.ForgotPasswordRoute(),
+			body:         `{"user": "adam"}`,
+			wantedStatus: http.StatusOK,
+		},
+		{
+			name:         "register throttled",
+			route:        authService.RegisterRoute(),
+			body:         `{"user": "beth", "email": "adam@example.org"}`,
+			wantedStatus: http.StatusTooManyRequests,
+			retryAfter:   "60",
+		},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			rsp := testCase.route.Handler(pz.Request{
+				Body: strings.NewReader(testCase.body),
+			})
+			if rsp.Status != testCase.wantedStatus {
+				t.Fatalf(
+					"Response.Status: wanted `%d`; found `%d`",
+					testCase.wantedStatus,
+					rsp.Status,
+				)
+			}
+			if found := rsp.Headers.Get(
+				"Retry-After",
+			); found != testCase.retryAfter {
+				t.Fatalf(
+					"Retry-After: wanted `%s`; found `%s`",
+					testCase.retryAfter,
+					found,
+				)
+			}
+		})
+	}
+}
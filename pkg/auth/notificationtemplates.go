@@ -0,0 +1,230 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	html "html/template"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	text "text/template"
+
+	"github.com/weberc2/auth/pkg/auth/types"
+)
+
+// NotificationTemplates holds localized notification templates, keyed by
+// notification type and then by locale. Locales are BCP 47 tags (e.g.,
+// `pt-BR`); they're matched case-insensitively, and `_` is treated as `-`.
+type NotificationTemplates struct {
+	// DefaultLocale is tried when a notification's locale has no templates.
+	DefaultLocale string
+
+	settings map[types.NotificationType]localizedSettings
+}
+
+// localizedSettings are a notification type's settings keyed by normalized
+// locale.
+type localizedSettings map[string]*NotificationSettings
+
+// Add registers the settings for a notification type and locale.
+func (nt *NotificationTemplates) Add(
+	typ types.NotificationType,
+	locale string,
+	settings *NotificationSettings,
+) {
+	if nt.settings == nil {
+		nt.settings = map[types.NotificationType]localizedSettings{}
+	}
+	if nt.settings[typ] == nil {
+		nt.settings[typ] = localizedSettings{}
+	}
+	nt.settings[typ][normalizeLocale(locale)] = settings
+}
+
+// Lookup returns the settings for a notification type, trying the locale,
+// then its base language (e.g., `pt` for `pt-BR`), then the default locale
+// and its base language. If none of those have templates (or if the
+// templates are `nil`), `nil` is returned and callers should fall back to
+// their built-in settings.
+func (nt *NotificationTemplates) Lookup(
+	typ types.NotificationType,
+	locale string,
+) *NotificationSettings {
+	if nt == nil {
+		return nil
+	}
+	locales := nt.settings[typ]
+	for _, candidate := range localeFallbacks(locale, nt.DefaultLocale) {
+		if settings, found := locales[candidate]; found {
+			return settings
+		}
+	}
+	return nil
+}
+
+// Locales returns the (normalized) locales which have templates for a
+// notification type, sorted.
+func (nt *NotificationTemplates) Locales(typ types.NotificationType) []string {
+	var locales []string
+	for locale := range nt.settings[typ] {
+		locales = append(locales, locale)
+	}
+	sort.Strings(locales)
+	return locales
+}
+
+// notificationTemplateDirs are the directory names of the notification
+// types' templates.
+var notificationTemplateDirs = map[types.NotificationType]string{
+	types.NotificationTypeRegister:          "register",
+	types.NotificationTypeForgotPassword:    "forgot_password",
+	types.NotificationTypeLockout:           "lockout",
+	types.NotificationTypeEmailChange:       "email_change",
+	types.NotificationTypeEmailChangeNotice: "email_change_notice",
+	types.NotificationTypeMagicLink:         "magic_link",
+}
+
+// LoadNotificationTemplates loads templates from a directory laid out as
+// `<type>/<locale>/{subject.txt,body.txt,body.html}`, where `<type>` is
+// `register`, `forgot_password`, `lockout`, `email_change`,
+// `email_change_notice` or `magic_link`. The bodies are `text/template` and
+// `html/template` templates respectively, and they're rendered with the same
+// data as the built-in templates (`.User`, `.Email`, `.TokenURL` and
+// `.Locale`). Types without a directory are skipped.
+func LoadNotificationTemplates(
+	dir string,
+	defaultLocale string,
+) (*NotificationTemplates, error) {
+	templates := NotificationTemplates{DefaultLocale: defaultLocale}
+	for typ, typeDir := range notificationTemplateDirs {
+		entries, err := ioutil.ReadDir(filepath.Join(dir, typeDir))
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				continue
+			}
+			return nil, fmt.Errorf("loading notification templates: %w", err)
+		}
+		for _, entry := range entries {
+			if !entry.IsDir() {
+				continue
+			}
+			settings, err := loadNotificationSettings(
+				filepath.Join(dir, typeDir, entry.Name()),
+			)
+			if err != nil {
+				return nil, fmt.Errorf(
+					"loading notification templates: %w",
+					err,
+				)
+			}
+			templates.Add(typ, entry.Name(), settings)
+		}
+	}
+	return &templates, nil
+}
+
+func loadNotificationSettings(dir string) (*NotificationSettings, error) {
+	subject, err := ioutil.ReadFile(filepath.Join(dir, "subject.txt"))
+	if err != nil {
+		return nil, err
+	}
+	textTemplate, err := text.ParseFiles(filepath.Join(dir, "body.txt"))
+	if err != nil {
+		return nil, err
+	}
+	htmlTemplate, err := html.ParseFiles(filepath.Join(dir, "body.html"))
+	if err != nil {
+		return nil, err
+	}
+	return &NotificationSettings{
+		Subject:      strings.TrimSpace(string(subject)),
+		TextTemplate: textTemplate,
+		HTMLTemplate: htmlTemplate,
+	}, nil
+}
+
+// localeFallbacks returns the locales to try for a notification, most
+// specific first and without duplicates.
+func localeFallbacks(locale, defaultLocale string) []string {
+	var fallbacks []string
+	for _, l := range []string{locale, defaultLocale} {
+		l = normalizeLocale(l)
+		for l != "" {
+			if !containsString(fallbacks, l) {
+				fallbacks = append(fallbacks, l)
+			}
+			i := strings.LastIndexByte(l, '-')
+			if i < 0 {
+				break
+			}
+			l = l[:i]
+		}
+	}
+	return fallbacks
+}
+
+// acceptLanguage returns the most preferred language from a request's
+// `Accept-Language` header, or the empty string if there is none.
+func acceptLanguage(headers http.Header) string {
+	var locale string
+	best := -1.0
+	for _, field := range strings.Split(
+		headers.Get("Accept-Language"),
+		",",
+	) {
+		parts := strings.Split(field, ";")
+		tag := strings.TrimSpace(parts[0])
+		if tag == "" || tag == "*" {
+			continue
+		}
+		quality := 1.0
+		for _, param := range parts[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				q, err := strconv.ParseFloat(param[len("q="):], 64)
+				if err != nil {
+					q = 0
+				}
+				quality = q
+			}
+		}
+		if quality > best && quality > 0 {
+			locale, best = tag, quality
+		}
+	}
+	return locale
+}
+
+// validLocale returns the locale if it looks like a language tag (e.g., from
+// a well-behaved client), or the empty string otherwise.
+func validLocale(locale string) string {
+	if len(locale) > 35 {
+		return ""
+	}
+	for _, c := range locale {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' ||
+			c >= '0' && c <= '9' || c == '-' || c == '_') {
+			return ""
+		}
+	}
+	return locale
+}
+
+func normalizeLocale(locale string) string {
+	return strings.ToLower(
+		strings.ReplaceAll(strings.TrimSpace(locale), "_", "-"),
+	)
+}
+
+func containsString(haystack []string, needle string) bool {
+	for _, s := range haystack {
+		if s == needle {
+			return true
+		}
+	}
+	return false
+}
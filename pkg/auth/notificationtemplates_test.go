@@ -0,0 +1,202 @@
+package auth
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+
+	"github.com/weberc2/auth/pkg/auth/testsupport"
+	"github.com/weberc2/auth/pkg/auth/types"
+)
+
+func TestNotificationTemplates(t *testing.T) {
+	dir := t.TempDir()
+	for _, template := range []struct {
+		typ     string
+		locale  string
+		subject string
+	}{
+		{typ: "register", locale: "en", subject: "Register"},
+		{typ: "register", locale: "pt", subject: "Registrar"},
+		{typ: "register", locale: "pt-BR", subject: "Cadastrar"},
+		{typ: "lockout", locale: "de", subject: "Konto gesperrt"},
+	} {
+		localeDir := filepath.Join(dir, template.typ, template.locale)
+		if err := os.MkdirAll(localeDir, 0700); err != nil {
+			t.Fatal(err)
+		}
+		for file, contents := range map[string]string{
+			"subject.txt": template.subject + "\n",
+			"body.txt":    template.subject + ": {{ .TokenURL }}",
+			"body.html":   `<a href="{{ .TokenURL }}">` + template.subject,
+		} {
+			if err := ioutil.WriteFile(
+				filepath.Join(localeDir, file),
+				[]byte(contents),
+				0600,
+			); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	templates, err := LoadNotificationTemplates(dir, "en")
+	if err != nil {
+		t.Fatalf("LoadNotificationTemplates(): unexpected err: %v", err)
+	}
+
+	for _, testCase := range []struct {
+		typ           types.NotificationType
+		locale        string
+		wantedSubject string
+	}{
+		{types.NotificationTypeRegister, "pt-BR", "Cadastrar"},
+		{types.NotificationTypeRegister, "pt_br", "Cadastrar"},
+		{types.NotificationTypeRegister, "pt-PT", "Registrar"},
+		{types.NotificationTypeRegister, "fr", "Register"},
+		{types.NotificationTypeRegister, "", "Register"},
+		{types.NotificationTypeLockout, "de-AT", "Konto gesperrt"},
+
+		// No lockout template for the locale or the default locale.
+		{types.NotificationTypeLockout, "fr", ""},
+		{types.NotificationTypeForgotPassword, "pt-BR", ""},
+	} {
+		settings := templates.Lookup(testCase.typ, testCase.locale)
+		var subject string
+		if settings != nil {
+			subject = settings.Subject
+		}
+		if subject != testCase.wantedSubject {
+			t.Fatalf(
+				"Lookup(%s, %s): wanted subject `%s`; found `%s`",
+				testCase.typ,
+				testCase.locale,
+				testCase.wantedSubject,
+				subject,
+			)
+		}
+	}
+
+	// Services fall back to their built-in settings.
+	var sb strings.Builder
+	console := ConsoleNotificationService{
+		Writer: &sb,
+		TokenURL: func(n *types.Notification) string {
+			return "/confirm?t=" + n.Token
+		},
+		EmailSettings: EmailSettings{
+			LockoutSettings: DefaultLockoutSettings,
+			Templates:       templates,
+		},
+	}
+	for _, n := range []types.Notification{
+		{Type: types.NotificationTypeRegister, Locale: "pt-BR", Token: "tok"},
+		{Type: types.NotificationTypeLockout, Locale: "fr"},
+	} {
+		n := n
+		if err := console.Notify(&n); err != nil {
+			t.Fatalf("Notify(): unexpected err: %v", err)
+		}
+	}
+	for _, wanted := range []string{
+		"Subject: Cadastrar\n",
+		"Cadastrar: /confirm?t=tok\n",
+		"Subject: " + DefaultLockoutSettings.Subject + "\n",
+	} {
+		if !strings.Contains(sb.String(), wanted) {
+			t.Fatalf(
+				"wanted output to contain `%s`; found:\n%s",
+				wanted,
+				sb.String(),
+			)
+		}
+	}
+}
+
+func TestAcceptLanguage(t *testing.T) {
+	for _, testCase := range []struct {
+		header string
+		wanted string
+	}{
+		{header: "", wanted: ""},
+		{header: "pt-BR", wanted: "pt-BR"},
+		{header: "pt-BR,pt;q=0.9,en;q=0.8", wanted: "pt-BR"},
+		{header: "en;q=0.5, de", wanted: "de"},
+		{header: "*, fr;q=0.1", wanted: "fr"},
+		{header: "fr;q=0", wanted: ""},
+	} {
+		found := acceptLanguage(http.Header{
+			"Accept-Language": []string{testCase.header},
+		})
+		if found != testCase.wanted {
+			t.Fatalf(
+				"acceptLanguage(`%s`): wanted `%s`; found `%s`",
+				testCase.header,
+				testCase.wanted,
+				found,
+			)
+		}
+	}
+}
+
+func TestAuthService_Locale(t *testing.T) {
+	jwt.TimeFunc = nowTimeFunc
+	defer func() { jwt.TimeFunc = time.Now }()
+
+	users := testsupport.UserStoreFake{}
+	notifications := testsupport.NotificationServiceFake{}
+	authService := AuthService{
+		Creds:         CredStore{Users: users},
+		ResetTokens:   resetTokenFactory,
+		Notifications: &notifications,
+		TimeFunc:      nowTimeFunc,
+	}
+
+	if err := authService.Register(
+		"adam",
+		"adam@example.org",
+		"pt-BR",
+	); err != nil {
+		t.Fatalf("Register(): unexpected err: %v", err)
+	}
+	if err := authService.ConfirmRegistration(
+		notifications.Notifications[0].Token,
+		goodPassword,
+	); err != nil {
+		t.Fatalf("ConfirmRegistration(): unexpected err: %v", err)
+	}
+	if locale := users["adam"].Locale; locale != "pt-BR" {
+		t.Fatalf("UserEntry.Locale: wanted `pt-BR`; found `%s`", locale)
+	}
+
+	if err := authService.ForgotPassword("adam"); err != nil {
+		t.Fatalf("ForgotPassword(): unexpected err: %v", err)
+	}
+	for i, n := range notifications.Notifications {
+		if n.Locale != "pt-BR" {
+			t.Fatalf(
+				"Notifications[%d].Locale: wanted `pt-BR`; found `%s`",
+				i,
+				n.Locale,
+			)
+		}
+	}
+
+	// Malformed locales are ignored.
+	if err := authService.Register(
+		"beth",
+		"beth@example.org",
+		"<script>",
+	); err != nil {
+		t.Fatalf("Register(): unexpected err: %v", err)
+	}
+	if n := notifications.Notifications[2]; n.Locale != "" {
+		t.Fatalf("Notification.Locale: wanted ``; found `%s`", n.Locale)
+	}
+}
@@ -0,0 +1,692 @@
+package auth
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/weberc2/auth/pkg/auth/types"
+	pz "github.com/weberc2/httpeasy"
+)
+
+// OIDCClient is a relying party which is registered to use this service as
+// its OpenID Connect identity provider.
+type OIDCClient struct {
+	// ID is the client's `client_id`.
+	ID string `json:"id" yaml:"id"`
+
+	// Secret is the client's `client_secret`. If empty, the client is a
+	// public client and it isn't authenticated at the token endpoint.
+	Secret string `json:"secret" yaml:"secret"`
+
+	// RedirectURIs are the exact redirect URIs which the client may use.
+	RedirectURIs []string `json:"redirectURIs" yaml:"redirectURIs"`
+}
+
+func (c *OIDCClient) allowsRedirect(uri string) bool {
+	for _, allowed := range c.RedirectURIs {
+		if uri == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// OIDCProvider implements the OpenID Connect authorization code flow (the
+// `/authorize` and `/token` endpoints as well as the discovery document) on
+// top of `AuthService`.
+type OIDCProvider struct {
+	// AuthService is the authentication service backend.
+	AuthService AuthService
+
+	// BaseURL is the base URL for the provider. This **must** end with a
+	// trailing slash. The issuer identifier is the base URL without the
+	// trailing slash.
+	BaseURL string
+
+	// Clients are the registered relying parties.
+	Clients []OIDCClient
+
+	// IDTokens creates the ID tokens. The issuer and audience are always
+	// overridden by the provider's issuer and the client ID respectively.
+	IDTokens TokenFactory
+}
+
+// OAuthError is the error format for the token endpoint (RFC 6749 section
+// 5.2). The same codes are passed as query parameters when errors are
+// redirected back to the client from the authorization endpoint.
+type OAuthError struct {
+	Code        string `json:"error"`
+	Description string `json:"error_description,omitempty"`
+}
+
+// IDTokenClaims are the claims carried by the ID tokens issued by the
+// `OIDCProvider`.
+type IDTokenClaims struct {
+	Nonce         string `json:"nonce,omitempty"`
+	Email         string `json:"email,omitempty"`
+	EmailVerified bool   `json:"email_verified,omitempty"`
+	jwt.StandardClaims
+}
+
+// OIDCDiscovery is the OpenID Provider Metadata document.
+type OIDCDiscovery struct {
+	Issuer                            string   `json:"issuer"`
+	AuthorizationEndpoint             string   `json:"authorization_endpoint"`
+	TokenEndpoint                     string   `json:"token_endpoint"`
+	JWKSURI                           string   `json:"jwks_uri"`
+	ResponseTypesSupported            []string `json:"response_types_supported"`
+	SubjectTypesSupported             []string `json:"subject_types_supported"`
+	IDTokenSigningAlgValuesSupported  []string `json:"id_token_signing_alg_values_supported"`
+	ScopesSupported                   []string `json:"scopes_supported"`
+	TokenEndpointAuthMethodsSupported []string `json:"token_endpoint_auth_methods_supported"`
+	GrantTypesSupported               []string `json:"grant_types_supported"`
+	ClaimsSupported                   []string `json:"claims_supported"`
+	CodeChallengeMethodsSupported     []string `json:"code_challenge_methods_supported"`
+}
+
+// OIDCTokenResponse is the successful response body from the token endpoint.
+type OIDCTokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int64  `json:"expires_in"`
+	RefreshToken string `json:"refresh_token,omitempty"`
+	IDToken      string `json:"id_token"`
+	Scope        string `json:"scope,omitempty"`
+}
+
+const (
+	scopeOpenID = "openid"
+	scopeEmail  = "email"
+)
+
+// Issuer returns the provider's issuer identifier.
+func (op *OIDCProvider) Issuer() string {
+	return strings.TrimSuffix(op.BaseURL, "/")
+}
+
+// Discovery returns the provider's metadata document.
+func (op *OIDCProvider) Discovery() *OIDCDiscovery {
+	return &OIDCDiscovery{
+		Issuer:                           op.Issuer(),
+		AuthorizationEndpoint:            op.BaseURL + "authorize",
+		TokenEndpoint:                    op.BaseURL + "token",
+		JWKSURI:                          op.BaseURL + ".well-known/jwks.json",
+		ResponseTypesSupported:           []string{"code"},
+		SubjectTypesSupported:            []string{"public"},
+		IDTokenSigningAlgValuesSupported: []string{"ES512"},
+		ScopesSupported:                  []string{scopeOpenID, scopeEmail},
+		TokenEndpointAuthMethodsSupported: []string{
+			"client_secret_basic",
+			"client_secret_post",
+			"none",
+		},
+		GrantTypesSupported: []string{"authorization_code"},
+		ClaimsSupported: []string{
+			"iss",
+			"sub",
+			"aud",
+			"exp",
+			"iat",
+			"nonce",
+			"email",
+			"email_verified",
+		},
+		CodeChallengeMethodsSupported: []string{
+			CodeChallengeMethodPlain,
+			CodeChallengeMethodS256,
+		},
+	}
+}
+
+func (op *OIDCProvider) DiscoveryRoute() pz.Route {
+	return pz.Route{
+		Path:   "/.well-known/openid-configuration",
+		Method: "GET",
+		Handler: func(pz.Request) pz.Response {
+			return pz.Ok(
+				pz.JSON(op.Discovery()),
+				&logging{Message: "serving OpenID provider metadata"},
+			)
+		},
+	}
+}
+
+func (op *OIDCProvider) AuthorizeFormRoute() pz.Route {
+	return pz.Route{
+		Path:   "/authorize",
+		Method: "GET",
+		Handler: func(r pz.Request) pz.Response {
+			ar := parseAuthorizationRequest(r.URL.Query())
+			if rsp, ok := op.validateAuthorization(&ar); !ok {
+				return rsp
+			}
+
+			context := struct {
+				Request *authorizationRequest `json:"request"`
+				*loginFormContext
+			}{
+				Request:          &ar,
+				loginFormContext: op.loginFormContext(&ar, ""),
+			}
+			return pz.Ok(pz.HTMLTemplate(loginForm, &context), &context)
+		},
+	}
+}
+
+// loginFormContext templates the login form for an authorization request.
+// Passkey and magic link logins resume at the web server's callback rather
+// than the client's redirect URI, so they aren't offered to OpenID Connect
+// clients.
+func (op *OIDCProvider) loginFormContext(
+	ar *authorizationRequest,
+	errorMessage string,
+) *loginFormContext {
+	return &loginFormContext{
+		FormAction:   op.BaseURL + "authorize?" + ar.query().Encode(),
+		ErrorMessage: errorMessage,
+
+		ForgotPasswordAction: op.BaseURL + "password/forgot",
+	}
+}
+
+func (op *OIDCProvider) AuthorizeHandlerRoute() pz.Route {
+	return pz.Route{
+		Path:   "/authorize",
+		Method: "POST",
+		Handler: func(r pz.Request) pz.Response {
+			ar := parseAuthorizationRequest(r.URL.Query())
+			if rsp, ok := op.validateAuthorization(&ar); !ok {
+				return rsp
+			}
+
+			form, err := parseForm(r)
+			if err != nil {
+				return pz.BadRequest(
+					pz.Stringf("parsing credentials: %v", err),
+					&logging{
+						Message:   "parsing credentials from form",
+						ErrorType: fmt.Sprintf("%T", err),
+						Error:     err.Error(),
+					},
+				)
+			}
+
+			username := types.UserID(form.Get("username"))
+			formAction := op.BaseURL + "authorize?" + ar.query().Encode()
+
+			var code string
+			if token := form.Get("second_factor_token"); token != "" {
+				code, err = op.AuthService.LoginAuthCodeSecondFactor(
+					token,
+					form.Get("code"),
+					ar.ClientID,
+					ar.RedirectURI,
+				)
+			} else {
+				code, err = op.AuthService.LoginAuthCode(
+					&types.Credentials{
+						User:     username,
+						Password: form.Get("password"),
+					},
+					&CodeParams{
+						ClientID:            ar.ClientID,
+						RedirectURI:         ar.RedirectURI,
+						Nonce:               ar.Nonce,
+						Scope:               ar.Scope,
+						CodeChallenge:       ar.CodeChallenge,
+						CodeChallengeMethod: ar.CodeChallengeMethod,
+					},
+					op.AuthService.clientInfo(r),
+				)
+			}
+			if err != nil {
+				if rsp, ok := secondFactorResponse(
+					formAction,
+					form,
+					err,
+				); ok {
+					return rsp
+				}
+				var throttled *ThrottledError
+				if errors.As(err, &throttled) {
+					return retryAfter(pz.Response{
+						Status: http.StatusTooManyRequests,
+						Data: pz.HTMLTemplate(
+							loginForm,
+							op.loginFormContext(&ar, throttledMessage),
+						),
+						Logging: []interface{}{&logging{
+							User:    username,
+							Message: "login throttled",
+							Error:   err.Error(),
+						}},
+					}, err)
+				}
+				if errors.Is(err, ErrCredentials) ||
+					errors.Is(err, ErrUnauthorized) {
+					return pz.Unauthorized(
+						pz.HTMLTemplate(
+							loginForm,
+							op.loginFormContext(&ar, "Invalid credentials"),
+						),
+						&logging{
+							User:    username,
+							Message: "login failed",
+							Error:   err.Error(),
+						},
+					)
+				}
+				return pz.InternalServerError(&logging{
+					User:      username,
+					Message:   "creating auth code",
+					ErrorType: fmt.Sprintf("%T", err),
+					Error:     err.Error(),
+				})
+			}
+
+			return pz.SeeOther(
+				withQuery(ar.RedirectURI, url.Values{
+					"code":  []string{code},
+					"state": []string{ar.State},
+				}),
+				&struct {
+					Message string                `json:"message"`
+					User    types.UserID          `json:"user"`
+					Request *authorizationRequest `json:"request"`
+				}{
+					Message: "issued auth code to OIDC client",
+					User:    username,
+					Request: &ar,
+				},
+			)
+		},
+	}
+}
+
+func (op *OIDCProvider) TokenRoute() pz.Route {
+	return pz.Route{
+		Path:   "/token",
+		Method: "POST",
+		Handler: func(r pz.Request) pz.Response {
+			form, err := parseForm(r)
+			if err != nil {
+				return oauthError(
+					http.StatusBadRequest,
+					"invalid_request",
+					fmt.Sprintf("parsing form: %v", err),
+				)
+			}
+
+			if grantType := form.Get("grant_type"); grantType !=
+				"authorization_code" {
+				return oauthError(
+					http.StatusBadRequest,
+					"unsupported_grant_type",
+					fmt.Sprintf("unsupported grant type: `%s`", grantType),
+				)
+			}
+
+			client := op.authenticateClient(r.Headers, form)
+			if client == nil {
+				return oauthError(
+					http.StatusUnauthorized,
+					"invalid_client",
+					"client authentication failed",
+				)
+			}
+
+			rsp, err := op.exchange(
+				client,
+				form.Get("code"),
+				form.Get("redirect_uri"),
+				form.Get("code_verifier"),
+			)
+			if err != nil {
+				if errors.Is(err, ErrUnauthorized) {
+					return oauthError(
+						http.StatusBadRequest,
+						"invalid_grant",
+						"invalid or expired code",
+					)
+				}
+				return pz.InternalServerError(&logging{
+					Message:   "exchanging auth code",
+					ErrorType: fmt.Sprintf("%T", err),
+					Error:     err.Error(),
+				})
+			}
+
+			return noStore(pz.Ok(
+				pz.JSON(rsp),
+				&struct {
+					Message string `json:"message"`
+					Client  string `json:"client"`
+				}{
+					Message: "issued tokens to OIDC client",
+					Client:  client.ID,
+				},
+			))
+		},
+	}
+}
+
+func (op *OIDCProvider) Routes() []pz.Route {
+	return []pz.Route{
+		op.DiscoveryRoute(),
+		op.AuthorizeFormRoute(),
+		op.AuthorizeHandlerRoute(),
+		op.TokenRoute(),
+	}
+}
+
+// exchange redeems an auth code on behalf of an authenticated client. If the
+// code is invalid or it wasn't issued to this client and redirect URI, an
+// error wrapping `ErrUnauthorized` is returned.
+func (op *OIDCProvider) exchange(
+	client *OIDCClient,
+	code string,
+	redirectURI string,
+	codeVerifier string,
+) (*OIDCTokenResponse, error) {
+	claims, err := op.AuthService.codeClaims(code)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := claims.verifyCodeVerifier(codeVerifier); err != nil {
+		return nil, err
+	}
+
+	if claims.ClientID != client.ID || claims.RedirectURI != redirectURI {
+		return nil, fmt.Errorf(
+			"code issued to client `%s` for redirect URI `%s`: %w",
+			claims.ClientID,
+			claims.RedirectURI,
+			ErrUnauthorized,
+		)
+	}
+
+	idToken, err := op.idToken(claims)
+	if err != nil {
+		return nil, err
+	}
+
+	tokens, err := op.AuthService.redeemCode(claims)
+	if err != nil {
+		return nil, err
+	}
+
+	return &OIDCTokenResponse{
+		AccessToken: tokens.AccessToken.Token,
+		TokenType:   "Bearer",
+		ExpiresIn: int64(
+			op.AuthService.TokenDetails.AccessTokens.TokenValidity.Seconds(),
+		),
+		RefreshToken: tokens.RefreshToken.Token,
+		IDToken:      idToken,
+		Scope:        claims.Scope,
+	}, nil
+}
+
+// idToken creates an ID token for the subject of the auth code claims. The
+// email claims are only included if the `email` scope was requested.
+func (op *OIDCProvider) idToken(code *CodeClaims) (string, error) {
+	claims := IDTokenClaims{
+		Nonce: code.Nonce,
+		StandardClaims: op.IDTokens.StandardClaims(
+			op.AuthService.TimeFunc(),
+			code.Subject,
+		),
+	}
+	claims.Issuer = op.Issuer()
+	claims.Audience = code.ClientID
+
+	if hasScope(code.Scope, scopeEmail) {
+		user, err := op.AuthService.Creds.Users.Get(types.UserID(code.Subject))
+		if err != nil {
+			return "", fmt.Errorf("fetching user for ID token: %w", err)
+		}
+		claims.Email = user.Email
+
+		// Users can only be created by confirming their email address.
+		claims.EmailVerified = true
+	}
+
+	token, err := op.IDTokens.Sign(&claims)
+	if err != nil {
+		return "", fmt.Errorf("creating ID token: %w", err)
+	}
+	return token, nil
+}
+
+// authenticateClient authenticates the client via HTTP basic auth or via the
+// `client_id`/`client_secret` form parameters. If authentication fails, nil
+// is returned.
+func (op *OIDCProvider) authenticateClient(
+	headers http.Header,
+	form url.Values,
+) *OIDCClient {
+	id, secret, ok := (&http.Request{Header: headers}).BasicAuth()
+	if ok {
+		// RFC 6749 section 2.3.1 requires the credentials to be form-encoded
+		// before being placed in the basic auth header.
+		var err error
+		if id, err = url.QueryUnescape(id); err != nil {
+			return nil
+		}
+		if secret, err = url.QueryUnescape(secret); err != nil {
+			return nil
+		}
+	} else {
+		id, secret = form.Get("client_id"), form.Get("client_secret")
+	}
+
+	client := op.client(id)
+	if client == nil {
+		return nil
+	}
+
+	if subtle.ConstantTimeCompare([]byte(client.Secret), []byte(secret)) !=
+		1 {
+		return nil
+	}
+	return client
+}
+
+func (op *OIDCProvider) client(id string) *OIDCClient {
+	for i := range op.Clients {
+		if op.Clients[i].ID == id {
+			return &op.Clients[i]
+		}
+	}
+	return nil
+}
+
+// validateAuthorization checks the authorization request. If the client or
+// the redirect URI is invalid, the error is shown to the user rather than
+// redirected (RFC 6749 section 4.1.2.1); other errors are redirected back to
+// the client. If the request is valid, `true` is returned.
+func (op *OIDCProvider) validateAuthorization(
+	ar *authorizationRequest,
+) (pz.Response, bool) {
+	client := op.client(ar.ClientID)
+	if client == nil {
+		return pz.BadRequest(
+			pz.String("Unknown client"),
+			&struct {
+				Message string                `json:"message"`
+				Request *authorizationRequest `json:"request"`
+			}{
+				Message: "authorization request for unknown client",
+				Request: ar,
+			},
+		), false
+	}
+
+	if !client.allowsRedirect(ar.RedirectURI) {
+		return pz.BadRequest(
+			pz.String("Invalid redirect URI"),
+			&struct {
+				Message string                `json:"message"`
+				Request *authorizationRequest `json:"request"`
+			}{
+				Message: "authorization request with unknown redirect URI",
+				Request: ar,
+			},
+		), false
+	}
+
+	redirectErr := func(code, description string) (pz.Response, bool) {
+		return pz.SeeOther(
+			withQuery(ar.RedirectURI, url.Values{
+				"error":             []string{code},
+				"error_description": []string{description},
+				"state":             []string{ar.State},
+			}),
+			&struct {
+				Message string                `json:"message"`
+				Error   string                `json:"error"`
+				Request *authorizationRequest `json:"request"`
+			}{
+				Message: "redirecting authorization error to client",
+				Error:   code,
+				Request: ar,
+			},
+		), false
+	}
+
+	if ar.ResponseType != "code" {
+		return redirectErr(
+			"unsupported_response_type",
+			"only the `code` response type is supported",
+		)
+	}
+
+	if !hasScope(ar.Scope, scopeOpenID) {
+		return redirectErr("invalid_scope", "the `openid` scope is required")
+	}
+
+	method, err := codeChallenge(ar.CodeChallenge, ar.CodeChallengeMethod)
+	if err != nil {
+		return redirectErr("invalid_request", err.Error())
+	}
+	ar.CodeChallengeMethod = method
+
+	// Public clients can't authenticate at the token endpoint, so PKCE is
+	// the only thing preventing an intercepted code from being redeemed.
+	if client.Secret == "" && ar.CodeChallenge == "" {
+		return redirectErr(
+			"invalid_request",
+			"public clients must provide a code challenge",
+		)
+	}
+
+	return pz.Response{}, true
+}
+
+type authorizationRequest struct {
+	ResponseType string `json:"responseType"`
+	ClientID     string `json:"clientID"`
+	RedirectURI  string `json:"redirectURI"`
+	Scope        string `json:"scope"`
+	State        string `json:"state,omitempty"`
+	Nonce        string `json:"nonce,omitempty"`
+
+	CodeChallenge       string `json:"codeChallenge,omitempty"`
+	CodeChallengeMethod string `json:"codeChallengeMethod,omitempty"`
+}
+
+func parseAuthorizationRequest(query url.Values) authorizationRequest {
+	return authorizationRequest{
+		ResponseType: query.Get("response_type"),
+		ClientID:     query.Get("client_id"),
+		RedirectURI:  query.Get("redirect_uri"),
+		Scope:        query.Get("scope"),
+		State:        query.Get("state"),
+		Nonce:        query.Get("nonce"),
+
+		CodeChallenge:       query.Get("code_challenge"),
+		CodeChallengeMethod: query.Get("code_challenge_method"),
+	}
+}
+
+func (ar *authorizationRequest) query() url.Values {
+	query := url.Values{
+		"response_type": []string{ar.ResponseType},
+		"client_id":     []string{ar.ClientID},
+		"redirect_uri":  []string{ar.RedirectURI},
+		"scope":         []string{ar.Scope},
+	}
+	if ar.State != "" {
+		query.Set("state", ar.State)
+	}
+	if ar.Nonce != "" {
+		query.Set("nonce", ar.Nonce)
+	}
+	if ar.CodeChallenge != "" {
+		query.Set("code_challenge", ar.CodeChallenge)
+		query.Set("code_challenge_method", ar.CodeChallengeMethod)
+	}
+	return query
+}
+
+func hasScope(scope, want string) bool {
+	for _, s := range strings.Fields(scope) {
+		if s == want {
+			return true
+		}
+	}
+	return false
+}
+
+// withQuery adds the non-empty values to the URI's query string, preserving
+// any query parameters which are already present.
+func withQuery(uri string, values url.Values) string {
+	u, err := url.Parse(uri)
+	if err != nil {
+		// Redirect URIs are validated against the registered URIs, so this
+		// should never happen.
+		return uri
+	}
+	query := u.Query()
+	for key, vs := range values {
+		for _, v := range vs {
+			if v != "" {
+				query.Add(key, v)
+			}
+		}
+	}
+	u.RawQuery = query.Encode()
+	return u.String()
+}
+
+func oauthError(status int, code, description string) pz.Response {
+	return noStore(pz.Response{
+		Status: status,
+		Data:   pz.JSON(&OAuthError{Code: code, Description: description}),
+		Logging: []interface{}{&struct {
+			Message string `json:"message"`
+			Error   string `json:"error"`
+		}{
+			Message: description,
+			Error:   code,
+		}},
+	})
+}
+
+// noStore sets the caching headers required for token endpoint responses
+// (RFC 6749 section 5.1).
+func noStore(rsp pz.Response) pz.Response {
+	rsp.Headers = rsp.Headers.Clone()
+	if rsp.Headers == nil {
+		rsp.Headers = http.Header{}
+	}
+	rsp.Headers.Set("Cache-Control", "no-store")
+	rsp.Headers.Set("Pragma", "no-cache")
+	return rsp
+}
@@ -0,0 +1,499 @@
+package auth
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/weberc2/auth/pkg/auth/testsupport"
+	"github.com/weberc2/auth/pkg/auth/types"
+	pz "github.com/weberc2/httpeasy"
+	pztest "github.com/weberc2/httpeasy/testsupport"
+)
+
+func TestOIDCProvider_DiscoveryRoute(t *testing.T) {
+	op := testOIDCProvider(nil, nil)
+	rsp := op.DiscoveryRoute().Handler(pz.Request{})
+	if rsp.Status != http.StatusOK {
+		t.Fatalf("Response.Status: wanted `200`; found `%d`", rsp.Status)
+	}
+
+	data, err := pztest.ReadAll(rsp.Data)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var discovery OIDCDiscovery
+	if err := json.Unmarshal(data, &discovery); err != nil {
+		t.Fatalf("unmarshaling discovery document: %v", err)
+	}
+
+	for _, field := range []struct {
+		name   string
+		wanted string
+		found  string
+	}{
+		{"Issuer", "https://auth.example.org", discovery.Issuer},
+		{
+			"AuthorizationEndpoint",
+			"https://auth.example.org/authorize",
+			discovery.AuthorizationEndpoint,
+		},
+		{
+			"TokenEndpoint",
+			"https://auth.example.org/token",
+			discovery.TokenEndpoint,
+		},
+		{
+			"JWKSURI",
+			"https://auth.example.org/.well-known/jwks.json",
+			discovery.JWKSURI,
+		},
+	} {
+		if field.wanted != field.found {
+			t.Fatalf(
+				"OIDCDiscovery.%s: wanted `%s`; found `%s`",
+				field.name,
+				field.wanted,
+				field.found,
+			)
+		}
+	}
+}
+
+func TestOIDCProvider_AuthorizeFormRoute(t *testing.T) {
+	for _, testCase := range []struct {
+		name           string
+		query          url.Values
+		wantedStatus   int
+		wantedLocation string
+		wantedBody     []string
+	}{
+		{
+			name:         "renders login form",
+			query:        authorizeQuery(nil),
+			wantedStatus: http.StatusOK,
+			wantedBody: []string{
+				`<form action="https://auth.example.org/authorize?`,
+				`<a href="https://auth.example.org/password/forgot">`,
+			},
+		},
+		{
+			// Errors must not be redirected to unregistered clients.
+			name: "unknown client",
+			query: authorizeQuery(url.Values{
+				"client_id": []string{"attacker"},
+			}),
+			wantedStatus: http.StatusBadRequest,
+		},
+		{
+			// Errors must not be redirected to unregistered redirect URIs.
+			name: "unknown redirect uri",
+			query: authorizeQuery(url.Values{
+				"redirect_uri": []string{"https://attacker.com/callback"},
+			}),
+			wantedStatus: http.StatusBadRequest,
+		},
+		{
+			name: "unsupported response type",
+			query: authorizeQuery(url.Values{
+				"response_type": []string{"token"},
+			}),
+			wantedStatus: http.StatusSeeOther,
+			wantedLocation: "https://app.example.org/callback?" +
+				"error=unsupported_response_type&" +
+				"error_description=only+the+%60code%60+response+type+is+" +
+				"supported&state=state",
+		},
+		{
+			name: "missing openid scope",
+			query: authorizeQuery(url.Values{
+				"scope": []string{"email"},
+			}),
+			wantedStatus: http.StatusSeeOther,
+			wantedLocation: "https://app.example.org/callback?" +
+				"error=invalid_scope&" +
+				"error_description=the+%60openid%60+scope+is+required&" +
+				"state=state",
+		},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			op := testOIDCProvider(nil, nil)
+			rsp := op.AuthorizeFormRoute().Handler(pz.Request{
+				URL: &url.URL{RawQuery: testCase.query.Encode()},
+			})
+
+			if rsp.Status != testCase.wantedStatus {
+				t.Fatalf(
+					"Response.Status: wanted `%d`; found `%d`",
+					testCase.wantedStatus,
+					rsp.Status,
+				)
+			}
+
+			if location := rsp.Headers.Get("Location"); location !=
+				testCase.wantedLocation {
+				t.Fatalf(
+					"Response.Headers[\"Location\"]: wanted `%s`; found `%s`",
+					testCase.wantedLocation,
+					location,
+				)
+			}
+
+			data, err := pztest.ReadAll(rsp.Data)
+			if err != nil {
+				t.Fatalf("rendering response body: %v", err)
+			}
+			for _, wanted := range testCase.wantedBody {
+				if !strings.Contains(string(data), wanted) {
+					t.Fatalf(
+						"Response.Data: wanted `%s`; found `%s`",
+						wanted,
+						data,
+					)
+				}
+			}
+
+			// Magic links would resume at the web server's callback, not
+			// the client's.
+			if strings.Contains(string(data), "login/magic") {
+				t.Fatalf("Response.Data: unexpected magic link: %s", data)
+			}
+		})
+	}
+}
+
+func TestOIDCProvider_AuthorizationCodeFlow(t *testing.T) {
+	jwt.TimeFunc = nowTimeFunc
+	defer func() { jwt.TimeFunc = time.Now }()
+
+	tokens := testsupport.TokenStoreFake{}
+	op := testOIDCProvider(
+		testsupport.UserStoreFake{
+			"adam": {
+				User:         "adam",
+				Email:        "adam@example.org",
+				PasswordHash: hashBcrypt("password"),
+			},
+		},
+		tokens,
+	)
+
+	query := authorizeQuery(nil)
+	rsp := op.AuthorizeHandlerRoute().Handler(pz.Request{
+		URL: &url.URL{RawQuery: query.Encode()},
+		Body: strings.NewReader(url.Values{
+			"username": []string{"adam"},
+			"password": []string{"password"},
+		}.Encode()),
+	})
+	if rsp.Status != http.StatusSeeOther {
+		t.Fatalf("Response.Status: wanted `303`; found `%d`", rsp.Status)
+	}
+
+	location, err := url.Parse(rsp.Headers.Get("Location"))
+	if err != nil {
+		t.Fatalf("parsing redirect location: %v", err)
+	}
+	if wanted, found := "app.example.org", location.Host; wanted != found {
+		t.Fatalf("Location.Host: wanted `%s`; found `%s`", wanted, found)
+	}
+	if state := location.Query().Get("state"); state != "state" {
+		t.Fatalf(
+			"Location.Query[\"state\"]: wanted `state`; found `%s`",
+			state,
+		)
+	}
+	code := location.Query().Get("code")
+
+	// OIDC codes can only be redeemed at the token endpoint.
+	if _, err := op.AuthService.Exchange(code, ""); err != ErrUnauthorized {
+		t.Fatalf(
+			"AuthService.Exchange(): wanted `%v`; found `%v`",
+			ErrUnauthorized,
+			err,
+		)
+	}
+
+	for _, testCase := range []struct {
+		name         string
+		form         url.Values
+		wantedStatus int
+		wantedError  string
+	}{
+		{
+			name: "wrong client secret",
+			form: url.Values{
+				"client_secret": []string{"wrong"},
+			},
+			wantedStatus: http.StatusUnauthorized,
+			wantedError:  "invalid_client",
+		},
+		{
+			name: "wrong redirect uri",
+			form: url.Values{
+				"redirect_uri": []string{"https://app.example.org/other"},
+			},
+			wantedStatus: http.StatusBadRequest,
+			wantedError:  "invalid_grant",
+		},
+		{
+			name: "unsupported grant type",
+			form: url.Values{
+				"grant_type": []string{"password"},
+			},
+			wantedStatus: http.StatusBadRequest,
+			wantedError:  "unsupported_grant_type",
+		},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			rsp := op.TokenRoute().Handler(tokenRequest(code, testCase.form))
+			if rsp.Status != testCase.wantedStatus {
+				t.Fatalf(
+					"Response.Status: wanted `%d`; found `%d`",
+					testCase.wantedStatus,
+					rsp.Status,
+				)
+			}
+
+			data, err := pztest.ReadAll(rsp.Data)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			var oauthErr OAuthError
+			if err := json.Unmarshal(data, &oauthErr); err != nil {
+				t.Fatalf("unmarshaling error response: %v", err)
+			}
+			if oauthErr.Code != testCase.wantedError {
+				t.Fatalf(
+					"OAuthError.Code: wanted `%s`; found `%s`",
+					testCase.wantedError,
+					oauthErr.Code,
+				)
+			}
+		})
+	}
+
+	rsp = op.TokenRoute().Handler(tokenRequest(code, nil))
+	if rsp.Status != http.StatusOK {
+		t.Fatalf("Response.Status: wanted `200`; found `%d`", rsp.Status)
+	}
+	if cc := rsp.Headers.Get("Cache-Control"); cc != "no-store" {
+		t.Fatalf(
+			"Response.Headers[\"Cache-Control\"]: wanted `no-store`; "+
+				"found `%s`",
+			cc,
+		)
+	}
+
+	data, err := pztest.ReadAll(rsp.Data)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var tokenRsp OIDCTokenResponse
+	if err := json.Unmarshal(data, &tokenRsp); err != nil {
+		t.Fatalf("unmarshaling token response: %v", err)
+	}
+
+	if err := tokens.Exists(tokenRsp.RefreshToken); err != nil {
+		t.Fatalf("refresh token wasn't stored: %v", err)
+	}
+
+	var claims IDTokenClaims
+	if _, err := jwt.ParseWithClaims(
+		tokenRsp.IDToken,
+		&claims,
+		func(*jwt.Token) (interface{}, error) {
+			return &accessSigningKey.PublicKey, nil
+		},
+	); err != nil {
+		t.Fatalf("parsing ID token: %v", err)
+	}
+
+	wanted := IDTokenClaims{
+		Nonce:         "nonce",
+		Email:         "adam@example.org",
+		EmailVerified: true,
+		StandardClaims: jwt.StandardClaims{
+			Issuer:    "https://auth.example.org",
+			Audience:  "client",
+			Subject:   "adam",
+			IssuedAt:  now.Unix(),
+			NotBefore: now.Unix(),
+			ExpiresAt: now.Add(15 * time.Minute).Unix(),
+		},
+	}
+	if claims != wanted {
+		t.Fatalf("ID token claims: wanted `%+v`; found `%+v`", wanted, claims)
+	}
+}
+
+func TestOIDCProvider_AuthorizeHandlerRoute_SecondFactor(t *testing.T) {
+	jwt.TimeFunc = nowTimeFunc
+	defer func() { jwt.TimeFunc = time.Now }()
+
+	totp := TOTP{EncryptionKey: "key"}
+	secret := []byte("12345678901234567890")
+	encrypted, err := totp.encrypt(secret)
+	if err != nil {
+		t.Fatalf("encrypting TOTP secret: %v", err)
+	}
+	op := testOIDCProvider(
+		testsupport.UserStoreFake{
+			"adam": {
+				User:         "adam",
+				Email:        "adam@example.org",
+				PasswordHash: hashBcrypt("password"),
+				TOTPSecret:   encrypted,
+				TOTPEnabled:  true,
+			},
+		},
+		testsupport.TokenStoreFake{},
+	)
+	op.AuthService.TOTP = totp
+
+	// secondFactorToken starts a login with the provided params and returns
+	// the second-factor token.
+	secondFactorToken := func(params *CodeParams) string {
+		t.Helper()
+		_, err := op.AuthService.LoginAuthCode(
+			&types.Credentials{User: "adam", Password: "password"},
+			params,
+			nil,
+		)
+		var required *SecondFactorRequired
+		if !errors.As(err, &required) {
+			t.Fatalf("LoginAuthCode(): wanted second factor; found `%v`", err)
+		}
+		return required.Token
+	}
+	authorize := func(token string) pz.Response {
+		return op.AuthorizeHandlerRoute().Handler(pz.Request{
+			URL: &url.URL{RawQuery: authorizeQuery(nil).Encode()},
+			Body: strings.NewReader(url.Values{
+				"username":            []string{"adam"},
+				"second_factor_token": []string{token},
+				"code":                []string{hotp(secret, totpStep(now))},
+			}.Encode()),
+		})
+	}
+
+	for _, testCase := range []struct {
+		name   string
+		params *CodeParams
+	}{
+		{
+			// A first-party code would be redeemable by the client at
+			// `/api/exchange`.
+			name:   "first-party login",
+			params: &CodeParams{},
+		},
+		{
+			name: "other redirect uri",
+			params: &CodeParams{
+				ClientID:    "client",
+				RedirectURI: "https://app.example.org/other",
+			},
+		},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			rsp := authorize(secondFactorToken(testCase.params))
+			if rsp.Status != http.StatusUnauthorized {
+				t.Fatalf(
+					"Response.Status: wanted `401`; found `%d`",
+					rsp.Status,
+				)
+			}
+		})
+	}
+
+	rsp := authorize(secondFactorToken(&CodeParams{
+		ClientID:    "client",
+		RedirectURI: "https://app.example.org/callback",
+		Nonce:       "nonce",
+		Scope:       "openid email",
+	}))
+	if rsp.Status != http.StatusSeeOther {
+		t.Fatalf("Response.Status: wanted `303`; found `%d`", rsp.Status)
+	}
+}
+
+func testOIDCProvider(
+	users testsupport.UserStoreFake,
+	tokens testsupport.TokenStoreFake,
+) *OIDCProvider {
+	return &OIDCProvider{
+		AuthService: AuthService{
+			Creds:         CredStore{Users: users},
+			Tokens:        tokens,
+			Notifications: &testsupport.NotificationServiceFake{},
+			Codes:         codesTokenFactory,
+			RedeemedCodes: testsupport.CodeStoreFake{},
+			TokenDetails: TokenDetailsFactory{
+				AccessTokens:  accessTokenFactory,
+				RefreshTokens: refreshTokenFactory,
+				TimeFunc:      nowTimeFunc,
+			},
+			TimeFunc: nowTimeFunc,
+		},
+		BaseURL: "https://auth.example.org/",
+		Clients: []OIDCClient{{
+			ID:           "client",
+			Secret:       "secret",
+			RedirectURIs: []string{"https://app.example.org/callback"},
+		}},
+		IDTokens: TokenFactory{
+			TokenValidity: 15 * time.Minute,
+			SigningKey:    accessSigningKey,
+		},
+	}
+}
+
+// authorizeQuery returns a valid authorization request query with any of the
+// provided overrides.
+func authorizeQuery(overrides url.Values) url.Values {
+	query := url.Values{
+		"response_type": []string{"code"},
+		"client_id":     []string{"client"},
+		"redirect_uri":  []string{"https://app.example.org/callback"},
+		"scope":         []string{"openid email"},
+		"state":         []string{"state"},
+		"nonce":         []string{"nonce"},
+	}
+	for key, values := range overrides {
+		query[key] = values
+	}
+	return query
+}
+
+// tokenRequest returns a valid token request for the code with any of the
+// provided form overrides. The client authenticates with basic auth unless
+// the overrides include a `client_secret`.
+func tokenRequest(code string, overrides url.Values) pz.Request {
+	form := url.Values{
+		"grant_type":   []string{"authorization_code"},
+		"code":         []string{code},
+		"redirect_uri": []string{"https://app.example.org/callback"},
+	}
+	for key, values := range overrides {
+		form[key] = values
+	}
+
+	headers := http.Header{}
+	if form.Get("client_secret") != "" {
+		form.Set("client_id", "client")
+	} else {
+		r := http.Request{Header: headers}
+		r.SetBasicAuth("client", "secret")
+	}
+
+	return pz.Request{
+		Headers: headers,
+		Body:    strings.NewReader(form.Encode()),
+	}
+}
@@ -0,0 +1,166 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/weberc2/auth/pkg/auth/types"
+)
+
+// OutboxNotificationService is a `types.NotificationService` which enqueues
+// notifications in an outbox rather than sending them, so that a mail outage
+// doesn't fail the request which triggered the notification. An
+// `OutboxWorker` delivers them.
+type OutboxNotificationService struct {
+	Outbox   types.OutboxStore
+	TimeFunc func() time.Time
+}
+
+func (ons *OutboxNotificationService) Notify(n *types.Notification) error {
+	var id [16]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return fmt.Errorf("generating outbox entry ID: %w", err)
+	}
+	now := ons.TimeFunc()
+	if err := ons.Outbox.Enqueue(&types.OutboxEntry{
+		ID:           hex.EncodeToString(id[:]),
+		Notification: *n,
+		Status:       types.OutboxStatusPending,
+		NextAttempt:  now,
+		Created:      now,
+	}); err != nil {
+		return fmt.Errorf("enqueueing notification: %w", err)
+	}
+	return nil
+}
+
+// OutboxWorker delivers the notifications in an outbox. Failed deliveries
+// are retried with exponential backoff: the nth retry waits `BaseDelay *
+// 2^(n-1)`, up to `MaxDelay`. After `MaxAttempts` failed attempts, the
+// notification is dead-lettered; it stays in the outbox until it's replayed
+// (see `types.OutboxStore.Replay`) or deleted.
+//
+// Note that replaying a notification sends the original token, which may
+// have expired in the meantime.
+type OutboxWorker struct {
+	Outbox        types.OutboxStore
+	Notifications types.NotificationService
+	BaseDelay     time.Duration
+	MaxDelay      time.Duration
+	MaxAttempts   int
+
+	// Interval is how often the outbox is polled.
+	Interval time.Duration
+
+	// BatchSize is the maximum number of notifications claimed at once.
+	BatchSize int
+
+	// Lease is how long claimed notifications are hidden from other workers.
+	// It should comfortably exceed the time it takes to deliver a batch.
+	Lease time.Duration
+
+	TimeFunc func() time.Time
+}
+
+// Run delivers notifications every `Interval` until the context is done.
+func (ow *OutboxWorker) Run(ctx context.Context) {
+	ticker := time.NewTicker(ow.Interval)
+	defer ticker.Stop()
+	for {
+		if err := ow.DeliverDue(); err != nil {
+			log.Printf("error delivering notifications: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// DeliverDue delivers the notifications which are due, repeating until none
+// are left. Delivery failures are recorded on the outbox entries rather than
+// returned; only outbox errors are returned.
+func (ow *OutboxWorker) DeliverDue() error {
+	for {
+		entries, err := ow.Outbox.Claim(
+			ow.TimeFunc(),
+			ow.Lease,
+			ow.BatchSize,
+		)
+		if err != nil {
+			return fmt.Errorf("claiming notifications: %w", err)
+		}
+		for _, entry := range entries {
+			if err := ow.deliver(entry); err != nil {
+				return err
+			}
+		}
+		if len(entries) == 0 || len(entries) < ow.BatchSize {
+			return nil
+		}
+	}
+}
+
+func (ow *OutboxWorker) deliver(entry *types.OutboxEntry) error {
+	// The entry ID identifies the notification across delivery attempts.
+	notification := entry.Notification
+	notification.ID = entry.ID
+	err := ow.Notifications.Notify(&notification)
+	if err == nil {
+		if err := ow.Outbox.Delete(entry.ID); err != nil {
+			return fmt.Errorf(
+				"deleting delivered notification `%s`: %w",
+				entry.ID,
+				err,
+			)
+		}
+		return nil
+	}
+
+	entry.LastError = err.Error()
+	entry.Attempts++
+	if entry.Attempts >= ow.MaxAttempts {
+		entry.Status = types.OutboxStatusDead
+		log.Printf(
+			"dead-lettering `%s` notification `%s` for user `%s` after %d "+
+				"attempts: %s",
+			entry.Notification.Type,
+			entry.ID,
+			entry.Notification.User,
+			entry.Attempts,
+			entry.LastError,
+		)
+	} else {
+		entry.NextAttempt = ow.TimeFunc().Add(ow.delay(entry.Attempts))
+	}
+	if err := ow.Outbox.Update(entry); err != nil {
+		return fmt.Errorf(
+			"recording failed notification `%s`: %w",
+			entry.ID,
+			err,
+		)
+	}
+	return nil
+}
+
+// delay returns the backoff after the given number of failed attempts.
+func (ow *OutboxWorker) delay(attempts int) time.Duration {
+	delay := ow.BaseDelay
+	for i := 1; i < attempts; i++ {
+		delay *= 2
+		if delay >= ow.MaxDelay {
+			return ow.MaxDelay
+		}
+	}
+	if delay > ow.MaxDelay {
+		return ow.MaxDelay
+	}
+	return delay
+}
+
+var _ types.NotificationService = &OutboxNotificationService{}
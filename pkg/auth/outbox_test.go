@@ -0,0 +1,176 @@
+package auth
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/weberc2/auth/pkg/auth/testsupport"
+	"github.com/weberc2/auth/pkg/auth/types"
+)
+
+func TestOutboxWorker(t *testing.T) {
+	current := now
+	timeFunc := func() time.Time { return current }
+	outbox := &MemOutboxStore{}
+	authService := AuthService{
+		Creds:         CredStore{Users: testsupport.UserStoreFake{}},
+		ResetTokens:   resetTokenFactory,
+		Notifications: &OutboxNotificationService{outbox, timeFunc},
+		TimeFunc:      timeFunc,
+	}
+	mail := flakyNotificationService{failures: 3}
+	worker := OutboxWorker{
+		Outbox:        outbox,
+		Notifications: &mail,
+		BaseDelay:     time.Minute,
+		MaxDelay:      90 * time.Second,
+		MaxAttempts:   3,
+		BatchSize:     10,
+		Lease:         time.Minute,
+		TimeFunc:      timeFunc,
+	}
+
+	// Registration succeeds even though the mail service is down.
+	if err := authService.Register(
+		"adam",
+		"adam@example.org",
+		"",
+	); err != nil {
+		t.Fatalf("Register(): unexpected err: %v", err)
+	}
+
+	for i, step := range []struct {
+		advance        time.Duration
+		wantedAttempts int
+		wantedDead     int
+	}{
+		{wantedAttempts: 1},
+		{wantedAttempts: 1}, // backing off
+		{advance: time.Minute, wantedAttempts: 2},
+		{advance: time.Minute, wantedAttempts: 2}, // backing off
+		{advance: 30 * time.Second, wantedAttempts: 3, wantedDead: 1},
+		{advance: time.Hour, wantedAttempts: 3, wantedDead: 1},
+	} {
+		current = current.Add(step.advance)
+		if err := worker.DeliverDue(); err != nil {
+			t.Fatalf("step %d: DeliverDue(): unexpected err: %v", i, err)
+		}
+		if mail.attempts != step.wantedAttempts {
+			t.Fatalf(
+				"step %d: wanted `%d` delivery attempts; found `%d`",
+				i,
+				step.wantedAttempts,
+				mail.attempts,
+			)
+		}
+		dead, err := outbox.Dead()
+		if err != nil {
+			t.Fatalf("step %d: Dead(): unexpected err: %v", i, err)
+		}
+		if len(dead) != step.wantedDead {
+			t.Fatalf(
+				"step %d: wanted `%d` dead notifications; found `%d`",
+				i,
+				step.wantedDead,
+				len(dead),
+			)
+		}
+	}
+
+	dead, err := outbox.Dead()
+	if err != nil {
+		t.Fatalf("Dead(): unexpected err: %v", err)
+	}
+	if dead[0].LastError != errMailUnavailable.Error() {
+		t.Fatalf(
+			"OutboxEntry.LastError: wanted `%v`; found `%s`",
+			errMailUnavailable,
+			dead[0].LastError,
+		)
+	}
+	if err := outbox.Replay(dead[0].ID, current); err != nil {
+		t.Fatalf("Replay(): unexpected err: %v", err)
+	}
+	if err := outbox.Replay(dead[0].ID, current); !errors.Is(
+		err,
+		types.ErrOutboxEntryNotFound,
+	) {
+		t.Fatalf(
+			"Replay(): wanted `%v` for a pending entry; found `%v`",
+			types.ErrOutboxEntryNotFound,
+			err,
+		)
+	}
+
+	// The mail service has recovered.
+	if err := worker.DeliverDue(); err != nil {
+		t.Fatalf("DeliverDue(): unexpected err: %v", err)
+	}
+	if len(mail.delivered) != 1 {
+		t.Fatalf(
+			"wanted 1 delivered notification; found %d",
+			len(mail.delivered),
+		)
+	}
+	if err := (&types.Notification{
+		ID:    dead[0].ID,
+		Type:  types.NotificationTypeRegister,
+		User:  "adam",
+		Email: "adam@example.org",
+		Token: mail.delivered[0].Token,
+	}).Compare(mail.delivered[0]); err != nil {
+		t.Fatal(err)
+	}
+	if err := outbox.Delete(dead[0].ID); !errors.Is(
+		err,
+		types.ErrOutboxEntryNotFound,
+	) {
+		t.Fatalf(
+			"wanted delivered notification to be deleted; found `%v`",
+			err,
+		)
+	}
+}
+
+func TestOutboxWorker_delay(t *testing.T) {
+	worker := OutboxWorker{BaseDelay: time.Second, MaxDelay: 5 * time.Second}
+	for _, testCase := range []struct {
+		attempts int
+		wanted   time.Duration
+	}{
+		{attempts: 1, wanted: time.Second},
+		{attempts: 2, wanted: 2 * time.Second},
+		{attempts: 3, wanted: 4 * time.Second},
+		{attempts: 4, wanted: 5 * time.Second},
+		{attempts: 100, wanted: 5 * time.Second},
+	} {
+		found := worker.delay(testCase.attempts)
+		if found != testCase.wanted {
+			t.Fatalf(
+				"delay(%d): wanted `%s`; found `%s`",
+				testCase.attempts,
+				testCase.wanted,
+				found,
+			)
+		}
+	}
+}
+
+var errMailUnavailable = errors.New("mail service unavailable")
+
+// flakyNotificationService fails the first `failures` attempts.
+type flakyNotificationService struct {
+	failures  int
+	attempts  int
+	delivered []*types.Notification
+}
+
+func (fns *flakyNotificationService) Notify(n *types.Notification) error {
+	fns.attempts++
+	if fns.attempts <= fns.failures {
+		return errMailUnavailable
+	}
+	fns.delivered = append(fns.delivered, n)
+	return nil
+}
@@ -0,0 +1,259 @@
+package auth
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var (
+	// ErrPasswordMismatch is returned by `ComparePasswordHash` if the
+	// password doesn't match the hash.
+	ErrPasswordMismatch = errors.New("password doesn't match hash")
+
+	// ErrUnsupportedPasswordHash is returned by `ComparePasswordHash` if the
+	// hash's algorithm isn't recognized or its parameters are malformed.
+	ErrUnsupportedPasswordHash = errors.New("unsupported password hash")
+)
+
+// PasswordHasher hashes passwords for storage. Hashes are PHC strings (e.g.,
+// `$argon2id$v=19$m=65536,t=3,p=4$<salt>$<hash>`; bcrypt hashes use their
+// traditional `$2a$<cost>$...` format), which identify their algorithm and
+// parameters so that `ComparePasswordHash` can verify hashes made by any
+// hasher.
+type PasswordHasher interface {
+	// Hash hashes the password with a new random salt.
+	Hash(password string) ([]byte, error)
+
+	// NeedsRehash reports whether the hash was made with a different
+	// algorithm or with weaker parameters than the hasher's.
+	NeedsRehash(hash []byte) bool
+}
+
+// DefaultPasswordHasher is used by `CredStore` if no hasher is configured.
+var DefaultPasswordHasher PasswordHasher = BcryptHasher{
+	Cost: bcrypt.DefaultCost,
+}
+
+// ComparePasswordHash checks the password against a hash made by any of the
+// supported `PasswordHasher`s. It returns `ErrPasswordMismatch` if the
+// password doesn't match.
+func ComparePasswordHash(hash []byte, password string) error {
+	switch {
+	case bytes.HasPrefix(hash, []byte(argon2idPrefix)):
+		return compareArgon2id(hash, password)
+	case isBcrypt(hash):
+		err := bcrypt.CompareHashAndPassword(hash, []byte(password))
+		if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+			return ErrPasswordMismatch
+		}
+		return err
+	default:
+		return ErrUnsupportedPasswordHash
+	}
+}
+
+// BcryptHasher hashes passwords with bcrypt. Note that bcrypt ignores
+// everything after the first 72 bytes of a password.
+type BcryptHasher struct {
+	Cost int
+}
+
+func (hasher BcryptHasher) Hash(password string) ([]byte, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), hasher.Cost)
+	if err != nil {
+		return nil, fmt.Errorf("bcrypt-hashing password: %w", err)
+	}
+	return hash, nil
+}
+
+func (hasher BcryptHasher) NeedsRehash(hash []byte) bool {
+	if !isBcrypt(hash) {
+		return true
+	}
+	cost, err := bcrypt.Cost(hash)
+	return err != nil || cost < hasher.Cost
+}
+
+func isBcrypt(hash []byte) bool {
+	for _, prefix := range []string{"$2a$", "$2b$", "$2y$"} {
+		if bytes.HasPrefix(hash, []byte(prefix)) {
+			return true
+		}
+	}
+	return false
+}
+
+// Argon2idHasher hashes passwords with argon2id. `Memory` is in KiB. If
+// `SaltLength` or `KeyLength` are zero, they default to 16 and 32 bytes.
+type Argon2idHasher struct {
+	Memory      uint32
+	Iterations  uint32
+	Parallelism uint8
+	SaltLength  uint32
+	KeyLength   uint32
+}
+
+// DefaultArgon2idHasher uses the parameters recommended by RFC 9106 for
+// memory-constrained environments.
+var DefaultArgon2idHasher = Argon2idHasher{
+	Memory:      64 * 1024,
+	Iterations:  3,
+	Parallelism: 4,
+}
+
+const argon2idPrefix = "$argon2id$"
+
+// argon2idHash is a parsed argon2id PHC string.
+type argon2idHash struct {
+	version     int
+	memory      uint32
+	iterations  uint32
+	parallelism uint8
+	salt        []byte
+	key         []byte
+}
+
+func (hasher Argon2idHasher) Hash(password string) ([]byte, error) {
+	saltLength, keyLength := hasher.SaltLength, hasher.KeyLength
+	if saltLength == 0 {
+		saltLength = 16
+	}
+	if keyLength == 0 {
+		keyLength = 32
+	}
+
+	salt := make([]byte, saltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, fmt.Errorf("generating salt: %w", err)
+	}
+	return argon2idHash{
+		version:     argon2.Version,
+		memory:      hasher.Memory,
+		iterations:  hasher.Iterations,
+		parallelism: hasher.Parallelism,
+		salt:        salt,
+		key: argon2.IDKey(
+			[]byte(password),
+			salt,
+			hasher.Iterations,
+			hasher.Memory,
+			hasher.Parallelism,
+			keyLength,
+		),
+	}.encode(), nil
+}
+
+func (hasher Argon2idHasher) NeedsRehash(hash []byte) bool {
+	parsed, err := parseArgon2id(hash)
+	if err != nil {
+		return true
+	}
+	keyLength := hasher.KeyLength
+	if keyLength == 0 {
+		keyLength = 32
+	}
+	return parsed.version != argon2.Version ||
+		parsed.memory < hasher.Memory ||
+		parsed.iterations < hasher.Iterations ||
+		parsed.parallelism < hasher.Parallelism ||
+		uint32(len(parsed.key)) < keyLength
+}
+
+func compareArgon2id(hash []byte, password string) error {
+	parsed, err := parseArgon2id(hash)
+	if err != nil {
+		return err
+	}
+	key := argon2.IDKey(
+		[]byte(password),
+		parsed.salt,
+		parsed.iterations,
+		parsed.memory,
+		parsed.parallelism,
+		uint32(len(parsed.key)),
+	)
+	if subtle.ConstantTimeCompare(key, parsed.key) != 1 {
+		return ErrPasswordMismatch
+	}
+	return nil
+}
+
+func (hash argon2idHash) encode() []byte {
+	return []byte(fmt.Sprintf(
+		"%sv=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2idPrefix,
+		hash.version,
+		hash.memory,
+		hash.iterations,
+		hash.parallelism,
+		base64.RawStdEncoding.EncodeToString(hash.salt),
+		base64.RawStdEncoding.EncodeToString(hash.key),
+	))
+}
+
+func parseArgon2id(hash []byte) (*argon2idHash, error) {
+	// "$argon2id$v=19$m=65536,t=3,p=4$<salt>$<key>" splits into
+	// ["", "argon2id", "v=19", "m=65536,t=3,p=4", "<salt>", "<key>"]
+	fields := bytes.Split(hash, []byte("$"))
+	if len(fields) != 6 || string(fields[1]) != "argon2id" {
+		return nil, ErrUnsupportedPasswordHash
+	}
+
+	var parsed argon2idHash
+	if _, err := fmt.Sscanf(
+		string(fields[2]),
+		"v=%d",
+		&parsed.version,
+	); err != nil {
+		return nil, fmt.Errorf(
+			"%w: parsing version: %v",
+			ErrUnsupportedPasswordHash,
+			err,
+		)
+	}
+	if _, err := fmt.Sscanf(
+		string(fields[3]),
+		"m=%d,t=%d,p=%d",
+		&parsed.memory,
+		&parsed.iterations,
+		&parsed.parallelism,
+	); err != nil {
+		return nil, fmt.Errorf(
+			"%w: parsing parameters: %v",
+			ErrUnsupportedPasswordHash,
+			err,
+		)
+	}
+
+	var err error
+	if parsed.salt, err = base64.RawStdEncoding.DecodeString(
+		string(fields[4]),
+	); err != nil {
+		return nil, fmt.Errorf(
+			"%w: decoding salt: %v",
+			ErrUnsupportedPasswordHash,
+			err,
+		)
+	}
+	if parsed.key, err = base64.RawStdEncoding.DecodeString(
+		string(fields[5]),
+	); err != nil {
+		return nil, fmt.Errorf(
+			"%w: decoding key: %v",
+			ErrUnsupportedPasswordHash,
+			err,
+		)
+	}
+	if parsed.memory == 0 || parsed.iterations == 0 ||
+		parsed.parallelism == 0 || len(parsed.key) == 0 {
+		return nil, ErrUnsupportedPasswordHash
+	}
+	return &parsed, nil
+}
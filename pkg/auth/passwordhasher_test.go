@@ -0,0 +1,287 @@
+package auth
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/weberc2/auth/pkg/auth/testsupport"
+	"github.com/weberc2/auth/pkg/auth/types"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// testArgon2idHasher is cheap so that the tests run quickly.
+var testArgon2idHasher = Argon2idHasher{
+	Memory:      64,
+	Iterations:  1,
+	Parallelism: 1,
+}
+
+func TestPasswordHashers(t *testing.T) {
+	for _, testCase := range []struct {
+		name   string
+		hasher PasswordHasher
+		prefix string
+	}{
+		{
+			name:   "bcrypt",
+			hasher: BcryptHasher{Cost: bcrypt.MinCost},
+			prefix: "$2a$04$",
+		},
+		{
+			name:   "argon2id",
+			hasher: testArgon2idHasher,
+			prefix: "$argon2id$v=19$m=64,t=1,p=1$",
+		},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			hash, err := testCase.hasher.Hash(goodPassword)
+			if err != nil {
+				t.Fatalf("Hash(): unexpected err: %v", err)
+			}
+			if !bytes.HasPrefix(hash, []byte(testCase.prefix)) {
+				t.Fatalf(
+					"Hash(): wanted prefix `%s`; found `%s`",
+					testCase.prefix,
+					hash,
+				)
+			}
+			if err := ComparePasswordHash(hash, goodPassword); err != nil {
+				t.Fatalf("ComparePasswordHash(): unexpected err: %v", err)
+			}
+			if err := ComparePasswordHash(
+				hash,
+				"wrong password",
+			); !errors.Is(err, ErrPasswordMismatch) {
+				t.Fatalf(
+					"ComparePasswordHash(): wanted `%v`; found `%v`",
+					ErrPasswordMismatch,
+					err,
+				)
+			}
+			if testCase.hasher.NeedsRehash(hash) {
+				t.Fatal("NeedsRehash(): wanted `false` for its own hash")
+			}
+		})
+	}
+}
+
+func TestComparePasswordHash_Unsupported(t *testing.T) {
+	for _, hash := range []string{
+		"",
+		"password",
+		"$scrypt$ln=16,r=8,p=1$c2FsdA$aGFzaA",
+		"$argon2id$v=19$m=64,t=1,p=1$c2FsdA",
+		"$argon2id$v=19$m=0,t=1,p=1$c2FsdA$aGFzaA",
+		"$argon2id$v=19$m=64,t=1,p=1$!!!$aGFzaA",
+	} {
+		if err := ComparePasswordHash(
+			[]byte(hash),
+			goodPassword,
+		); !errors.Is(err, ErrUnsupportedPasswordHash) {
+			t.Fatalf(
+				"ComparePasswordHash(`%s`): wanted `%v`; found `%v`",
+				hash,
+				ErrUnsupportedPasswordHash,
+				err,
+			)
+		}
+	}
+}
+
+func TestPasswordHasher_NeedsRehash(t *testing.T) {
+	mustHash := func(hasher PasswordHasher) []byte {
+		hash, err := hasher.Hash(goodPassword)
+		if err != nil {
+			t.Fatalf("hashing password: %v", err)
+		}
+		return hash
+	}
+	bcrypt4 := mustHash(BcryptHasher{Cost: 4})
+	bcrypt5 := mustHash(BcryptHasher{Cost: 5})
+	argon2id := mustHash(testArgon2idHasher)
+
+	for _, testCase := range []struct {
+		name   string
+		hasher PasswordHasher
+		hash   []byte
+		wanted bool
+	}{
+		{
+			name:   "bcrypt cost too low",
+			hasher: BcryptHasher{Cost: 5},
+			hash:   bcrypt4,
+			wanted: true,
+		},
+		{
+			name:   "bcrypt cost above target",
+			hasher: BcryptHasher{Cost: 4},
+			hash:   bcrypt5,
+		},
+		{
+			name:   "bcrypt to argon2id",
+			hasher: testArgon2idHasher,
+			hash:   bcrypt5,
+			wanted: true,
+		},
+		{
+			name:   "argon2id to bcrypt",
+			hasher: BcryptHasher{Cost: 4},
+			hash:   argon2id,
+			wanted: true,
+		},
+		{
+			name: "argon2id memory too low",
+			hasher: Argon2idHasher{
+				Memory:      128,
+				Iterations:  1,
+				Parallelism: 1,
+			},
+			hash:   argon2id,
+			wanted: true,
+		},
+		{
+			name: "argon2id iterations too low",
+			hasher: Argon2idHasher{
+				Memory:      64,
+				Iterations:  2,
+				Parallelism: 1,
+			},
+			hash:   argon2id,
+			wanted: true,
+		},
+		{
+			name: "argon2id key too short",
+			hasher: Argon2idHasher{
+				Memory:      64,
+				Iterations:  1,
+				Parallelism: 1,
+				KeyLength:   64,
+			},
+			hash:   argon2id,
+			wanted: true,
+		},
+		{
+			name: "argon2id above target",
+			hasher: Argon2idHasher{
+				Memory:      32,
+				Iterations:  1,
+				Parallelism: 1,
+			},
+			hash: argon2id,
+		},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			if found := testCase.hasher.NeedsRehash(
+				testCase.hash,
+			); found != testCase.wanted {
+				t.Fatalf(
+					"NeedsRehash(): wanted `%t`; found `%t`",
+					testCase.wanted,
+					found,
+				)
+			}
+		})
+	}
+}
+
+func TestCredStore_Rehash(t *testing.T) {
+	oldHash, err := BcryptHasher{Cost: bcrypt.MinCost}.Hash(goodPassword)
+	if err != nil {
+		t.Fatalf("hashing password: %v", err)
+	}
+	users := testsupport.UserStoreFake{
+		"user": {
+			User:          "user",
+			Email:         "user@example.org",
+			PasswordHash:  oldHash,
+			TOTPSecret:    "secret",
+			TOTPEnabled:   true,
+			RecoveryCodes: []string{"digest"},
+		},
+	}
+	creds := CredStore{Users: users, Hasher: testArgon2idHasher}
+
+	// A failed login mustn't rehash.
+	if err := creds.Validate(&types.Credentials{
+		User:     "user",
+		Password: "wrong password",
+	}); err != ErrCredentials {
+		t.Fatalf("Validate(): wanted `%v`; found `%v`", ErrCredentials, err)
+	}
+	if !bytes.Equal(users["user"].PasswordHash, oldHash) {
+		t.Fatal("PasswordHash: rehashed after a failed login")
+	}
+
+	if err := creds.Validate(&types.Credentials{
+		User:     "user",
+		Password: goodPassword,
+	}); err != nil {
+		t.Fatalf("Validate(): unexpected err: %v", err)
+	}
+	rehashed := users["user"].PasswordHash
+	if !bytes.HasPrefix(rehashed, []byte(argon2idPrefix)) {
+		t.Fatalf("PasswordHash: wanted argon2id hash; found `%s`", rehashed)
+	}
+	if err := (&types.UserEntry{
+		User:          "user",
+		Email:         "user@example.org",
+		PasswordHash:  rehashed,
+		TOTPSecret:    "secret",
+		TOTPEnabled:   true,
+		RecoveryCodes: []string{"digest"},
+	}).Compare(users["user"]); err != nil {
+		t.Fatal(err)
+	}
+
+	// The new hash meets the target, so it's left alone.
+	if err := creds.Validate(&types.Credentials{
+		User:     "user",
+		Password: goodPassword,
+	}); err != nil {
+		t.Fatalf("Validate(): unexpected err: %v", err)
+	}
+	if !bytes.Equal(users["user"].PasswordHash, rehashed) {
+		t.Fatal("PasswordHash: rehashed a hash which meets the target")
+	}
+}
+
+// countingHasher counts the hashes it makes.
+type countingHasher struct {
+	PasswordHasher
+	hashes *int
+}
+
+func (hasher countingHasher) Hash(password string) ([]byte, error) {
+	*hasher.hashes++
+	return hasher.PasswordHasher.Hash(password)
+}
+
+func TestCredStore_UnknownUser(t *testing.T) {
+	var hashes int
+	creds := CredStore{
+		Users: testsupport.UserStoreFake{},
+		Hasher: countingHasher{
+			PasswordHasher: BcryptHasher{Cost: bcrypt.MinCost},
+			hashes:         &hashes,
+		},
+	}
+
+	// Unknown users are checked against a dummy hash made with the
+	// configured hasher, which is only made once.
+	for i := 0; i < 2; i++ {
+		if err := creds.Validate(&types.Credentials{
+			User:     "user",
+			Password: goodPassword,
+		}); err != ErrCredentials {
+			t.Fatalf(
+				"Validate(): wanted `%v`; found `%v`",
+				ErrCredentials,
+				err,
+			)
+		}
+	}
+	if hashes != 1 {
+		t.Fatalf("hashes: wanted `1`; found `%d`", hashes)
+	}
+}
@@ -0,0 +1,250 @@
+package auth
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/nbutton23/zxcvbn-go"
+	"github.com/weberc2/auth/pkg/auth/types"
+	pz "github.com/weberc2/httpeasy"
+)
+
+var ErrPasswordRejected = &pz.HTTPError{
+	Status:  http.StatusBadRequest,
+	Message: "password doesn't meet the requirements",
+}
+
+// Reasons for rejecting passwords (see `PasswordRejection`).
+const (
+	PasswordReasonTooSimple = "too_simple"
+	PasswordReasonTooShort  = "too_short"
+	PasswordReasonTooLong   = "too_long"
+	PasswordReasonBreached  = "breached"
+	PasswordReasonReused    = "reused"
+)
+
+// PasswordRejection is a reason why a password was rejected. `Reason` is one
+// of the `PasswordReason*` constants for programs; `Message` is for people.
+type PasswordRejection struct {
+	Reason  string `json:"reason"`
+	Message string `json:"message"`
+}
+
+// PasswordPolicyError is returned when a password is rejected by the
+// password policy. It unwraps to `ErrPasswordRejected`.
+type PasswordPolicyError struct {
+	Rejections []PasswordRejection `json:"rejections"`
+}
+
+func (err *PasswordPolicyError) Error() string {
+	messages := make([]string, len(err.Rejections))
+	for i := range err.Rejections {
+		messages[i] = err.Rejections[i].Message
+	}
+	return fmt.Sprintf(
+		"%s: %s",
+		ErrPasswordRejected.Message,
+		strings.Join(messages, "; "),
+	)
+}
+
+func (err *PasswordPolicyError) Unwrap() error { return ErrPasswordRejected }
+
+// Is reports whether the password was rejected for being too simple when
+// `target` is `ErrPasswordTooSimple`, which predates structured rejections.
+func (err *PasswordPolicyError) Is(target error) bool {
+	if target != ErrPasswordTooSimple {
+		return false
+	}
+	for _, rejection := range err.Rejections {
+		if rejection.Reason == PasswordReasonTooSimple {
+			return true
+		}
+	}
+	return false
+}
+
+// PasswordPolicy decides whether a user may use a password. `existing` is the
+// user's current entry, or `nil` if the user is new. Errors are reserved for
+// failures to evaluate the policy; rejections are returned instead.
+type PasswordPolicy interface {
+	Check(creds *types.Credentials, existing *types.UserEntry) (
+		[]PasswordRejection,
+		error,
+	)
+}
+
+// DefaultPasswordPolicy is used by `CredStore` if no policy is configured.
+var DefaultPasswordPolicy PasswordPolicy = ZxcvbnPolicy{MinScore: 3}
+
+// PasswordPolicies combines policies. A password is accepted if every policy
+// accepts it; otherwise the rejections from all of the policies are returned.
+type PasswordPolicies []PasswordPolicy
+
+func (policies PasswordPolicies) Check(
+	creds *types.Credentials,
+	existing *types.UserEntry,
+) ([]PasswordRejection, error) {
+	var rejections []PasswordRejection
+	for _, policy := range policies {
+		found, err := policy.Check(creds, existing)
+		if err != nil {
+			return nil, err
+		}
+		rejections = append(rejections, found...)
+	}
+	return rejections, nil
+}
+
+// ZxcvbnPolicy rejects passwords whose zxcvbn strength score (0-4) is below
+// `MinScore`. The username and email address count against the password.
+type ZxcvbnPolicy struct {
+	MinScore int
+}
+
+func (policy ZxcvbnPolicy) Check(
+	creds *types.Credentials,
+	existing *types.UserEntry,
+) ([]PasswordRejection, error) {
+	minEntropyMatch := zxcvbn.PasswordStrength(
+		creds.Password,
+		[]string{string(creds.User), creds.Email},
+	)
+	if minEntropyMatch.Score < policy.MinScore {
+		return []PasswordRejection{{
+			Reason:  PasswordReasonTooSimple,
+			Message: "Password is too simple",
+		}}, nil
+	}
+	return nil, nil
+}
+
+// LengthPolicy rejects passwords with fewer than `Min` or more than `Max`
+// characters. A zero bound isn't enforced. Note that bcrypt ignores
+// everything after the first 72 bytes of a password.
+type LengthPolicy struct {
+	Min int
+	Max int
+}
+
+func (policy LengthPolicy) Check(
+	creds *types.Credentials,
+	existing *types.UserEntry,
+) ([]PasswordRejection, error) {
+	length := utf8.RuneCountInString(creds.Password)
+	if policy.Min > 0 && length < policy.Min {
+		return []PasswordRejection{{
+			Reason: PasswordReasonTooShort,
+			Message: fmt.Sprintf(
+				"Password must have at least %d characters",
+				policy.Min,
+			),
+		}}, nil
+	}
+	if policy.Max > 0 && length > policy.Max {
+		return []PasswordRejection{{
+			Reason: PasswordReasonTooLong,
+			Message: fmt.Sprintf(
+				"Password must have at most %d characters",
+				policy.Max,
+			),
+		}}, nil
+	}
+	return nil, nil
+}
+
+// BreachedPasswordPolicy rejects passwords which appear in a local copy of a
+// breached-password corpus. The corpus is split by hash prefix in the style
+// of the Pwned Passwords range API: `Dir` holds one file per five-character
+// uppercase hex prefix of the passwords' SHA-1 hashes, named `<PREFIX>.txt`,
+// with one `<SUFFIX>:<COUNT>` line per password. Only the file for the
+// password's prefix is read. A missing file means no passwords with that
+// prefix were breached.
+type BreachedPasswordPolicy struct {
+	Dir string
+}
+
+func (policy BreachedPasswordPolicy) Check(
+	creds *types.Credentials,
+	existing *types.UserEntry,
+) ([]PasswordRejection, error) {
+	sum := sha1.Sum([]byte(creds.Password))
+	digest := strings.ToUpper(hex.EncodeToString(sum[:]))
+	prefix, suffix := digest[:5], digest[5:]
+
+	breached, err := policy.contains(prefix, suffix)
+	if err != nil {
+		return nil, err
+	}
+	if breached {
+		return []PasswordRejection{{
+			Reason: PasswordReasonBreached,
+			Message: "Password has appeared in a data breach; please " +
+				"choose another",
+		}}, nil
+	}
+	return nil, nil
+}
+
+func (policy BreachedPasswordPolicy) contains(
+	prefix string,
+	suffix string,
+) (bool, error) {
+	file, err := os.Open(filepath.Join(policy.Dir, prefix+".txt"))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return false, nil
+		}
+		return false, fmt.Errorf("opening breached passwords: %w", err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if i := strings.IndexByte(line, ':'); i >= 0 {
+			line = line[:i]
+		}
+		if strings.EqualFold(line, suffix) {
+			return true, nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return false, fmt.Errorf("reading breached passwords: %w", err)
+	}
+	return false, nil
+}
+
+// PasswordHistoryPolicy rejects a user's current password and the previous
+// passwords which `CredStore` keeps (see `CredStore.PasswordHistory`).
+type PasswordHistoryPolicy struct{}
+
+func (PasswordHistoryPolicy) Check(
+	creds *types.Credentials,
+	existing *types.UserEntry,
+) ([]PasswordRejection, error) {
+	if existing == nil {
+		return nil, nil
+	}
+	hashes := append(
+		[][]byte{existing.PasswordHash},
+		existing.PasswordHistory...,
+	)
+	for _, hash := range hashes {
+		if ComparePasswordHash(hash, creds.Password) == nil {
+			return []PasswordRejection{{
+				Reason:  PasswordReasonReused,
+				Message: "Password was used recently; please choose another",
+			}}, nil
+		}
+	}
+	return nil, nil
+}
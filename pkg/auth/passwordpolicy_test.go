@@ -0,0 +1,259 @@
+package auth
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/weberc2/auth/pkg/auth/testsupport"
+	"github.com/weberc2/auth/pkg/auth/types"
+	pz "github.com/weberc2/httpeasy"
+	pztest "github.com/weberc2/httpeasy/testsupport"
+)
+
+func TestPasswordPolicies(t *testing.T) {
+	const breached = "correct horse battery staple"
+	sum := sha1.Sum([]byte(breached))
+	digest := strings.ToUpper(hex.EncodeToString(sum[:]))
+	dir := t.TempDir()
+	if err := os.WriteFile(
+		filepath.Join(dir, digest[:5]+".txt"),
+		[]byte("0000000000000000000000000000000000A:3\r\n"+
+			strings.ToLower(digest[5:])+":52579\r\n"),
+		0644,
+	); err != nil {
+		t.Fatalf("writing breached passwords: %v", err)
+	}
+
+	existing := &types.UserEntry{
+		User:            "user",
+		Email:           "user@example.org",
+		PasswordHash:    hashBcrypt("current password"),
+		PasswordHistory: [][]byte{hashBcrypt(goodPassword)},
+	}
+
+	for _, testCase := range []struct {
+		name     string
+		policy   PasswordPolicy
+		password string
+		existing *types.UserEntry
+		wanted   []string
+	}{
+		{
+			name:     "zxcvbn ok",
+			policy:   ZxcvbnPolicy{MinScore: 3},
+			password: goodPassword,
+		},
+		{
+			name:     "zxcvbn too simple",
+			policy:   ZxcvbnPolicy{MinScore: 3},
+			password: "password",
+			wanted:   []string{PasswordReasonTooSimple},
+		},
+		{
+			name:     "zxcvbn counts username against password",
+			policy:   ZxcvbnPolicy{MinScore: 1},
+			password: "user",
+			wanted:   []string{PasswordReasonTooSimple},
+		},
+		{
+			name:     "too short",
+			policy:   LengthPolicy{Min: 12, Max: 64},
+			password: "ünïcödé",
+			wanted:   []string{PasswordReasonTooShort},
+		},
+		{
+			name:     "length counts characters rather than bytes",
+			policy:   LengthPolicy{Max: 7},
+			password: "ünïcödé",
+		},
+		{
+			name:     "too long",
+			policy:   LengthPolicy{Min: 12, Max: 64},
+			password: strings.Repeat("a", 65),
+			wanted:   []string{PasswordReasonTooLong},
+		},
+		{
+			name:     "breached",
+			policy:   BreachedPasswordPolicy{Dir: dir},
+			password: breached,
+			wanted:   []string{PasswordReasonBreached},
+		},
+		{
+			name:     "not breached",
+			policy:   BreachedPasswordPolicy{Dir: dir},
+			password: goodPassword,
+		},
+		{
+			name:     "history new user",
+			policy:   PasswordHistoryPolicy{},
+			password: goodPassword,
+		},
+		{
+			name:     "history current password",
+			policy:   PasswordHistoryPolicy{},
+			password: "current password",
+			existing: existing,
+			wanted:   []string{PasswordReasonReused},
+		},
+		{
+			name:     "history previous password",
+			policy:   PasswordHistoryPolicy{},
+			password: goodPassword,
+			existing: existing,
+			wanted:   []string{PasswordReasonReused},
+		},
+		{
+			name:     "history novel password",
+			policy:   PasswordHistoryPolicy{},
+			password: "novel password",
+			existing: existing,
+		},
+		{
+			name: "policies",
+			policy: PasswordPolicies{
+				ZxcvbnPolicy{MinScore: 3},
+				LengthPolicy{Min: 12},
+				BreachedPasswordPolicy{Dir: dir},
+			},
+			password: "password",
+			wanted: []string{
+				PasswordReasonTooSimple,
+				PasswordReasonTooShort,
+			},
+		},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			rejections, err := testCase.policy.Check(
+				&types.Credentials{
+					User:     "user",
+					Email:    "user@example.org",
+					Password: testCase.password,
+				},
+				testCase.existing,
+			)
+			if err != nil {
+				t.Fatalf("unexpected err: %v", err)
+			}
+			var found []string
+			for _, rejection := range rejections {
+				found = append(found, rejection.Reason)
+			}
+			if strings.Join(found, ", ") !=
+				strings.Join(testCase.wanted, ", ") {
+				t.Fatalf(
+					"rejection reasons: wanted `%v`; found `%v`",
+					testCase.wanted,
+					found,
+				)
+			}
+		})
+	}
+}
+
+func TestCredStore_PasswordHistory(t *testing.T) {
+	users := testsupport.UserStoreFake{}
+	creds := CredStore{
+		Users:           users,
+		Policy:          PasswordHistoryPolicy{},
+		PasswordHistory: 2,
+	}
+	upsert := func(password string) error {
+		return creds.Upsert(&types.Credentials{
+			User:     "user",
+			Email:    "user@example.org",
+			Password: password,
+		})
+	}
+
+	for _, password := range []string{"first", "second", "third", "fourth"} {
+		if err := upsert(password); err != nil {
+			t.Fatalf("Upsert(`%s`): unexpected err: %v", password, err)
+		}
+	}
+	if found := len(users["user"].PasswordHistory); found != 2 {
+		t.Fatalf("len(PasswordHistory): wanted `2`; found `%d`", found)
+	}
+
+	for _, password := range []string{"second", "third", "fourth"} {
+		err := upsert(password)
+		var rejected *PasswordPolicyError
+		if !errors.As(err, &rejected) {
+			t.Fatalf(
+				"Upsert(`%s`): wanted PasswordPolicyError; found `%v`",
+				password,
+				err,
+			)
+		}
+		if !errors.Is(err, ErrPasswordRejected) {
+			t.Fatalf("Upsert(`%s`): wanted ErrPasswordRejected", password)
+		}
+	}
+
+	// "first" has fallen out of the history.
+	if err := upsert("first"); err != nil {
+		t.Fatalf("Upsert(`first`): unexpected err: %v", err)
+	}
+}
+
+func TestUpdatePasswordRoute_Rejected(t *testing.T) {
+	jwt.TimeFunc = nowTimeFunc
+	defer func() { jwt.TimeFunc = time.Now }()
+
+	entry := types.UserEntry{User: "user", Email: "user@example.org"}
+	authService := AuthHTTPService{AuthService: AuthService{
+		Creds: CredStore{
+			Users:  testsupport.UserStoreFake{"user": &entry},
+			Policy: LengthPolicy{Min: 12},
+		},
+		ResetTokens: resetTokenFactory,
+		TimeFunc:    nowTimeFunc,
+	}}
+	token, err := resetTokenFactory.CreatePasswordReset(now, &entry)
+	if err != nil {
+		t.Fatalf("creating reset token: %v", err)
+	}
+
+	body, err := json.Marshal(&UpdatePassword{
+		Password: "short",
+		Token:    token,
+	})
+	if err != nil {
+		t.Fatalf("marshaling request: %v", err)
+	}
+	rsp := authService.UpdatePasswordRoute().Handler(pz.Request{
+		Body: strings.NewReader(string(body)),
+	})
+	if rsp.Status != http.StatusBadRequest {
+		t.Fatalf(
+			"Response.Status: wanted `%d`; found `%d`",
+			http.StatusBadRequest,
+			rsp.Status,
+		)
+	}
+
+	data, err := pztest.ReadAll(rsp.Data)
+	if err != nil {
+		t.Fatalf("reading response body: %v", err)
+	}
+	var found PasswordPolicyError
+	if err := json.Unmarshal(data, &found); err != nil {
+		t.Fatalf("unmarshaling response body: %v", err)
+	}
+	if len(found.Rejections) != 1 ||
+		found.Rejections[0].Reason != PasswordReasonTooShort {
+		t.Fatalf(
+			"wanted a single `%s` rejection; found `%+v`",
+			PasswordReasonTooShort,
+			found.Rejections,
+		)
+	}
+}
@@ -0,0 +1,165 @@
+package auth
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/weberc2/auth/pkg/auth/testsupport"
+	pz "github.com/weberc2/httpeasy"
+)
+
+// verifier and challenge are from RFC 7636 appendix B.
+const (
+	verifier  = "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"
+	challenge = "E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM"
+)
+
+func TestCodeChallengeS256(t *testing.T) {
+	if found := CodeChallengeS256(verifier); found != challenge {
+		t.Fatalf("wanted `%s`; found `%s`", challenge, found)
+	}
+}
+
+func TestCodeClaims_verifyCodeVerifier(t *testing.T) {
+	for _, testCase := range []struct {
+		name      string
+		challenge string
+		method    string
+		verifier  string
+		wantedErr error
+	}{
+		{
+			name:      "S256",
+			challenge: challenge,
+			method:    CodeChallengeMethodS256,
+			verifier:  verifier,
+		},
+		{
+			name:      "plain",
+			challenge: verifier,
+			method:    CodeChallengeMethodPlain,
+			verifier:  verifier,
+		},
+		{
+			name: "no challenge",
+		},
+		{
+			name:      "wrong verifier",
+			challenge: challenge,
+			method:    CodeChallengeMethodS256,
+			verifier:  strings.Repeat("a", len(verifier)),
+			wantedErr: ErrUnauthorized,
+		},
+		{
+			// Sending the challenge itself as the verifier must fail for
+			// `S256`.
+			name:      "challenge as verifier",
+			challenge: challenge,
+			method:    CodeChallengeMethodS256,
+			verifier:  challenge,
+			wantedErr: ErrUnauthorized,
+		},
+		{
+			name:      "missing verifier",
+			challenge: challenge,
+			method:    CodeChallengeMethodS256,
+			wantedErr: ErrUnauthorized,
+		},
+		{
+			name:      "unexpected verifier",
+			verifier:  verifier,
+			wantedErr: ErrUnauthorized,
+		},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			claims := CodeClaims{CodeParams: CodeParams{
+				CodeChallenge:       testCase.challenge,
+				CodeChallengeMethod: testCase.method,
+			}}
+			if err := claims.verifyCodeVerifier(
+				testCase.verifier,
+			); err != testCase.wantedErr {
+				t.Fatalf(
+					"wanted error `%v`; found `%v`",
+					testCase.wantedErr,
+					err,
+				)
+			}
+		})
+	}
+}
+
+func TestWebServer_LoginHandler_PKCE(t *testing.T) {
+	jwt.TimeFunc = nowTimeFunc
+	defer func() { jwt.TimeFunc = time.Now }()
+
+	webServer := WebServer{
+		AuthService: AuthService{
+			Creds: CredStore{
+				Users: testsupport.UserStoreFake{
+					"adam": {
+						User:         "adam",
+						Email:        "adam@example.org",
+						PasswordHash: hashBcrypt("password"),
+					},
+				},
+			},
+			Tokens:        testsupport.TokenStoreFake{},
+			Codes:         codesTokenFactory,
+			RedeemedCodes: testsupport.CodeStoreFake{},
+			TokenDetails: TokenDetailsFactory{
+				AccessTokens:  accessTokenFactory,
+				RefreshTokens: refreshTokenFactory,
+				TimeFunc:      nowTimeFunc,
+			},
+			TimeFunc: nowTimeFunc,
+		},
+		BaseURL:                 "https://auth.example.org/",
+		RedirectDomain:          "app.example.org",
+		DefaultRedirectLocation: "https://app.example.org/default/",
+	}
+
+	login := func(method string) pz.Response {
+		return webServer.LoginHandler(pz.Request{
+			Body: strings.NewReader(url.Values{
+				"username": []string{"adam"},
+				"password": []string{"password"},
+			}.Encode()),
+			URL: &url.URL{RawQuery: url.Values{
+				"callback":              []string{"https://app.example.org/"},
+				"code_challenge":        []string{challenge},
+				"code_challenge_method": []string{method},
+			}.Encode()},
+		})
+	}
+
+	if rsp := login("md5"); rsp.Status != http.StatusBadRequest {
+		t.Fatalf("Response.Status: wanted `400`; found `%d`", rsp.Status)
+	}
+
+	rsp := login(CodeChallengeMethodS256)
+	if rsp.Status != http.StatusSeeOther {
+		t.Fatalf("Response.Status: wanted `303`; found `%d`", rsp.Status)
+	}
+	location, err := url.Parse(rsp.Headers.Get("Location"))
+	if err != nil {
+		t.Fatalf("parsing redirect location: %v", err)
+	}
+	code := location.Query().Get("code")
+
+	if _, err := webServer.AuthService.Exchange(
+		code,
+		"",
+	); !errors.Is(err, ErrUnauthorized) {
+		t.Fatalf("wanted `%v`; found `%v`", ErrUnauthorized, err)
+	}
+
+	if _, err := webServer.AuthService.Exchange(code, verifier); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,82 @@
+package auth
+
+import (
+	"sync"
+	"time"
+
+	"github.com/weberc2/auth/pkg/auth/types"
+)
+
+// RefreshGrace lets a refresh token which was just rotated be presented again
+// for a short while. Browsers often send several requests at once with the
+// same expired access token and the same refresh token; the first rotates the
+// refresh token, and without a grace period the others would look like a
+// stolen token being reused and revoke the session. Within `Period`, they get
+// the tokens which replaced it instead.
+//
+// Rotations are remembered in memory (keyed by the predecessor's digest), so
+// the grace period only applies to requests handled by the same instance;
+// elsewhere, a reused token still revokes its family. The zero value is ready
+// to use, but with a zero `Period` there's no grace period.
+type RefreshGrace struct {
+	Period time.Duration
+
+	lock      sync.Mutex
+	rotations map[string]*rotation
+}
+
+// rotation is the outcome of rotating a refresh token. `done` is closed once
+// `tokens` and `err` are set.
+type rotation struct {
+	done    chan struct{}
+	tokens  *TokenDetails
+	err     error
+	expires time.Time
+}
+
+// rotate rotates the token with `f` unless it was rotated within the grace
+// period, in which case the tokens which replaced it are returned (waiting
+// for a concurrent rotation to finish if necessary). Failed rotations aren't
+// remembered.
+func (rg *RefreshGrace) rotate(
+	token string,
+	now time.Time,
+	f func() (*TokenDetails, error),
+) (*TokenDetails, error) {
+	if rg == nil || rg.Period <= 0 {
+		return f()
+	}
+
+	digest := types.TokenDigest(token)
+	rg.lock.Lock()
+	for key, r := range rg.rotations {
+		if r.tokens != nil && !now.Before(r.expires) {
+			delete(rg.rotations, key)
+		}
+	}
+	if r, found := rg.rotations[digest]; found {
+		rg.lock.Unlock()
+		<-r.done
+		if r.err == nil {
+			return r.tokens, nil
+		}
+		// The rotation failed, so this attempt gets its own.
+		return f()
+	}
+	if rg.rotations == nil {
+		rg.rotations = map[string]*rotation{}
+	}
+	r := &rotation{done: make(chan struct{}), expires: now.Add(rg.Period)}
+	rg.rotations[digest] = r
+	rg.lock.Unlock()
+
+	tokens, err := f()
+	rg.lock.Lock()
+	r.tokens, r.err = tokens, err
+	if err != nil {
+		delete(rg.rotations, digest)
+	}
+	rg.lock.Unlock()
+	close(r.done)
+	return tokens, err
+}
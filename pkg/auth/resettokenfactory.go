@@ -1,6 +1,8 @@
 package auth
 
 import (
+	"crypto/sha256"
+	"encoding/base64"
 	"fmt"
 	"time"
 
@@ -11,6 +13,24 @@ import (
 type Claims struct {
 	User  types.UserID
 	Email string
+
+	// Locale is the user's preferred locale, if known. It's carried through
+	// registration so that it can be recorded when the user is created.
+	Locale string `json:",omitempty"`
+
+	// NewEmail is set for email change tokens, whose `Email` is the user's
+	// email address when the change was requested. Only email change
+	// tokens have it, so they can't be used to register or to reset
+	// passwords (and vice versa).
+	NewEmail string `json:",omitempty"`
+
+	// PasswordHash is set for password reset tokens. It's a digest of the
+	// user's password hash when the token was issued (see
+	// `passwordHashDigest`), so the token stops working once the password
+	// changes, including when the token itself is used. Registration tokens
+	// don't have it.
+	PasswordHash string `json:",omitempty"`
+
 	jwt.StandardClaims
 }
 
@@ -20,23 +40,63 @@ func (rtf *ResetTokenFactory) Create(
 	now time.Time,
 	user types.UserID,
 	email string,
+	locale string,
 ) (string, error) {
-	token := jwt.NewWithClaims(
-		jwt.SigningMethodES512,
-		Claims{
-			User:  user,
-			Email: email,
-			StandardClaims: jwt.StandardClaims{
-				Subject:   string(user),
-				Audience:  rtf.Audience,
-				Issuer:    rtf.Issuer,
-				IssuedAt:  now.Unix(),
-				ExpiresAt: now.Add(rtf.TokenValidity).Unix(),
-				NotBefore: now.Unix(),
-			},
-		},
-	)
-	return token.SignedString(rtf.SigningKey)
+	return rtf.create(now, &Claims{User: user, Email: email, Locale: locale})
+}
+
+// CreatePasswordReset creates a token which resets the user's password. It's
+// bound to the user's current password hash, so it can only be used once.
+func (rtf *ResetTokenFactory) CreatePasswordReset(
+	now time.Time,
+	entry *types.UserEntry,
+) (string, error) {
+	return rtf.create(now, &Claims{
+		User:         entry.User,
+		Email:        entry.Email,
+		Locale:       entry.Locale,
+		PasswordHash: passwordHashDigest(entry.PasswordHash),
+	})
+}
+
+// CreateEmailChange creates a token which confirms that the user controls
+// the new email address.
+func (rtf *ResetTokenFactory) CreateEmailChange(
+	now time.Time,
+	user types.UserID,
+	email string,
+	newEmail string,
+	locale string,
+) (string, error) {
+	return rtf.create(now, &Claims{
+		User:     user,
+		Email:    email,
+		Locale:   locale,
+		NewEmail: newEmail,
+	})
+}
+
+func (rtf *ResetTokenFactory) create(
+	now time.Time,
+	claims *Claims,
+) (string, error) {
+	claims.StandardClaims = jwt.StandardClaims{
+		Subject:   string(claims.User),
+		Audience:  rtf.Audience,
+		Issuer:    rtf.Issuer,
+		IssuedAt:  now.Unix(),
+		ExpiresAt: now.Add(rtf.TokenValidity).Unix(),
+		NotBefore: now.Unix(),
+	}
+	return (*TokenFactory)(rtf).Sign(claims)
+}
+
+// passwordHashDigest digests a password hash for binding reset tokens to it.
+// Tokens are signed, not encrypted, so they carry the digest rather than the
+// hash itself.
+func passwordHashDigest(hash []byte) string {
+	digest := sha256.Sum256(hash)
+	return base64.RawURLEncoding.EncodeToString(digest[:])
 }
 
 func (rtf *ResetTokenFactory) Claims(token string) (*Claims, error) {
@@ -44,9 +104,7 @@ func (rtf *ResetTokenFactory) Claims(token string) (*Claims, error) {
 	if _, err := jwt.ParseWithClaims(
 		token,
 		&claims,
-		func(*jwt.Token) (interface{}, error) {
-			return &rtf.SigningKey.PublicKey, nil
-		},
+		(*TokenFactory)(rtf).VerificationKey,
 	); err != nil {
 		return nil, fmt.Errorf("parsing claims from token: %w", err)
 	}
@@ -38,55 +38,199 @@ Someone has attempted to reset your password. If this was not you, please disreg
 		TextTemplate: text.Must(text.New("").Parse(`Hello {{ .User }},
 Someone has attempted to reset your password. If this was not you, please disregard this message. If this was intentional, please enter the following URL into your web browser to reset your password: {{ .TokenURL }}`)),
 	}
+
+	DefaultLockoutSettings = NotificationSettings{
+		Subject: "Account locked",
+		HTMLTemplate: html.Must(
+			html.New("").Parse(`<p>Hello {{ .User }},<br /><br />
+
+There have been too many failed attempts to log into your account, so it has been temporarily locked. If this was you, please wait a while and try again. If this was not you, someone may be trying to guess your password, and you may want to change it.</p>`),
+		),
+		TextTemplate: text.Must(text.New("").Parse(`Hello {{ .User }},
+There have been too many failed attempts to log into your account, so it has been temporarily locked. If this was you, please wait a while and try again. If this was not you, someone may be trying to guess your password, and you may want to change it.`)),
+	}
+
+	DefaultEmailChangeSettings = NotificationSettings{
+		Subject: "Confirm email address",
+		HTMLTemplate: html.Must(
+			html.New("").Parse(`<p>Hello {{ .User }},<br /><br />
+
+Someone has asked to change the email address of your account to this one. If this was not you, please disregard this message. If this was intentional, please click this <a href="{{ .TokenURL }}">link</a> to confirm the change.</p>`),
+		),
+		TextTemplate: text.Must(text.New("").Parse(`Hello {{ .User }},
+Someone has asked to change the email address of your account to this one. If this was not you, please disregard this message. If this was intentional, please enter the following URL into your web browser to confirm the change: {{ .TokenURL }}`)),
+	}
+
+	DefaultEmailChangeNoticeSettings = NotificationSettings{
+		Subject: "Email address change requested",
+		HTMLTemplate: html.Must(
+			html.New("").Parse(`<p>Hello {{ .User }},<br /><br />
+
+Someone has asked to change the email address of your account. The change will take effect once it's confirmed from the new address. If this was not you, someone may have access to your account, and you should change your password.</p>`),
+		),
+		TextTemplate: text.Must(text.New("").Parse(`Hello {{ .User }},
+Someone has asked to change the email address of your account. The change will take effect once it's confirmed from the new address. If this was not you, someone may have access to your account, and you should change your password.`)),
+	}
+
+	DefaultMagicLinkSettings = NotificationSettings{
+		Subject: "Log in",
+		HTMLTemplate: html.Must(
+			html.New("").Parse(`<p>Hello {{ .User }},<br /><br />
+
+Someone has asked to log into your account with this email address. If this was not you, please disregard this message. If this was intentional, please click this <a href="{{ .TokenURL }}">link</a> to log in. The link can only be used once.</p>`),
+		),
+		TextTemplate: text.Must(text.New("").Parse(`Hello {{ .User }},
+Someone has asked to log into your account with this email address. If this was not you, please disregard this message. If this was intentional, please enter the following URL into your web browser to log in: {{ .TokenURL }} The link can only be used once.`)),
+	}
 )
 
-type SESNotificationService struct {
-	Client                 *ses.SES
-	Sender                 string
-	TokenURL               func(string) string
+// EmailSettings holds the email content for each notification type. The
+// notification services embed it.
+type EmailSettings struct {
 	RegistrationSettings   NotificationSettings
 	ForgotPasswordSettings NotificationSettings
+	LockoutSettings        NotificationSettings
+
+	// EmailChangeSettings confirm a new email address; the notice settings
+	// tell the old address about the change.
+	EmailChangeSettings       NotificationSettings
+	EmailChangeNoticeSettings NotificationSettings
+
+	// MagicLinkSettings carry magic login links.
+	MagicLinkSettings NotificationSettings
+
+	// Templates are localized templates. If they have none for a
+	// notification's type and locale, the settings above are used.
+	Templates *NotificationTemplates
 }
 
-func (sns *SESNotificationService) Notify(token *types.Notification) error {
+// DefaultEmailSettings uses the default settings for every notification
+// type and has no localized templates.
+var DefaultEmailSettings = EmailSettings{
+	RegistrationSettings:      DefaultRegistrationSettings,
+	ForgotPasswordSettings:    DefaultForgotPasswordSettings,
+	LockoutSettings:           DefaultLockoutSettings,
+	EmailChangeSettings:       DefaultEmailChangeSettings,
+	EmailChangeNoticeSettings: DefaultEmailChangeNoticeSettings,
+	MagicLinkSettings:         DefaultMagicLinkSettings,
+}
+
+// settingsFor returns the settings for a notification type and locale. It
+// returns an error for unknown types and for types without settings rather
+// than sending some other notification's email.
+func (es *EmailSettings) settingsFor(
+	typ types.NotificationType,
+	locale string,
+) (*NotificationSettings, error) {
+	var settings *NotificationSettings
+	switch typ {
+	case types.NotificationTypeRegister:
+		settings = &es.RegistrationSettings
+	case types.NotificationTypeForgotPassword:
+		settings = &es.ForgotPasswordSettings
+	case types.NotificationTypeLockout:
+		settings = &es.LockoutSettings
+	case types.NotificationTypeEmailChange:
+		settings = &es.EmailChangeSettings
+	case types.NotificationTypeEmailChangeNotice:
+		settings = &es.EmailChangeNoticeSettings
+	case types.NotificationTypeMagicLink:
+		settings = &es.MagicLinkSettings
+	default:
+		return nil, fmt.Errorf("unknown notification type: `%s`", typ)
+	}
+
+	if localized := es.Templates.Lookup(typ, locale); localized != nil {
+		return localized, nil
+	}
+	if settings.TextTemplate == nil || settings.HTMLTemplate == nil {
+		return nil, fmt.Errorf("no settings for notification type `%s`", typ)
+	}
+	return settings, nil
+}
+
+type SESNotificationService struct {
+	Client   *ses.SES
+	Sender   string
+	TokenURL func(*types.Notification) string
+	EmailSettings
+}
+
+// renderedNotification is a notification's email content.
+type renderedNotification struct {
+	Subject string
+	Text    string
+	HTML    string
+}
+
+// render renders the notification's text and HTML bodies from the settings.
+func (settings *NotificationSettings) render(
+	n *types.Notification,
+	tokenURL func(*types.Notification) string,
+) (*renderedNotification, error) {
 	var htmlBuf, textBuf bytes.Buffer
 	payload := struct {
 		User     types.UserID
 		Email    string
 		TokenURL string
+		Locale   string
 	}{
-		User:     token.User,
-		Email:    token.Email,
-		TokenURL: sns.TokenURL(token.Token),
+		User:     n.User,
+		Email:    n.Email,
+		TokenURL: tokenURL(n),
+		Locale:   n.Locale,
 	}
-	var settings *NotificationSettings
-	if token.Type == types.NotificationTypeRegister {
-		settings = &sns.RegistrationSettings
-	} else {
-		settings = &sns.ForgotPasswordSettings
+	if err := settings.TextTemplate.Execute(&textBuf, &payload); err != nil {
+		return nil, fmt.Errorf("rendering text template: %w", err)
+	}
+	if err := settings.HTMLTemplate.Execute(&htmlBuf, &payload); err != nil {
+		return nil, fmt.Errorf("rendering html template: %w", err)
 	}
+	return &renderedNotification{
+		Subject: settings.Subject,
+		Text:    textBuf.String(),
+		HTML:    htmlBuf.String(),
+	}, nil
+}
+
+// Render renders a notification's subject, text body and HTML body, e.g., to
+// preview the templates.
+func (settings *NotificationSettings) Render(
+	n *types.Notification,
+	tokenURL func(*types.Notification) string,
+) (subject, textBody, htmlBody string, err error) {
+	rendered, err := settings.render(n, tokenURL)
+	if err != nil {
+		return "", "", "", err
+	}
+	return rendered.Subject, rendered.Text, rendered.HTML, nil
+}
 
-	if err := settings.TextTemplate.Execute(&htmlBuf, &payload); err != nil {
-		return fmt.Errorf("rendering text template: %w", err)
+func (sns *SESNotificationService) Notify(token *types.Notification) error {
+	settings, err := sns.settingsFor(token.Type, token.Locale)
+	if err != nil {
+		return err
 	}
-	if err := settings.HTMLTemplate.Execute(&textBuf, &payload); err != nil {
-		return fmt.Errorf("rendering html template: %w", err)
+
+	rendered, err := settings.render(token, sns.TokenURL)
+	if err != nil {
+		return err
 	}
 	if _, err := sns.Client.SendEmail(&ses.SendEmailInput{
 		Destination: &ses.Destination{ToAddresses: []*string{&token.Email}},
 		Message: &ses.Message{
 			Subject: &ses.Content{
 				Charset: aws.String("UTF-8"),
-				Data:    &settings.Subject,
+				Data:    &rendered.Subject,
 			},
 			Body: &ses.Body{
 				Html: &ses.Content{
 					Charset: aws.String("UTF-8"),
-					Data:    aws.String(htmlBuf.String()),
+					Data:    &rendered.HTML,
 				},
 				Text: &ses.Content{
 					Charset: aws.String("UTF-8"),
-					Data:    aws.String(textBuf.String()),
+					Data:    &rendered.Text,
 				},
 			},
 		},
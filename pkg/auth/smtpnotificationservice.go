@@ -0,0 +1,236 @@
+package auth
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"time"
+
+	"github.com/weberc2/auth/pkg/auth/types"
+)
+
+// SMTPSecurity selects how the connection to the SMTP server is secured.
+type SMTPSecurity string
+
+const (
+	// SMTPSecuritySTARTTLS connects in plaintext and upgrades the connection
+	// with the STARTTLS command (typically on port 587). If the server doesn't
+	// support STARTTLS, no email is sent.
+	SMTPSecuritySTARTTLS SMTPSecurity = "starttls"
+
+	// SMTPSecurityTLS connects with TLS from the start (typically on port
+	// 465).
+	SMTPSecurityTLS SMTPSecurity = "tls"
+
+	// SMTPSecurityNone doesn't secure the connection. It's only appropriate
+	// for relays on the local host or network.
+	SMTPSecurityNone SMTPSecurity = "none"
+)
+
+// SMTPNotificationService sends notification emails through an SMTP server.
+type SMTPNotificationService struct {
+	// Addr is the SMTP server's `host:port`.
+	Addr string
+
+	// Security selects how the connection is secured. If it's empty,
+	// `SMTPSecuritySTARTTLS` is used.
+	Security SMTPSecurity
+
+	// TLSConfig configures TLS. If it's `nil`, the server's certificate is
+	// verified against the system roots and the host from `Addr`.
+	TLSConfig *tls.Config
+
+	// Username and Password authenticate with the server (via `AUTH PLAIN`).
+	// If `Username` is empty, no authentication is attempted.
+	Username string
+	Password string
+
+	Sender   string
+	TokenURL func(*types.Notification) string
+	EmailSettings
+
+	// Timeout bounds the whole exchange with the server. If it's zero, a
+	// minute is used.
+	Timeout time.Duration
+}
+
+func (sns *SMTPNotificationService) Notify(n *types.Notification) error {
+	settings, err := sns.settingsFor(n.Type, n.Locale)
+	if err != nil {
+		return err
+	}
+
+	rendered, err := settings.render(n, sns.TokenURL)
+	if err != nil {
+		return err
+	}
+
+	// Parsing the addresses also guards against header injection.
+	from, err := mail.ParseAddress(sns.Sender)
+	if err != nil {
+		return fmt.Errorf("parsing sender address: %w", err)
+	}
+	to, err := mail.ParseAddress(n.Email)
+	if err != nil {
+		return fmt.Errorf("parsing recipient address: %w", err)
+	}
+
+	message, err := smtpMessage(from, to, rendered, time.Now())
+	if err != nil {
+		return fmt.Errorf("building email: %w", err)
+	}
+	if err := sns.send(from.Address, to.Address, message); err != nil {
+		return fmt.Errorf("sending email via SMTP: %w", err)
+	}
+	return nil
+}
+
+func (sns *SMTPNotificationService) send(
+	from string,
+	to string,
+	message []byte,
+) error {
+	host, _, err := net.SplitHostPort(sns.Addr)
+	if err != nil {
+		return fmt.Errorf("parsing address: %w", err)
+	}
+	tlsConfig := sns.TLSConfig
+	if tlsConfig == nil {
+		tlsConfig = &tls.Config{ServerName: host}
+	}
+	timeout := sns.Timeout
+	if timeout == 0 {
+		timeout = time.Minute
+	}
+
+	dialer := net.Dialer{Timeout: timeout}
+	var conn net.Conn
+	switch sns.Security {
+	case SMTPSecurityTLS:
+		conn, err = tls.DialWithDialer(&dialer, "tcp", sns.Addr, tlsConfig)
+	case SMTPSecuritySTARTTLS, SMTPSecurityNone, "":
+		conn, err = dialer.Dial("tcp", sns.Addr)
+	default:
+		return fmt.Errorf("unsupported security: `%s`", sns.Security)
+	}
+	if err != nil {
+		return fmt.Errorf("connecting: %w", err)
+	}
+	if err := conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		conn.Close()
+		return fmt.Errorf("setting deadline: %w", err)
+	}
+
+	client, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return fmt.Errorf("greeting: %w", err)
+	}
+	defer client.Close()
+
+	if sns.Security == SMTPSecuritySTARTTLS || sns.Security == "" {
+		if ok, _ := client.Extension("STARTTLS"); !ok {
+			return fmt.Errorf("server doesn't support STARTTLS")
+		}
+		if err := client.StartTLS(tlsConfig); err != nil {
+			return fmt.Errorf("starting TLS: %w", err)
+		}
+	}
+
+	if sns.Username != "" {
+		if err := client.Auth(smtp.PlainAuth(
+			"",
+			sns.Username,
+			sns.Password,
+			host,
+		)); err != nil {
+			return fmt.Errorf("authenticating: %w", err)
+		}
+	}
+
+	if err := client.Mail(from); err != nil {
+		return fmt.Errorf("setting sender: %w", err)
+	}
+	if err := client.Rcpt(to); err != nil {
+		return fmt.Errorf("setting recipient: %w", err)
+	}
+	w, err := client.Data()
+	if err != nil {
+		return fmt.Errorf("starting data: %w", err)
+	}
+	if _, err := w.Write(message); err != nil {
+		return fmt.Errorf("writing data: %w", err)
+	}
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("finishing data: %w", err)
+	}
+	return client.Quit()
+}
+
+// smtpMessage builds a `multipart/alternative` MIME message with text and
+// HTML parts. Clients display the last part that they support, so the HTML
+// part comes last.
+func smtpMessage(
+	from *mail.Address,
+	to *mail.Address,
+	rendered *renderedNotification,
+	now time.Time,
+) ([]byte, error) {
+	var body bytes.Buffer
+	parts := multipart.NewWriter(&body)
+	for _, part := range []struct {
+		contentType string
+		content     string
+	}{
+		{"text/plain; charset=utf-8", rendered.Text},
+		{"text/html; charset=utf-8", rendered.HTML},
+	} {
+		w, err := parts.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {part.contentType},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		if err != nil {
+			return nil, err
+		}
+		qp := quotedprintable.NewWriter(w)
+		if _, err := qp.Write([]byte(part.content)); err != nil {
+			return nil, err
+		}
+		if err := qp.Close(); err != nil {
+			return nil, err
+		}
+	}
+	if err := parts.Close(); err != nil {
+		return nil, err
+	}
+
+	var message bytes.Buffer
+	for _, header := range [][2]string{
+		{"From", from.String()},
+		{"To", to.String()},
+		{"Subject", mime.QEncoding.Encode("utf-8", rendered.Subject)},
+		{"Date", now.Format(time.RFC1123Z)},
+		{"MIME-Version", "1.0"},
+		{
+			"Content-Type",
+			mime.FormatMediaType(
+				"multipart/alternative",
+				map[string]string{"boundary": parts.Boundary()},
+			),
+		},
+	} {
+		fmt.Fprintf(&message, "%s: %s\r\n", header[0], header[1])
+	}
+	message.WriteString("\r\n")
+	message.Write(body.Bytes())
+	return message.Bytes(), nil
+}
+
+var _ types.NotificationService = &SMTPNotificationService{}
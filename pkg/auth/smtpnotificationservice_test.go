@@ -0,0 +1,298 @@
+package auth
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io/ioutil"
+	"math/big"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/weberc2/auth/pkg/auth/testsupport"
+	"github.com/weberc2/auth/pkg/auth/types"
+)
+
+func TestSMTPNotificationService(t *testing.T) {
+	serverTLS, clientTLS := testTLSConfigs(t)
+
+	for _, testCase := range []struct {
+		name        string
+		server      *testsupport.SMTPServerFake
+		security    SMTPSecurity
+		username    string
+		wantedTLS   bool
+		wantedError string
+	}{
+		{
+			name: "starttls",
+			server: &testsupport.SMTPServerFake{
+				TLSConfig: serverTLS,
+				Username:  "adam",
+				Password:  "password",
+			},
+			security:  SMTPSecuritySTARTTLS,
+			username:  "adam",
+			wantedTLS: true,
+		},
+		{
+			name: "implicit tls",
+			server: &testsupport.SMTPServerFake{
+				TLSConfig:   serverTLS,
+				ImplicitTLS: true,
+				Username:    "adam",
+				Password:    "password",
+			},
+			security:  SMTPSecurityTLS,
+			username:  "adam",
+			wantedTLS: true,
+		},
+		{
+			name:     "none",
+			server:   &testsupport.SMTPServerFake{},
+			security: SMTPSecurityNone,
+		},
+		{
+			name:        "starttls unsupported",
+			server:      &testsupport.SMTPServerFake{},
+			security:    SMTPSecuritySTARTTLS,
+			wantedError: "server doesn't support STARTTLS",
+		},
+		{
+			name: "bad credentials",
+			server: &testsupport.SMTPServerFake{
+				TLSConfig: serverTLS,
+				Username:  "adam",
+				Password:  "wrong",
+			},
+			security:    SMTPSecuritySTARTTLS,
+			username:    "adam",
+			wantedError: "authenticating",
+		},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			server := testCase.server
+			if err := server.Start(); err != nil {
+				t.Fatal(err)
+			}
+			defer server.Close()
+
+			err := (&SMTPNotificationService{
+				Addr:      server.Addr(),
+				Security:  testCase.security,
+				TLSConfig: clientTLS,
+				Username:  testCase.username,
+				Password:  "password",
+				Sender:    "Auth <auth@example.org>",
+				TokenURL: func(n *types.Notification) string {
+					return n.Token
+				},
+				EmailSettings: DefaultEmailSettings,
+				Timeout:       5 * time.Second,
+			}).Notify(&types.Notification{
+				Type:  types.NotificationTypeForgotPassword,
+				User:  "adam",
+				Email: "adam@example.org",
+				Token: "https://example.org/confirm?t=token",
+			})
+			if testCase.wantedError != "" {
+				if err == nil ||
+					!strings.Contains(err.Error(), testCase.wantedError) {
+					t.Fatalf(
+						"wanted error containing `%s`; found `%v`",
+						testCase.wantedError,
+						err,
+					)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Notify(): unexpected err: %v", err)
+			}
+
+			messages := server.Messages()
+			if len(messages) != 1 {
+				t.Fatalf("wanted 1 message; found %d", len(messages))
+			}
+			message := messages[0]
+			if message.TLS != testCase.wantedTLS {
+				t.Fatalf(
+					"SMTPMessage.TLS: wanted `%t`; found `%t`",
+					testCase.wantedTLS,
+					message.TLS,
+				)
+			}
+			if message.User != testCase.username {
+				t.Fatalf(
+					"SMTPMessage.User: wanted `%s`; found `%s`",
+					testCase.username,
+					message.User,
+				)
+			}
+			if message.From != "auth@example.org" {
+				t.Fatalf(
+					"SMTPMessage.From: wanted `auth@example.org`; found `%s`",
+					message.From,
+				)
+			}
+			if len(message.To) != 1 || message.To[0] != "adam@example.org" {
+				t.Fatalf(
+					"SMTPMessage.To: wanted `[adam@example.org]`; found `%v`",
+					message.To,
+				)
+			}
+			checkSMTPMessage(t, message.Data)
+		})
+	}
+}
+
+func TestSMTPNotificationService_HeaderInjection(t *testing.T) {
+	server := &testsupport.SMTPServerFake{}
+	if err := server.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	if err := (&SMTPNotificationService{
+		Addr:     server.Addr(),
+		Security: SMTPSecurityNone,
+		Sender:   "auth@example.org",
+		TokenURL: func(n *types.Notification) string {
+			return n.Token
+		},
+		EmailSettings: DefaultEmailSettings,
+	}).Notify(&types.Notification{
+		Type:  types.NotificationTypeForgotPassword,
+		User:  "adam",
+		Email: "adam@example.org\r\nBcc: eve@example.org",
+	}); err == nil {
+		t.Fatal("Notify(): wanted error; found `nil`")
+	}
+	if messages := server.Messages(); len(messages) != 0 {
+		t.Fatalf("wanted no messages; found %d", len(messages))
+	}
+}
+
+// checkSMTPMessage checks that the message is `multipart/alternative` with
+// the rendered forgot-password text and HTML parts.
+func checkSMTPMessage(t *testing.T, data []byte) {
+	t.Helper()
+	message, err := mail.ReadMessage(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("parsing message: %v", err)
+	}
+	if found := message.Header.Get("Subject"); found != "Forgot password" {
+		t.Fatalf("Subject: wanted `Forgot password`; found `%s`", found)
+	}
+	if found := message.Header.Get("To"); found != "<adam@example.org>" {
+		t.Fatalf("To: wanted `<adam@example.org>`; found `%s`", found)
+	}
+	mediaType, params, err := mime.ParseMediaType(
+		message.Header.Get("Content-Type"),
+	)
+	if err != nil {
+		t.Fatalf("parsing Content-Type: %v", err)
+	}
+	if mediaType != "multipart/alternative" {
+		t.Fatalf(
+			"Content-Type: wanted `multipart/alternative`; found `%s`",
+			mediaType,
+		)
+	}
+
+	reader := multipart.NewReader(message.Body, params["boundary"])
+	for _, wanted := range []struct {
+		contentType string
+		content     string
+	}{
+		{
+			contentType: "text/plain; charset=utf-8",
+			content: "into your web browser to reset your password: " +
+				"https://example.org/confirm?t=token",
+		},
+		{
+			contentType: "text/html; charset=utf-8",
+			content: `please click this <a href=` +
+				`"https://example.org/confirm?t=token">link</a>`,
+		},
+	} {
+		part, err := reader.NextPart()
+		if err != nil {
+			t.Fatalf("reading `%s` part: %v", wanted.contentType, err)
+		}
+		if found := part.Header.Get("Content-Type"); found !=
+			wanted.contentType {
+			t.Fatalf(
+				"Content-Type: wanted `%s`; found `%s`",
+				wanted.contentType,
+				found,
+			)
+		}
+		content, err := ioutil.ReadAll(quotedprintable.NewReader(part))
+		if err != nil {
+			t.Fatalf("decoding `%s` part: %v", wanted.contentType, err)
+		}
+		if !strings.Contains(string(content), wanted.content) {
+			t.Fatalf(
+				"`%s` part: wanted `%s`; found `%s`",
+				wanted.contentType,
+				wanted.content,
+				content,
+			)
+		}
+	}
+}
+
+// testTLSConfigs returns TLS configs for a server on 127.0.0.1 with a
+// self-signed certificate and for a client which trusts it.
+func testTLSConfigs(t *testing.T) (*tls.Config, *tls.Config) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generating key: %v", err)
+	}
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "127.0.0.1"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(
+		rand.Reader,
+		&template,
+		&template,
+		&key.PublicKey,
+		key,
+	)
+	if err != nil {
+		t.Fatalf("creating certificate: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("parsing certificate: %v", err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(cert)
+	return &tls.Config{
+		Certificates: []tls.Certificate{{
+			Certificate: [][]byte{der},
+			PrivateKey:  key,
+		}},
+	}, &tls.Config{
+		RootCAs:    roots,
+		ServerName: "127.0.0.1",
+	}
+}
@@ -0,0 +1,33 @@
+package testsupport
+
+import (
+	"time"
+
+	"github.com/weberc2/auth/pkg/auth/types"
+)
+
+type CodeStoreFake map[string]types.RedeemedCode
+
+func (csf CodeStoreFake) Redeem(code *types.RedeemedCode) error {
+	if _, found := csf[code.ID]; found {
+		return types.ErrCodeRedeemed
+	}
+	csf[code.ID] = *code
+	return nil
+}
+
+func (csf CodeStoreFake) Get(id string) (*types.RedeemedCode, error) {
+	if code, found := csf[id]; found {
+		return &code, nil
+	}
+	return nil, types.ErrCodeNotFound
+}
+
+func (csf CodeStoreFake) DeleteExpired(now time.Time) error {
+	for id, code := range csf {
+		if code.Expires.Before(now) {
+			delete(csf, id)
+		}
+	}
+	return nil
+}
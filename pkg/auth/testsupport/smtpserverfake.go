@@ -0,0 +1,199 @@
+package testsupport
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/textproto"
+	"strings"
+	"sync"
+)
+
+// SMTPMessage is a message received by `SMTPServerFake`.
+type SMTPMessage struct {
+	From string
+	To   []string
+	Data []byte
+
+	// TLS reports whether the message was sent over TLS.
+	TLS bool
+
+	// User is the authenticated user, if any.
+	User string
+}
+
+// SMTPServerFake is an in-process SMTP server which records the messages it
+// receives. It supports just enough of SMTP for `net/smtp` clients.
+type SMTPServerFake struct {
+	// TLSConfig enables TLS: STARTTLS by default, or TLS from the start if
+	// `ImplicitTLS` is set.
+	TLSConfig   *tls.Config
+	ImplicitTLS bool
+
+	// Username and Password enable `AUTH PLAIN`, which is then required
+	// before sending mail.
+	Username string
+	Password string
+
+	lock     sync.Mutex
+	listener net.Listener
+	messages []SMTPMessage
+}
+
+// Start listens on a random local port and serves in the background.
+func (server *SMTPServerFake) Start() error {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return fmt.Errorf("starting SMTP server: %w", err)
+	}
+	if server.ImplicitTLS {
+		listener = tls.NewListener(listener, server.TLSConfig)
+	}
+	server.listener = listener
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go server.serve(conn)
+		}
+	}()
+	return nil
+}
+
+// Addr returns the server's `host:port`.
+func (server *SMTPServerFake) Addr() string {
+	return server.listener.Addr().String()
+}
+
+// Close stops listening.
+func (server *SMTPServerFake) Close() error {
+	return server.listener.Close()
+}
+
+// Messages returns the messages received so far.
+func (server *SMTPServerFake) Messages() []SMTPMessage {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+	return append([]SMTPMessage(nil), server.messages...)
+}
+
+func (server *SMTPServerFake) serve(conn net.Conn) {
+	defer conn.Close()
+	session := SMTPMessage{TLS: server.ImplicitTLS}
+	text := textproto.NewConn(conn)
+	reply := func(format string, args ...interface{}) bool {
+		return text.PrintfLine(format, args...) == nil
+	}
+
+	if !reply("220 localhost ESMTP") {
+		return
+	}
+	for {
+		line, err := text.ReadLine()
+		if err != nil {
+			return
+		}
+		verb, arg := line, ""
+		if i := strings.IndexByte(line, ' '); i >= 0 {
+			verb, arg = line[:i], line[i+1:]
+		}
+
+		switch strings.ToUpper(verb) {
+		case "EHLO", "HELO":
+			extensions := []string{"localhost"}
+			if server.TLSConfig != nil && !session.TLS {
+				extensions = append(extensions, "STARTTLS")
+			}
+			if server.Username != "" {
+				extensions = append(extensions, "AUTH PLAIN")
+			}
+			for i, extension := range extensions {
+				separator := "-"
+				if i == len(extensions)-1 {
+					separator = " "
+				}
+				if !reply("250%s%s", separator, extension) {
+					return
+				}
+			}
+		case "STARTTLS":
+			if server.TLSConfig == nil || session.TLS {
+				reply("502 STARTTLS not available")
+				continue
+			}
+			if !reply("220 ready to start TLS") {
+				return
+			}
+			tlsConn := tls.Server(conn, server.TLSConfig)
+			if err := tlsConn.Handshake(); err != nil {
+				return
+			}
+			conn, text = tlsConn, textproto.NewConn(tlsConn)
+			session = SMTPMessage{TLS: true}
+		case "AUTH":
+			fields := strings.Fields(arg)
+			if len(fields) != 2 || strings.ToUpper(fields[0]) != "PLAIN" {
+				reply("504 unsupported authentication mechanism")
+				continue
+			}
+			decoded, err := base64.StdEncoding.DecodeString(fields[1])
+			if err != nil {
+				reply("501 malformed credentials")
+				continue
+			}
+			parts := bytes.Split(decoded, []byte{0})
+			if len(parts) != 3 ||
+				string(parts[1]) != server.Username ||
+				string(parts[2]) != server.Password {
+				reply("535 authentication failed")
+				continue
+			}
+			session.User = server.Username
+			reply("235 authenticated")
+		case "MAIL":
+			if server.Username != "" && session.User == "" {
+				reply("530 authentication required")
+				continue
+			}
+			session.From = angleAddr(arg)
+			reply("250 OK")
+		case "RCPT":
+			session.To = append(session.To, angleAddr(arg))
+			reply("250 OK")
+		case "DATA":
+			if !reply("354 end data with <CR><LF>.<CR><LF>") {
+				return
+			}
+			data, err := text.ReadDotBytes()
+			if err != nil {
+				return
+			}
+			session.Data = data
+			server.lock.Lock()
+			server.messages = append(server.messages, session)
+			server.lock.Unlock()
+			session = SMTPMessage{TLS: session.TLS, User: session.User}
+			reply("250 OK")
+		case "RSET", "NOOP":
+			reply("250 OK")
+		case "QUIT":
+			reply("221 bye")
+			return
+		default:
+			reply("502 command not implemented")
+		}
+	}
+}
+
+// angleAddr extracts the address from `FROM:<address>` or `TO:<address>`.
+func angleAddr(arg string) string {
+	start, end := strings.IndexByte(arg, '<'), strings.IndexByte(arg, '>')
+	if start < 0 || end < start {
+		return ""
+	}
+	return arg[start+1 : end]
+}
@@ -1,18 +1,36 @@
 package testsupport
 
 import (
+	"sort"
 	"time"
 
 	"github.com/weberc2/auth/pkg/auth/types"
 )
 
-type TokenStoreFake map[string]time.Time
+// TokenStoreFake is an in-memory `types.TokenStore`.
+type TokenStoreFake map[string]TokenStoreEntry
 
-func (tsf TokenStoreFake) Put(token string, expires time.Time) error {
+// TokenStoreEntry is a token and the session (i.e., the family) it belongs
+// to.
+type TokenStoreEntry struct {
+	Token   string
+	Expires time.Time
+	Session types.Session
+}
+
+func (tsf TokenStoreFake) Put(
+	token string,
+	session *types.Session,
+	expires time.Time,
+) error {
 	if _, found := tsf[token]; found {
 		return types.ErrTokenExists
 	}
-	tsf[token] = expires
+	tsf[token] = TokenStoreEntry{
+		Token:   token,
+		Expires: expires,
+		Session: *session,
+	}
 	return nil
 }
 
@@ -31,9 +49,50 @@ func (tsf TokenStoreFake) Delete(token string) error {
 	return types.ErrTokenNotFound
 }
 
+func (tsf TokenStoreFake) DeleteFamily(family string) error {
+	for token, entry := range tsf {
+		if entry.Session.ID == family {
+			delete(tsf, token)
+		}
+	}
+	return nil
+}
+
+func (tsf TokenStoreFake) GetSession(family string) (*types.Session, error) {
+	for _, entry := range tsf {
+		if entry.Session.ID == family {
+			session := entry.Session
+			return &session, nil
+		}
+	}
+	return nil, types.ErrSessionNotFound
+}
+
+func (tsf TokenStoreFake) ListSessions(
+	subject string,
+) ([]types.Session, error) {
+	out := []types.Session{}
+	for _, entry := range tsf {
+		if entry.Session.Subject == subject {
+			out = append(out, entry.Session)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].ID < out[j].ID })
+	return out, nil
+}
+
+func (tsf TokenStoreFake) DeleteSessions(subject string) error {
+	for token, entry := range tsf {
+		if entry.Session.Subject == subject {
+			delete(tsf, token)
+		}
+	}
+	return nil
+}
+
 func (tsf TokenStoreFake) DeleteExpired(now time.Time) error {
-	for token, expires := range tsf {
-		if expires.Before(now) {
+	for token, entry := range tsf {
+		if entry.Expires.Before(now) {
 			delete(tsf, token)
 		}
 	}
@@ -42,8 +101,12 @@ func (tsf TokenStoreFake) DeleteExpired(now time.Time) error {
 
 func (tsf TokenStoreFake) List() ([]types.Token, error) {
 	out := make([]types.Token, 0, len(tsf))
-	for token, expires := range tsf {
-		out = append(out, types.Token{Token: token, Expires: expires})
+	for _, entry := range tsf {
+		out = append(out, types.Token{
+			Token:   entry.Token,
+			Family:  entry.Session.ID,
+			Expires: entry.Expires,
+		})
 	}
 	return out, nil
 }
@@ -11,6 +11,15 @@ func (usf UserStoreFake) Get(u types.UserID) (*types.UserEntry, error) {
 	return nil, types.ErrUserNotFound
 }
 
+func (usf UserStoreFake) GetByEmail(email string) (*types.UserEntry, error) {
+	for _, entry := range usf {
+		if entry.Email == email {
+			return entry, nil
+		}
+	}
+	return nil, types.ErrUserNotFound
+}
+
 func (usf UserStoreFake) Insert(entry *types.UserEntry) error {
 	usf[entry.User] = entry
 	return nil
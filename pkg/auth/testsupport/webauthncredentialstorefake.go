@@ -0,0 +1,47 @@
+package testsupport
+
+import (
+	"sort"
+
+	"github.com/weberc2/auth/pkg/auth/types"
+)
+
+type WebAuthnCredentialStoreFake map[types.UserID][]types.WebAuthnCredential
+
+func (wcsf WebAuthnCredentialStoreFake) Insert(
+	credential *types.WebAuthnCredential,
+) error {
+	for _, c := range wcsf[credential.User] {
+		if c.ID == credential.ID {
+			return types.ErrWebAuthnCredentialExists
+		}
+	}
+	wcsf[credential.User] = append(wcsf[credential.User], *credential)
+	return nil
+}
+
+func (wcsf WebAuthnCredentialStoreFake) Update(
+	credential *types.WebAuthnCredential,
+) error {
+	credentials := wcsf[credential.User]
+	for i := range credentials {
+		if credentials[i].ID == credential.ID {
+			credentials[i] = *credential
+			return nil
+		}
+	}
+	return types.ErrWebAuthnCredentialNotFound
+}
+
+func (wcsf WebAuthnCredentialStoreFake) List(
+	user types.UserID,
+) ([]types.WebAuthnCredential, error) {
+	credentials := append(
+		[]types.WebAuthnCredential{},
+		wcsf[user]...,
+	)
+	sort.Slice(credentials, func(i, j int) bool {
+		return credentials[i].ID < credentials[j].ID
+	})
+	return credentials, nil
+}
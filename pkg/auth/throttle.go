@@ -0,0 +1,338 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/weberc2/auth/pkg/auth/types"
+	pz "github.com/weberc2/httpeasy"
+)
+
+// throttledMessage is shown on login forms when the login is throttled.
+const throttledMessage = "Too many failed login attempts. Please try again " +
+	"later."
+
+// ThrottledError is returned when a login is attempted too soon after
+// previous failures for the same user or client IP address, or while the
+// user is locked out.
+type ThrottledError struct {
+	RetryAfter time.Duration
+}
+
+func (err *ThrottledError) Error() string {
+	return fmt.Sprintf(
+		"too many failed login attempts; retry after %s",
+		err.RetryAfter,
+	)
+}
+
+// HTTPError implements `pz.Error` so that `pz.HandleError()` responds with
+// `429 Too Many Requests`.
+func (err *ThrottledError) HTTPError() *pz.HTTPError {
+	return &pz.HTTPError{
+		Status:  http.StatusTooManyRequests,
+		Message: "too many failed login attempts",
+	}
+}
+
+func (err *ThrottledError) retryAfter() time.Duration { return err.RetryAfter }
+
+// retryAfterError is implemented by the errors for throttled requests.
+type retryAfterError interface {
+	error
+	retryAfter() time.Duration
+}
+
+// retryAfter sets the `Retry-After` header on the response if the request was
+// throttled.
+func retryAfter(rsp pz.Response, err error) pz.Response {
+	var throttled retryAfterError
+	if !errors.As(err, &throttled) {
+		return rsp
+	}
+	if rsp.Headers == nil {
+		rsp.Headers = http.Header{}
+	}
+	// Round up so that clients which wait as long as they're told don't get
+	// throttled again.
+	seconds := (throttled.retryAfter() + time.Second - 1) / time.Second
+	rsp.Headers.Set("Retry-After", strconv.FormatInt(int64(seconds), 10))
+	return rsp
+}
+
+// LoginThrottle slows down password guessing. Failed logins are counted per
+// user and per client IP address; once a key has more than `FreeAttempts`
+// failures, each further attempt must wait `BaseDelay`, doubling with every
+// failure up to `MaxDelay`. Throttled attempts are rejected before the
+// password is checked, so they don't cost a bcrypt comparison.
+//
+// If `LockoutThreshold` is set, a user is also locked out for
+// `LockoutDuration` after that many failures and notified via the auth
+// service's `Notifications`. The zero value doesn't throttle anything.
+type LoginThrottle struct {
+	Attempts         types.LoginAttemptStore
+	FreeAttempts     int
+	BaseDelay        time.Duration
+	MaxDelay         time.Duration
+	LockoutThreshold int
+	LockoutDuration  time.Duration
+
+	// Window is how long failures are remembered: if a login fails more than
+	// `Window` after the previous failure, the count starts over.
+	Window time.Duration
+}
+
+func throttleUserKey(user types.UserID) string {
+	return "user:" + string(user)
+}
+
+// throttleKeys returns the keys to throttle a login on: the user and, if
+// it's known, the client IP address.
+func throttleKeys(user types.UserID, client *types.ClientInfo) []string {
+	keys := []string{throttleUserKey(user)}
+	if client != nil && client.IP != "" {
+		keys = append(keys, "ip:"+client.IP)
+	}
+	return keys
+}
+
+// delay returns how long after the last failure the next attempt must wait.
+func (lt *LoginThrottle) delay(failures int) time.Duration {
+	excess := failures - lt.FreeAttempts
+	if excess < 1 {
+		return 0
+	}
+	delay := lt.BaseDelay
+	for i := 1; i < excess && delay < lt.MaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > lt.MaxDelay {
+		delay = lt.MaxDelay
+	}
+	return delay
+}
+
+// check returns a `*ThrottledError` if any of the keys is throttled or
+// locked out at `now`. Otherwise, it returns the keys' failure counts so that
+// `reserve` can tell whether other attempts raced this one.
+func (lt *LoginThrottle) check(
+	keys []string,
+	now time.Time,
+) (map[string]int, error) {
+	failures := map[string]int{}
+	var retryAfter time.Duration
+	for _, key := range keys {
+		attempts, err := lt.Attempts.Get(key)
+		if err != nil {
+			if errors.Is(err, types.ErrLoginAttemptsNotFound) {
+				continue
+			}
+			return nil, fmt.Errorf("fetching login attempts: %w", err)
+		}
+		if now.Sub(attempts.LastFailure) <= lt.Window {
+			failures[key] = attempts.Failures
+		}
+
+		allowed := attempts.LastFailure.Add(lt.delay(attempts.Failures))
+		if attempts.LockedUntil.After(allowed) {
+			allowed = attempts.LockedUntil
+		}
+		if wait := allowed.Sub(now); wait > retryAfter {
+			retryAfter = wait
+		}
+	}
+
+	if retryAfter > 0 {
+		log.Printf("login throttled for keys %v: %s", keys, retryAfter)
+		return nil, &ThrottledError{RetryAfter: retryAfter}
+	}
+	return failures, nil
+}
+
+// reserve records an attempt as a failure for each of the keys before the
+// attempt is made, so that concurrent attempts which all passed `check` can't
+// all proceed. Beyond the free attempts, only the first reservation after the
+// failures seen by `check` may proceed; the others are rejected with a
+// `*ThrottledError`, and their reservations stand. The attempts as of the
+// reservation are returned.
+func (lt *LoginThrottle) reserve(
+	keys []string,
+	failures map[string]int,
+	now time.Time,
+) (map[string]*types.LoginAttempts, error) {
+	reserved := map[string]*types.LoginAttempts{}
+	var retryAfter time.Duration
+	for _, key := range keys {
+		attempts, err := lt.Attempts.Fail(key, now, lt.Window)
+		if err != nil {
+			return nil, fmt.Errorf("reserving login attempt: %w", err)
+		}
+		reserved[key] = attempts
+
+		if attempts.Failures > lt.FreeAttempts &&
+			attempts.Failures > failures[key]+1 {
+			if wait := lt.delay(attempts.Failures - 1); wait > retryAfter {
+				retryAfter = wait
+			}
+		}
+	}
+
+	if retryAfter > 0 {
+		log.Printf("concurrent logins throttled for keys %v", keys)
+		return nil, &ThrottledError{RetryAfter: retryAfter}
+	}
+	return reserved, nil
+}
+
+// refund takes back the reservations of an attempt which didn't fail. The
+// keys' last failure times aren't restored, so a key which is already being
+// delayed waits from the refunded attempt.
+func (lt *LoginThrottle) refund(keys []string) error {
+	for _, key := range keys {
+		if err := lt.Attempts.Refund(key); err != nil {
+			return fmt.Errorf("refunding login attempt: %w", err)
+		}
+	}
+	return nil
+}
+
+// lockOut locks the user out if the failed attempt reached the lockout
+// threshold and reports whether it did. Only users are locked out; locking
+// out an IP address would lock out everyone behind the same NAT.
+func (lt *LoginThrottle) lockOut(
+	user types.UserID,
+	reserved map[string]*types.LoginAttempts,
+	now time.Time,
+) (bool, error) {
+	key := throttleUserKey(user)
+	attempts := reserved[key]
+	if lt.LockoutThreshold < 1 || attempts == nil ||
+		attempts.Failures < lt.LockoutThreshold {
+		return false, nil
+	}
+	if err := lt.Attempts.Lock(
+		key,
+		now.Add(lt.LockoutDuration),
+	); err != nil {
+		return false, fmt.Errorf("locking out user: %w", err)
+	}
+	return true, nil
+}
+
+// succeed forgets the user's failures after a successful login. Failures for
+// the client IP address aren't forgotten so that an attacker can't reset
+// their throttle by logging into their own account.
+func (lt *LoginThrottle) succeed(user types.UserID) error {
+	if lt.Attempts == nil {
+		return nil
+	}
+	if err := lt.Attempts.Reset(throttleUserKey(user)); err != nil {
+		return fmt.Errorf("resetting login attempts: %w", err)
+	}
+	return nil
+}
+
+// throttled runs a login step which may fail with `failure` (e.g., a wrong
+// password or two-factor code) under the login throttle. The attempt is
+// reserved before the step runs and refunded unless it fails.
+func (as *AuthService) throttled(
+	user types.UserID,
+	client *types.ClientInfo,
+	failure error,
+	step func() error,
+) error {
+	if as.Throttle.Attempts == nil {
+		return step()
+	}
+
+	keys := throttleKeys(user, client)
+	now := as.TimeFunc()
+	failures, err := as.Throttle.check(keys, now)
+	if err != nil {
+		return err
+	}
+	reserved, err := as.Throttle.reserve(keys, failures, now)
+	if err != nil {
+		return err
+	}
+
+	err = step()
+	if !errors.Is(err, failure) {
+		if rerr := as.Throttle.refund(keys); rerr != nil {
+			return rerr
+		}
+		return err
+	}
+
+	locked, lerr := as.Throttle.lockOut(user, reserved, now)
+	if lerr != nil {
+		return lerr
+	}
+	if locked {
+		as.notifyLockout(user)
+	}
+	return err
+}
+
+// notifyLockout tells a user that their account was locked out. Failures are
+// only logged: the login has already failed, and responding differently
+// would reveal whether the user exists.
+func (as *AuthService) notifyLockout(user types.UserID) {
+	log.Printf(
+		"user `%s` locked out for %s",
+		user,
+		as.Throttle.LockoutDuration,
+	)
+	if as.Notifications == nil {
+		return
+	}
+
+	entry, err := as.Creds.Users.Get(user)
+	if err != nil {
+		if !errors.Is(err, types.ErrUserNotFound) {
+			log.Printf("fetching locked-out user `%s`: %v", user, err)
+		}
+		return
+	}
+	if err := as.Notifications.Notify(&types.Notification{
+		Type:   types.NotificationTypeLockout,
+		User:   user,
+		Email:  entry.Email,
+		Locale: entry.Locale,
+	}); err != nil {
+		log.Printf("notifying user `%s` of lockout: %v", user, err)
+	}
+}
+
+// checkCredentials validates the credentials under the login throttle. The
+// user's failures are forgotten once the login succeeds, which isn't until
+// the second factor is checked if the user has enabled it. `c.User` may be a
+// user ID or an email address; callers should use the returned entry's ID.
+func (as *AuthService) checkCredentials(
+	c *types.Credentials,
+	client *types.ClientInfo,
+) (*types.UserEntry, error) {
+	// Throttle by user ID so that alternating between the ID and the email
+	// address doesn't earn extra attempts.
+	user := as.Creds.userID(c.User)
+
+	var entry *types.UserEntry
+	if err := as.throttled(user, client, ErrCredentials, func() error {
+		var err error
+		entry, err = as.Creds.check(c)
+		return err
+	}); err != nil {
+		return nil, err
+	}
+
+	if !entry.TOTPEnabled {
+		if err := as.Throttle.succeed(entry.User); err != nil {
+			return nil, err
+		}
+	}
+	return entry, nil
+}
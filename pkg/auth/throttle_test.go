@@ -0,0 +1,271 @@
+package auth
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/weberc2/auth/pkg/auth/testsupport"
+	"github.com/weberc2/auth/pkg/auth/types"
+	pz "github.com/weberc2/httpeasy"
+)
+
+func TestLoginThrottle_delay(t *testing.T) {
+	throttle := LoginThrottle{
+		FreeAttempts: 3,
+		BaseDelay:    time.Second,
+		MaxDelay:     time.Minute,
+	}
+	for _, testCase := range []struct {
+		failures int
+		wanted   time.Duration
+	}{
+		{failures: 0, wanted: 0},
+		{failures: 3, wanted: 0},
+		{failures: 4, wanted: time.Second},
+		{failures: 5, wanted: 2 * time.Second},
+		{failures: 9, wanted: 32 * time.Second},
+		{failures: 10, wanted: time.Minute},
+		{failures: 1000, wanted: time.Minute},
+	} {
+		found := throttle.delay(testCase.failures)
+		if found != testCase.wanted {
+			t.Fatalf(
+				"delay(%d): wanted `%s`; found `%s`",
+				testCase.failures,
+				testCase.wanted,
+				found,
+			)
+		}
+	}
+}
+
+func TestAuthService_LoginThrottle(t *testing.T) {
+	current := now
+	notifications := testsupport.NotificationServiceFake{}
+	attempts := MemLoginAttemptStore{}
+	authService := AuthService{
+		Creds: CredStore{Users: testsupport.UserStoreFake{
+			"user": {
+				User:         "user",
+				Email:        "user@example.org",
+				PasswordHash: hashBcrypt("password"),
+			},
+		}},
+		Tokens:        testsupport.TokenStoreFake{},
+		Notifications: &notifications,
+		Throttle: LoginThrottle{
+			Attempts:         &attempts,
+			FreeAttempts:     2,
+			BaseDelay:        time.Second,
+			MaxDelay:         time.Minute,
+			LockoutThreshold: 5,
+			LockoutDuration:  15 * time.Minute,
+			Window:           time.Hour,
+		},
+		TokenDetails: TokenDetailsFactory{
+			AccessTokens:  accessTokenFactory,
+			RefreshTokens: refreshTokenFactory,
+			TimeFunc:      nowTimeFunc,
+		},
+		TimeFunc: func() time.Time { return current },
+	}
+	client := types.ClientInfo{IP: "192.0.2.1"}
+
+	login := func(user types.UserID, password string) error {
+		_, err := authService.Login(
+			&types.Credentials{User: user, Password: password},
+			&client,
+		)
+		return err
+	}
+	wantThrottled := func(err error, retryAfter time.Duration) {
+		t.Helper()
+		var throttled *ThrottledError
+		if !errors.As(err, &throttled) {
+			t.Fatalf("Login(): wanted throttled error; found `%v`", err)
+		}
+		if throttled.RetryAfter != retryAfter {
+			t.Fatalf(
+				"ThrottledError.RetryAfter: wanted `%s`; found `%s`",
+				retryAfter,
+				throttled.RetryAfter,
+			)
+		}
+	}
+
+	// The free attempts and the first attempt which triggers the backoff
+	// are checked as usual.
+	for i := 0; i < 3; i++ {
+		if err := login("user", "wrong"); !errors.Is(err, ErrCredentials) {
+			t.Fatalf(
+				"Login() #%d: wanted `%v`; found `%v`",
+				i,
+				ErrCredentials,
+				err,
+			)
+		}
+	}
+
+	// Even the right password is rejected during the backoff.
+	wantThrottled(login("user", "password"), time.Second)
+
+	current = current.Add(time.Second)
+	if err := login("user", "wrong"); !errors.Is(err, ErrCredentials) {
+		t.Fatalf("Login(): wanted `%v`; found `%v`", ErrCredentials, err)
+	}
+	wantThrottled(login("user", "password"), 2*time.Second)
+
+	// Other users are throttled by the client IP address.
+	wantThrottled(login("other", "password"), 2*time.Second)
+
+	current = current.Add(2 * time.Second)
+	if err := login("user", "wrong"); !errors.Is(err, ErrCredentials) {
+		t.Fatalf("Login(): wanted `%v`; found `%v`", ErrCredentials, err)
+	}
+	if err := (&types.Notification{
+		Type:  types.NotificationTypeLockout,
+		User:  "user",
+		Email: "user@example.org",
+	}).Compare(notifications.Notifications[0]); err != nil {
+		t.Fatal(err)
+	}
+
+	// Changing IP addresses doesn't get around the lockout.
+	client.IP = "192.0.2.2"
+	wantThrottled(login("user", "password"), 15*time.Minute)
+
+	current = current.Add(15 * time.Minute)
+	if err := login("user", "password"); err != nil {
+		t.Fatalf("Login(): unexpected error: %v", err)
+	}
+	if _, err := attempts.Get(
+		throttleUserKey("user"),
+	); !errors.Is(err, types.ErrLoginAttemptsNotFound) {
+		t.Fatalf(
+			"wanted `%v`; found `%v`",
+			types.ErrLoginAttemptsNotFound,
+			err,
+		)
+	}
+
+	if len(notifications.Notifications) != 1 {
+		t.Fatalf(
+			"wanted 1 notification; found %d",
+			len(notifications.Notifications),
+		)
+	}
+}
+
+func TestAuthService_LoginThrottle_Concurrent(t *testing.T) {
+	authService := AuthService{
+		Creds: CredStore{Users: testsupport.UserStoreFake{
+			"user": {
+				User:         "user",
+				Email:        "user@example.org",
+				PasswordHash: hashBcrypt("password"),
+			},
+		}},
+		Tokens: testsupport.TokenStoreFake{},
+		Throttle: LoginThrottle{
+			Attempts:  &MemLoginAttemptStore{},
+			BaseDelay: time.Minute,
+			MaxDelay:  time.Hour,
+			Window:    time.Hour,
+		},
+		TimeFunc: nowTimeFunc,
+	}
+	client := types.ClientInfo{IP: "192.0.2.1"}
+
+	// Parallel guesses may all pass the check before any of them fails,
+	// but only one of them may go on to check the password.
+	const guesses = 10
+	errs := make(chan error, guesses)
+	var wg sync.WaitGroup
+	for i := 0; i < guesses; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := authService.Login(
+				&types.Credentials{User: "user", Password: "wrong"},
+				&client,
+			)
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	checked := 0
+	for err := range errs {
+		var throttled *ThrottledError
+		switch {
+		case errors.Is(err, ErrCredentials):
+			checked++
+		case errors.As(err, &throttled):
+		default:
+			t.Fatalf("Login(): unexpected error: %v", err)
+		}
+	}
+	if checked != 1 {
+		t.Fatalf("wanted 1 password checked; found %d", checked)
+	}
+}
+
+func TestLoginRoutes_Throttled(t *testing.T) {
+	attempts := MemLoginAttemptStore{}
+	if err := attempts.Lock(
+		throttleUserKey("user"),
+		now.Add(90*time.Second+time.Millisecond),
+	); err != nil {
+		t.Fatalf("locking out user: %v", err)
+	}
+	authService := AuthService{
+		Creds:    CredStore{Users: testsupport.UserStoreFake{}},
+		Throttle: LoginThrottle{Attempts: &attempts},
+		TimeFunc: nowTimeFunc,
+	}
+
+	for _, testCase := range []struct {
+		name    string
+		handler pz.Handler
+		body    string
+	}{
+		{
+			name: "api",
+			handler: (&AuthHTTPService{
+				AuthService: authService,
+			}).LoginRoute().Handler,
+			body: `{"user": "user", "password": "password"}`,
+		},
+		{
+			name: "web",
+			handler: (&WebServer{
+				AuthService:    authService,
+				BaseURL:        "https://auth.example.org/",
+				RedirectDomain: "app.example.org",
+			}).LoginHandler,
+			body: "username=user&password=password",
+		},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			rsp := testCase.handler(pz.Request{
+				Body: strings.NewReader(testCase.body),
+				URL:  &url.URL{},
+			})
+			if rsp.Status != http.StatusTooManyRequests {
+				t.Fatalf(
+					"Response.Status: wanted `429`; found `%d`",
+					rsp.Status,
+				)
+			}
+			if found := rsp.Headers.Get("Retry-After"); found != "91" {
+				t.Fatalf("Retry-After: wanted `91`; found `%s`", found)
+			}
+		})
+	}
+}
@@ -4,6 +4,8 @@ import (
 	"fmt"
 	"time"
 
+	"github.com/dgrijalva/jwt-go"
+	"github.com/google/uuid"
 	"github.com/weberc2/auth/pkg/auth/types"
 )
 
@@ -18,21 +20,49 @@ type TokenDetailsFactory struct {
 	TimeFunc      func() time.Time
 }
 
+// RefreshClaims are the claims carried by refresh tokens.
+type RefreshClaims struct {
+	// Family identifies the chain of refresh tokens which descend from a
+	// single login. Tokens issued before refresh tokens were rotated don't
+	// have a family.
+	Family string `json:"fam,omitempty"`
+	jwt.StandardClaims
+}
+
+// Create creates an access token and the first refresh token in a new family.
 func (tdf *TokenDetailsFactory) Create(subject string) (*TokenDetails, error) {
+	return tdf.CreateInFamily(subject, uuid.NewString())
+}
+
+// CreateInFamily creates an access token and a refresh token in an existing
+// family. This is used to rotate refresh tokens.
+func (tdf *TokenDetailsFactory) CreateInFamily(
+	subject string,
+	family string,
+) (*TokenDetails, error) {
 	now := tdf.TimeFunc()
 	accessToken, err := tdf.AccessTokens.Create(now, subject)
 	if err != nil {
 		return nil, fmt.Errorf("creating access token: %w", err)
 	}
 
-	refreshToken, err := tdf.RefreshTokens.Create(now, subject)
+	claims := RefreshClaims{
+		Family:         family,
+		StandardClaims: tdf.RefreshTokens.StandardClaims(now, subject),
+	}
+	claims.Id = uuid.NewString()
+	refreshToken, err := tdf.RefreshTokens.Sign(&claims)
 	if err != nil {
 		return nil, fmt.Errorf("creating refresh token: %w", err)
 	}
 
 	return &TokenDetails{
-		AccessToken:  *accessToken,
-		RefreshToken: *refreshToken,
+		AccessToken: *accessToken,
+		RefreshToken: types.Token{
+			Token:   refreshToken,
+			Family:  family,
+			Expires: now.Add(tdf.RefreshTokens.TokenValidity),
+		},
 	}, nil
 }
 
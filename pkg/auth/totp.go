@@ -0,0 +1,636 @@
+package auth
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/weberc2/auth/pkg/auth/types"
+	pz "github.com/weberc2/httpeasy"
+)
+
+// TOTP parameters (RFC 6238). These are the defaults that authenticator apps
+// assume, so they're also advertised in the enrollment URI.
+const (
+	totpDigits = 6
+	totpPeriod = 30 * time.Second
+
+	// totpSkew is the number of time steps before or after the current one
+	// for which codes are accepted, to allow for clock drift.
+	totpSkew = 1
+
+	totpSecretSize    = 20
+	recoveryCodeCount = 10
+	recoveryCodeSize  = 10
+
+	// secondFactorValidity is how long a user has to provide their second
+	// factor after providing their password.
+	secondFactorValidity = 5 * time.Minute
+
+	// secondFactorAudience distinguishes second-factor tokens from auth codes,
+	// which are signed with the same key.
+	secondFactorAudience = "second-factor"
+)
+
+var (
+	ErrSecondFactor = &pz.HTTPError{
+		Status:  http.StatusUnauthorized,
+		Message: "invalid two-factor code",
+	}
+	ErrTOTPUnavailable = &pz.HTTPError{
+		Status:  http.StatusNotImplemented,
+		Message: "two-factor authentication is not configured",
+	}
+	ErrTOTPEnabled = &pz.HTTPError{
+		Status:  http.StatusConflict,
+		Message: "two-factor authentication is already enabled",
+	}
+	ErrTOTPNotEnrolled = &pz.HTTPError{
+		Status:  http.StatusConflict,
+		Message: "two-factor enrollment hasn't been started",
+	}
+	ErrTOTPNotEnabled = &pz.HTTPError{
+		Status:  http.StatusConflict,
+		Message: "two-factor authentication is not enabled",
+	}
+)
+
+// SecondFactorRequired is returned by `AuthService.Login` and
+// `AuthService.LoginAuthCode` when the credentials are valid but the user has
+// enabled two-factor authentication. The login is completed by passing the
+// token along with a TOTP or recovery code to
+// `AuthService.LoginSecondFactor` or `AuthService.LoginAuthCodeSecondFactor`,
+// respectively.
+type SecondFactorRequired struct {
+	Token string `json:"secondFactorToken"`
+}
+
+func (*SecondFactorRequired) Error() string {
+	return "second factor required"
+}
+
+// TOTP configures time-based one-time password (RFC 6238) two-factor
+// authentication.
+type TOTP struct {
+	// Issuer is the name under which authenticator apps list the account.
+	Issuer string
+
+	// EncryptionKey is used to encrypt TOTP secrets at rest. If it's empty,
+	// users can't enroll in two-factor authentication.
+	EncryptionKey string
+}
+
+// TOTPEnrollment holds the secret which the user adds to their authenticator
+// app, both as base32 text (for manual entry) and as an `otpauth://` URI (for
+// rendering as a QR code).
+type TOTPEnrollment struct {
+	Secret string `json:"secret"`
+	URI    string `json:"uri"`
+}
+
+func (t *TOTP) enrollment(
+	user types.UserID,
+	secret []byte,
+) *TOTPEnrollment {
+	encoded := base32.StdEncoding.WithPadding(base32.NoPadding).
+		EncodeToString(secret)
+	return &TOTPEnrollment{
+		Secret: encoded,
+		URI: (&url.URL{
+			Scheme: "otpauth",
+			Host:   "totp",
+			Path:   "/" + t.Issuer + ":" + string(user),
+			RawQuery: url.Values{
+				"secret":    []string{encoded},
+				"issuer":    []string{t.Issuer},
+				"algorithm": []string{"SHA1"},
+				"digits":    []string{fmt.Sprint(totpDigits)},
+				"period": []string{
+					fmt.Sprint(int(totpPeriod / time.Second)),
+				},
+			}.Encode(),
+		}).String(),
+	}
+}
+
+// encrypt encrypts a TOTP secret with AES-GCM, returning the nonce and the
+// ciphertext as base64.
+func (t *TOTP) encrypt(secret []byte) (string, error) {
+	gcm, err := t.cipher()
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", fmt.Errorf("generating nonce: %w", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(
+		gcm.Seal(nonce, nonce, secret, nil),
+	), nil
+}
+
+func (t *TOTP) decrypt(encrypted string) ([]byte, error) {
+	gcm, err := t.cipher()
+	if err != nil {
+		return nil, err
+	}
+	data, err := base64.RawURLEncoding.DecodeString(encrypted)
+	if err != nil {
+		return nil, fmt.Errorf("decoding TOTP secret: %w", err)
+	}
+	if len(data) < gcm.NonceSize() {
+		return nil, fmt.Errorf("decrypting TOTP secret: ciphertext too short")
+	}
+	secret, err := gcm.Open(
+		nil,
+		data[:gcm.NonceSize()],
+		data[gcm.NonceSize():],
+		nil,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("decrypting TOTP secret: %w", err)
+	}
+	return secret, nil
+}
+
+func (t *TOTP) cipher() (cipher.AEAD, error) {
+	if t.EncryptionKey == "" {
+		return nil, ErrTOTPUnavailable
+	}
+	key := sha256.Sum256([]byte(t.EncryptionKey))
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, fmt.Errorf("creating TOTP cipher: %w", err)
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("creating TOTP cipher: %w", err)
+	}
+	return gcm, nil
+}
+
+// totpStep returns the RFC 6238 time step for the provided time.
+func totpStep(now time.Time) int64 {
+	return now.Unix() / int64(totpPeriod/time.Second)
+}
+
+// hotp computes the RFC 4226 one-time password for the counter.
+func hotp(secret []byte, counter int64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(counter))
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	// dynamic truncation (RFC 4226 section 5.3)
+	offset := sum[len(sum)-1] & 0xf
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, value%1000000)
+}
+
+// verifyTOTP checks the code against the time steps around `now`, returning
+// the matching step. Steps at or before `last` (the step of the last accepted
+// code) are skipped so that a code can't be used twice.
+func verifyTOTP(
+	secret []byte,
+	code string,
+	now time.Time,
+	last int64,
+) (int64, bool) {
+	current := totpStep(now)
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		if step <= last {
+			continue
+		}
+		if subtle.ConstantTimeCompare(
+			[]byte(hotp(secret, step)),
+			[]byte(code),
+		) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// newRecoveryCodes generates a set of recovery codes, returning the codes
+// (formatted for the user) and their digests (for storage).
+func newRecoveryCodes() ([]string, []string, error) {
+	encoding := base32.StdEncoding.WithPadding(base32.NoPadding)
+	codes := make([]string, recoveryCodeCount)
+	digests := make([]string, recoveryCodeCount)
+	for i := range codes {
+		var data [recoveryCodeSize]byte
+		if _, err := rand.Read(data[:]); err != nil {
+			return nil, nil, fmt.Errorf("generating recovery code: %w", err)
+		}
+		code := strings.ToLower(encoding.EncodeToString(data[:]))
+		digests[i] = types.TokenDigest(code)
+
+		var groups []string
+		for len(code) > 4 {
+			groups, code = append(groups, code[:4]), code[4:]
+		}
+		codes[i] = strings.Join(append(groups, code), "-")
+	}
+	return codes, digests, nil
+}
+
+// recoveryCodeDigest normalizes a recovery code as entered by the user (which
+// may have different casing or be missing separators) and returns its digest.
+func recoveryCodeDigest(code string) string {
+	return types.TokenDigest(strings.ToLower(strings.NewReplacer(
+		"-", "",
+		" ", "",
+	).Replace(code)))
+}
+
+// checkSecondFactor checks a TOTP code or recovery code against the user
+// entry. On success, the entry is updated to prevent the code from being used
+// again; the caller is responsible for storing it.
+func (as *AuthService) checkSecondFactor(
+	entry *types.UserEntry,
+	code string,
+) error {
+	secret, err := as.TOTP.decrypt(entry.TOTPSecret)
+	if err != nil {
+		return err
+	}
+
+	if step, ok := verifyTOTP(
+		secret,
+		code,
+		as.TimeFunc(),
+		entry.TOTPCounter,
+	); ok {
+		entry.TOTPCounter = step
+		return nil
+	}
+
+	digest := recoveryCodeDigest(code)
+	for i, recoveryCode := range entry.RecoveryCodes {
+		if subtle.ConstantTimeCompare(
+			[]byte(recoveryCode),
+			[]byte(digest),
+		) == 1 {
+			entry.RecoveryCodes = append(
+				entry.RecoveryCodes[:i:i],
+				entry.RecoveryCodes[i+1:]...,
+			)
+			log.Printf("user `%s` used a recovery code", entry.User)
+			return nil
+		}
+	}
+
+	return ErrSecondFactor
+}
+
+// secondFactorClaims are the claims carried by the second-factor tokens which
+// link the two steps of a two-factor login. `AuthCode` and `Params` record
+// whether the login will result in tokens or in an auth code.
+type secondFactorClaims struct {
+	AuthCode bool        `json:"auth_code,omitempty"`
+	Params   *CodeParams `json:"params,omitempty"`
+	types.ClientInfo
+	jwt.StandardClaims
+}
+
+// secondFactorRequired creates a `SecondFactorRequired` error for a user
+// whose password has been validated.
+func (as *AuthService) secondFactorRequired(
+	user types.UserID,
+	authCode bool,
+	params *CodeParams,
+	client *types.ClientInfo,
+) error {
+	now := as.TimeFunc()
+	claims := secondFactorClaims{
+		AuthCode:       authCode,
+		Params:         params,
+		StandardClaims: as.Codes.StandardClaims(now, string(user)),
+	}
+	claims.Audience = secondFactorAudience
+	claims.ExpiresAt = now.Add(secondFactorValidity).Unix()
+	if client != nil {
+		claims.ClientInfo = *client
+	}
+
+	token, err := as.Codes.Sign(&claims)
+	if err != nil {
+		return fmt.Errorf("creating second-factor token: %w", err)
+	}
+	return &SecondFactorRequired{Token: token}
+}
+
+// secondFactor validates the second-factor token and the code, returning the
+// token's claims. Invalid tokens (including tokens for the other kind of login
+// per `authCode` and auth code tokens for another client or redirect URI)
+// result in `ErrUnauthorized` and invalid codes in `ErrSecondFactor`.
+func (as *AuthService) secondFactor(
+	token string,
+	code string,
+	authCode bool,
+	clientID string,
+	redirectURI string,
+) (*secondFactorClaims, error) {
+	var claims secondFactorClaims
+	if _, err := jwt.ParseWithClaims(
+		token,
+		&claims,
+		as.Codes.VerificationKey,
+	); err != nil {
+		log.Printf("jwt.ParseWithClaims(): %v", err)
+		return nil, ErrUnauthorized
+	}
+	if !claims.VerifyAudience(secondFactorAudience, true) {
+		log.Printf("token isn't a second-factor token")
+		return nil, ErrUnauthorized
+	}
+	if claims.AuthCode != authCode {
+		log.Printf(
+			"second-factor token is for the wrong kind of login: "+
+				"auth code: %t",
+			claims.AuthCode,
+		)
+		return nil, ErrUnauthorized
+	}
+
+	// The auth code goes to the redirect URI of the request which completes
+	// the login, so it must be the one for which the login was started.
+	// Otherwise, a first-party token could be completed via an OpenID
+	// Connect client's authorization request, handing that client a
+	// first-party code.
+	var params CodeParams
+	if claims.Params != nil {
+		params = *claims.Params
+	}
+	if params.ClientID != clientID || params.RedirectURI != redirectURI {
+		log.Printf(
+			"second-factor token is for another client: wanted `%s` (`%s`); "+
+				"found `%s` (`%s`)",
+			params.ClientID,
+			params.RedirectURI,
+			clientID,
+			redirectURI,
+		)
+		return nil, ErrUnauthorized
+	}
+
+	entry, err := as.Creds.Users.Get(types.UserID(claims.Subject))
+	if err != nil {
+		return nil, fmt.Errorf("fetching user: %w", err)
+	}
+
+	// If two-factor authentication was disabled in the meantime, the token
+	// can't be redeemed; the user will have to log in again.
+	if !entry.TOTPEnabled {
+		return nil, ErrSecondFactor
+	}
+
+	// Six-digit codes are easy to guess, so they're throttled like
+	// passwords.
+	updated := *entry
+	if err := as.throttled(
+		entry.User,
+		&claims.ClientInfo,
+		ErrSecondFactor,
+		func() error { return as.checkSecondFactor(&updated, code) },
+	); err != nil {
+		return nil, err
+	}
+	if err := as.Creds.Users.Upsert(&updated); err != nil {
+		return nil, fmt.Errorf("updating user: %w", err)
+	}
+	if err := as.Throttle.succeed(entry.User); err != nil {
+		return nil, err
+	}
+
+	return &claims, nil
+}
+
+// LoginSecondFactor completes a two-factor `Login`.
+func (as *AuthService) LoginSecondFactor(
+	token string,
+	code string,
+) (*TokenDetails, error) {
+	claims, err := as.secondFactor(token, code, false, "", "")
+	if err != nil {
+		return nil, fmt.Errorf("validating second factor: %w", err)
+	}
+	return as.issueTokens(claims.Subject, &claims.ClientInfo)
+}
+
+// LoginAuthCodeSecondFactor completes a two-factor `LoginAuthCode`. The
+// client ID and redirect URI are those of the request which completes the
+// login (both empty for first-party logins); they must match the ones with
+// which the login was started.
+func (as *AuthService) LoginAuthCodeSecondFactor(
+	token string,
+	code string,
+	clientID string,
+	redirectURI string,
+) (string, error) {
+	claims, err := as.secondFactor(token, code, true, clientID, redirectURI)
+	if err != nil {
+		return "", fmt.Errorf("validating second factor: %w", err)
+	}
+	return as.authCode(
+		types.UserID(claims.Subject),
+		claims.Params,
+		&claims.ClientInfo,
+	)
+}
+
+// EnrollTOTP starts enrolling the user in two-factor authentication by
+// generating a new TOTP secret. Two-factor authentication isn't enabled until
+// the user proves they've stored the secret with `ConfirmTOTP`.
+func (as *AuthService) EnrollTOTP(
+	user types.UserID,
+) (*TOTPEnrollment, error) {
+	entry, err := as.Creds.Users.Get(user)
+	if err != nil {
+		return nil, fmt.Errorf("enrolling in TOTP: %w", err)
+	}
+	if entry.TOTPEnabled {
+		return nil, fmt.Errorf("enrolling in TOTP: %w", ErrTOTPEnabled)
+	}
+
+	secret := make([]byte, totpSecretSize)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, fmt.Errorf("generating TOTP secret: %w", err)
+	}
+	encrypted, err := as.TOTP.encrypt(secret)
+	if err != nil {
+		return nil, fmt.Errorf("enrolling in TOTP: %w", err)
+	}
+
+	updated := *entry
+	updated.TOTPSecret = encrypted
+	updated.TOTPCounter = 0
+	if err := as.Creds.Users.Upsert(&updated); err != nil {
+		return nil, fmt.Errorf("enrolling in TOTP: %w", err)
+	}
+
+	return as.TOTP.enrollment(user, secret), nil
+}
+
+// ConfirmTOTP enables two-factor authentication if the code matches the
+// secret from `EnrollTOTP`, returning the user's recovery codes. Codes are
+// throttled like passwords.
+func (as *AuthService) ConfirmTOTP(
+	user types.UserID,
+	code string,
+	client *types.ClientInfo,
+) ([]string, error) {
+	entry, err := as.Creds.Users.Get(user)
+	if err != nil {
+		return nil, fmt.Errorf("confirming TOTP: %w", err)
+	}
+	if entry.TOTPEnabled {
+		return nil, fmt.Errorf("confirming TOTP: %w", ErrTOTPEnabled)
+	}
+	if entry.TOTPSecret == "" {
+		return nil, fmt.Errorf("confirming TOTP: %w", ErrTOTPNotEnrolled)
+	}
+
+	secret, err := as.TOTP.decrypt(entry.TOTPSecret)
+	if err != nil {
+		return nil, fmt.Errorf("confirming TOTP: %w", err)
+	}
+
+	// Recovery codes don't exist yet, so only a TOTP code will do.
+	var step int64
+	if err := as.throttled(
+		user,
+		client,
+		ErrSecondFactor,
+		func() error {
+			var ok bool
+			step, ok = verifyTOTP(
+				secret,
+				code,
+				as.TimeFunc(),
+				entry.TOTPCounter,
+			)
+			if !ok {
+				return ErrSecondFactor
+			}
+			return nil
+		},
+	); err != nil {
+		return nil, fmt.Errorf("confirming TOTP: %w", err)
+	}
+
+	codes, digests, err := newRecoveryCodes()
+	if err != nil {
+		return nil, fmt.Errorf("confirming TOTP: %w", err)
+	}
+
+	updated := *entry
+	updated.TOTPEnabled = true
+	updated.TOTPCounter = step
+	updated.RecoveryCodes = digests
+	if err := as.Creds.Users.Upsert(&updated); err != nil {
+		return nil, fmt.Errorf("confirming TOTP: %w", err)
+	}
+	if err := as.Throttle.succeed(user); err != nil {
+		return nil, fmt.Errorf("confirming TOTP: %w", err)
+	}
+
+	return codes, nil
+}
+
+// RegenerateRecoveryCodes replaces the user's recovery codes. The user must
+// provide a TOTP code or one of their current recovery codes.
+func (as *AuthService) RegenerateRecoveryCodes(
+	user types.UserID,
+	code string,
+	client *types.ClientInfo,
+) ([]string, error) {
+	entry, err := as.totpEntry(user, code, client)
+	if err != nil {
+		return nil, fmt.Errorf("regenerating recovery codes: %w", err)
+	}
+
+	codes, digests, err := newRecoveryCodes()
+	if err != nil {
+		return nil, fmt.Errorf("regenerating recovery codes: %w", err)
+	}
+
+	entry.RecoveryCodes = digests
+	if err := as.Creds.Users.Upsert(entry); err != nil {
+		return nil, fmt.Errorf("regenerating recovery codes: %w", err)
+	}
+	if err := as.Throttle.succeed(user); err != nil {
+		return nil, fmt.Errorf("regenerating recovery codes: %w", err)
+	}
+
+	return codes, nil
+}
+
+// DisableTOTP turns off two-factor authentication for the user. The user must
+// provide a TOTP code or one of their recovery codes.
+func (as *AuthService) DisableTOTP(
+	user types.UserID,
+	code string,
+	client *types.ClientInfo,
+) error {
+	entry, err := as.totpEntry(user, code, client)
+	if err != nil {
+		return fmt.Errorf("disabling TOTP: %w", err)
+	}
+
+	entry.TOTPSecret = ""
+	entry.TOTPEnabled = false
+	entry.TOTPCounter = 0
+	entry.RecoveryCodes = nil
+	if err := as.Creds.Users.Upsert(entry); err != nil {
+		return fmt.Errorf("disabling TOTP: %w", err)
+	}
+	if err := as.Throttle.succeed(user); err != nil {
+		return fmt.Errorf("disabling TOTP: %w", err)
+	}
+
+	return nil
+}
+
+// totpEntry fetches a copy of the entry for a user who has enabled two-factor
+// authentication and checks their code under the login throttle, so that a
+// stolen access token isn't enough to guess the code.
+func (as *AuthService) totpEntry(
+	user types.UserID,
+	code string,
+	client *types.ClientInfo,
+) (*types.UserEntry, error) {
+	entry, err := as.Creds.Users.Get(user)
+	if err != nil {
+		return nil, err
+	}
+	if !entry.TOTPEnabled {
+		return nil, ErrTOTPNotEnabled
+	}
+
+	updated := *entry
+	if err := as.throttled(
+		user,
+		client,
+		ErrSecondFactor,
+		func() error { return as.checkSecondFactor(&updated, code) },
+	); err != nil {
+		return nil, err
+	}
+	return &updated, nil
+}
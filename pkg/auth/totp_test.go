@@ -0,0 +1,436 @@
+package auth
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/weberc2/auth/pkg/auth/testsupport"
+	"github.com/weberc2/auth/pkg/auth/types"
+	pz "github.com/weberc2/httpeasy"
+)
+
+func TestHOTP(t *testing.T) {
+	// Test vectors from RFC 6238 appendix B (SHA1, truncated to 6 digits).
+	secret := []byte("12345678901234567890")
+	for _, testCase := range []struct {
+		time   int64
+		wanted string
+	}{
+		{time: 59, wanted: "287082"},
+		{time: 1111111109, wanted: "081804"},
+		{time: 1111111111, wanted: "050471"},
+		{time: 1234567890, wanted: "005924"},
+		{time: 2000000000, wanted: "279037"},
+	} {
+		found := hotp(secret, totpStep(time.Unix(testCase.time, 0)))
+		if found != testCase.wanted {
+			t.Fatalf(
+				"hotp() at %d: wanted `%s`; found `%s`",
+				testCase.time,
+				testCase.wanted,
+				found,
+			)
+		}
+	}
+}
+
+func TestAuthService_TOTP(t *testing.T) {
+	current := now
+	timeFunc := func() time.Time { return current }
+	jwt.TimeFunc = timeFunc
+	defer func() { jwt.TimeFunc = time.Now }()
+
+	users := testsupport.UserStoreFake{
+		"user": {
+			User:         "user",
+			Email:        "user@example.org",
+			PasswordHash: hashBcrypt("password"),
+		},
+	}
+	authService := AuthService{
+		Creds:         CredStore{Users: users},
+		Tokens:        testsupport.TokenStoreFake{},
+		Codes:         codesTokenFactory,
+		RedeemedCodes: testsupport.CodeStoreFake{},
+		TOTP:          TOTP{Issuer: "Example", EncryptionKey: "key"},
+		TokenDetails: TokenDetailsFactory{
+			AccessTokens:  accessTokenFactory,
+			RefreshTokens: refreshTokenFactory,
+			TimeFunc:      nowTimeFunc,
+		},
+		TimeFunc: timeFunc,
+	}
+	creds := types.Credentials{User: "user", Password: "password"}
+
+	enrollment, err := authService.EnrollTOTP("user")
+	if err != nil {
+		t.Fatalf("EnrollTOTP(): unexpected error: %v", err)
+	}
+	if !strings.HasPrefix(enrollment.URI, "otpauth://totp/Example:user?") {
+		t.Fatalf("TOTPEnrollment.URI: unexpected URI `%s`", enrollment.URI)
+	}
+	secret, err := authService.TOTP.decrypt(users["user"].TOTPSecret)
+	if err != nil {
+		t.Fatalf("decrypting TOTP secret: %v", err)
+	}
+	code := func() string { return hotp(secret, totpStep(current)) }
+
+	// Enrollment isn't complete until it's confirmed.
+	if _, err := authService.Login(&creds, nil); err != nil {
+		t.Fatalf("Login(): unexpected error: %v", err)
+	}
+
+	if _, err := authService.ConfirmTOTP(
+		"user",
+		"000000",
+		nil,
+	); !errors.Is(err, ErrSecondFactor) {
+		t.Fatalf(
+			"ConfirmTOTP(): wanted `%v`; found `%v`",
+			ErrSecondFactor,
+			err,
+		)
+	}
+	recoveryCodes, err := authService.ConfirmTOTP("user", code(), nil)
+	if err != nil {
+		t.Fatalf("ConfirmTOTP(): unexpected error: %v", err)
+	}
+	if len(recoveryCodes) != recoveryCodeCount {
+		t.Fatalf(
+			"len(recoveryCodes): wanted `%d`; found `%d`",
+			recoveryCodeCount,
+			len(recoveryCodes),
+		)
+	}
+	if _, err := authService.EnrollTOTP(
+		"user",
+	); !errors.Is(err, ErrTOTPEnabled) {
+		t.Fatalf("EnrollTOTP(): wanted `%v`; found `%v`", ErrTOTPEnabled, err)
+	}
+
+	login := func() string {
+		_, err := authService.Login(&creds, nil)
+		var required *SecondFactorRequired
+		if !errors.As(err, &required) {
+			t.Fatalf("Login(): wanted second factor required; found `%v`", err)
+		}
+		return required.Token
+	}
+
+	// The code used for confirmation can't be reused.
+	token := login()
+	if _, err := authService.LoginSecondFactor(
+		token,
+		code(),
+	); !errors.Is(err, ErrSecondFactor) {
+		t.Fatalf(
+			"LoginSecondFactor(): wanted `%v`; found `%v`",
+			ErrSecondFactor,
+			err,
+		)
+	}
+
+	current = current.Add(totpPeriod)
+	if _, err := authService.LoginSecondFactor(token, code()); err != nil {
+		t.Fatalf("LoginSecondFactor(): unexpected error: %v", err)
+	}
+
+	// Second-factor tokens from `Login` can't be used to get auth codes and
+	// they aren't auth codes themselves.
+	current = current.Add(totpPeriod)
+	token = login()
+	if _, err := authService.LoginAuthCodeSecondFactor(
+		token,
+		code(),
+		"",
+		"",
+	); !errors.Is(err, ErrUnauthorized) {
+		t.Fatalf(
+			"LoginAuthCodeSecondFactor(): wanted `%v`; found `%v`",
+			ErrUnauthorized,
+			err,
+		)
+	}
+	if _, err := authService.Exchange(token, ""); err != ErrUnauthorized {
+		t.Fatalf("Exchange(): wanted `%v`; found `%v`", ErrUnauthorized, err)
+	}
+
+	// Recovery codes work once, regardless of formatting.
+	recoveryCode := strings.ToUpper(
+		strings.ReplaceAll(recoveryCodes[0], "-", ""),
+	)
+	if _, err := authService.LoginSecondFactor(
+		token,
+		recoveryCode,
+	); err != nil {
+		t.Fatalf("LoginSecondFactor(): unexpected error: %v", err)
+	}
+	if _, err := authService.LoginSecondFactor(
+		token,
+		recoveryCodes[0],
+	); !errors.Is(err, ErrSecondFactor) {
+		t.Fatalf(
+			"LoginSecondFactor(): wanted `%v`; found `%v`",
+			ErrSecondFactor,
+			err,
+		)
+	}
+
+	// Second-factor tokens expire.
+	token = login()
+	current = current.Add(secondFactorValidity + time.Second)
+	if _, err := authService.LoginSecondFactor(
+		token,
+		code(),
+	); !errors.Is(err, ErrUnauthorized) {
+		t.Fatalf(
+			"LoginSecondFactor(): wanted `%v`; found `%v`",
+			ErrUnauthorized,
+			err,
+		)
+	}
+
+	if err := authService.DisableTOTP(
+		"user",
+		recoveryCodes[1],
+		nil,
+	); err != nil {
+		t.Fatalf("DisableTOTP(): unexpected error: %v", err)
+	}
+	if err := (&types.UserEntry{
+		User:         "user",
+		Email:        "user@example.org",
+		PasswordHash: users["user"].PasswordHash,
+	}).Compare(users["user"]); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := authService.Login(&creds, nil); err != nil {
+		t.Fatalf("Login(): unexpected error: %v", err)
+	}
+}
+
+func TestWebServer_LoginHandler_SecondFactor(t *testing.T) {
+	jwt.TimeFunc = nowTimeFunc
+	defer func() { jwt.TimeFunc = time.Now }()
+
+	totp := TOTP{EncryptionKey: "key"}
+	secret := []byte("12345678901234567890")
+	encrypted, err := totp.encrypt(secret)
+	if err != nil {
+		t.Fatalf("encrypting TOTP secret: %v", err)
+	}
+
+	webServer := WebServer{
+		AuthService: AuthService{
+			Creds: CredStore{
+				Users: testsupport.UserStoreFake{
+					"adam": {
+						User:         "adam",
+						Email:        "adam@example.org",
+						PasswordHash: hashBcrypt("password"),
+						TOTPSecret:   encrypted,
+						TOTPEnabled:  true,
+					},
+				},
+			},
+			Tokens:        testsupport.TokenStoreFake{},
+			Codes:         codesTokenFactory,
+			RedeemedCodes: testsupport.CodeStoreFake{},
+			TOTP:          totp,
+			TokenDetails: TokenDetailsFactory{
+				AccessTokens:  accessTokenFactory,
+				RefreshTokens: refreshTokenFactory,
+				TimeFunc:      nowTimeFunc,
+			},
+			TimeFunc: nowTimeFunc,
+		},
+		BaseURL:                 "https://auth.example.org/",
+		RedirectDomain:          "app.example.org",
+		DefaultRedirectLocation: "https://app.example.org/default/",
+	}
+
+	post := func(form url.Values) pz.Response {
+		return webServer.LoginHandler(pz.Request{
+			Body: strings.NewReader(form.Encode()),
+			URL: &url.URL{RawQuery: url.Values{
+				"callback": []string{"https://app.example.org/"},
+			}.Encode()},
+		})
+	}
+
+	rsp := post(url.Values{
+		"username": []string{"adam"},
+		"password": []string{"password"},
+	})
+	if rsp.Status != http.StatusOK {
+		t.Fatalf("Response.Status: wanted `200`; found `%d`", rsp.Status)
+	}
+	context, ok := rsp.Logging[0].(*secondFactorContext)
+	if !ok {
+		t.Fatalf("Response.Logging[0]: wanted second-factor form context")
+	}
+
+	rsp = post(url.Values{
+		"second_factor_token": []string{context.Token},
+		"code":                []string{"000000"},
+	})
+	if rsp.Status != http.StatusUnauthorized {
+		t.Fatalf("Response.Status: wanted `401`; found `%d`", rsp.Status)
+	}
+
+	rsp = post(url.Values{
+		"second_factor_token": []string{context.Token},
+		"code":                []string{hotp(secret, totpStep(now))},
+	})
+	if rsp.Status != http.StatusSeeOther {
+		t.Fatalf("Response.Status: wanted `303`; found `%d`", rsp.Status)
+	}
+	location, err := url.Parse(rsp.Headers.Get("Location"))
+	if err != nil {
+		t.Fatalf("parsing redirect location: %v", err)
+	}
+	if _, err := webServer.AuthService.Exchange(
+		location.Query().Get("code"),
+		"",
+	); err != nil {
+		t.Fatalf("Exchange(): unexpected error: %v", err)
+	}
+}
+
+func TestAuthService_ChangePassword_SecondFactor(t *testing.T) {
+	totp := TOTP{EncryptionKey: "key"}
+	secret := []byte("12345678901234567890")
+	encrypted, err := totp.encrypt(secret)
+	if err != nil {
+		t.Fatalf("encrypting TOTP secret: %v", err)
+	}
+
+	users := testsupport.UserStoreFake{
+		"adam": {
+			User:         "adam",
+			Email:        "adam@example.org",
+			PasswordHash: hashBcrypt(goodPassword),
+			TOTPSecret:   encrypted,
+			TOTPEnabled:  true,
+		},
+	}
+	tokens := testsupport.TokenStoreFake{}
+	authService := AuthService{
+		Creds:    CredStore{Users: users},
+		Tokens:   tokens,
+		TOTP:     totp,
+		TimeFunc: nowTimeFunc,
+	}
+	if err := tokens.Put(
+		"refresh-token",
+		&types.Session{ID: "session", Subject: "adam"},
+		now.Add(time.Hour),
+	); err != nil {
+		t.Fatalf("storing session: %v", err)
+	}
+
+	creds := types.Credentials{User: "adam", Password: goodPassword}
+	newPassword := goodPassword + "!"
+	for _, code := range []string{"", "000000"} {
+		if err := authService.ChangePassword(
+			&creds,
+			code,
+			newPassword,
+			nil,
+		); !errors.Is(err, ErrSecondFactor) {
+			t.Fatalf(
+				"ChangePassword(): wanted `%v`; found `%v`",
+				ErrSecondFactor,
+				err,
+			)
+		}
+	}
+
+	if err := authService.ChangePassword(
+		&creds,
+		hotp(secret, totpStep(now)),
+		newPassword,
+		nil,
+	); err != nil {
+		t.Fatalf("ChangePassword(): unexpected err: %v", err)
+	}
+	if err := (&types.Credentials{
+		User:     "adam",
+		Email:    "adam@example.org",
+		Password: newPassword,
+	}).CompareUserEntry(users["adam"]); err != nil {
+		t.Fatalf("UserStore[adam]: %v", err)
+	}
+	if !users["adam"].TOTPEnabled {
+		t.Fatal("changing the password turned off two-factor authentication")
+	}
+	if len(tokens) != 0 {
+		t.Fatalf("wanted all sessions revoked; found %d tokens", len(tokens))
+	}
+}
+
+func TestAuthService_DisableTOTP_Throttled(t *testing.T) {
+	totp := TOTP{EncryptionKey: "key"}
+	secret := []byte("12345678901234567890")
+	encrypted, err := totp.encrypt(secret)
+	if err != nil {
+		t.Fatalf("encrypting TOTP secret: %v", err)
+	}
+
+	users := testsupport.UserStoreFake{
+		"adam": {
+			User:         "adam",
+			Email:        "adam@example.org",
+			PasswordHash: hashBcrypt(goodPassword),
+			TOTPSecret:   encrypted,
+			TOTPEnabled:  true,
+		},
+	}
+	authService := AuthService{
+		Creds: CredStore{Users: users},
+		TOTP:  totp,
+		Throttle: LoginThrottle{
+			Attempts:     &MemLoginAttemptStore{},
+			FreeAttempts: 2,
+			BaseDelay:    time.Minute,
+			MaxDelay:     time.Hour,
+			Window:       time.Hour,
+		},
+		TimeFunc: nowTimeFunc,
+	}
+	client := types.ClientInfo{IP: "192.0.2.1"}
+
+	// A stolen access token isn't enough to guess the code: once the free
+	// attempts (and the first delayed one) are spent, even the right code is
+	// throttled.
+	for i := 0; i < 3; i++ {
+		if err := authService.DisableTOTP(
+			"adam",
+			"000000",
+			&client,
+		); !errors.Is(err, ErrSecondFactor) {
+			t.Fatalf(
+				"DisableTOTP() #%d: wanted `%v`; found `%v`",
+				i,
+				ErrSecondFactor,
+				err,
+			)
+		}
+	}
+	var throttled *ThrottledError
+	if err := authService.DisableTOTP(
+		"adam",
+		hotp(secret, totpStep(now)),
+		&client,
+	); !errors.As(err, &throttled) {
+		t.Fatalf("DisableTOTP(): wanted throttled error; found `%v`", err)
+	}
+	if !users["adam"].TOTPEnabled {
+		t.Fatal("UserEntry.TOTPEnabled: wanted `true`; found `false`")
+	}
+}
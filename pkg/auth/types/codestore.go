@@ -0,0 +1,51 @@
+package types
+
+import (
+	"net/http"
+	"time"
+
+	pz "github.com/weberc2/httpeasy"
+)
+
+var (
+	ErrCodeRedeemed = &pz.HTTPError{
+		Status:  http.StatusUnauthorized,
+		Message: "code already redeemed",
+	}
+	ErrCodeNotFound = &pz.HTTPError{
+		Status:  http.StatusNotFound,
+		Message: "code not found",
+	}
+)
+
+// RedeemedCode records an auth code which has been exchanged for tokens.
+type RedeemedCode struct {
+	// ID is the code's `jti` claim.
+	ID string `json:"id"`
+
+	// Family is the family of the refresh token which was issued in exchange
+	// for the code. The family is revoked if the code is replayed.
+	Family string `json:"family"`
+
+	// Expires is the code's expiry time. The record can be deleted after this
+	// time since the code can no longer be exchanged anyway.
+	Expires time.Time `json:"expires"`
+}
+
+// CodeStore tracks redeemed auth codes so that each code can only be
+// exchanged once.
+type CodeStore interface {
+	// Redeem records a code as redeemed. Returns `ErrCodeRedeemed` if the code
+	// was already redeemed. Other errors (e.g., I/O errors) may also be
+	// returned.
+	Redeem(code *RedeemedCode) error
+
+	// Get returns the record for a redeemed code or `ErrCodeNotFound` if the
+	// code hasn't been redeemed. Other errors (e.g., I/O errors) may also be
+	// returned.
+	Get(id string) (*RedeemedCode, error)
+
+	// DeleteExpired deletes all records for codes which expire before the
+	// provided time.
+	DeleteExpired(time.Time) error
+}
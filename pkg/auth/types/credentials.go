@@ -10,6 +10,10 @@ type Credentials struct {
 	User     UserID `json:"user"`
 	Email    string `json:"email"`
 	Password string `json:"password"`
+
+	// Locale is the user's preferred locale. It's recorded when the user is
+	// created; it isn't part of the credentials' JSON.
+	Locale string `json:"-"`
 }
 
 func (wanted *Credentials) CompareUserEntry(found *UserEntry) error {
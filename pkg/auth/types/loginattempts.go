@@ -0,0 +1,113 @@
+package types
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	pz "github.com/weberc2/httpeasy"
+)
+
+var (
+	ErrLoginAttemptsNotFound = &pz.HTTPError{
+		Status:  http.StatusNotFound,
+		Message: "login attempts not found",
+	}
+	ErrLoginAttemptsExists = &pz.HTTPError{
+		Status:  http.StatusConflict,
+		Message: "login attempts already exist",
+	}
+)
+
+// LoginAttempts tracks the recent failed logins for a throttling key (e.g., a
+// user or a client IP address).
+type LoginAttempts struct {
+	Key string `json:"key"`
+
+	// Failures is the number of consecutive failed logins. It starts over
+	// when a login fails long enough after the previous failure.
+	Failures int `json:"failures"`
+
+	// LastFailure is the time of the most recent failed login.
+	LastFailure time.Time `json:"lastFailure"`
+
+	// LockedUntil is the end of the key's most recent lockout. It's in the
+	// past (or the zero time) if the key isn't locked out.
+	LockedUntil time.Time `json:"lockedUntil"`
+}
+
+// LoginAttemptStore stores failed login attempts for throttling. `Fail` and
+// `Refund` must be atomic so that concurrent guesses can't slip past the
+// throttle.
+type LoginAttemptStore interface {
+	// Get returns the attempts for a key. If there are none,
+	// `ErrLoginAttemptsNotFound` is returned.
+	Get(key string) (*LoginAttempts, error)
+
+	// Fail records a failed login at `now` and returns the updated
+	// attempts. If the previous failure was more than `window` before
+	// `now`, the count starts over.
+	Fail(key string, now time.Time, window time.Duration) (
+		*LoginAttempts,
+		error,
+	)
+
+	// Refund takes back a failure recorded by `Fail` for an attempt which
+	// didn't fail. The last failure time is left alone, and the count never
+	// drops below zero. Refunding a key without attempts isn't an error.
+	Refund(key string) error
+
+	// Lock locks the key out until the provided time.
+	Lock(key string, until time.Time) error
+
+	// Reset forgets the attempts for a key. Resetting a key without attempts
+	// isn't an error.
+	Reset(key string) error
+}
+
+func (wanted *LoginAttempts) Compare(found *LoginAttempts) error {
+	if wanted == found {
+		return nil
+	}
+	if wanted == nil || found == nil {
+		return fmt.Errorf(
+			"LoginAttempts: wanted `%v`; found `%v`",
+			wanted,
+			found,
+		)
+	}
+
+	if wanted.Key != found.Key {
+		return fmt.Errorf(
+			"LoginAttempts.Key: wanted `%s`; found `%s`",
+			wanted.Key,
+			found.Key,
+		)
+	}
+
+	if wanted.Failures != found.Failures {
+		return fmt.Errorf(
+			"LoginAttempts.Failures: wanted `%d`; found `%d`",
+			wanted.Failures,
+			found.Failures,
+		)
+	}
+
+	if !wanted.LastFailure.Equal(found.LastFailure) {
+		return fmt.Errorf(
+			"LoginAttempts.LastFailure: wanted `%s`; found `%s`",
+			wanted.LastFailure,
+			found.LastFailure,
+		)
+	}
+
+	if !wanted.LockedUntil.Equal(found.LockedUntil) {
+		return fmt.Errorf(
+			"LoginAttempts.LockedUntil: wanted `%s`; found `%s`",
+			wanted.LockedUntil,
+			found.LockedUntil,
+		)
+	}
+
+	return nil
+}
@@ -10,13 +10,40 @@ type NotificationType string
 const (
 	NotificationTypeRegister       NotificationType = "REGISTER"
 	NotificationTypeForgotPassword NotificationType = "FORGOT_PASSWORD"
+
+	// NotificationTypeLockout tells a user that their account was
+	// temporarily locked after too many failed logins. Lockout notifications
+	// don't have a token.
+	NotificationTypeLockout NotificationType = "LOCKOUT"
+
+	// NotificationTypeEmailChange asks a user to confirm a new email address.
+	// It's sent to the new address.
+	NotificationTypeEmailChange NotificationType = "EMAIL_CHANGE"
+
+	// NotificationTypeEmailChangeNotice tells a user that a change of their
+	// email address was requested. It's sent to the old address, and it
+	// doesn't have a token.
+	NotificationTypeEmailChangeNotice NotificationType = "EMAIL_CHANGE_NOTICE"
+
+	// NotificationTypeMagicLink carries a link which logs the user in
+	// without their password. The token may only be used once.
+	NotificationTypeMagicLink NotificationType = "MAGIC_LINK"
 )
 
 type Notification struct {
-	Type  NotificationType
-	User  UserID
-	Email string
-	Token string
+	// ID optionally identifies the notification. It's set when a
+	// notification may be delivered more than once (e.g., from an outbox) so
+	// that receivers can recognize duplicates.
+	ID string `json:"id,omitempty"`
+
+	Type  NotificationType `json:"type"`
+	User  UserID           `json:"user"`
+	Email string           `json:"email"`
+	Token string           `json:"token,omitempty"`
+
+	// Locale is the recipient's preferred locale (a BCP 47 tag, e.g.,
+	// `pt-BR`), if known. It selects the notification's templates.
+	Locale string `json:"locale,omitempty"`
 }
 
 type NotificationService interface {
@@ -36,6 +63,14 @@ func (wanted *Notification) Compare(found *Notification) error {
 		return fmt.Errorf("Notification: wanted `nil`; found not-nil")
 	}
 
+	if wanted.ID != found.ID {
+		return fmt.Errorf(
+			"Notification.ID: wanted `%s`; found `%s`",
+			wanted.ID,
+			found.ID,
+		)
+	}
+
 	if wanted.Type != found.Type {
 		return fmt.Errorf(
 			"Notification.Type: wanted `%s`; found `%s`",
@@ -68,6 +103,14 @@ func (wanted *Notification) Compare(found *Notification) error {
 		)
 	}
 
+	if wanted.Locale != found.Locale {
+		return fmt.Errorf(
+			"Notification.Locale: wanted `%s`; found `%s`",
+			wanted.Locale,
+			found.Locale,
+		)
+	}
+
 	return nil
 }
 
@@ -0,0 +1,134 @@
+package types
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	pz "github.com/weberc2/httpeasy"
+)
+
+var (
+	ErrOutboxEntryNotFound = &pz.HTTPError{
+		Status:  http.StatusNotFound,
+		Message: "outbox entry not found",
+	}
+	ErrOutboxEntryExists = &pz.HTTPError{
+		Status:  http.StatusConflict,
+		Message: "outbox entry exists",
+	}
+)
+
+type OutboxStatus string
+
+const (
+	// OutboxStatusPending entries are delivered once their `NextAttempt`
+	// passes.
+	OutboxStatusPending OutboxStatus = "PENDING"
+
+	// OutboxStatusDead entries failed too many times. They're kept until
+	// they're replayed or deleted.
+	OutboxStatusDead OutboxStatus = "DEAD"
+)
+
+// OutboxEntry is a notification waiting to be delivered. Delivered entries
+// are deleted.
+type OutboxEntry struct {
+	ID           string
+	Notification Notification
+	Status       OutboxStatus
+	Attempts     int
+	NextAttempt  time.Time
+	LastError    string
+	Created      time.Time
+}
+
+func (wanted *OutboxEntry) Compare(found *OutboxEntry) error {
+	if wanted == nil && found == nil {
+		return nil
+	}
+	if wanted != nil && found == nil {
+		return fmt.Errorf("OutboxEntry: unexpected `nil`")
+	}
+	if wanted == nil && found != nil {
+		return fmt.Errorf("OutboxEntry: wanted `nil`; found not-nil")
+	}
+	if wanted.ID != found.ID {
+		return fmt.Errorf(
+			"OutboxEntry.ID: wanted `%s`; found `%s`",
+			wanted.ID,
+			found.ID,
+		)
+	}
+	if err := wanted.Notification.Compare(&found.Notification); err != nil {
+		return fmt.Errorf("OutboxEntry.%w", err)
+	}
+	if wanted.Status != found.Status {
+		return fmt.Errorf(
+			"OutboxEntry.Status: wanted `%s`; found `%s`",
+			wanted.Status,
+			found.Status,
+		)
+	}
+	if wanted.Attempts != found.Attempts {
+		return fmt.Errorf(
+			"OutboxEntry.Attempts: wanted `%d`; found `%d`",
+			wanted.Attempts,
+			found.Attempts,
+		)
+	}
+	if !wanted.NextAttempt.Equal(found.NextAttempt) {
+		return fmt.Errorf(
+			"OutboxEntry.NextAttempt: wanted `%s`; found `%s`",
+			wanted.NextAttempt,
+			found.NextAttempt,
+		)
+	}
+	if wanted.LastError != found.LastError {
+		return fmt.Errorf(
+			"OutboxEntry.LastError: wanted `%s`; found `%s`",
+			wanted.LastError,
+			found.LastError,
+		)
+	}
+	if !wanted.Created.Equal(found.Created) {
+		return fmt.Errorf(
+			"OutboxEntry.Created: wanted `%s`; found `%s`",
+			wanted.Created,
+			found.Created,
+		)
+	}
+	return nil
+}
+
+// OutboxStore persists notifications until they're delivered.
+type OutboxStore interface {
+	// Enqueue adds an entry. If an entry with the same ID exists,
+	// `ErrOutboxEntryExists` is returned.
+	Enqueue(*OutboxEntry) error
+
+	// Claim returns up to `limit` pending entries whose `NextAttempt` has
+	// passed, oldest first, and postpones their `NextAttempt` by `lease` so
+	// that concurrent workers don't claim them too. If the claiming worker
+	// dies, the entries are claimable again once the lease expires.
+	Claim(now time.Time, lease time.Duration, limit int) (
+		[]*OutboxEntry,
+		error,
+	)
+
+	// Update replaces an entry (e.g., to record a failed attempt). If the
+	// entry doesn't exist, `ErrOutboxEntryNotFound` is returned.
+	Update(*OutboxEntry) error
+
+	// Delete removes an entry (e.g., once it's delivered). If the entry
+	// doesn't exist, `ErrOutboxEntryNotFound` is returned.
+	Delete(id string) error
+
+	// Dead lists the dead-lettered entries, oldest first.
+	Dead() ([]*OutboxEntry, error)
+
+	// Replay makes a dead-lettered entry pending again with no attempts,
+	// due at `now`. If there is no dead-lettered entry with the ID,
+	// `ErrOutboxEntryNotFound` is returned.
+	Replay(id string, now time.Time) error
+}
@@ -0,0 +1,65 @@
+package types
+
+import (
+	"fmt"
+	"time"
+)
+
+// RateLimitWindow counts the events for a rate-limiting key (e.g., the
+// emails sent to an address) in a fixed window of time.
+type RateLimitWindow struct {
+	Key   string    `json:"key"`
+	Count int       `json:"count"`
+	Start time.Time `json:"start"`
+}
+
+// RateLimitStore stores fixed-window event counts for rate limiting.
+type RateLimitStore interface {
+	// Increment counts an event for the key at `now` and returns the key's
+	// current window. If the key's window started `window` or more before
+	// `now`, a new window starting at `now` replaces it. Increment must be
+	// atomic so that concurrent events are all counted.
+	Increment(key string, now time.Time, window time.Duration) (
+		*RateLimitWindow,
+		error,
+	)
+}
+
+func (wanted *RateLimitWindow) Compare(found *RateLimitWindow) error {
+	if wanted == found {
+		return nil
+	}
+	if wanted == nil || found == nil {
+		return fmt.Errorf(
+			"RateLimitWindow: wanted `%v`; found `%v`",
+			wanted,
+			found,
+		)
+	}
+
+	if wanted.Key != found.Key {
+		return fmt.Errorf(
+			"RateLimitWindow.Key: wanted `%s`; found `%s`",
+			wanted.Key,
+			found.Key,
+		)
+	}
+
+	if wanted.Count != found.Count {
+		return fmt.Errorf(
+			"RateLimitWindow.Count: wanted `%d`; found `%d`",
+			wanted.Count,
+			found.Count,
+		)
+	}
+
+	if !wanted.Start.Equal(found.Start) {
+		return fmt.Errorf(
+			"RateLimitWindow.Start: wanted `%s`; found `%s`",
+			wanted.Start,
+			found.Start,
+		)
+	}
+
+	return nil
+}
@@ -0,0 +1,105 @@
+package types
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	pz "github.com/weberc2/httpeasy"
+)
+
+var ErrSessionNotFound = &pz.HTTPError{
+	Status:  http.StatusNotFound,
+	Message: "session not found",
+}
+
+// ClientInfo describes the client which started a session.
+type ClientInfo struct {
+	UserAgent string `json:"userAgent,omitempty"`
+	IP        string `json:"ip,omitempty"`
+}
+
+// Session is a login which hasn't been logged out or revoked, i.e., a family
+// of refresh tokens (see `Token.Family`) which still has a valid member.
+type Session struct {
+	// ID is the refresh token family.
+	ID string `json:"id"`
+
+	// Subject is the user who logged in.
+	Subject string `json:"subject"`
+
+	// IssuedAt is the time of the login. It doesn't change as the session's
+	// refresh tokens are rotated.
+	IssuedAt time.Time `json:"issuedAt"`
+
+	ClientInfo
+}
+
+func (wanted *Session) Compare(found *Session) error {
+	if wanted == found {
+		return nil
+	}
+	if (wanted == nil && found != nil) || (wanted != nil && found == nil) {
+		return fmt.Errorf("Session: wanted `%v`; found `%v`", wanted, found)
+	}
+
+	if wanted.ID != found.ID {
+		return fmt.Errorf(
+			"Session.ID: wanted `%s`; found `%s`",
+			wanted.ID,
+			found.ID,
+		)
+	}
+
+	if wanted.Subject != found.Subject {
+		return fmt.Errorf(
+			"Session.Subject: wanted `%s`; found `%s`",
+			wanted.Subject,
+			found.Subject,
+		)
+	}
+
+	if !wanted.IssuedAt.Equal(found.IssuedAt) {
+		return fmt.Errorf(
+			"Session.IssuedAt: wanted `%s`; found `%s`",
+			wanted.IssuedAt,
+			found.IssuedAt,
+		)
+	}
+
+	if wanted.UserAgent != found.UserAgent {
+		return fmt.Errorf(
+			"Session.UserAgent: wanted `%s`; found `%s`",
+			wanted.UserAgent,
+			found.UserAgent,
+		)
+	}
+
+	if wanted.IP != found.IP {
+		return fmt.Errorf(
+			"Session.IP: wanted `%s`; found `%s`",
+			wanted.IP,
+			found.IP,
+		)
+	}
+
+	return nil
+}
+
+func CompareSessions(wanted, found []Session) error {
+	if len(wanted) != len(found) {
+		return fmt.Errorf(
+			"len([]Session): wanted `%d`; found `%d`",
+			len(wanted),
+			len(found),
+		)
+	}
+
+	for i := range wanted {
+		if err := wanted[i].Compare(&found[i]); err != nil {
+			return fmt.Errorf("[]Session[%d]: %w", i, err)
+		}
+	}
+
+	return nil
+}
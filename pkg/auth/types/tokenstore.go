@@ -1,6 +1,8 @@
 package types
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"net/http"
 	"time"
@@ -20,10 +22,23 @@ var (
 )
 
 type Token struct {
-	Token   string    `json:"token"`
+	Token string `json:"token"`
+
+	// Family identifies the chain of refresh tokens which descend from a
+	// single login. It's empty for other kinds of tokens.
+	Family  string    `json:"family,omitempty"`
 	Expires time.Time `json:"expires"`
 }
 
+// TokenDigest returns the hex-encoded SHA-256 digest of a token. Persistent
+// `TokenStore` implementations key tokens by their digest rather than storing
+// the tokens themselves so that a leaked store can't be used to impersonate
+// users.
+func TokenDigest(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
 func (wanted *Token) Compare(found *Token) error {
 	if wanted == found {
 		return nil
@@ -40,6 +55,14 @@ func (wanted *Token) Compare(found *Token) error {
 		)
 	}
 
+	if wanted.Family != found.Family {
+		return fmt.Errorf(
+			"TokenEntry.Family: wanted `%s`; found `%s`",
+			wanted.Family,
+			found.Family,
+		)
+	}
+
 	if !wanted.Expires.Equal(found.Expires) {
 		return fmt.Errorf(
 			"TokenEntry.Expires: wanted `%s`; found `%s`",
@@ -69,10 +92,15 @@ func CompareTokens(wanted, found []Token) error {
 	return nil
 }
 
+// TokenStore stores the refresh tokens which are currently valid. Refresh
+// tokens are rotated on each use, and the tokens descending from a single
+// login share a family so that the whole family can be revoked if a rotated
+// token is presented again. Each family is a session (see `Session`).
 type TokenStore interface {
-	// Put stores a token. Returns `ErrTokenexists` if the token already
-	// exists. Other errors (e.g., I/O errors) may also be returned.
-	Put(token string, expires time.Time) error
+	// Put stores a token as a member of the session's family. Returns
+	// `ErrTokenexists` if the token already exists. Other errors (e.g., I/O
+	// errors) may also be returned.
+	Put(token string, session *Session, expires time.Time) error
 
 	// Exists returns `nil` if the token exists or `ErrTokenNotFound` if not.
 	// Other errors (e.g., I/O errors) may also be returned.
@@ -82,10 +110,28 @@ type TokenStore interface {
 	// will be returned. Other errors (e.g., I/O errors) may also be returned.
 	Delete(token string) error
 
+	// DeleteFamily deletes all tokens in the family. If there are no such
+	// tokens, this is a no-op. Errors (e.g., I/O errors) may be returned.
+	DeleteFamily(family string) error
+
+	// GetSession returns the session for a token family or
+	// `ErrSessionNotFound` if the family has no tokens. Other errors (e.g.,
+	// I/O errors) may also be returned.
+	GetSession(family string) (*Session, error)
+
+	// ListSessions lists the subject's sessions.
+	ListSessions(subject string) ([]Session, error)
+
+	// DeleteSessions deletes all of the subject's tokens. If there are no
+	// such tokens, this is a no-op. Errors (e.g., I/O errors) may be
+	// returned.
+	DeleteSessions(subject string) error
+
 	// Delete expired will delete all tokens which expire before the provieded
 	// time.
 	DeleteExpired(time.Time) error
 
-	// List all token entries.
+	// List all token entries. Implementations which store token digests (see
+	// `TokenDigest`) return the digest in each entry's `Token` field.
 	List() ([]Token, error)
 }
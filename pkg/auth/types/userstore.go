@@ -16,6 +16,29 @@ type UserEntry struct {
 	Email        string    `json:"email"`
 	Created      time.Time `json:"created"`
 	PasswordHash []byte    `json:"-"`
+
+	// TOTPSecret is the user's encrypted TOTP secret. It's set when the user
+	// starts enrolling in two-factor authentication.
+	TOTPSecret string `json:"-"`
+
+	// TOTPEnabled is set once the user confirms enrollment with a valid code.
+	// From then on, logins require a second factor.
+	TOTPEnabled bool `json:"totpEnabled"`
+
+	// TOTPCounter is the time step of the last accepted TOTP code. Codes from
+	// this time step or earlier are rejected so that codes can't be replayed.
+	TOTPCounter int64 `json:"-"`
+
+	// RecoveryCodes are the digests of the user's unused recovery codes.
+	RecoveryCodes []string `json:"-"`
+
+	// PasswordHistory are the hashes of the user's previous passwords, newest
+	// first.
+	PasswordHistory [][]byte `json:"-"`
+
+	// Locale is the user's preferred locale for notifications (a BCP 47 tag,
+	// e.g., `pt-BR`). If it's empty, the default locale is used.
+	Locale string `json:"locale,omitempty"`
 }
 
 func (wanted *UserEntry) Compare(found *UserEntry) error {
@@ -49,6 +72,68 @@ func (wanted *UserEntry) Compare(found *UserEntry) error {
 			found.PasswordHash,
 		)
 	}
+	if wanted.TOTPSecret != found.TOTPSecret {
+		return fmt.Errorf(
+			"UserEntry.TOTPSecret: wanted `%s`; found `%s`",
+			wanted.TOTPSecret,
+			found.TOTPSecret,
+		)
+	}
+	if wanted.TOTPEnabled != found.TOTPEnabled {
+		return fmt.Errorf(
+			"UserEntry.TOTPEnabled: wanted `%t`; found `%t`",
+			wanted.TOTPEnabled,
+			found.TOTPEnabled,
+		)
+	}
+	if wanted.TOTPCounter != found.TOTPCounter {
+		return fmt.Errorf(
+			"UserEntry.TOTPCounter: wanted `%d`; found `%d`",
+			wanted.TOTPCounter,
+			found.TOTPCounter,
+		)
+	}
+	if len(wanted.RecoveryCodes) != len(found.RecoveryCodes) {
+		return fmt.Errorf(
+			"len(UserEntry.RecoveryCodes): wanted `%d`; found `%d`",
+			len(wanted.RecoveryCodes),
+			len(found.RecoveryCodes),
+		)
+	}
+	for i := range wanted.RecoveryCodes {
+		if wanted.RecoveryCodes[i] != found.RecoveryCodes[i] {
+			return fmt.Errorf(
+				"UserEntry.RecoveryCodes[%d]: wanted `%s`; found `%s`",
+				i,
+				wanted.RecoveryCodes[i],
+				found.RecoveryCodes[i],
+			)
+		}
+	}
+	if len(wanted.PasswordHistory) != len(found.PasswordHistory) {
+		return fmt.Errorf(
+			"len(UserEntry.PasswordHistory): wanted `%d`; found `%d`",
+			len(wanted.PasswordHistory),
+			len(found.PasswordHistory),
+		)
+	}
+	for i := range wanted.PasswordHistory {
+		if !bytes.Equal(wanted.PasswordHistory[i], found.PasswordHistory[i]) {
+			return fmt.Errorf(
+				"UserEntry.PasswordHistory[%d]: wanted `%s`; found `%s`",
+				i,
+				wanted.PasswordHistory[i],
+				found.PasswordHistory[i],
+			)
+		}
+	}
+	if wanted.Locale != found.Locale {
+		return fmt.Errorf(
+			"UserEntry.Locale: wanted `%s`; found `%s`",
+			wanted.Locale,
+			found.Locale,
+		)
+	}
 	return nil
 }
 
@@ -72,6 +157,11 @@ func CompareUserEntries(wanted, found []*UserEntry) error {
 
 type UserStore interface {
 	Get(UserID) (*UserEntry, error)
+
+	// GetByEmail returns the user with the email address. If there is none,
+	// `ErrUserNotFound` is returned.
+	GetByEmail(string) (*UserEntry, error)
+
 	Insert(*UserEntry) error
 	Upsert(*UserEntry) error
 }
@@ -0,0 +1,129 @@
+package types
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	pz "github.com/weberc2/httpeasy"
+)
+
+var (
+	ErrWebAuthnCredentialExists = &pz.HTTPError{
+		Status:  http.StatusConflict,
+		Message: "credential already registered",
+	}
+	ErrWebAuthnCredentialNotFound = &pz.HTTPError{
+		Status:  http.StatusNotFound,
+		Message: "credential not found",
+	}
+)
+
+// WebAuthnCredential is a public key credential (e.g., a passkey) which a user
+// has registered for logging in.
+type WebAuthnCredential struct {
+	User UserID `json:"user"`
+
+	// ID is the base64url-encoded credential ID.
+	ID string `json:"id"`
+
+	// PublicKey is the base64url-encoded PKIX (DER) public key.
+	PublicKey string `json:"-"`
+
+	// SignCount is the authenticator's signature counter as of the last
+	// login. Authenticators which don't implement a counter always report
+	// zero.
+	SignCount int64 `json:"signCount"`
+
+	Created time.Time `json:"created"`
+}
+
+func (wanted *WebAuthnCredential) Compare(found *WebAuthnCredential) error {
+	if wanted == found {
+		return nil
+	}
+	if (wanted == nil && found != nil) || (wanted != nil && found == nil) {
+		return fmt.Errorf(
+			"WebAuthnCredential: wanted `%v`; found `%v`",
+			wanted,
+			found,
+		)
+	}
+
+	if wanted.User != found.User {
+		return fmt.Errorf(
+			"WebAuthnCredential.User: wanted `%s`; found `%s`",
+			wanted.User,
+			found.User,
+		)
+	}
+
+	if wanted.ID != found.ID {
+		return fmt.Errorf(
+			"WebAuthnCredential.ID: wanted `%s`; found `%s`",
+			wanted.ID,
+			found.ID,
+		)
+	}
+
+	if wanted.PublicKey != found.PublicKey {
+		return fmt.Errorf(
+			"WebAuthnCredential.PublicKey: wanted `%s`; found `%s`",
+			wanted.PublicKey,
+			found.PublicKey,
+		)
+	}
+
+	if wanted.SignCount != found.SignCount {
+		return fmt.Errorf(
+			"WebAuthnCredential.SignCount: wanted `%d`; found `%d`",
+			wanted.SignCount,
+			found.SignCount,
+		)
+	}
+
+	if !wanted.Created.Equal(found.Created) {
+		return fmt.Errorf(
+			"WebAuthnCredential.Created: wanted `%s`; found `%s`",
+			wanted.Created,
+			found.Created,
+		)
+	}
+
+	return nil
+}
+
+func CompareWebAuthnCredentials(wanted, found []WebAuthnCredential) error {
+	if len(wanted) != len(found) {
+		return fmt.Errorf(
+			"len([]WebAuthnCredential): wanted `%d`; found `%d`",
+			len(wanted),
+			len(found),
+		)
+	}
+
+	for i := range wanted {
+		if err := wanted[i].Compare(&found[i]); err != nil {
+			return fmt.Errorf("[]WebAuthnCredential[%d]: %w", i, err)
+		}
+	}
+
+	return nil
+}
+
+// WebAuthnCredentialStore stores users' WebAuthn credentials.
+type WebAuthnCredentialStore interface {
+	// Insert adds a credential. Returns `ErrWebAuthnCredentialExists` if the
+	// user already has a credential with the same ID. Other errors (e.g., I/O
+	// errors) may also be returned.
+	Insert(credential *WebAuthnCredential) error
+
+	// Update replaces a credential (e.g., to record a new sign count).
+	// Returns `ErrWebAuthnCredentialNotFound` if the user has no credential
+	// with the same ID. Other errors (e.g., I/O errors) may also be returned.
+	Update(credential *WebAuthnCredential) error
+
+	// List returns the user's credentials ordered by ID. Users without
+	// credentials get an empty list rather than an error.
+	List(user UserID) ([]WebAuthnCredential, error)
+}
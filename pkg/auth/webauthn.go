@@ -0,0 +1,766 @@
+package auth
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/weberc2/auth/pkg/auth/types"
+	pz "github.com/weberc2/httpeasy"
+)
+
+const (
+	webAuthnChallengeSize = 32
+
+	// webAuthnTimeout is how long a user has to complete a ceremony.
+	webAuthnTimeout = 5 * time.Minute
+
+	// webAuthnAudience distinguishes ceremony tokens from auth codes, which
+	// are signed with the same key.
+	webAuthnAudience = "webauthn"
+
+	// coseAlgES256 is the COSE algorithm identifier for ECDSA with P-256 and
+	// SHA-256, the only algorithm we support.
+	coseAlgES256 = -7
+
+	// authenticator data flags (WebAuthn section 6.1)
+	authDataUserPresent  = 0x01
+	authDataUserVerified = 0x04
+	authDataAttested     = 0x40
+)
+
+var (
+	ErrWebAuthnUnavailable = &pz.HTTPError{
+		Status:  http.StatusNotImplemented,
+		Message: "passkeys are not configured",
+	}
+	ErrWebAuthn = &pz.HTTPError{
+		Status:  http.StatusUnauthorized,
+		Message: "passkey verification failed",
+	}
+)
+
+// WebAuthn configures passkey (WebAuthn) registration and login.
+type WebAuthn struct {
+	// RPID is the relying party ID: the domain which credentials are scoped
+	// to, e.g., `auth.example.org`.
+	RPID string
+
+	// RPName is the name which authenticators show for the relying party.
+	RPName string
+
+	// Origin is the origin which ceremonies must be performed from, e.g.,
+	// `https://auth.example.org`.
+	Origin string
+
+	// Credentials stores the registered credentials. If it's `nil`, passkeys
+	// are unavailable.
+	Credentials types.WebAuthnCredentialStore
+}
+
+// Base64URL is binary data which is represented in JSON as unpadded base64url
+// text, as is customary for WebAuthn data exchanged with browsers.
+type Base64URL []byte
+
+func (b Base64URL) MarshalJSON() ([]byte, error) {
+	return json.Marshal(base64.RawURLEncoding.EncodeToString(b))
+}
+
+func (b *Base64URL) UnmarshalJSON(data []byte) error {
+	var s *string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	if s == nil {
+		*b = nil
+		return nil
+	}
+	decoded, err := base64.RawURLEncoding.DecodeString(
+		strings.TrimRight(*s, "="),
+	)
+	if err != nil {
+		return fmt.Errorf("decoding base64url: %w", err)
+	}
+	*b = decoded
+	return nil
+}
+
+// WebAuthnRelyingParty identifies the relying party to authenticators.
+type WebAuthnRelyingParty struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+// WebAuthnUser identifies the user to authenticators.
+type WebAuthnUser struct {
+	ID          Base64URL `json:"id"`
+	Name        string    `json:"name"`
+	DisplayName string    `json:"displayName"`
+}
+
+type WebAuthnCredentialParameters struct {
+	Type string `json:"type"`
+	Alg  int    `json:"alg"`
+}
+
+type WebAuthnCredentialDescriptor struct {
+	Type string    `json:"type"`
+	ID   Base64URL `json:"id"`
+}
+
+type WebAuthnAuthenticatorSelection struct {
+	ResidentKey      string `json:"residentKey"`
+	UserVerification string `json:"userVerification"`
+}
+
+// WebAuthnCreationOptions are the options for
+// `navigator.credentials.create()`.
+type WebAuthnCreationOptions struct {
+	Challenge              Base64URL                      `json:"challenge"`
+	RP                     WebAuthnRelyingParty           `json:"rp"`
+	User                   WebAuthnUser                   `json:"user"`
+	PubKeyCredParams       []WebAuthnCredentialParameters `json:"pubKeyCredParams"`
+	Timeout                int64                          `json:"timeout"`
+	ExcludeCredentials     []WebAuthnCredentialDescriptor `json:"excludeCredentials"`
+	AuthenticatorSelection WebAuthnAuthenticatorSelection `json:"authenticatorSelection"`
+	Attestation            string                         `json:"attestation"`
+}
+
+// WebAuthnRequestOptions are the options for `navigator.credentials.get()`.
+type WebAuthnRequestOptions struct {
+	Challenge        Base64URL                      `json:"challenge"`
+	RPID             string                         `json:"rpId"`
+	Timeout          int64                          `json:"timeout"`
+	AllowCredentials []WebAuthnCredentialDescriptor `json:"allowCredentials"`
+	UserVerification string                         `json:"userVerification"`
+}
+
+// WebAuthnRegistration starts a registration ceremony. The token must be
+// returned along with the new credential.
+type WebAuthnRegistration struct {
+	Token     string                  `json:"token"`
+	PublicKey WebAuthnCreationOptions `json:"publicKey"`
+}
+
+// WebAuthnLogin starts a login (assertion) ceremony. The token must be
+// returned along with the assertion.
+type WebAuthnLogin struct {
+	Token     string                 `json:"token"`
+	PublicKey WebAuthnRequestOptions `json:"publicKey"`
+}
+
+// WebAuthnAttestation is the `PublicKeyCredential` returned by
+// `navigator.credentials.create()` with its binary fields base64url-encoded.
+type WebAuthnAttestation struct {
+	RawID    Base64URL                   `json:"rawId"`
+	Type     string                      `json:"type"`
+	Response WebAuthnAttestationResponse `json:"response"`
+}
+
+type WebAuthnAttestationResponse struct {
+	ClientDataJSON    Base64URL `json:"clientDataJSON"`
+	AttestationObject Base64URL `json:"attestationObject"`
+}
+
+// WebAuthnAssertion is the `PublicKeyCredential` returned by
+// `navigator.credentials.get()` with its binary fields base64url-encoded.
+type WebAuthnAssertion struct {
+	RawID    Base64URL                 `json:"rawId"`
+	Type     string                    `json:"type"`
+	Response WebAuthnAssertionResponse `json:"response"`
+}
+
+type WebAuthnAssertionResponse struct {
+	ClientDataJSON    Base64URL `json:"clientDataJSON"`
+	AuthenticatorData Base64URL `json:"authenticatorData"`
+	Signature         Base64URL `json:"signature"`
+	UserHandle        Base64URL `json:"userHandle,omitempty"`
+}
+
+// webAuthnClaims are the claims carried by the tokens which link the two
+// steps of a ceremony. The challenge is kept in the token so that no
+// server-side state is needed until the ceremony completes.
+type webAuthnClaims struct {
+	Challenge    string      `json:"challenge"`
+	Registration bool        `json:"registration,omitempty"`
+	Params       *CodeParams `json:"params,omitempty"`
+	jwt.StandardClaims
+}
+
+// webAuthnChallenge creates a new challenge and the token which carries it.
+func (as *AuthService) webAuthnChallenge(
+	user types.UserID,
+	registration bool,
+	params *CodeParams,
+) (string, []byte, error) {
+	if as.WebAuthn.Credentials == nil {
+		return "", nil, ErrWebAuthnUnavailable
+	}
+
+	challenge := make([]byte, webAuthnChallengeSize)
+	if _, err := rand.Read(challenge); err != nil {
+		return "", nil, fmt.Errorf("generating challenge: %w", err)
+	}
+
+	now := as.TimeFunc()
+	claims := webAuthnClaims{
+		Challenge:      base64.RawURLEncoding.EncodeToString(challenge),
+		Registration:   registration,
+		Params:         params,
+		StandardClaims: as.Codes.StandardClaims(now, string(user)),
+	}
+	claims.Id = base64.RawURLEncoding.EncodeToString(challenge)
+	claims.Audience = webAuthnAudience
+	claims.ExpiresAt = now.Add(webAuthnTimeout).Unix()
+
+	token, err := as.Codes.Sign(&claims)
+	if err != nil {
+		return "", nil, fmt.Errorf("creating webauthn token: %w", err)
+	}
+	return token, challenge, nil
+}
+
+// webAuthnClaims validates a ceremony token. Invalid tokens (including tokens
+// for the other kind of ceremony per `registration`) result in
+// `ErrUnauthorized`.
+func (as *AuthService) webAuthnClaims(
+	token string,
+	registration bool,
+) (*webAuthnClaims, error) {
+	if as.WebAuthn.Credentials == nil {
+		return nil, ErrWebAuthnUnavailable
+	}
+
+	var claims webAuthnClaims
+	if _, err := jwt.ParseWithClaims(
+		token,
+		&claims,
+		as.Codes.VerificationKey,
+	); err != nil {
+		log.Printf("jwt.ParseWithClaims(): %v", err)
+		return nil, ErrUnauthorized
+	}
+	if !claims.VerifyAudience(webAuthnAudience, true) {
+		log.Printf("token isn't a webauthn token")
+		return nil, ErrUnauthorized
+	}
+	if claims.Registration != registration {
+		log.Printf(
+			"webauthn token is for the wrong ceremony: registration: %t",
+			claims.Registration,
+		)
+		return nil, ErrUnauthorized
+	}
+	return &claims, nil
+}
+
+// redeemWebAuthnToken makes sure that each ceremony token is only used once
+// so that responses can't be replayed.
+func (as *AuthService) redeemWebAuthnToken(claims *webAuthnClaims) error {
+	if err := as.RedeemedCodes.Redeem(&types.RedeemedCode{
+		ID:      claims.Id,
+		Expires: time.Unix(claims.ExpiresAt, 0),
+	}); err != nil {
+		if errors.Is(err, types.ErrCodeRedeemed) {
+			log.Printf("webauthn token `%s` replayed", claims.Id)
+			return ErrUnauthorized
+		}
+		return fmt.Errorf("redeeming webauthn token: %w", err)
+	}
+	return nil
+}
+
+// BeginWebAuthnRegistration starts registering a new credential for the user.
+func (as *AuthService) BeginWebAuthnRegistration(
+	user types.UserID,
+) (*WebAuthnRegistration, error) {
+	entry, err := as.Creds.Users.Get(user)
+	if err != nil {
+		return nil, fmt.Errorf("beginning webauthn registration: %w", err)
+	}
+
+	token, challenge, err := as.webAuthnChallenge(user, true, nil)
+	if err != nil {
+		return nil, fmt.Errorf("beginning webauthn registration: %w", err)
+	}
+
+	// Authenticators refuse to create a second credential for the same user
+	// if it would replace one of these.
+	exclude, err := as.webAuthnCredentialDescriptors(user)
+	if err != nil {
+		return nil, fmt.Errorf("beginning webauthn registration: %w", err)
+	}
+
+	return &WebAuthnRegistration{
+		Token: token,
+		PublicKey: WebAuthnCreationOptions{
+			Challenge: challenge,
+			RP: WebAuthnRelyingParty{
+				ID:   as.WebAuthn.RPID,
+				Name: as.WebAuthn.RPName,
+			},
+			User: WebAuthnUser{
+				ID:          Base64URL(user),
+				Name:        string(user),
+				DisplayName: entry.Email,
+			},
+			PubKeyCredParams: []WebAuthnCredentialParameters{{
+				Type: "public-key",
+				Alg:  coseAlgES256,
+			}},
+			Timeout:            webAuthnTimeout.Milliseconds(),
+			ExcludeCredentials: exclude,
+			AuthenticatorSelection: WebAuthnAuthenticatorSelection{
+				ResidentKey:      "preferred",
+				UserVerification: "required",
+			},
+			Attestation: "none",
+		},
+	}, nil
+}
+
+// FinishWebAuthnRegistration verifies a new credential from the browser and
+// stores it. Attestation statements aren't verified: we request `none`
+// attestation since we don't restrict which authenticators may be used.
+func (as *AuthService) FinishWebAuthnRegistration(
+	user types.UserID,
+	token string,
+	attestation *WebAuthnAttestation,
+) error {
+	claims, err := as.webAuthnClaims(token, true)
+	if err != nil {
+		return fmt.Errorf("finishing webauthn registration: %w", err)
+	}
+	if claims.Subject != string(user) {
+		log.Printf(
+			"webauthn token for `%s` used by `%s`",
+			claims.Subject,
+			user,
+		)
+		return fmt.Errorf(
+			"finishing webauthn registration: %w",
+			ErrUnauthorized,
+		)
+	}
+
+	authData, err := as.verifyWebAuthnAttestation(claims, attestation)
+	if err != nil {
+		return fmt.Errorf(
+			"finishing webauthn registration: %v: %w",
+			err,
+			ErrWebAuthn,
+		)
+	}
+
+	if err := as.redeemWebAuthnToken(claims); err != nil {
+		return fmt.Errorf("finishing webauthn registration: %w", err)
+	}
+
+	if err := as.WebAuthn.Credentials.Insert(&types.WebAuthnCredential{
+		User:      user,
+		ID:        base64.RawURLEncoding.EncodeToString(attestation.RawID),
+		PublicKey: authData.publicKey,
+		SignCount: int64(authData.signCount),
+		Created:   as.TimeFunc(),
+	}); err != nil {
+		return fmt.Errorf("finishing webauthn registration: %w", err)
+	}
+
+	return nil
+}
+
+func (as *AuthService) verifyWebAuthnAttestation(
+	claims *webAuthnClaims,
+	attestation *WebAuthnAttestation,
+) (*authenticatorData, error) {
+	if err := as.verifyClientData(
+		attestation.Response.ClientDataJSON,
+		"webauthn.create",
+		claims.Challenge,
+	); err != nil {
+		return nil, err
+	}
+
+	d := cborDecoder{data: attestation.Response.AttestationObject}
+	object, err := d.decode()
+	if err != nil {
+		return nil, fmt.Errorf("decoding attestation object: %w", err)
+	}
+	m, ok := object.(map[interface{}]interface{})
+	if !ok {
+		return nil, fmt.Errorf("attestation object isn't a map")
+	}
+	data, ok := m["authData"].([]byte)
+	if !ok {
+		return nil, fmt.Errorf("attestation object is missing `authData`")
+	}
+
+	authData, err := as.verifyAuthenticatorData(data)
+	if err != nil {
+		return nil, err
+	}
+	if authData.flags&authDataAttested == 0 {
+		return nil, fmt.Errorf("authenticator data has no credential")
+	}
+	if !bytes.Equal(authData.credentialID, attestation.RawID) {
+		return nil, fmt.Errorf("credential ID mismatch")
+	}
+	return authData, nil
+}
+
+// BeginWebAuthnLogin starts a passkey login for the user. Like
+// `LoginAuthCode`, the code params are bound into the resulting auth code.
+// Unknown users get a challenge (without any allowed credentials) like
+// everyone else so as to not give away which users exist.
+func (as *AuthService) BeginWebAuthnLogin(
+	user types.UserID,
+	params *CodeParams,
+) (*WebAuthnLogin, error) {
+	if params != nil {
+		method, err := codeChallenge(
+			params.CodeChallenge,
+			params.CodeChallengeMethod,
+		)
+		if err != nil {
+			return nil, err
+		}
+		params.CodeChallengeMethod = method
+	}
+
+	// As with passwords, users may identify themselves by email address.
+	user = as.Creds.userID(user)
+
+	token, challenge, err := as.webAuthnChallenge(user, false, params)
+	if err != nil {
+		return nil, fmt.Errorf("beginning webauthn login: %w", err)
+	}
+
+	allow, err := as.webAuthnCredentialDescriptors(user)
+	if err != nil {
+		return nil, fmt.Errorf("beginning webauthn login: %w", err)
+	}
+
+	return &WebAuthnLogin{
+		Token: token,
+		PublicKey: WebAuthnRequestOptions{
+			Challenge:        challenge,
+			RPID:             as.WebAuthn.RPID,
+			Timeout:          webAuthnTimeout.Milliseconds(),
+			AllowCredentials: allow,
+			UserVerification: "required",
+		},
+	}, nil
+}
+
+// FinishWebAuthnLogin verifies a passkey assertion and mints an auth code
+// exactly like `LoginAuthCode` does for a password login.
+func (as *AuthService) FinishWebAuthnLogin(
+	token string,
+	assertion *WebAuthnAssertion,
+	client *types.ClientInfo,
+) (string, error) {
+	claims, err := as.webAuthnClaims(token, false)
+	if err != nil {
+		return "", fmt.Errorf("finishing webauthn login: %w", err)
+	}
+
+	// Failed assertions count against the login throttle like wrong
+	// passwords, so that a locked-out account can't be logged into with a
+	// passkey either.
+	user := types.UserID(claims.Subject)
+	var credential *types.WebAuthnCredential
+	var signCount uint32
+	if err := as.throttled(
+		user,
+		client,
+		ErrWebAuthn,
+		func() error {
+			credential, signCount, err = as.verifyWebAuthnAssertion(
+				claims,
+				assertion,
+			)
+			if err != nil {
+				return fmt.Errorf("%v: %w", err, ErrWebAuthn)
+			}
+			return nil
+		},
+	); err != nil {
+		return "", fmt.Errorf("finishing webauthn login: %w", err)
+	}
+
+	if err := as.redeemWebAuthnToken(claims); err != nil {
+		return "", fmt.Errorf("finishing webauthn login: %w", err)
+	}
+
+	credential.SignCount = int64(signCount)
+	if err := as.WebAuthn.Credentials.Update(credential); err != nil {
+		return "", fmt.Errorf("finishing webauthn login: %w", err)
+	}
+	if err := as.Throttle.succeed(user); err != nil {
+		return "", fmt.Errorf("finishing webauthn login: %w", err)
+	}
+
+	return as.authCode(credential.User, claims.Params, client)
+}
+
+func (as *AuthService) verifyWebAuthnAssertion(
+	claims *webAuthnClaims,
+	assertion *WebAuthnAssertion,
+) (*types.WebAuthnCredential, uint32, error) {
+	credentials, err := as.WebAuthn.Credentials.List(
+		types.UserID(claims.Subject),
+	)
+	if err != nil {
+		return nil, 0, fmt.Errorf("listing credentials: %w", err)
+	}
+	id := base64.RawURLEncoding.EncodeToString(assertion.RawID)
+	var credential *types.WebAuthnCredential
+	for i := range credentials {
+		if credentials[i].ID == id {
+			credential = &credentials[i]
+			break
+		}
+	}
+	if credential == nil {
+		return nil, 0, fmt.Errorf("unknown credential `%s`", id)
+	}
+
+	if assertion.Response.UserHandle != nil && !bytes.Equal(
+		assertion.Response.UserHandle,
+		[]byte(claims.Subject),
+	) {
+		return nil, 0, fmt.Errorf("user handle mismatch")
+	}
+
+	if err := as.verifyClientData(
+		assertion.Response.ClientDataJSON,
+		"webauthn.get",
+		claims.Challenge,
+	); err != nil {
+		return nil, 0, err
+	}
+
+	authData, err := as.verifyAuthenticatorData(
+		assertion.Response.AuthenticatorData,
+	)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	der, err := base64.RawURLEncoding.DecodeString(credential.PublicKey)
+	if err != nil {
+		return nil, 0, fmt.Errorf("decoding public key: %w", err)
+	}
+	key, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		return nil, 0, fmt.Errorf("parsing public key: %w", err)
+	}
+	publicKey, ok := key.(*ecdsa.PublicKey)
+	if !ok {
+		return nil, 0, fmt.Errorf("unsupported public key type `%T`", key)
+	}
+
+	clientDataHash := sha256.Sum256(assertion.Response.ClientDataJSON)
+	digest := sha256.Sum256(append(
+		append([]byte(nil), assertion.Response.AuthenticatorData...),
+		clientDataHash[:]...,
+	))
+	if !ecdsa.VerifyASN1(
+		publicKey,
+		digest[:],
+		assertion.Response.Signature,
+	) {
+		return nil, 0, fmt.Errorf("invalid signature")
+	}
+
+	// A counter which doesn't increase suggests that the authenticator was
+	// cloned. Authenticators without counters always report zero.
+	if (authData.signCount != 0 || credential.SignCount != 0) &&
+		int64(authData.signCount) <= credential.SignCount {
+		return nil, 0, fmt.Errorf(
+			"sign count didn't increase (stored: %d; received: %d)",
+			credential.SignCount,
+			authData.signCount,
+		)
+	}
+
+	return credential, authData.signCount, nil
+}
+
+// webAuthnCredentialDescriptors describes the user's credentials for the
+// browser.
+func (as *AuthService) webAuthnCredentialDescriptors(
+	user types.UserID,
+) ([]WebAuthnCredentialDescriptor, error) {
+	credentials, err := as.WebAuthn.Credentials.List(user)
+	if err != nil {
+		return nil, fmt.Errorf("listing credentials: %w", err)
+	}
+
+	descriptors := make([]WebAuthnCredentialDescriptor, len(credentials))
+	for i := range credentials {
+		id, err := base64.RawURLEncoding.DecodeString(credentials[i].ID)
+		if err != nil {
+			return nil, fmt.Errorf("decoding credential ID: %w", err)
+		}
+		descriptors[i] = WebAuthnCredentialDescriptor{
+			Type: "public-key",
+			ID:   id,
+		}
+	}
+	return descriptors, nil
+}
+
+// verifyClientData checks the client data collected by the browser
+// (WebAuthn section 5.8.1).
+func (as *AuthService) verifyClientData(
+	data []byte,
+	ceremony string,
+	challenge string,
+) error {
+	var clientData struct {
+		Type      string `json:"type"`
+		Challenge string `json:"challenge"`
+		Origin    string `json:"origin"`
+	}
+	if err := json.Unmarshal(data, &clientData); err != nil {
+		return fmt.Errorf("parsing client data: %w", err)
+	}
+	if clientData.Type != ceremony {
+		return fmt.Errorf("client data has wrong type `%s`", clientData.Type)
+	}
+	if clientData.Challenge != challenge {
+		return fmt.Errorf("client data has wrong challenge")
+	}
+	if clientData.Origin != as.WebAuthn.Origin {
+		return fmt.Errorf(
+			"client data has wrong origin `%s`",
+			clientData.Origin,
+		)
+	}
+	return nil
+}
+
+// authenticatorData is the parsed authenticator data (WebAuthn section 6.1).
+// The credential ID and public key are only set for attestations.
+type authenticatorData struct {
+	rpIDHash     []byte
+	flags        byte
+	signCount    uint32
+	credentialID []byte
+
+	// publicKey is the base64url-encoded PKIX (DER) public key.
+	publicKey string
+}
+
+// verifyAuthenticatorData parses the authenticator data and checks that it's
+// for our relying party and that the user was verified.
+func (as *AuthService) verifyAuthenticatorData(
+	data []byte,
+) (*authenticatorData, error) {
+	authData, err := parseAuthenticatorData(data)
+	if err != nil {
+		return nil, err
+	}
+
+	rpIDHash := sha256.Sum256([]byte(as.WebAuthn.RPID))
+	if !bytes.Equal(authData.rpIDHash, rpIDHash[:]) {
+		return nil, fmt.Errorf("authenticator data is for another RP ID")
+	}
+	if authData.flags&authDataUserPresent == 0 {
+		return nil, fmt.Errorf("user wasn't present")
+	}
+	if authData.flags&authDataUserVerified == 0 {
+		return nil, fmt.Errorf("user wasn't verified")
+	}
+	return authData, nil
+}
+
+func parseAuthenticatorData(data []byte) (*authenticatorData, error) {
+	if len(data) < 37 {
+		return nil, fmt.Errorf("authenticator data too short")
+	}
+	authData := authenticatorData{
+		rpIDHash:  data[:32],
+		flags:     data[32],
+		signCount: binary.BigEndian.Uint32(data[33:37]),
+	}
+	if authData.flags&authDataAttested == 0 {
+		return &authData, nil
+	}
+
+	// attested credential data: AAGUID (16 bytes), credential ID length (2
+	// bytes), credential ID, and COSE public key
+	rest := data[37:]
+	if len(rest) < 18 {
+		return nil, fmt.Errorf("attested credential data too short")
+	}
+	n := int(binary.BigEndian.Uint16(rest[16:18]))
+	rest = rest[18:]
+	if len(rest) < n {
+		return nil, fmt.Errorf("attested credential data too short")
+	}
+	authData.credentialID = rest[:n]
+
+	d := cborDecoder{data: rest[n:]}
+	key, err := d.decode()
+	if err != nil {
+		return nil, fmt.Errorf("decoding credential public key: %w", err)
+	}
+	publicKey, err := coseES256Key(key)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalPKIXPublicKey(publicKey)
+	if err != nil {
+		return nil, fmt.Errorf("marshaling public key: %w", err)
+	}
+	authData.publicKey = base64.RawURLEncoding.EncodeToString(der)
+	return &authData, nil
+}
+
+// coseES256Key converts a decoded COSE_Key (RFC 8152 section 13.1.1) to an
+// ECDSA public key. Only ES256 (P-256) keys are supported.
+func coseES256Key(key interface{}) (*ecdsa.PublicKey, error) {
+	m, ok := key.(map[interface{}]interface{})
+	if !ok {
+		return nil, fmt.Errorf("credential public key isn't a map")
+	}
+
+	// labels: 1 = kty (2 = EC2), 3 = alg, -1 = crv (1 = P-256), -2 = x,
+	// -3 = y
+	if m[int64(1)] != int64(2) ||
+		m[int64(3)] != int64(coseAlgES256) ||
+		m[int64(-1)] != int64(1) {
+		return nil, fmt.Errorf("unsupported credential public key type")
+	}
+	x, xOK := m[int64(-2)].([]byte)
+	y, yOK := m[int64(-3)].([]byte)
+	if !xOK || !yOK || len(x) != 32 || len(y) != 32 {
+		return nil, fmt.Errorf("malformed credential public key")
+	}
+
+	publicKey := ecdsa.PublicKey{
+		Curve: elliptic.P256(),
+		X:     new(big.Int).SetBytes(x),
+		Y:     new(big.Int).SetBytes(y),
+	}
+	if !publicKey.Curve.IsOnCurve(publicKey.X, publicKey.Y) {
+		return nil, fmt.Errorf("credential public key isn't on the curve")
+	}
+	return &publicKey, nil
+}
@@ -0,0 +1,614 @@
+package auth
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/weberc2/auth/pkg/auth/testsupport"
+	"github.com/weberc2/auth/pkg/auth/types"
+	pz "github.com/weberc2/httpeasy"
+	pztest "github.com/weberc2/httpeasy/testsupport"
+)
+
+func TestCBORDecoder(t *testing.T) {
+	for _, testCase := range []struct {
+		name      string
+		data      []byte
+		wanted    interface{}
+		wantedErr bool
+	}{
+		{name: "small int", data: []byte{0x17}, wanted: int64(23)},
+		{name: "uint16", data: []byte{0x19, 0x01, 0x00}, wanted: int64(256)},
+		{name: "negative int", data: []byte{0x26}, wanted: int64(-7)},
+		{name: "bytes", data: []byte{0x42, 1, 2}, wanted: []byte{1, 2}},
+		{name: "text", data: []byte{0x62, 'h', 'i'}, wanted: "hi"},
+		{
+			name: "map",
+			data: []byte{0xa1, 0x61, 'k', 0x82, 0x01, 0xf5},
+			wanted: map[interface{}]interface{}{
+				"k": []interface{}{int64(1), true},
+			},
+		},
+		{name: "truncated", data: []byte{0x42, 1}, wantedErr: true},
+		{
+			name:      "huge array",
+			data:      []byte{0x9a, 0xff, 0xff, 0xff, 0xff},
+			wantedErr: true,
+		},
+		{name: "indefinite", data: []byte{0x5f}, wantedErr: true},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			d := cborDecoder{data: testCase.data}
+			found, err := d.decode()
+			if testCase.wantedErr {
+				if err == nil {
+					t.Fatalf("wanted error; found `%v`", found)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			wanted, _ := json.Marshal(cborJSON(testCase.wanted))
+			data, _ := json.Marshal(cborJSON(found))
+			if !bytes.Equal(wanted, data) {
+				t.Fatalf("wanted `%s`; found `%s`", wanted, data)
+			}
+		})
+	}
+}
+
+// cborJSON converts decoded CBOR into something `json.Marshal` accepts so
+// that values can be compared.
+func cborJSON(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[interface{}]interface{}:
+		m := map[string]interface{}{}
+		for key, value := range v {
+			data, _ := json.Marshal(key)
+			m[string(data)] = cborJSON(value)
+		}
+		return m
+	case []interface{}:
+		items := make([]interface{}, len(v))
+		for i := range v {
+			items[i] = cborJSON(v[i])
+		}
+		return items
+	}
+	return v
+}
+
+func TestAuthService_WebAuthn(t *testing.T) {
+	jwt.TimeFunc = nowTimeFunc
+	defer func() { jwt.TimeFunc = time.Now }()
+
+	credentials := testsupport.WebAuthnCredentialStoreFake{}
+	authService := testWebAuthnAuthService(credentials)
+	authenticator := newSoftwareAuthenticator(t)
+
+	registration, err := authService.BeginWebAuthnRegistration("user")
+	if err != nil {
+		t.Fatalf("BeginWebAuthnRegistration(): unexpected error: %v", err)
+	}
+
+	// The ceremony must be performed from our origin.
+	phished := *authenticator
+	phished.origin = "https://attacker.example.com"
+	if err := authService.FinishWebAuthnRegistration(
+		"user",
+		registration.Token,
+		phished.create(&registration.PublicKey),
+	); !errors.Is(err, ErrWebAuthn) {
+		t.Fatalf(
+			"FinishWebAuthnRegistration(): wanted `%v`; found `%v`",
+			ErrWebAuthn,
+			err,
+		)
+	}
+
+	// Registration tokens can't be used by other users.
+	if err := authService.FinishWebAuthnRegistration(
+		"other",
+		registration.Token,
+		authenticator.create(&registration.PublicKey),
+	); !errors.Is(err, ErrUnauthorized) {
+		t.Fatalf(
+			"FinishWebAuthnRegistration(): wanted `%v`; found `%v`",
+			ErrUnauthorized,
+			err,
+		)
+	}
+
+	attestation := authenticator.create(&registration.PublicKey)
+	if err := authService.FinishWebAuthnRegistration(
+		"user",
+		registration.Token,
+		attestation,
+	); err != nil {
+		t.Fatalf("FinishWebAuthnRegistration(): unexpected error: %v", err)
+	}
+	if err := authService.FinishWebAuthnRegistration(
+		"user",
+		registration.Token,
+		attestation,
+	); !errors.Is(err, ErrUnauthorized) {
+		t.Fatalf(
+			"FinishWebAuthnRegistration(): wanted `%v`; found `%v`",
+			ErrUnauthorized,
+			err,
+		)
+	}
+
+	login, err := authService.BeginWebAuthnLogin("user", nil)
+	if err != nil {
+		t.Fatalf("BeginWebAuthnLogin(): unexpected error: %v", err)
+	}
+	if len(login.PublicKey.AllowCredentials) != 1 || !bytes.Equal(
+		login.PublicKey.AllowCredentials[0].ID,
+		authenticator.credentialID,
+	) {
+		t.Fatalf(
+			"WebAuthnRequestOptions.AllowCredentials: wanted the " +
+				"registered credential",
+		)
+	}
+
+	// Login tokens can't be used for registration.
+	if err := authService.FinishWebAuthnRegistration(
+		"user",
+		login.Token,
+		authenticator.create(&registration.PublicKey),
+	); !errors.Is(err, ErrUnauthorized) {
+		t.Fatalf(
+			"FinishWebAuthnRegistration(): wanted `%v`; found `%v`",
+			ErrUnauthorized,
+			err,
+		)
+	}
+
+	// An assertion from a different key for the same credential ID fails.
+	impostor := newSoftwareAuthenticator(t)
+	impostor.credentialID = authenticator.credentialID
+	if _, err := authService.FinishWebAuthnLogin(
+		login.Token,
+		impostor.get(&login.PublicKey),
+		nil,
+	); !errors.Is(err, ErrWebAuthn) {
+		t.Fatalf(
+			"FinishWebAuthnLogin(): wanted `%v`; found `%v`",
+			ErrWebAuthn,
+			err,
+		)
+	}
+
+	// Users must be verified (e.g., with a PIN or biometrics).
+	unverified := *authenticator
+	unverified.flags = authDataUserPresent
+	if _, err := authService.FinishWebAuthnLogin(
+		login.Token,
+		unverified.get(&login.PublicKey),
+		nil,
+	); !errors.Is(err, ErrWebAuthn) {
+		t.Fatalf(
+			"FinishWebAuthnLogin(): wanted `%v`; found `%v`",
+			ErrWebAuthn,
+			err,
+		)
+	}
+
+	code, err := authService.FinishWebAuthnLogin(
+		login.Token,
+		authenticator.get(&login.PublicKey),
+		&types.ClientInfo{UserAgent: "agent"},
+	)
+	if err != nil {
+		t.Fatalf("FinishWebAuthnLogin(): unexpected error: %v", err)
+	}
+	if _, err := authService.FinishWebAuthnLogin(
+		login.Token,
+		authenticator.get(&login.PublicKey),
+		nil,
+	); !errors.Is(err, ErrUnauthorized) {
+		t.Fatalf(
+			"FinishWebAuthnLogin(): wanted `%v`; found `%v`",
+			ErrUnauthorized,
+			err,
+		)
+	}
+
+	tokens, err := authService.Exchange(code, "")
+	if err != nil {
+		t.Fatalf("Exchange(): unexpected error: %v", err)
+	}
+	var claims jwt.StandardClaims
+	if _, err := jwt.ParseWithClaims(
+		tokens.AccessToken.Token,
+		&claims,
+		accessTokenFactory.VerificationKey,
+	); err != nil {
+		t.Fatalf("parsing access token: %v", err)
+	}
+	if claims.Subject != "user" {
+		t.Fatalf(
+			"AccessToken.Subject: wanted `user`; found `%s`",
+			claims.Subject,
+		)
+	}
+
+	// A sign count which doesn't increase indicates a cloned authenticator.
+	clone := *authenticator
+	clone.signCount = uint32(credentials["user"][0].SignCount) - 1
+	login, err = authService.BeginWebAuthnLogin("user", nil)
+	if err != nil {
+		t.Fatalf("BeginWebAuthnLogin(): unexpected error: %v", err)
+	}
+	if _, err := authService.FinishWebAuthnLogin(
+		login.Token,
+		clone.get(&login.PublicKey),
+		nil,
+	); !errors.Is(err, ErrWebAuthn) {
+		t.Fatalf(
+			"FinishWebAuthnLogin(): wanted `%v`; found `%v`",
+			ErrWebAuthn,
+			err,
+		)
+	}
+}
+
+func TestAuthService_FinishWebAuthnLogin_Throttled(t *testing.T) {
+	jwt.TimeFunc = nowTimeFunc
+	defer func() { jwt.TimeFunc = time.Now }()
+
+	credentials := testsupport.WebAuthnCredentialStoreFake{}
+	authService := testWebAuthnAuthService(credentials)
+	authService.Throttle = LoginThrottle{
+		Attempts:     &MemLoginAttemptStore{},
+		FreeAttempts: 2,
+		BaseDelay:    time.Minute,
+		MaxDelay:     time.Hour,
+		Window:       time.Hour,
+	}
+	authenticator := newSoftwareAuthenticator(t)
+	registration, err := authService.BeginWebAuthnRegistration("user")
+	if err != nil {
+		t.Fatalf("BeginWebAuthnRegistration(): unexpected error: %v", err)
+	}
+	if err := authService.FinishWebAuthnRegistration(
+		"user",
+		registration.Token,
+		authenticator.create(&registration.PublicKey),
+	); err != nil {
+		t.Fatalf("FinishWebAuthnRegistration(): unexpected error: %v", err)
+	}
+	login, err := authService.BeginWebAuthnLogin("user", nil)
+	if err != nil {
+		t.Fatalf("BeginWebAuthnLogin(): unexpected error: %v", err)
+	}
+
+	// Once the free attempts (and the first delayed one) are spent on bad
+	// assertions, even a good one is throttled.
+	impostor := newSoftwareAuthenticator(t)
+	impostor.credentialID = authenticator.credentialID
+	for i := 0; i < 3; i++ {
+		if _, err := authService.FinishWebAuthnLogin(
+			login.Token,
+			impostor.get(&login.PublicKey),
+			nil,
+		); !errors.Is(err, ErrWebAuthn) {
+			t.Fatalf(
+				"FinishWebAuthnLogin() #%d: wanted `%v`; found `%v`",
+				i,
+				ErrWebAuthn,
+				err,
+			)
+		}
+	}
+	var throttled *ThrottledError
+	if _, err := authService.FinishWebAuthnLogin(
+		login.Token,
+		authenticator.get(&login.PublicKey),
+		nil,
+	); !errors.As(err, &throttled) {
+		t.Fatalf(
+			"FinishWebAuthnLogin(): wanted throttled error; found `%v`",
+			err,
+		)
+	}
+}
+
+func TestWebServer_WebAuthnLogin(t *testing.T) {
+	jwt.TimeFunc = nowTimeFunc
+	defer func() { jwt.TimeFunc = time.Now }()
+
+	webServer := WebServer{
+		AuthService: *testWebAuthnAuthService(
+			testsupport.WebAuthnCredentialStoreFake{},
+		),
+		BaseURL:                 "https://auth.example.org/",
+		RedirectDomain:          "app.example.org",
+		DefaultRedirectLocation: "https://app.example.org/default/",
+	}
+	authenticator := newSoftwareAuthenticator(t)
+	registration, err := webServer.AuthService.BeginWebAuthnRegistration(
+		"user",
+	)
+	if err != nil {
+		t.Fatalf("BeginWebAuthnRegistration(): unexpected error: %v", err)
+	}
+	if err := webServer.AuthService.FinishWebAuthnRegistration(
+		"user",
+		registration.Token,
+		authenticator.create(&registration.PublicKey),
+	); err != nil {
+		t.Fatalf("FinishWebAuthnRegistration(): unexpected error: %v", err)
+	}
+
+	query := &url.URL{RawQuery: url.Values{
+		"callback": []string{"https://app.example.org/callback"},
+	}.Encode()}
+
+	// The login form offers passkeys.
+	rsp := webServer.LoginFormPage(pz.Request{URL: query})
+	data, err := pztest.ReadAll(rsp.Data)
+	if err != nil {
+		t.Fatalf("rendering login form: %v", err)
+	}
+	if !bytes.Contains(data, []byte(`id="passkey"`)) {
+		t.Fatalf("login form doesn't offer passkeys: %s", data)
+	}
+
+	rsp = webServer.WebAuthnLoginRoute().Handler(pz.Request{
+		URL:  query,
+		Body: strings.NewReader(`{"username": "user"}`),
+	})
+	if rsp.Status != http.StatusOK {
+		t.Fatalf("Response.Status: wanted `200`; found `%d`", rsp.Status)
+	}
+	if data, err = pztest.ReadAll(rsp.Data); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var login WebAuthnLogin
+	if err := json.Unmarshal(data, &login); err != nil {
+		t.Fatalf("unmarshaling passkey login: %v", err)
+	}
+
+	body, err := json.Marshal(&struct {
+		Token      string             `json:"token"`
+		Credential *WebAuthnAssertion `json:"credential"`
+	}{login.Token, authenticator.get(&login.PublicKey)})
+	if err != nil {
+		t.Fatalf("marshaling assertion: %v", err)
+	}
+	rsp = webServer.WebAuthnLoginFinishRoute().Handler(pz.Request{
+		URL:  query,
+		Body: bytes.NewReader(body),
+	})
+	if rsp.Status != http.StatusOK {
+		t.Fatalf("Response.Status: wanted `200`; found `%d`", rsp.Status)
+	}
+	if data, err = pztest.ReadAll(rsp.Data); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var result WebAuthnLoginResult
+	if err := json.Unmarshal(data, &result); err != nil {
+		t.Fatalf("unmarshaling passkey login result: %v", err)
+	}
+
+	location, err := url.Parse(result.Location)
+	if err != nil {
+		t.Fatalf("parsing location: %v", err)
+	}
+	if location.Path != "/callback" {
+		t.Fatalf(
+			"Location.Path: wanted `/callback`; found `%s`",
+			location.Path,
+		)
+	}
+	if _, err := webServer.AuthService.Exchange(
+		location.Query().Get("code"),
+		"",
+	); err != nil {
+		t.Fatalf("Exchange(): unexpected error: %v", err)
+	}
+}
+
+func testWebAuthnAuthService(
+	credentials testsupport.WebAuthnCredentialStoreFake,
+) *AuthService {
+	return &AuthService{
+		Creds: CredStore{Users: testsupport.UserStoreFake{
+			"user": {
+				User:         "user",
+				Email:        "user@example.org",
+				PasswordHash: hashBcrypt("password"),
+			},
+		}},
+		Tokens:        testsupport.TokenStoreFake{},
+		Codes:         codesTokenFactory,
+		RedeemedCodes: testsupport.CodeStoreFake{},
+		WebAuthn: WebAuthn{
+			RPID:        "auth.example.org",
+			RPName:      "Example",
+			Origin:      "https://auth.example.org",
+			Credentials: credentials,
+		},
+		TokenDetails: TokenDetailsFactory{
+			AccessTokens:  accessTokenFactory,
+			RefreshTokens: refreshTokenFactory,
+			TimeFunc:      nowTimeFunc,
+		},
+		TimeFunc: nowTimeFunc,
+	}
+}
+
+// softwareAuthenticator is a WebAuthn authenticator (and the browser which
+// talks to it) for exercising the ceremonies in tests. It supports ES256
+// credentials and `none` attestation.
+type softwareAuthenticator struct {
+	rpID         string
+	origin       string
+	key          *ecdsa.PrivateKey
+	credentialID []byte
+	signCount    uint32
+	flags        byte
+}
+
+func newSoftwareAuthenticator(t *testing.T) *softwareAuthenticator {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generating authenticator key: %v", err)
+	}
+	credentialID := make([]byte, 16)
+	if _, err := rand.Read(credentialID); err != nil {
+		t.Fatalf("generating credential ID: %v", err)
+	}
+	return &softwareAuthenticator{
+		rpID:         "auth.example.org",
+		origin:       "https://auth.example.org",
+		key:          key,
+		credentialID: credentialID,
+		flags:        authDataUserPresent | authDataUserVerified,
+	}
+}
+
+func (sa *softwareAuthenticator) create(
+	options *WebAuthnCreationOptions,
+) *WebAuthnAttestation {
+	sa.signCount++
+
+	// attested credential data: AAGUID, credential ID length, credential ID,
+	// and COSE key
+	var attested bytes.Buffer
+	attested.Write(make([]byte, 16))
+	binary.Write(&attested, binary.BigEndian, uint16(len(sa.credentialID)))
+	attested.Write(sa.credentialID)
+	attested.Write(cborEncode(cborMap{
+		{int64(1), int64(2)},
+		{int64(3), int64(coseAlgES256)},
+		{int64(-1), int64(1)},
+		{int64(-2), sa.key.X.FillBytes(make([]byte, 32))},
+		{int64(-3), sa.key.Y.FillBytes(make([]byte, 32))},
+	}))
+
+	return &WebAuthnAttestation{
+		RawID: sa.credentialID,
+		Type:  "public-key",
+		Response: WebAuthnAttestationResponse{
+			ClientDataJSON: sa.clientData(
+				"webauthn.create",
+				options.Challenge,
+			),
+			AttestationObject: cborEncode(cborMap{
+				{"fmt", "none"},
+				{"attStmt", cborMap{}},
+				{"authData", append(
+					sa.authData(sa.flags|authDataAttested),
+					attested.Bytes()...,
+				)},
+			}),
+		},
+	}
+}
+
+func (sa *softwareAuthenticator) get(
+	options *WebAuthnRequestOptions,
+) *WebAuthnAssertion {
+	sa.signCount++
+	clientData := sa.clientData("webauthn.get", options.Challenge)
+	authData := sa.authData(sa.flags)
+
+	clientDataHash := sha256.Sum256(clientData)
+	digest := sha256.Sum256(append(
+		append([]byte(nil), authData...),
+		clientDataHash[:]...,
+	))
+	signature, err := ecdsa.SignASN1(rand.Reader, sa.key, digest[:])
+	if err != nil {
+		panic(err)
+	}
+
+	return &WebAuthnAssertion{
+		RawID: sa.credentialID,
+		Type:  "public-key",
+		Response: WebAuthnAssertionResponse{
+			ClientDataJSON:    clientData,
+			AuthenticatorData: authData,
+			Signature:         signature,
+		},
+	}
+}
+
+func (sa *softwareAuthenticator) clientData(
+	ceremony string,
+	challenge []byte,
+) []byte {
+	data, err := json.Marshal(map[string]string{
+		"type":      ceremony,
+		"challenge": base64.RawURLEncoding.EncodeToString(challenge),
+		"origin":    sa.origin,
+	})
+	if err != nil {
+		panic(err)
+	}
+	return data
+}
+
+func (sa *softwareAuthenticator) authData(flags byte) []byte {
+	rpIDHash := sha256.Sum256([]byte(sa.rpID))
+	data := append(rpIDHash[:], flags)
+	return binary.BigEndian.AppendUint32(data, sa.signCount)
+}
+
+// cborMap is a CBOR map with ordered keys.
+type cborMap [][2]interface{}
+
+// cborEncode encodes the values which `softwareAuthenticator` needs.
+func cborEncode(v interface{}) []byte {
+	head := func(major byte, n uint64) []byte {
+		switch {
+		case n < 24:
+			return []byte{major<<5 | byte(n)}
+		case n < 1<<8:
+			return []byte{major<<5 | 24, byte(n)}
+		default:
+			return binary.BigEndian.AppendUint16(
+				[]byte{major<<5 | 25},
+				uint16(n),
+			)
+		}
+	}
+
+	switch v := v.(type) {
+	case int64:
+		if v < 0 {
+			return head(1, uint64(-1-v))
+		}
+		return head(0, uint64(v))
+	case []byte:
+		return append(head(2, uint64(len(v))), v...)
+	case string:
+		return append(head(3, uint64(len(v))), v...)
+	case cborMap:
+		data := head(5, uint64(len(v)))
+		for _, pair := range v {
+			data = append(data, cborEncode(pair[0])...)
+			data = append(data, cborEncode(pair[1])...)
+		}
+		return data
+	}
+	panic("cborEncode: unsupported type")
+}
@@ -0,0 +1,239 @@
+package auth
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/weberc2/auth/pkg/auth/types"
+)
+
+// The headers which accompany each webhook. The signature covers the ID, the
+// timestamp (in Unix seconds) and the body; see `SignWebhook`. Receivers can
+// verify webhooks with `client.WebhookVerifier`.
+const (
+	WebhookIDHeader        = "Webhook-Id"
+	WebhookTimestampHeader = "Webhook-Timestamp"
+	WebhookSignatureHeader = "Webhook-Signature"
+
+	webhookSignaturePrefix = "v1="
+)
+
+// WebhookEndpoint is a URL which receives webhooks and the secret with which
+// they're signed.
+type WebhookEndpoint struct {
+	URL    string `json:"url" yaml:"url"`
+	Secret string `json:"secret" yaml:"secret"`
+
+	// Types are the notification types which the endpoint receives. If
+	// there are none, it receives every type.
+	Types []types.NotificationType `json:"types,omitempty" yaml:"types"`
+
+	// IncludeToken includes the notifications' tokens in the webhooks. The
+	// tokens are secrets (e.g., a forgot-password token lets its holder reset
+	// the user's password), so only endpoints which deliver them to users
+	// (e.g., an email relay) should receive them.
+	IncludeToken bool `json:"includeToken,omitempty" yaml:"includeToken"`
+}
+
+// receives reports whether the endpoint receives a notification type.
+func (endpoint *WebhookEndpoint) receives(typ types.NotificationType) bool {
+	if len(endpoint.Types) < 1 {
+		return true
+	}
+	for _, t := range endpoint.Types {
+		if t == typ {
+			return true
+		}
+	}
+	return false
+}
+
+// WebhookNotificationService POSTs each notification as JSON to each of its
+// endpoints which receives the notification's type. The `Webhook-Id` header
+// is an idempotency key: it's the same for every attempt to deliver a
+// notification (including redeliveries from an outbox), so receivers can
+// discard duplicates.
+//
+// Deliveries are retried within `Notify`, so without an outbox they hold up
+// the request which caused the notification: with the defaults, each
+// unreachable endpoint delays it by about half a minute.
+type WebhookNotificationService struct {
+	Endpoints []WebhookEndpoint
+
+	// Client sends the requests. If it's `nil`, a client with a `Timeout`
+	// timeout is used.
+	Client *http.Client
+
+	// Timeout bounds each request. If it's zero, 10 seconds is used.
+	Timeout time.Duration
+
+	// MaxAttempts is the number of times a request is attempted before
+	// giving up on an endpoint. Only connection errors, 429s and 5xxs are
+	// retried. If it's zero, 3 is used.
+	MaxAttempts int
+
+	// RetryDelay is the wait before the first retry; it doubles with each
+	// subsequent retry. If it's zero, a second is used.
+	RetryDelay time.Duration
+
+	TimeFunc func() time.Time
+}
+
+func (wns *WebhookNotificationService) Notify(n *types.Notification) error {
+	id := n.ID
+	if id == "" {
+		var data [16]byte
+		if _, err := rand.Read(data[:]); err != nil {
+			return fmt.Errorf("generating webhook ID: %w", err)
+		}
+		id = hex.EncodeToString(data[:])
+	}
+
+	// Deliver to every endpoint even if some fail; if the notification is
+	// retried, endpoints which already received it can recognize it by its
+	// ID.
+	var failures []string
+	bodies := map[bool][]byte{}
+	for i := range wns.Endpoints {
+		endpoint := &wns.Endpoints[i]
+		if !endpoint.receives(n.Type) {
+			continue
+		}
+
+		body, found := bodies[endpoint.IncludeToken]
+		if !found {
+			redacted := *n
+			if !endpoint.IncludeToken {
+				redacted.Token = ""
+			}
+			data, err := json.Marshal(&redacted)
+			if err != nil {
+				return fmt.Errorf("marshaling notification: %w", err)
+			}
+			body = data
+			bodies[endpoint.IncludeToken] = body
+		}
+
+		if err := wns.send(endpoint, id, body); err != nil {
+			failures = append(failures, err.Error())
+		}
+	}
+	if len(failures) > 0 {
+		return fmt.Errorf(
+			"delivering webhooks: %s",
+			strings.Join(failures, "; "),
+		)
+	}
+	return nil
+}
+
+func (wns *WebhookNotificationService) send(
+	endpoint *WebhookEndpoint,
+	id string,
+	body []byte,
+) error {
+	maxAttempts := wns.MaxAttempts
+	if maxAttempts < 1 {
+		maxAttempts = 3
+	}
+	delay := wns.RetryDelay
+	if delay == 0 {
+		delay = time.Second
+	}
+
+	var err error
+	for attempt := 1; ; attempt++ {
+		var retry bool
+		if retry, err = wns.post(endpoint, id, body); err == nil {
+			return nil
+		}
+		if !retry || attempt >= maxAttempts {
+			break
+		}
+		time.Sleep(delay)
+		delay *= 2
+	}
+	return fmt.Errorf("posting webhook to `%s`: %w", endpoint.URL, err)
+}
+
+// post makes a single delivery attempt. It returns whether a failed attempt
+// is worth retrying.
+func (wns *WebhookNotificationService) post(
+	endpoint *WebhookEndpoint,
+	id string,
+	body []byte,
+) (bool, error) {
+	req, err := http.NewRequest(
+		http.MethodPost,
+		endpoint.URL,
+		bytes.NewReader(body),
+	)
+	if err != nil {
+		return false, fmt.Errorf("building request: %w", err)
+	}
+
+	// Sign each attempt afresh so that the timestamp stays current.
+	timestamp := wns.TimeFunc()
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(WebhookIDHeader, id)
+	req.Header.Set(
+		WebhookTimestampHeader,
+		strconv.FormatInt(timestamp.Unix(), 10),
+	)
+	req.Header.Set(
+		WebhookSignatureHeader,
+		SignWebhook(endpoint.Secret, id, timestamp, body),
+	)
+
+	client := wns.Client
+	if client == nil {
+		timeout := wns.Timeout
+		if timeout == 0 {
+			timeout = 10 * time.Second
+		}
+		client = &http.Client{Timeout: timeout}
+	}
+	rsp, err := client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer rsp.Body.Close()
+
+	// Drain the body so that the connection can be reused.
+	io.Copy(ioutil.Discard, io.LimitReader(rsp.Body, 4096))
+
+	if rsp.StatusCode >= 200 && rsp.StatusCode < 300 {
+		return false, nil
+	}
+	return rsp.StatusCode == http.StatusTooManyRequests ||
+			rsp.StatusCode >= 500,
+		fmt.Errorf("unexpected status code: %d", rsp.StatusCode)
+}
+
+// SignWebhook returns the `Webhook-Signature` header value for a webhook:
+// `v1=` followed by the hex-encoded HMAC-SHA256 (keyed with the secret) of
+// the ID, the Unix timestamp and the body, joined by periods.
+func SignWebhook(
+	secret string,
+	id string,
+	timestamp time.Time,
+	body []byte,
+) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%s.%d.", id, timestamp.Unix())
+	mac.Write(body)
+	return webhookSignaturePrefix + hex.EncodeToString(mac.Sum(nil))
+}
+
+var _ types.NotificationService = &WebhookNotificationService{}
@@ -0,0 +1,222 @@
+package auth
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/weberc2/auth/pkg/auth/types"
+)
+
+func TestWebhookNotificationService(t *testing.T) {
+	notification := types.Notification{
+		Type:  types.NotificationTypeRegister,
+		User:  "adam",
+		Email: "adam@example.org",
+		Token: "token",
+	}
+
+	for _, testCase := range []struct {
+		name           string
+		id             string
+		statuses       []int
+		wantedAttempts int
+		wantedErr      bool
+	}{
+		{
+			name:           "delivered",
+			statuses:       []int{http.StatusNoContent},
+			wantedAttempts: 1,
+		},
+		{
+			name:           "notification ID is the idempotency key",
+			id:             "outbox-entry",
+			statuses:       []int{http.StatusOK},
+			wantedAttempts: 1,
+		},
+		{
+			name: "retries server errors",
+			statuses: []int{
+				http.StatusServiceUnavailable,
+				http.StatusTooManyRequests,
+				http.StatusOK,
+			},
+			wantedAttempts: 3,
+		},
+		{
+			name: "gives up after max attempts",
+			statuses: []int{
+				http.StatusInternalServerError,
+				http.StatusInternalServerError,
+				http.StatusInternalServerError,
+				http.StatusOK,
+			},
+			wantedAttempts: 3,
+			wantedErr:      true,
+		},
+		{
+			name:           "doesn't retry client errors",
+			statuses:       []int{http.StatusBadRequest, http.StatusOK},
+			wantedAttempts: 1,
+			wantedErr:      true,
+		},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			var (
+				lock     sync.Mutex
+				requests []*http.Request
+				bodies   [][]byte
+			)
+			server := httptest.NewServer(http.HandlerFunc(
+				func(w http.ResponseWriter, r *http.Request) {
+					lock.Lock()
+					defer lock.Unlock()
+					body, err := ioutil.ReadAll(r.Body)
+					if err != nil {
+						t.Errorf("reading request body: %v", err)
+					}
+					requests = append(requests, r)
+					bodies = append(bodies, body)
+					w.WriteHeader(testCase.statuses[len(requests)-1])
+				},
+			))
+			defer server.Close()
+
+			webhooks := WebhookNotificationService{
+				Endpoints: []WebhookEndpoint{{
+					URL:          server.URL,
+					Secret:       "secret",
+					IncludeToken: true,
+				}},
+				RetryDelay: time.Millisecond,
+				TimeFunc:   func() time.Time { return now },
+			}
+			n := notification
+			n.ID = testCase.id
+			err := webhooks.Notify(&n)
+			if testCase.wantedErr && err == nil {
+				t.Fatal("Notify(): wanted an error; found `nil`")
+			}
+			if !testCase.wantedErr && err != nil {
+				t.Fatalf("Notify(): unexpected err: %v", err)
+			}
+
+			if len(requests) != testCase.wantedAttempts {
+				t.Fatalf(
+					"wanted `%d` attempts; found `%d`",
+					testCase.wantedAttempts,
+					len(requests),
+				)
+			}
+			id := requests[0].Header.Get(WebhookIDHeader)
+			if testCase.id != "" && id != testCase.id {
+				t.Fatalf(
+					"%s: wanted `%s`; found `%s`",
+					WebhookIDHeader,
+					testCase.id,
+					id,
+				)
+			}
+			for i, r := range requests {
+				if found := r.Header.Get(WebhookIDHeader); found != id {
+					t.Fatalf(
+						"attempt %d: %s: wanted `%s`; found `%s`",
+						i,
+						WebhookIDHeader,
+						id,
+						found,
+					)
+				}
+				wanted := strconv.FormatInt(now.Unix(), 10)
+				found := r.Header.Get(WebhookTimestampHeader)
+				if found != wanted {
+					t.Fatalf(
+						"attempt %d: %s: wanted `%s`; found `%s`",
+						i,
+						WebhookTimestampHeader,
+						wanted,
+						found,
+					)
+				}
+				wanted = SignWebhook("secret", id, now, bodies[i])
+				found = r.Header.Get(WebhookSignatureHeader)
+				if found != wanted {
+					t.Fatalf(
+						"attempt %d: %s: wanted `%s`; found `%s`",
+						i,
+						WebhookSignatureHeader,
+						wanted,
+						found,
+					)
+				}
+				if err := n.CompareData(bodies[i]); err != nil {
+					t.Fatalf("attempt %d: %v", i, err)
+				}
+			}
+		})
+	}
+}
+
+func TestWebhookNotificationService_Endpoints(t *testing.T) {
+	var (
+		lock   sync.Mutex
+		bodies = map[string][]byte{}
+	)
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			lock.Lock()
+			defer lock.Unlock()
+			body, err := ioutil.ReadAll(r.Body)
+			if err != nil {
+				t.Errorf("reading request body: %v", err)
+			}
+			bodies[r.URL.Path] = body
+			w.WriteHeader(http.StatusNoContent)
+		},
+	))
+	defer server.Close()
+
+	webhooks := WebhookNotificationService{
+		Endpoints: []WebhookEndpoint{
+			{URL: server.URL + "/redacted", Secret: "secret"},
+			{
+				URL:          server.URL + "/token",
+				Secret:       "secret",
+				IncludeToken: true,
+			},
+			{
+				URL:    server.URL + "/lockouts",
+				Secret: "secret",
+				Types: []types.NotificationType{
+					types.NotificationTypeLockout,
+				},
+			},
+		},
+		TimeFunc: func() time.Time { return now },
+	}
+	n := types.Notification{
+		Type:  types.NotificationTypeForgotPassword,
+		User:  "adam",
+		Email: "adam@example.org",
+		Token: "token",
+	}
+	if err := webhooks.Notify(&n); err != nil {
+		t.Fatalf("Notify(): unexpected err: %v", err)
+	}
+
+	if err := n.CompareData(bodies["/token"]); err != nil {
+		t.Fatalf("/token: %v", err)
+	}
+	redacted := n
+	redacted.Token = ""
+	if err := redacted.CompareData(bodies["/redacted"]); err != nil {
+		t.Fatalf("/redacted: %v", err)
+	}
+	if body, found := bodies["/lockouts"]; found {
+		t.Fatalf("/lockouts: wanted no webhook; found `%s`", body)
+	}
+}
@@ -16,6 +16,10 @@ import (
 
 type Code struct {
 	Code string `json:"code"`
+
+	// CodeVerifier is the PKCE code verifier. It's required if a code
+	// challenge was provided when the code was requested.
+	CodeVerifier string `json:"codeVerifier,omitempty"`
 }
 
 // WebServer serves the authentication pages for websites (as opposed to
@@ -39,12 +43,49 @@ type WebServer struct {
 }
 
 const (
+	pathWebAuthnLogin                   = "/login/webauthn"
+	pathWebAuthnLoginFinish             = "/login/webauthn/finish"
 	pathRegistrationConfirmationHandler = "/confirm"
 	pathRegistrationConfirmationForm    = "/confirm"
 	pathRegistrationHandler             = "/register"
 	pathRegistrationForm                = "/register"
+	pathEmailChangeConfirmationForm     = "/email/confirm"
+	pathEmailChangeConfirmationHandler  = "/email/confirm"
+	pathMagicLinkForm                   = "/login/magic"
+	pathMagicLinkHandler                = "/login/magic"
+	pathMagicLinkConfirmationForm       = "/login/magic/confirm"
+	pathMagicLinkConfirmationHandler    = "/login/magic/confirm"
+	pathPasswordResetForm               = "/password/reset"
+	pathPasswordResetHandler            = "/password/reset"
+	pathForgotPasswordForm              = "/password/forgot"
+	pathForgotPasswordHandler           = "/password/forgot"
+	pathPasswordChangeForm              = "/password/change"
+	pathPasswordChangeHandler           = "/password/change"
 )
 
+// TokenURL returns a function which links notifications' tokens to the web
+// server's pages at the base URL (e.g., `https://auth.example.org/`).
+func TokenURL(baseURL string) func(*types.Notification) string {
+	baseURL = strings.TrimSuffix(baseURL, "/")
+	return func(n *types.Notification) string {
+		path := pathRegistrationConfirmationForm
+		switch n.Type {
+		case types.NotificationTypeEmailChange:
+			path = pathEmailChangeConfirmationForm
+		case types.NotificationTypeMagicLink:
+			path = pathMagicLinkConfirmationForm
+		case types.NotificationTypeForgotPassword:
+			path = pathPasswordResetForm
+		}
+		return fmt.Sprintf(
+			"%s%s?t=%s",
+			baseURL,
+			path,
+			url.QueryEscape(n.Token),
+		)
+	}
+}
+
 func (ws *WebServer) RegistrationFormRoute() pz.Route {
 	return pz.Route{
 		Path:   pathRegistrationForm,
@@ -111,21 +152,27 @@ func (ws *WebServer) RegistrationHandlerRoute() pz.Route {
 			if err := ws.AuthService.Register(
 				username,
 				form.Get("email"),
+				acceptLanguage(r.Headers),
 			); err != nil {
 				httpErr := &pz.HTTPError{
 					Status:  http.StatusInternalServerError,
 					Message: "internal server error",
 				}
-				errors.As(err, &httpErr)
+				var throttled *NotificationThrottledError
+				if errors.As(err, &throttled) {
+					httpErr = throttled.HTTPError()
+				} else {
+					errors.As(err, &httpErr)
+				}
 				context := registrationFormContext{
 					FormAction:   pathRegistrationHandler,
 					ErrorMessage: httpErr.Message,
 					PrivateError: err.Error(),
 				}
-				return pz.Response{
+				return retryAfter(pz.Response{
 					Status: httpErr.Status,
 					Data:   pz.HTMLTemplate(registrationForm, &context),
-				}.WithLogging(&context)
+				}.WithLogging(&context), err)
 			}
 			return pz.Created(
 				pz.String(registrationSuccessPage),
@@ -175,6 +222,9 @@ var registrationConfirmationForm = html.Must(html.New("").Parse(`<html>
 <body>
 <h1>Confirm Registration<h1>
 {{ if .ErrorMessage }}<p id="error-message">{{ .ErrorMessage }}</p>{{ end }}
+{{ if .PasswordRejections }}<ul id="password-rejections">
+{{ range .PasswordRejections }}	<li class="{{ .Reason }}">{{ .Message }}</li>
+{{ end }}</ul>{{ end }}
 <form action="{{ .FormAction }}" method="POST">
 	<label for="password">Password</label>
 	<input type="password" id="password" name="password"><br><br>
@@ -190,6 +240,10 @@ type registrationConfirmationContext struct {
 	ErrorMessage string `json:"errorMessage,omitempty"` // for html template
 	PrivateError string `json:"privateError,omitempty"` // logging only
 	ErrorType    string `json:"errorType,omitempty"`    // type of PrivateError
+
+	// PasswordRejections are the reasons the password policy rejected the
+	// password, if any.
+	PasswordRejections []PasswordRejection `json:"rejections,omitempty"`
 }
 
 func (ws *WebServer) RegistrationConfirmationHandlerRoute() pz.Route {
@@ -221,6 +275,10 @@ func (ws *WebServer) RegistrationConfirmationHandlerRoute() pz.Route {
 					PrivateError: err.Error(),
 					ErrorType:    fmt.Sprintf("%T", err),
 				}
+				var rejected *PasswordPolicyError
+				if errors.As(err, &rejected) {
+					context.PasswordRejections = rejected.Rejections
+				}
 				return pz.Response{
 					Status: httpErr.Status,
 					Data: pz.HTMLTemplate(
@@ -236,126 +294,1137 @@ func (ws *WebServer) RegistrationConfirmationHandlerRoute() pz.Route {
 	}
 }
 
-func (ws *WebServer) LoginFormPage(r pz.Request) pz.Response {
-	query := r.URL.Query()
+// EmailChangeConfirmationFormRoute serves the page which the email change
+// confirmation link opens. The change is only applied when the form is
+// submitted so that link scanners which follow the link don't apply it.
+func (ws *WebServer) EmailChangeConfirmationFormRoute() pz.Route {
+	return pz.Route{
+		Path:   pathEmailChangeConfirmationForm,
+		Method: "GET",
+		Handler: func(r pz.Request) pz.Response {
+			context := emailChangeConfirmationContext{
+				FormAction: pathEmailChangeConfirmationHandler,
+				Token:      r.URL.Query().Get("t"),
+			}
+			return pz.Ok(
+				pz.HTMLTemplate(emailChangeConfirmationForm, &context),
+				&context,
+			)
+		},
+	}
+}
+
+var emailChangeConfirmationForm = html.Must(html.New("").Parse(`<html>
+<head>
+	<title>Confirm Email Address</title>
+</head>
+<body>
+<h1>Confirm Email Address</h1>
+{{ if .ErrorMessage }}<p id="error-message">{{ .ErrorMessage }}</p>{{ end }}
+<form action="{{ .FormAction }}" method="POST">
+	<input type="hidden" id="token" name="token" value="{{.Token}}">
+	<input type="submit" value="Confirm">
+</form>
+</body>
+</html>`))
+
+type emailChangeConfirmationContext struct {
+	FormAction   string `json:"formAction"`
+	Token        string `json:"token"`                  // hidden form field
+	ErrorMessage string `json:"errorMessage,omitempty"` // for html template
+	PrivateError string `json:"privateError,omitempty"` // logging only
+	ErrorType    string `json:"errorType,omitempty"`    // type of PrivateError
+}
 
-	// create a struct for templating and logging
-	context := struct {
-		FormAction   string `json:"formAction"`
-		ErrorMessage string `json:"-"`
-	}{
-		FormAction: ws.BaseURL + "login?" + url.Values{
-			"callback": []string{query.Get("callback")},
-			"redirect": []string{query.Get("redirect")},
-		}.Encode(),
+func (ws *WebServer) EmailChangeConfirmationHandlerRoute() pz.Route {
+	return pz.Route{
+		Path:   pathEmailChangeConfirmationHandler,
+		Method: "POST",
+		Handler: func(r pz.Request) pz.Response {
+			form, err := parseForm(r)
+			if err != nil {
+				return pz.BadRequest(pz.String("error parsing form"), &logging{
+					Message: "parsing email change confirmation form",
+					Error:   err.Error(),
+				})
+			}
+			if err := ws.AuthService.ConfirmEmailChange(
+				form.Get("token"),
+			); err != nil {
+				httpErr := &pz.HTTPError{
+					Status:  http.StatusInternalServerError,
+					Message: "internal server error",
+				}
+				_ = errors.As(err, &httpErr)
+				context := emailChangeConfirmationContext{
+					FormAction:   pathEmailChangeConfirmationHandler,
+					Token:        form.Get("token"),
+					ErrorMessage: httpErr.Message,
+					PrivateError: err.Error(),
+					ErrorType:    fmt.Sprintf("%T", err),
+				}
+				return pz.Response{
+					Status: httpErr.Status,
+					Data: pz.HTMLTemplate(
+						emailChangeConfirmationForm,
+						&context,
+					),
+				}.WithLogging(&context)
+			}
+			return pz.Ok(
+				pz.String(emailChangeSuccessPage),
+				&logging{Message: "changed email address"},
+			)
+		},
 	}
+}
 
-	return pz.Ok(pz.HTMLTemplate(loginForm, &context), &context)
+const emailChangeSuccessPage = `<html>
+<head>
+	<title>Email Address Changed</title>
+</head>
+<body>
+<h1>Email Address Changed</h1>
+<p>Your email address has been changed.</p>
+</body>
+</html>`
+
+// PasswordResetFormRoute serves the page which the forgot-password link
+// opens, where the user chooses their new password.
+func (ws *WebServer) PasswordResetFormRoute() pz.Route {
+	return pz.Route{
+		Path:   pathPasswordResetForm,
+		Method: "GET",
+		Handler: func(r pz.Request) pz.Response {
+			context := passwordResetContext{
+				FormAction: pathPasswordResetHandler,
+				Token:      r.URL.Query().Get("t"),
+			}
+			return pz.Ok(
+				pz.HTMLTemplate(passwordResetForm, &context),
+				&context,
+			)
+		},
+	}
 }
 
-var loginForm = html.Must(html.New("").Parse(`<html>
+var passwordResetForm = html.Must(html.New("").Parse(`<html>
 <head>
-	<title>Login</title>
+	<title>Reset Password</title>
 </head>
 <body>
-<h1>Login</h1>
+<h1>Reset Password</h1>
 {{ if .ErrorMessage }}<p id="error-message">{{ .ErrorMessage }}</p>{{ end }}
+{{ if .PasswordRejections }}<ul id="password-rejections">
+{{ range .PasswordRejections }}	<li class="{{ .Reason }}">{{ .Message }}</li>
+{{ end }}</ul>{{ end }}
 <form action="{{ .FormAction }}" method="POST">
-	<label for="username">Username</label>
-	<input type="text" id="username" name="username"><br><br>
-	<label for="password">Password</label>
+	<label for="password">New password</label>
 	<input type="password" id="password" name="password"><br><br>
+	<input type="hidden" id="token" name="token" value="{{.Token}}">
 	<input type="submit" value="Submit">
 </form>
 </body>
 </html>`))
 
-func (ws *WebServer) LoginHandler(r pz.Request) pz.Response {
-	form, err := parseForm(r)
-	if err != nil {
-		return pz.BadRequest(
-			pz.Stringf("parsing credentials: %v", err),
-			&logging{
-				Message:   "parsing credentials from multi-part form",
-				ErrorType: fmt.Sprintf("%T", err),
-				Error:     err.Error(),
-			},
-		)
-	}
+type passwordResetContext struct {
+	FormAction   string `json:"formAction"`
+	Token        string `json:"-"`                      // hidden form field
+	ErrorMessage string `json:"errorMessage,omitempty"` // for html template
+	PrivateError string `json:"privateError,omitempty"` // logging only
+	ErrorType    string `json:"errorType,omitempty"`    // type of PrivateError
 
-	username := types.UserID(form.Get("username"))
+	// PasswordRejections are the reasons the password policy rejected the
+	// password, if any.
+	PasswordRejections []PasswordRejection `json:"rejections,omitempty"`
+}
 
-	code, err := ws.AuthService.LoginAuthCode(&types.Credentials{
-		User:     username,
-		Password: form.Get("password"),
-	})
-	if err != nil {
-		if errors.Is(err, ErrCredentials) {
-			return pz.Unauthorized(
-				pz.HTMLTemplate(loginForm, &struct {
-					Location     html.HTML
-					FormAction   string
-					ErrorMessage string
-				}{
-					FormAction:   ws.BaseURL + "login",
-					ErrorMessage: "Invalid credentials",
-				}),
-				&logging{
-					User:    username,
-					Message: "login failed",
+// PasswordResetHandlerRoute sets the password of the user to whom the reset
+// token was issued.
+func (ws *WebServer) PasswordResetHandlerRoute() pz.Route {
+	return pz.Route{
+		Path:   pathPasswordResetHandler,
+		Method: "POST",
+		Handler: func(r pz.Request) pz.Response {
+			form, err := parseForm(r)
+			if err != nil {
+				return pz.BadRequest(pz.String("error parsing form"), &logging{
+					Message: "parsing password reset form",
 					Error:   err.Error(),
-				},
+				})
+			}
+			if err := ws.AuthService.UpdatePassword(&UpdatePassword{
+				Password: form.Get("password"),
+				Token:    form.Get("token"),
+			}); err != nil {
+				httpErr := &pz.HTTPError{
+					Status:  http.StatusInternalServerError,
+					Message: "internal server error",
+				}
+				_ = errors.As(err, &httpErr)
+				context := passwordResetContext{
+					FormAction:   pathPasswordResetHandler,
+					Token:        form.Get("token"),
+					ErrorMessage: httpErr.Message,
+					PrivateError: err.Error(),
+					ErrorType:    fmt.Sprintf("%T", err),
+				}
+				var rejected *PasswordPolicyError
+				if errors.As(err, &rejected) {
+					context.PasswordRejections = rejected.Rejections
+				}
+				return pz.Response{
+					Status: httpErr.Status,
+					Data:   pz.HTMLTemplate(passwordResetForm, &context),
+				}.WithLogging(&context)
+			}
+			return pz.Ok(
+				pz.HTMLTemplate(
+					passwordChangedPage,
+					ws.passwordChangedContext(),
+				),
+				&logging{Message: "reset password"},
 			)
-		}
-		return pz.InternalServerError(&logging{
-			User:      username,
-			Message:   "logging in",
-			ErrorType: fmt.Sprintf("%T", err),
-			Error:     err.Error(),
-		})
+		},
 	}
+}
 
-	query := r.URL.Query()
-	context := struct {
-		Message  string `json:"message,omitempty"`
-		Target   string `json:"target,omitempty"`
-		Redirect redirectResult
-		Callback redirectResult
-	}{
-		Callback: redirectResult{
-			Specified: query.Get("callback"),
-			Default:   ws.DefaultRedirectLocation,
-			Domain:    ws.RedirectDomain,
-		},
-		Redirect: redirectResult{
-			Specified: query.Get("redirect"),
-			Default:   ws.DefaultRedirectLocation,
-			Domain:    ws.RedirectDomain,
+var passwordChangedPage = html.Must(html.New("").Parse(`<html>
+<head>
+	<title>Password Changed</title>
+</head>
+<body>
+<h1>Password Changed</h1>
+<p>Your password has been changed. <a href="{{ .LoginAction }}">Log in</a>
+</p>
+</body>
+</html>`))
+
+type passwordChangedContext struct {
+	LoginAction string
+}
+
+func (ws *WebServer) passwordChangedContext() *passwordChangedContext {
+	return &passwordChangedContext{LoginAction: ws.BaseURL + "login"}
+}
+
+// ForgotPasswordFormRoute serves the form for requesting a password reset
+// link.
+func (ws *WebServer) ForgotPasswordFormRoute() pz.Route {
+	return pz.Route{
+		Path:   pathForgotPasswordForm,
+		Method: "GET",
+		Handler: func(r pz.Request) pz.Response {
+			context := forgotPasswordContext{
+				FormAction: pathForgotPasswordHandler,
+			}
+			return pz.Ok(
+				pz.HTMLTemplate(forgotPasswordForm, &context),
+				&context,
+			)
 		},
 	}
+}
 
-	validateRedirect(&context.Callback)
-	if context.Callback.ParseError != "" {
-		context.Message = "`callback` parameter contains invalid URL"
-		return pz.BadRequest(nil, &context)
-	}
-	validateRedirect(&context.Redirect)
-	if context.Redirect.ParseError != "" {
-		context.Message = "`redirect` parameter contains invalid URL"
-		return pz.BadRequest(nil, &context)
+var forgotPasswordForm = html.Must(html.New("").Parse(`<html>
+<head>
+	<title>Forgot Password</title>
+</head>
+<body>
+<h1>Forgot Password</h1>
+{{ if .ErrorMessage }}<p id="error-message">{{ .ErrorMessage }}</p>{{ end }}
+<form action="{{ .FormAction }}" method="POST">
+	<label for="username">Username or email</label>
+	<input type="text" id="username" name="username"><br><br>
+	<input type="submit" value="Submit">
+</form>
+</body>
+</html>`))
+
+type forgotPasswordContext struct {
+	FormAction   string `json:"formAction"`
+	ErrorMessage string `json:"errorMessage,omitempty"` // for html template
+	PrivateError string `json:"privateError,omitempty"` // logging only
+	ErrorType    string `json:"errorType,omitempty"`    // type of PrivateError
+}
+
+// ForgotPasswordHandlerRoute emails a password reset link. Like the JSON
+// route, unknown users get the same response as everyone else so as to not
+// give away which users exist.
+func (ws *WebServer) ForgotPasswordHandlerRoute() pz.Route {
+	return pz.Route{
+		Path:   pathForgotPasswordHandler,
+		Method: "POST",
+		Handler: func(r pz.Request) pz.Response {
+			form, err := parseForm(r)
+			if err != nil {
+				return pz.BadRequest(pz.String("error parsing form"), &logging{
+					Message: "parsing forgot-password form",
+					Error:   err.Error(),
+				})
+			}
+
+			username := types.UserID(form.Get("username"))
+			err = ws.AuthService.ForgotPassword(username)
+			var throttled *NotificationThrottledError
+			if errors.Is(err, types.ErrUserNotFound) ||
+				errors.As(err, &throttled) {
+				return pz.Ok(pz.String(forgotPasswordSentPage), &logging{
+					Message: "reset link not sent; silently succeeding",
+					User:    username,
+					Error:   err.Error(),
+				})
+			}
+			if err != nil {
+				httpErr := &pz.HTTPError{
+					Status:  http.StatusInternalServerError,
+					Message: "internal server error",
+				}
+				_ = errors.As(err, &httpErr)
+				context := forgotPasswordContext{
+					FormAction:   pathForgotPasswordHandler,
+					ErrorMessage: httpErr.Message,
+					PrivateError: err.Error(),
+					ErrorType:    fmt.Sprintf("%T", err),
+				}
+				return pz.Response{
+					Status: httpErr.Status,
+					Data:   pz.HTMLTemplate(forgotPasswordForm, &context),
+				}.WithLogging(&context)
+			}
+			return pz.Ok(pz.String(forgotPasswordSentPage), &logging{
+				Message: "password reset notification sent",
+				User:    username,
+			})
+		},
 	}
+}
 
-	context.Target = context.Callback.Actual + "?" + url.Values{
-		"code":     []string{code},
-		"redirect": []string{context.Redirect.Actual},
-		"callback": []string{context.Callback.Actual},
-	}.Encode()
+const forgotPasswordSentPage = `<html>
+<head>
+	<title>Check Your Email</title>
+</head>
+<body>
+<h1>Check Your Email</h1>
+<p>If the account exists, a password reset link has been sent to its email
+address.</p>
+</body>
+</html>`
 
-	// Previously we used 307 Temporary Redirect, but since we're handling a
-	// POST request, the redirect also issued a POST request instead of a GET
-	// request. It seems like 303 See Other does what we want.
-	// https://developer.mozilla.org/en-US/docs/Web/HTTP/Redirections#temporary_redirections
-	return pz.SeeOther(context.Target, &context)
+// PasswordChangeFormRoute serves the form for changing a password. The auth
+// service doesn't keep login sessions of its own, so rather than relying on
+// one, the form asks for the user's current credentials, including the
+// second factor if they've enabled it.
+func (ws *WebServer) PasswordChangeFormRoute() pz.Route {
+	return pz.Route{
+		Path:   pathPasswordChangeForm,
+		Method: "GET",
+		Handler: func(r pz.Request) pz.Response {
+			context := passwordChangeContext{
+				FormAction: pathPasswordChangeHandler,
+			}
+			return pz.Ok(
+				pz.HTMLTemplate(passwordChangeForm, &context),
+				&context,
+			)
+		},
+	}
+}
+
+var passwordChangeForm = html.Must(html.New("").Parse(`<html>
+<head>
+	<title>Change Password</title>
+</head>
+<body>
+<h1>Change Password</h1>
+{{ if .ErrorMessage }}<p id="error-message">{{ .ErrorMessage }}</p>{{ end }}
+{{ if .PasswordRejections }}<ul id="password-rejections">
+{{ range .PasswordRejections }}	<li class="{{ .Reason }}">{{ .Message }}</li>
+{{ end }}</ul>{{ end }}
+<form action="{{ .FormAction }}" method="POST">
+	<label for="username">Username or email</label>
+	<input type="text" id="username" name="username"><br><br>
+	<label for="password">Current password</label>
+	<input type="password" id="password" name="password"><br><br>
+	<label for="code">Two-factor code (if enabled)</label>
+	<input type="text" id="code" name="code"
+		autocomplete="one-time-code"><br><br>
+	<label for="new_password">New password</label>
+	<input type="password" id="new_password" name="new_password"><br><br>
+	<input type="submit" value="Submit">
+</form>
+</body>
+</html>`))
+
+type passwordChangeContext struct {
+	FormAction   string `json:"formAction"`
+	ErrorMessage string `json:"errorMessage,omitempty"` // for html template
+	PrivateError string `json:"privateError,omitempty"` // logging only
+	ErrorType    string `json:"errorType,omitempty"`    // type of PrivateError
+
+	// User is the submitted username or email address.
+	User types.UserID `json:"user,omitempty"`
+
+	// PasswordRejections are the reasons the password policy rejected the
+	// new password, if any.
+	PasswordRejections []PasswordRejection `json:"rejections,omitempty"`
+}
+
+// PasswordChangeHandlerRoute changes the password of the user whose current
+// credentials are submitted and logs them out everywhere.
+func (ws *WebServer) PasswordChangeHandlerRoute() pz.Route {
+	return pz.Route{
+		Path:   pathPasswordChangeHandler,
+		Method: "POST",
+		Handler: func(r pz.Request) pz.Response {
+			form, err := parseForm(r)
+			if err != nil {
+				return pz.BadRequest(pz.String("error parsing form"), &logging{
+					Message: "parsing password change form",
+					Error:   err.Error(),
+				})
+			}
+
+			username := types.UserID(form.Get("username"))
+			if err := ws.AuthService.ChangePassword(
+				&types.Credentials{
+					User:     username,
+					Password: form.Get("password"),
+				},
+				form.Get("code"),
+				form.Get("new_password"),
+				ws.AuthService.clientInfo(r),
+			); err != nil {
+				httpErr := &pz.HTTPError{
+					Status:  http.StatusInternalServerError,
+					Message: "internal server error",
+				}
+				var throttled *ThrottledError
+				if errors.As(err, &throttled) {
+					httpErr = &pz.HTTPError{
+						Status:  http.StatusTooManyRequests,
+						Message: throttledMessage,
+					}
+				}
+				_ = errors.As(err, &httpErr)
+				context := passwordChangeContext{
+					FormAction:   pathPasswordChangeHandler,
+					User:         username,
+					ErrorMessage: httpErr.Message,
+					PrivateError: err.Error(),
+					ErrorType:    fmt.Sprintf("%T", err),
+				}
+				var rejected *PasswordPolicyError
+				if errors.As(err, &rejected) {
+					context.PasswordRejections = rejected.Rejections
+				}
+				return retryAfter(pz.Response{
+					Status: httpErr.Status,
+					Data:   pz.HTMLTemplate(passwordChangeForm, &context),
+				}.WithLogging(&context), err)
+			}
+			return pz.Ok(
+				pz.HTMLTemplate(
+					passwordChangedPage,
+					ws.passwordChangedContext(),
+				),
+				&logging{Message: "changed password", User: username},
+			)
+		},
+	}
+}
+
+// MagicLinkFormRoute serves the form for requesting a magic login link. It
+// takes the same query parameters as the login form.
+func (ws *WebServer) MagicLinkFormRoute() pz.Route {
+	return pz.Route{
+		Path:   pathMagicLinkForm,
+		Method: "GET",
+		Handler: func(r pz.Request) pz.Response {
+			context := magicLinkFormContext{
+				FormAction: ws.magicLinkAction(r.URL.Query()),
+			}
+			return pz.Ok(
+				pz.HTMLTemplate(magicLinkForm, &context),
+				&context,
+			)
+		},
+	}
+}
+
+var magicLinkForm = html.Must(html.New("").Parse(`<html>
+<head>
+	<title>Email Me a Login Link</title>
+</head>
+<body>
+<h1>Email Me a Login Link</h1>
+{{ if .ErrorMessage }}<p id="error-message">{{ .ErrorMessage }}</p>{{ end }}
+<form action="{{ .FormAction }}" method="POST">
+	<label for="username">Username or email</label>
+	<input type="text" id="username" name="username"><br><br>
+	<input type="submit" value="Submit">
+</form>
+</body>
+</html>`))
+
+type magicLinkFormContext struct {
+	FormAction   string `json:"formAction"`
+	ErrorMessage string `json:"errorMessage,omitempty"` // for html template
+	PrivateError string `json:"privateError,omitempty"` // logging only
+}
+
+// magicLinkAction returns the URL for requesting a magic link with the login
+// form's query parameters.
+func (ws *WebServer) magicLinkAction(query url.Values) string {
+	return ws.BaseURL + "login/magic?" + loginQuery(query).Encode()
+}
+
+// MagicLinkHandlerRoute emails a magic login link. The login form's query
+// parameters are carried in the link so that the login resumes where it
+// started. Unknown users get the same response as everyone else so as to not
+// give away which users exist.
+func (ws *WebServer) MagicLinkHandlerRoute() pz.Route {
+	return pz.Route{
+		Path:   pathMagicLinkHandler,
+		Method: "POST",
+		Handler: func(r pz.Request) pz.Response {
+			form, err := parseForm(r)
+			if err != nil {
+				return pz.HandleError(
+					"error parsing form data",
+					ErrParsingFormData,
+					&logging{
+						Message:   "parsing magic link form data",
+						ErrorType: fmt.Sprintf("%T", err),
+						Error:     err.Error(),
+					},
+				)
+			}
+
+			username := types.UserID(form.Get("username"))
+			query := r.URL.Query()
+			err = ws.AuthService.RequestMagicLink(
+				username,
+				&CodeParams{
+					CodeChallenge:       query.Get("code_challenge"),
+					CodeChallengeMethod: query.Get("code_challenge_method"),
+				},
+				loginQuery(query).Encode(),
+			)
+			var throttled *NotificationThrottledError
+			if errors.Is(err, types.ErrUserNotFound) ||
+				errors.As(err, &throttled) {
+				return pz.Ok(pz.String(magicLinkSentPage), &logging{
+					Message: "magic link not sent; silently succeeding",
+					User:    username,
+					Error:   err.Error(),
+				})
+			}
+			if err != nil {
+				httpErr := &pz.HTTPError{
+					Status:  http.StatusInternalServerError,
+					Message: "internal server error",
+				}
+				_ = errors.As(err, &httpErr)
+				context := magicLinkFormContext{
+					FormAction:   ws.magicLinkAction(query),
+					ErrorMessage: httpErr.Message,
+					PrivateError: err.Error(),
+				}
+				return pz.Response{
+					Status: httpErr.Status,
+					Data:   pz.HTMLTemplate(magicLinkForm, &context),
+				}.WithLogging(&context)
+			}
+			return pz.Ok(pz.String(magicLinkSentPage), &logging{
+				Message: "sent magic link",
+				User:    username,
+			})
+		},
+	}
+}
+
+const magicLinkSentPage = `<html>
+<head>
+	<title>Check Your Email</title>
+</head>
+<body>
+<h1>Check Your Email</h1>
+<p>If the account exists, a login link has been sent to its email address.
+The link can only be used once.</p>
+</body>
+</html>`
+
+// MagicLinkConfirmationFormRoute serves the page which the magic link opens.
+// The link is only used when the form is submitted so that link scanners
+// which follow the link don't use it up.
+func (ws *WebServer) MagicLinkConfirmationFormRoute() pz.Route {
+	return pz.Route{
+		Path:   pathMagicLinkConfirmationForm,
+		Method: "GET",
+		Handler: func(r pz.Request) pz.Response {
+			context := magicLinkConfirmationContext{
+				FormAction: pathMagicLinkConfirmationHandler,
+				Token:      r.URL.Query().Get("t"),
+			}
+			return pz.Ok(
+				pz.HTMLTemplate(magicLinkConfirmationForm, &context),
+				&context,
+			)
+		},
+	}
+}
+
+var magicLinkConfirmationForm = html.Must(html.New("").Parse(`<html>
+<head>
+	<title>Log In</title>
+</head>
+<body>
+<h1>Log In</h1>
+{{ if .ErrorMessage }}<p id="error-message">{{ .ErrorMessage }}</p>
+<p><a href="{{ .RequestAction }}">Request a new login link</a></p>{{ end }}
+{{ if .Token }}<form action="{{ .FormAction }}" method="POST">
+	<input type="hidden" id="token" name="token" value="{{.Token}}">
+	<input type="submit" value="Log in">
+</form>{{ end }}
+</body>
+</html>`))
+
+type magicLinkConfirmationContext struct {
+	FormAction   string `json:"formAction"`
+	Token        string `json:"-"`                      // hidden form field
+	ErrorMessage string `json:"errorMessage,omitempty"` // for html template
+	PrivateError string `json:"privateError,omitempty"` // logging only
+	ErrorType    string `json:"errorType,omitempty"`    // type of PrivateError
+
+	// RequestAction links to the magic link form if the link didn't work.
+	RequestAction string `json:"requestAction,omitempty"`
+}
+
+// MagicLinkConfirmationHandlerRoute logs the user in with a magic link and
+// redirects to the callback with an auth code exactly like `LoginHandler`.
+// If the user has enabled two-factor authentication, the second-factor form
+// is served instead.
+func (ws *WebServer) MagicLinkConfirmationHandlerRoute() pz.Route {
+	return pz.Route{
+		Path:   pathMagicLinkConfirmationHandler,
+		Method: "POST",
+		Handler: func(r pz.Request) pz.Response {
+			form, err := parseForm(r)
+			if err != nil {
+				return pz.BadRequest(pz.String("error parsing form"), &logging{
+					Message: "parsing magic link confirmation form",
+					Error:   err.Error(),
+				})
+			}
+
+			code, state, err := ws.AuthService.LoginMagicLink(
+				form.Get("token"),
+				ws.AuthService.clientInfo(r),
+			)
+
+			// The state is the login form's query string (see
+			// `MagicLinkHandlerRoute`). It was signed into the link, so it
+			// hasn't been tampered with.
+			query, _ := url.ParseQuery(state)
+			if err != nil {
+				formAction := ws.BaseURL + "login?" +
+					loginQuery(query).Encode()
+				if rsp, ok := secondFactorResponse(
+					formAction,
+					form,
+					err,
+				); ok {
+					return rsp
+				}
+
+				httpErr := &pz.HTTPError{
+					Status:  http.StatusInternalServerError,
+					Message: "internal server error",
+				}
+				if errors.Is(err, ErrUnauthorized) {
+					httpErr = &pz.HTTPError{
+						Status:  http.StatusUnauthorized,
+						Message: "Invalid or expired login link",
+					}
+				}
+				context := magicLinkConfirmationContext{
+					FormAction:    pathMagicLinkConfirmationHandler,
+					ErrorMessage:  httpErr.Message,
+					PrivateError:  err.Error(),
+					ErrorType:     fmt.Sprintf("%T", err),
+					RequestAction: ws.magicLinkAction(query),
+				}
+				return pz.Response{
+					Status: httpErr.Status,
+					Data: pz.HTMLTemplate(
+						magicLinkConfirmationForm,
+						&context,
+					),
+				}.WithLogging(&context)
+			}
+
+			context := ws.loginTarget(query, code)
+			if context.Target == "" {
+				return pz.BadRequest(nil, context)
+			}
+			return pz.SeeOther(context.Target, context)
+		},
+	}
+}
+
+func (ws *WebServer) LoginFormPage(r pz.Request) pz.Response {
+	query := r.URL.Query()
+
+	context := ws.loginFormContext(query, "")
+	return pz.Ok(pz.HTMLTemplate(loginForm, context), context)
+}
+
+// loginFormContext is used for templating the login form and for logging.
+type loginFormContext struct {
+	FormAction      string `json:"formAction"`
+	WebAuthnAction  string `json:"webAuthnAction,omitempty"`
+	MagicLinkAction string `json:"magicLinkAction,omitempty"`
+	ErrorMessage    string `json:"-"`
+
+	// ForgotPasswordAction links to the forgot-password form.
+	ForgotPasswordAction string `json:"forgotPasswordAction,omitempty"`
+}
+
+func (ws *WebServer) loginFormContext(
+	query url.Values,
+	errorMessage string,
+) *loginFormContext {
+	return &loginFormContext{
+		FormAction:      ws.BaseURL + "login?" + loginQuery(query).Encode(),
+		WebAuthnAction:  ws.webAuthnAction(query),
+		MagicLinkAction: ws.magicLinkAction(query),
+		ErrorMessage:    errorMessage,
+
+		ForgotPasswordAction: ws.BaseURL + "password/forgot",
+	}
+}
+
+// loginQuery selects the login parameters from the query string so they can
+// be passed along to the login form's action.
+func loginQuery(query url.Values) url.Values {
+	values := url.Values{
+		"callback": []string{query.Get("callback")},
+		"redirect": []string{query.Get("redirect")},
+	}
+	for _, key := range []string{"code_challenge", "code_challenge_method"} {
+		if value := query.Get(key); value != "" {
+			values.Set(key, value)
+		}
+	}
+	return values
+}
+
+var loginForm = html.Must(html.New("").Parse(`<html>
+<head>
+	<title>Login</title>
+</head>
+<body>
+<h1>Login</h1>
+{{ if .ErrorMessage }}<p id="error-message">{{ .ErrorMessage }}</p>{{ end }}
+<form action="{{ .FormAction }}" method="POST">
+	<label for="username">Username or email</label>
+	<input type="text" id="username" name="username"><br><br>
+	<label for="password">Password</label>
+	<input type="password" id="password" name="password"><br><br>
+	<input type="submit" value="Submit">
+</form>
+{{ if .MagicLinkAction }}<p><a href="{{ .MagicLinkAction }}">Email me a login
+link</a></p>{{ end }}
+{{ if .ForgotPasswordAction }}<p><a href="{{ .ForgotPasswordAction }}">Forgot
+your password?</a></p>{{ end }}
+{{ if .WebAuthnAction }}
+<button type="button" id="passkey">Log in with a passkey</button>
+<p id="passkey-error"></p>
+<script>
+(function () {
+	var action = new URL({{ .WebAuthnAction }});
+	function decode(s) {
+		s = s.replace(/-/g, "+").replace(/_/g, "/");
+		return Uint8Array.from(atob(s), function (c) {
+			return c.charCodeAt(0);
+		});
+	}
+	function encode(buf) {
+		return btoa(String.fromCharCode.apply(null, new Uint8Array(buf)))
+			.replace(/\+/g, "-").replace(/\//g, "_").replace(/=+$/, "");
+	}
+	async function login() {
+		var rsp = await fetch(action, {
+			method: "POST",
+			body: JSON.stringify({
+				username: document.getElementById("username").value
+			})
+		});
+		if (!rsp.ok) {
+			throw new Error(await rsp.text());
+		}
+		var ceremony = await rsp.json();
+		var options = ceremony.publicKey;
+		options.challenge = decode(options.challenge);
+		options.allowCredentials.forEach(function (c) {
+			c.id = decode(c.id);
+		});
+		var credential = await navigator.credentials.get({publicKey: options});
+		var response = credential.response;
+		var finish = new URL(action);
+		finish.pathname += "/finish";
+		rsp = await fetch(finish, {
+			method: "POST",
+			body: JSON.stringify({
+				token: ceremony.token,
+				credential: {
+					rawId: encode(credential.rawId),
+					type: credential.type,
+					response: {
+						clientDataJSON: encode(response.clientDataJSON),
+						authenticatorData: encode(response.authenticatorData),
+						signature: encode(response.signature),
+						userHandle: response.userHandle ?
+							encode(response.userHandle) : null
+					}
+				}
+			})
+		});
+		if (!rsp.ok) {
+			throw new Error(await rsp.text());
+		}
+		window.location = (await rsp.json()).location;
+	}
+	document.getElementById("passkey").onclick = function () {
+		login().catch(function (err) {
+			document.getElementById("passkey-error").textContent =
+				"Passkey login failed: " + err.message;
+		});
+	};
+})();
+</script>
+{{ end }}
+</body>
+</html>`))
+
+// webAuthnAction returns the URL for starting a passkey login with the login
+// form's query parameters, or an empty string if passkeys aren't configured.
+func (ws *WebServer) webAuthnAction(query url.Values) string {
+	if ws.AuthService.WebAuthn.Credentials == nil {
+		return ""
+	}
+	return ws.BaseURL + "login/webauthn?" + loginQuery(query).Encode()
+}
+
+func (ws *WebServer) LoginHandler(r pz.Request) pz.Response {
+	form, err := parseForm(r)
+	if err != nil {
+		return pz.BadRequest(
+			pz.Stringf("parsing credentials: %v", err),
+			&logging{
+				Message:   "parsing credentials from multi-part form",
+				ErrorType: fmt.Sprintf("%T", err),
+				Error:     err.Error(),
+			},
+		)
+	}
+
+	username := types.UserID(form.Get("username"))
+	query := r.URL.Query()
+	formAction := ws.BaseURL + "login?" + loginQuery(query).Encode()
+
+	var code string
+	if token := form.Get("second_factor_token"); token != "" {
+		code, err = ws.AuthService.LoginAuthCodeSecondFactor(
+			token,
+			form.Get("code"),
+			"",
+			"",
+		)
+	} else {
+		code, err = ws.AuthService.LoginAuthCode(
+			&types.Credentials{
+				User:     username,
+				Password: form.Get("password"),
+			},
+			&CodeParams{
+				CodeChallenge:       query.Get("code_challenge"),
+				CodeChallengeMethod: query.Get("code_challenge_method"),
+			},
+			ws.AuthService.clientInfo(r),
+		)
+	}
+	if err != nil {
+		if rsp, ok := secondFactorResponse(formAction, form, err); ok {
+			return rsp
+		}
+		if errors.Is(err, ErrInvalidCodeChallenge) {
+			return pz.BadRequest(
+				pz.String(ErrInvalidCodeChallenge.Message),
+				&logging{
+					User:    username,
+					Message: "login failed",
+					Error:   err.Error(),
+				},
+			)
+		}
+		var throttled *ThrottledError
+		if errors.As(err, &throttled) {
+			return retryAfter(pz.Response{
+				Status: http.StatusTooManyRequests,
+				Data: pz.HTMLTemplate(
+					loginForm,
+					ws.loginFormContext(query, throttledMessage),
+				),
+				Logging: []interface{}{&logging{
+					User:    username,
+					Message: "login throttled",
+					Error:   err.Error(),
+				}},
+			}, err)
+		}
+		// An invalid second-factor token (e.g., because it expired) sends
+		// the user back to the login form.
+		if errors.Is(err, ErrCredentials) ||
+			errors.Is(err, ErrUnauthorized) {
+			return pz.Unauthorized(
+				pz.HTMLTemplate(
+					loginForm,
+					ws.loginFormContext(query, "Invalid credentials"),
+				),
+				&logging{
+					User:    username,
+					Message: "login failed",
+					Error:   err.Error(),
+				},
+			)
+		}
+		return pz.InternalServerError(&logging{
+			User:      username,
+			Message:   "logging in",
+			ErrorType: fmt.Sprintf("%T", err),
+			Error:     err.Error(),
+		})
+	}
+
+	context := ws.loginTarget(query, code)
+	if context.Target == "" {
+		return pz.BadRequest(nil, context)
+	}
+
+	// Previously we used 307 Temporary Redirect, but since we're handling a
+	// POST request, the redirect also issued a POST request instead of a GET
+	// request. It seems like 303 See Other does what we want.
+	// https://developer.mozilla.org/en-US/docs/Web/HTTP/Redirections#temporary_redirections
+	return pz.SeeOther(context.Target, context)
+}
+
+// WebAuthnLoginRoute starts a passkey login. It takes the same query
+// parameters as the login form.
+func (ws *WebServer) WebAuthnLoginRoute() pz.Route {
+	return pz.Route{
+		Path:   pathWebAuthnLogin,
+		Method: "POST",
+		Handler: func(r pz.Request) pz.Response {
+			var payload struct {
+				Username types.UserID `json:"username"`
+			}
+			if err := r.JSON(&payload); err != nil {
+				return pz.BadRequest(nil, &logging{
+					Message: "failed to parse passkey login JSON",
+					Error:   err.Error(),
+				})
+			}
+
+			query := r.URL.Query()
+			login, err := ws.AuthService.BeginWebAuthnLogin(
+				payload.Username,
+				&CodeParams{
+					CodeChallenge:       query.Get("code_challenge"),
+					CodeChallengeMethod: query.Get("code_challenge_method"),
+				},
+			)
+			if err != nil {
+				return pz.HandleError(
+					"beginning passkey login",
+					err,
+					&logging{
+						Message:   "beginning passkey login",
+						ErrorType: fmt.Sprintf("%T", err),
+						Error:     err.Error(),
+						User:      payload.Username,
+					},
+				)
+			}
+
+			return pz.Ok(pz.JSON(login), &logging{
+				Message: "began passkey login",
+				User:    payload.Username,
+			})
+		},
+	}
+}
+
+// WebAuthnLoginFinishRoute completes a passkey login. Since the request comes
+// from a script rather than a form, the response holds the location to send
+// the browser to instead of redirecting.
+func (ws *WebServer) WebAuthnLoginFinishRoute() pz.Route {
+	return pz.Route{
+		Path:   pathWebAuthnLoginFinish,
+		Method: "POST",
+		Handler: func(r pz.Request) pz.Response {
+			var payload struct {
+				Token      string            `json:"token"`
+				Credential WebAuthnAssertion `json:"credential"`
+			}
+			if err := r.JSON(&payload); err != nil {
+				return pz.BadRequest(nil, &logging{
+					Message: "failed to parse passkey assertion JSON",
+					Error:   err.Error(),
+				})
+			}
+
+			code, err := ws.AuthService.FinishWebAuthnLogin(
+				payload.Token,
+				&payload.Credential,
+				ws.AuthService.clientInfo(r),
+			)
+			if err != nil {
+				return retryAfter(pz.HandleError(
+					"finishing passkey login",
+					err,
+					&logging{
+						Message:   "finishing passkey login",
+						ErrorType: fmt.Sprintf("%T", err),
+						Error:     err.Error(),
+					},
+				), err)
+			}
+
+			context := ws.loginTarget(r.URL.Query(), code)
+			if context.Target == "" {
+				return pz.BadRequest(nil, context)
+			}
+			return pz.Ok(
+				pz.JSON(&WebAuthnLoginResult{Location: context.Target}),
+				context,
+			)
+		},
+	}
+}
+
+// WebAuthnLoginResult tells the login page where to send the browser after a
+// successful passkey login.
+type WebAuthnLoginResult struct {
+	Location string `json:"location"`
+}
+
+type loginTargetContext struct {
+	Message  string `json:"message,omitempty"`
+	Target   string `json:"target,omitempty"`
+	Redirect redirectResult
+	Callback redirectResult
+}
+
+// loginTarget validates the `callback` and `redirect` query parameters and
+// builds the callback URL which delivers the auth code to the app. If either
+// parameter is invalid, the target is empty and the message says why.
+func (ws *WebServer) loginTarget(
+	query url.Values,
+	code string,
+) *loginTargetContext {
+	context := loginTargetContext{
+		Callback: redirectResult{
+			Specified: query.Get("callback"),
+			Default:   ws.DefaultRedirectLocation,
+			Domain:    ws.RedirectDomain,
+		},
+		Redirect: redirectResult{
+			Specified: query.Get("redirect"),
+			Default:   ws.DefaultRedirectLocation,
+			Domain:    ws.RedirectDomain,
+		},
+	}
+
+	validateRedirect(&context.Callback)
+	if context.Callback.ParseError != "" {
+		context.Message = "`callback` parameter contains invalid URL"
+		return &context
+	}
+	validateRedirect(&context.Redirect)
+	if context.Redirect.ParseError != "" {
+		context.Message = "`redirect` parameter contains invalid URL"
+		return &context
+	}
+
+	context.Target = context.Callback.Actual + "?" + url.Values{
+		"code":     []string{code},
+		"redirect": []string{context.Redirect.Actual},
+		"callback": []string{context.Callback.Actual},
+	}.Encode()
+	return &context
+}
+
+var secondFactorForm = html.Must(html.New("").Parse(`<html>
+<head>
+	<title>Two-Factor Authentication</title>
+</head>
+<body>
+<h1>Two-Factor Authentication</h1>
+{{ if .ErrorMessage }}<p id="error-message">{{ .ErrorMessage }}</p>{{ end }}
+<form action="{{ .FormAction }}" method="POST">
+	<label for="code">Authentication or recovery code</label>
+	<input type="text" id="code" name="code"
+		autocomplete="one-time-code"><br><br>
+	<input type="hidden" id="second_factor_token" name="second_factor_token"
+		value="{{ .Token }}">
+	<input type="submit" value="Submit">
+</form>
+</body>
+</html>`))
+
+type secondFactorContext struct {
+	FormAction   string `json:"formAction"`
+	Token        string `json:"-"`                      // hidden form field
+	ErrorMessage string `json:"errorMessage,omitempty"` // for html template
+	PrivateError string `json:"privateError,omitempty"` // logging only
+}
+
+// secondFactorResponse renders the second-factor form if a login requires a
+// second factor or if the submitted second-factor code was invalid. The form
+// posts back to `formAction` along with the second-factor token.
+func secondFactorResponse(
+	formAction string,
+	form url.Values,
+	err error,
+) (pz.Response, bool) {
+	var required *SecondFactorRequired
+	if errors.As(err, &required) {
+		context := secondFactorContext{
+			FormAction: formAction,
+			Token:      required.Token,
+		}
+		return pz.Ok(
+			pz.HTMLTemplate(secondFactorForm, &context),
+			&context,
+		), true
+	}
+
+	if errors.Is(err, ErrSecondFactor) {
+		context := secondFactorContext{
+			FormAction:   formAction,
+			Token:        form.Get("second_factor_token"),
+			ErrorMessage: "Invalid code",
+			PrivateError: err.Error(),
+		}
+		return pz.Unauthorized(
+			pz.HTMLTemplate(secondFactorForm, &context),
+			&context,
+		), true
+	}
+
+	return pz.Response{}, false
 }
 
 func validateRedirect(context *redirectResult) {
@@ -46,7 +46,7 @@ func TestWebServer_RegistrationConfirmationHandlerRoute(t *testing.T) {
 		{
 			name:         "missing token",
 			body:         confirmationForm("", goodPassword),
-			wantedStatus: http.StatusBadRequest,
+			wantedStatus: http.StatusUnauthorized,
 		},
 		{
 			name: "missing password",
@@ -58,12 +58,15 @@ func TestWebServer_RegistrationConfirmationHandlerRoute(t *testing.T) {
 		},
 	} {
 		t.Run(testCase.name, func(t *testing.T) {
+			jwt.TimeFunc = nowTimeFunc
+			defer func() { jwt.TimeFunc = time.Now }()
+
 			if testCase.existingUsers == nil {
 				testCase.existingUsers = testsupport.UserStoreFake{}
 			}
 			webServer := WebServer{
 				AuthService: AuthService{
-					Creds:       CredStore{testCase.existingUsers},
+					Creds:       CredStore{Users: testCase.existingUsers},
 					Tokens:      testsupport.TokenStoreFake{},
 					ResetTokens: resetTokenFactory,
 					TokenDetails: TokenDetailsFactory{
@@ -124,6 +127,234 @@ func TestWebServer_RegistrationConfirmationHandlerRoute(t *testing.T) {
 	}
 }
 
+func TestWebServer_PasswordReset(t *testing.T) {
+	jwt.TimeFunc = nowTimeFunc
+	defer func() { jwt.TimeFunc = time.Now }()
+
+	users := testsupport.UserStoreFake{
+		"adam": {
+			User:         "adam",
+			Email:        "adam@example.org",
+			PasswordHash: hashBcrypt(goodPassword),
+		},
+		"beth": {
+			User:         "beth",
+			Email:        "beth@example.org",
+			PasswordHash: hashBcrypt(goodPassword),
+		},
+	}
+	notifications := testsupport.NotificationServiceFake{}
+	webServer := WebServer{
+		AuthService: AuthService{
+			Creds:         CredStore{Users: users},
+			Tokens:        testsupport.TokenStoreFake{},
+			ResetTokens:   resetTokenFactory,
+			Notifications: &notifications,
+			TimeFunc:      nowTimeFunc,
+		},
+		BaseURL: "https://auth.example.org/",
+	}
+	if err := webServer.AuthService.ForgotPassword("adam"); err != nil {
+		t.Fatalf("ForgotPassword(): unexpected err: %v", err)
+	}
+	link, err := url.Parse(TokenURL(webServer.BaseURL)(
+		notifications.Notifications[0],
+	))
+	if err != nil {
+		t.Fatalf("parsing reset link: %v", err)
+	}
+	if link.Path != pathPasswordResetForm {
+		t.Fatalf(
+			"link path: wanted `%s`; found `%s`",
+			pathPasswordResetForm,
+			link.Path,
+		)
+	}
+
+	reset := func(password string) pz.Response {
+		return webServer.PasswordResetHandlerRoute().Handler(pz.Request{
+			Body: strings.NewReader(url.Values{
+				"token":    []string{link.Query().Get("t")},
+				"password": []string{password},
+			}.Encode()),
+		})
+	}
+	newPassword := goodPassword + "!"
+	if rsp := reset(newPassword); rsp.Status != http.StatusOK {
+		t.Fatalf(
+			"Response.Status: wanted `%d`; found `%d`",
+			http.StatusOK,
+			rsp.Status,
+		)
+	}
+	for _, wanted := range []types.Credentials{
+		{User: "adam", Email: "adam@example.org", Password: newPassword},
+		{User: "beth", Email: "beth@example.org", Password: goodPassword},
+	} {
+		if err := wanted.CompareUserEntry(users[wanted.User]); err != nil {
+			t.Fatalf("UserStore[%s]: %v", wanted.User, err)
+		}
+	}
+
+	// The link only works once.
+	if rsp := reset(goodPassword); rsp.Status != http.StatusUnauthorized {
+		t.Fatalf(
+			"Response.Status: wanted `%d`; found `%d`",
+			http.StatusUnauthorized,
+			rsp.Status,
+		)
+	}
+}
+
+func TestWebServer_ForgotPasswordHandlerRoute(t *testing.T) {
+	jwt.TimeFunc = nowTimeFunc
+	defer func() { jwt.TimeFunc = time.Now }()
+
+	notifications := testsupport.NotificationServiceFake{}
+	webServer := WebServer{AuthService: AuthService{
+		Creds: CredStore{Users: testsupport.UserStoreFake{
+			"adam": {User: "adam", Email: "adam@example.org"},
+		}},
+		ResetTokens:   resetTokenFactory,
+		Notifications: &notifications,
+		TimeFunc:      nowTimeFunc,
+	}}
+
+	// Unknown users get the same response as everyone else.
+	for _, username := range []string{"adam@example.org", "beth"} {
+		rsp := webServer.ForgotPasswordHandlerRoute().Handler(pz.Request{
+			Body: strings.NewReader(url.Values{
+				"username": []string{username},
+			}.Encode()),
+		})
+		if rsp.Status != http.StatusOK {
+			t.Fatalf(
+				"Response.Status: wanted `%d`; found `%d`",
+				http.StatusOK,
+				rsp.Status,
+			)
+		}
+	}
+	if len(notifications.Notifications) != 1 {
+		t.Fatalf(
+			"wanted 1 notification; found %d",
+			len(notifications.Notifications),
+		)
+	}
+	if n := notifications.Notifications[0]; n.Type !=
+		types.NotificationTypeForgotPassword || n.User != "adam" {
+		t.Fatalf("unexpected notification: %s %s", n.Type, n.User)
+	}
+}
+
+func TestWebServer_PasswordChangeHandlerRoute(t *testing.T) {
+	users := testsupport.UserStoreFake{
+		"adam": {
+			User:         "adam",
+			Email:        "adam@example.org",
+			PasswordHash: hashBcrypt(goodPassword),
+		},
+	}
+	tokens := testsupport.TokenStoreFake{}
+	webServer := WebServer{
+		AuthService: AuthService{
+			Creds: CredStore{
+				Users:  users,
+				Policy: LengthPolicy{Min: 12},
+			},
+			Tokens:   tokens,
+			TimeFunc: nowTimeFunc,
+		},
+		BaseURL: "https://auth.example.org/",
+	}
+	if err := tokens.Put(
+		"refresh-token",
+		&types.Session{ID: "session", Subject: "adam"},
+		now.Add(time.Hour),
+	); err != nil {
+		t.Fatalf("storing session: %v", err)
+	}
+	newPassword := goodPassword + "!"
+	for _, testCase := range []struct {
+		name        string
+		username    string
+		password    string
+		newPassword string
+		wanted      int
+		wantedBody  string
+	}{
+		{
+			name:        "wrong password",
+			username:    "adam",
+			password:    newPassword,
+			newPassword: newPassword,
+			wanted:      http.StatusUnauthorized,
+			wantedBody:  ErrCredentials.Message,
+		},
+		{
+			name:        "rejected",
+			username:    "adam",
+			password:    goodPassword,
+			newPassword: "short",
+			wanted:      http.StatusBadRequest,
+			wantedBody:  `<li class="too_short">`,
+		},
+		{
+			name:        "simple",
+			username:    "adam@example.org",
+			password:    goodPassword,
+			newPassword: newPassword,
+			wanted:      http.StatusOK,
+			wantedBody:  `<a href="https://auth.example.org/login">`,
+		},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			rsp := webServer.PasswordChangeHandlerRoute().Handler(pz.Request{
+				Body: strings.NewReader(url.Values{
+					"username":     []string{testCase.username},
+					"password":     []string{testCase.password},
+					"new_password": []string{testCase.newPassword},
+				}.Encode()),
+				Headers: http.Header{},
+			})
+			if rsp.Status != testCase.wanted {
+				data, err := json.Marshal(rsp.Logging)
+				if err != nil {
+					t.Logf("marshaling response logging: %v", err)
+				}
+				t.Logf("LOGS: %s", data)
+				t.Fatalf(
+					"Response.Status: wanted `%d`; found `%d`",
+					testCase.wanted,
+					rsp.Status,
+				)
+			}
+			data, err := pztest.ReadAll(rsp.Data)
+			if err != nil {
+				t.Fatalf("reading response body: %v", err)
+			}
+			if !strings.Contains(string(data), testCase.wantedBody) {
+				t.Fatalf(
+					"Response.Data: wanted `%s`; found `%s`",
+					testCase.wantedBody,
+					data,
+				)
+			}
+		})
+	}
+
+	if err := (&types.Credentials{
+		User:     "adam",
+		Email:    "adam@example.org",
+		Password: newPassword,
+	}).CompareUserEntry(users["adam"]); err != nil {
+		t.Fatalf("UserStore[adam]: %v", err)
+	}
+	if len(tokens) != 0 {
+		t.Fatalf("wanted all sessions revoked; found %d tokens", len(tokens))
+	}
+}
+
 func TestWebServer_RegistrationHandlerRoute(t *testing.T) {
 	for _, testCase := range []struct {
 		name                string
@@ -147,6 +378,7 @@ func TestWebServer_RegistrationHandlerRoute(t *testing.T) {
 						now,
 						"user",
 						"user@example.org",
+						"",
 					)
 					if err != nil {
 						t.Fatalf(
@@ -184,13 +416,16 @@ func TestWebServer_RegistrationHandlerRoute(t *testing.T) {
 		},
 	} {
 		t.Run(testCase.name, func(t *testing.T) {
+			jwt.TimeFunc = nowTimeFunc
+			defer func() { jwt.TimeFunc = time.Now }()
+
 			notificationService := testsupport.NotificationServiceFake{}
 			if testCase.existingUsers == nil {
 				testCase.existingUsers = testsupport.UserStoreFake{}
 			}
 			webServer := WebServer{
 				AuthService: AuthService{
-					Creds:       CredStore{testCase.existingUsers},
+					Creds:       CredStore{Users: testCase.existingUsers},
 					Tokens:      testsupport.TokenStoreFake{},
 					ResetTokens: resetTokenFactory,
 					TokenDetails: TokenDetailsFactory{
@@ -0,0 +1,117 @@
+package pgtokenstore
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/weberc2/auth/pkg/auth/types"
+	"github.com/weberc2/auth/pkg/pgutil"
+)
+
+// PGCodeStore is a postgres implementation of `types.CodeStore`. It can share
+// a database connection with `PGTokenStore`.
+type PGCodeStore sql.DB
+
+func (pgcs *PGCodeStore) EnsureTable() error {
+	if err := CodesTable.Ensure((*sql.DB)(pgcs)); err != nil {
+		return err
+	}
+
+	// Records used to hold the raw refresh token rather than its family. The
+	// records only live as long as the codes, so the old column is dropped
+	// rather than migrated.
+	if _, err := (*sql.DB)(pgcs).Exec(fmt.Sprintf(
+		"ALTER TABLE \"%s\" DROP COLUMN IF EXISTS \"refresh_token\"",
+		CodesTable.Name,
+	)); err != nil {
+		return fmt.Errorf(
+			"dropping legacy column from postgres table `%s`: %w",
+			CodesTable.Name,
+			err,
+		)
+	}
+	return nil
+}
+
+func (pgcs *PGCodeStore) DropTable() error {
+	return CodesTable.Drop((*sql.DB)(pgcs))
+}
+
+func (pgcs *PGCodeStore) ClearTable() error {
+	return CodesTable.Clear((*sql.DB)(pgcs))
+}
+
+func (pgcs *PGCodeStore) ResetTable() error {
+	return CodesTable.Reset((*sql.DB)(pgcs))
+}
+
+// Redeem inserts a record for the code. If the code was already redeemed,
+// `types.ErrCodeRedeemed` is returned.
+func (pgcs *PGCodeStore) Redeem(code *types.RedeemedCode) error {
+	return CodesTable.Insert((*sql.DB)(pgcs), (*codeEntry)(code))
+}
+
+// Get returns the record for a redeemed code. If the code hasn't been
+// redeemed, `types.ErrCodeNotFound` is returned.
+func (pgcs *PGCodeStore) Get(id string) (*types.RedeemedCode, error) {
+	var entry codeEntry
+	if err := CodesTable.Get(
+		(*sql.DB)(pgcs),
+		&codeEntry{ID: id},
+		&entry,
+	); err != nil {
+		return nil, err
+	}
+	return (*types.RedeemedCode)(&entry), nil
+}
+
+// DeleteExpired deletes the records for all codes that expired before `now`.
+func (pgcs *PGCodeStore) DeleteExpired(now time.Time) error {
+	if _, err := (*sql.DB)(pgcs).Exec(
+		fmt.Sprintf(
+			"DELETE FROM \"%s\" WHERE \"%s\" < $1",
+			CodesTable.Name,
+			expiresColumnName,
+		),
+		now,
+	); err != nil {
+		return fmt.Errorf("deleting expired codes from postgres: %w", err)
+	}
+	return nil
+}
+
+type codeEntry types.RedeemedCode
+
+func (entry *codeEntry) Scan(pointers []interface{}) {
+	pointers[0] = &entry.ID
+	pointers[1] = &entry.Family
+	pointers[2] = &entry.Expires
+}
+
+func (entry *codeEntry) Values(values []interface{}) {
+	values[0] = entry.ID
+	values[1] = entry.Family
+	values[2] = entry.Expires
+}
+
+var (
+	_ types.CodeStore = &PGCodeStore{}
+	_ pgutil.Item     = &codeEntry{}
+
+	// CodesTable holds the IDs of redeemed auth codes.
+	CodesTable = pgutil.Table{
+		Name:        "codes",
+		PrimaryKeys: []pgutil.Column{{Name: "id", Type: "VARCHAR(128)"}},
+		OtherColumns: []pgutil.Column{
+			{
+				Name:    familyColumnName,
+				Type:    "VARCHAR(64)",
+				Default: pgutil.SQL("''"),
+			},
+			{Name: expiresColumnName, Type: "TIMESTAMPTZ"},
+		},
+		ExistsErr:   types.ErrCodeRedeemed,
+		NotFoundErr: types.ErrCodeNotFound,
+	}
+)
@@ -0,0 +1,90 @@
+package pgtokenstore
+
+import (
+	"database/sql"
+	"log"
+	"testing"
+
+	"github.com/weberc2/auth/pkg/auth/types"
+)
+
+func TestPGCodeStore_Redeem(t *testing.T) {
+	if err := codeStore.ClearTable(); err != nil {
+		t.Fatalf("preparing postgres table: %v", err)
+	}
+
+	code := types.RedeemedCode{
+		ID:      "code",
+		Family:  "family",
+		Expires: afterNow,
+	}
+	if err := codeStore.Redeem(&code); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if err := types.ErrCodeRedeemed.CompareErr(
+		codeStore.Redeem(&types.RedeemedCode{
+			ID:      "code",
+			Family:  "replayed",
+			Expires: afterNow,
+		}),
+	); err != nil {
+		t.Fatal(err)
+	}
+
+	found, err := codeStore.Get("code")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if found.Family != code.Family {
+		t.Fatalf(
+			"RedeemedCode.Family: wanted `%s`; found `%s`",
+			code.Family,
+			found.Family,
+		)
+	}
+	if !found.Expires.Equal(code.Expires) {
+		t.Fatalf(
+			"RedeemedCode.Expires: wanted `%s`; found `%s`",
+			code.Expires,
+			found.Expires,
+		)
+	}
+}
+
+func TestPGCodeStore_DeleteExpired(t *testing.T) {
+	if err := codeStore.ClearTable(); err != nil {
+		t.Fatalf("preparing postgres table: %v", err)
+	}
+
+	for _, code := range []types.RedeemedCode{
+		{ID: "expired", Expires: beforeNow},
+		{ID: "valid", Expires: afterNow},
+	} {
+		if err := codeStore.Redeem(&code); err != nil {
+			t.Fatalf("preparing postgres table: %v", err)
+		}
+	}
+
+	if err := codeStore.DeleteExpired(now); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if _, err := codeStore.Get("expired"); err != types.ErrCodeNotFound {
+		t.Fatalf("wanted `%v`; found `%v`", types.ErrCodeNotFound, err)
+	}
+	if _, err := codeStore.Get("valid"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+var codeStore = func() *PGCodeStore {
+	s := (*PGCodeStore)((*sql.DB)(store))
+	if err := s.ResetTable(); err != nil {
+		log.Fatalf(
+			"unexpected error resetting code store postgres table: %v",
+			err,
+		)
+	}
+	return s
+}()
@@ -0,0 +1,184 @@
+package pgtokenstore
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/weberc2/auth/pkg/auth/types"
+	"github.com/weberc2/auth/pkg/pgutil"
+)
+
+// PGLoginAttemptStore is a postgres implementation of
+// `types.LoginAttemptStore`. It can share a database connection with
+// `PGTokenStore`.
+type PGLoginAttemptStore sql.DB
+
+func (pglas *PGLoginAttemptStore) EnsureTable() error {
+	return LoginAttemptsTable.Ensure((*sql.DB)(pglas))
+}
+
+func (pglas *PGLoginAttemptStore) DropTable() error {
+	return LoginAttemptsTable.Drop((*sql.DB)(pglas))
+}
+
+func (pglas *PGLoginAttemptStore) ClearTable() error {
+	return LoginAttemptsTable.Clear((*sql.DB)(pglas))
+}
+
+func (pglas *PGLoginAttemptStore) ResetTable() error {
+	return LoginAttemptsTable.Reset((*sql.DB)(pglas))
+}
+
+// Get returns the attempts for a key. If there are none,
+// `types.ErrLoginAttemptsNotFound` is returned.
+func (pglas *PGLoginAttemptStore) Get(
+	key string,
+) (*types.LoginAttempts, error) {
+	var entry loginAttemptsEntry
+	if err := LoginAttemptsTable.Get(
+		(*sql.DB)(pglas),
+		&loginAttemptsEntry{Key: key},
+		&entry,
+	); err != nil {
+		return nil, err
+	}
+	return (*types.LoginAttempts)(&entry), nil
+}
+
+// Fail records a failed login in a single statement so that concurrent
+// failures are all counted.
+func (pglas *PGLoginAttemptStore) Fail(
+	key string,
+	now time.Time,
+	window time.Duration,
+) (*types.LoginAttempts, error) {
+	var entry loginAttemptsEntry
+	if err := (*sql.DB)(pglas).QueryRow(
+		fmt.Sprintf(
+			"INSERT INTO \"%[1]s\" (\"%[2]s\", \"%[3]s\", \"%[4]s\") "+
+				"VALUES ($1, 1, $2) ON CONFLICT (\"%[2]s\") DO UPDATE SET "+
+				"\"%[3]s\" = CASE WHEN \"%[1]s\".\"%[4]s\" < $3 THEN 1 "+
+				"ELSE \"%[1]s\".\"%[3]s\" + 1 END, \"%[4]s\" = $2 "+
+				"RETURNING \"%[2]s\", \"%[3]s\", \"%[4]s\", \"%[5]s\"",
+			LoginAttemptsTable.Name,
+			keyColumnName,
+			failuresColumnName,
+			lastFailureColumnName,
+			lockedUntilColumnName,
+		),
+		key,
+		now,
+		now.Add(-window),
+	).Scan(
+		&entry.Key,
+		&entry.Failures,
+		&entry.LastFailure,
+		&entry.LockedUntil,
+	); err != nil {
+		return nil, fmt.Errorf("recording failed login in postgres: %w", err)
+	}
+	return (*types.LoginAttempts)(&entry), nil
+}
+
+// Refund takes back a failed login in a single statement so that it can't
+// race other attempts.
+func (pglas *PGLoginAttemptStore) Refund(key string) error {
+	if _, err := (*sql.DB)(pglas).Exec(
+		fmt.Sprintf(
+			"UPDATE \"%[1]s\" SET \"%[3]s\" = GREATEST(\"%[3]s\" - 1, 0) "+
+				"WHERE \"%[2]s\" = $1",
+			LoginAttemptsTable.Name,
+			keyColumnName,
+			failuresColumnName,
+		),
+		key,
+	); err != nil {
+		return fmt.Errorf("refunding failed login in postgres: %w", err)
+	}
+	return nil
+}
+
+// Lock locks the key out until the provided time.
+func (pglas *PGLoginAttemptStore) Lock(key string, until time.Time) error {
+	if _, err := (*sql.DB)(pglas).Exec(
+		fmt.Sprintf(
+			"INSERT INTO \"%[1]s\" (\"%[2]s\", \"%[3]s\") VALUES ($1, $2) "+
+				"ON CONFLICT (\"%[2]s\") DO UPDATE SET \"%[3]s\" = $2",
+			LoginAttemptsTable.Name,
+			keyColumnName,
+			lockedUntilColumnName,
+		),
+		key,
+		until,
+	); err != nil {
+		return fmt.Errorf("locking out key in postgres: %w", err)
+	}
+	return nil
+}
+
+// Reset deletes the attempts for a key.
+func (pglas *PGLoginAttemptStore) Reset(key string) error {
+	if err := LoginAttemptsTable.Delete(
+		(*sql.DB)(pglas),
+		&loginAttemptsEntry{Key: key},
+	); err != nil && !errors.Is(err, types.ErrLoginAttemptsNotFound) {
+		return err
+	}
+	return nil
+}
+
+type loginAttemptsEntry types.LoginAttempts
+
+func (entry *loginAttemptsEntry) Scan(pointers []interface{}) {
+	pointers[0] = &entry.Key
+	pointers[1] = &entry.Failures
+	pointers[2] = &entry.LastFailure
+	pointers[3] = &entry.LockedUntil
+}
+
+func (entry *loginAttemptsEntry) Values(values []interface{}) {
+	values[0] = entry.Key
+	values[1] = entry.Failures
+	values[2] = entry.LastFailure
+	values[3] = entry.LockedUntil
+}
+
+var (
+	_ types.LoginAttemptStore = &PGLoginAttemptStore{}
+	_ pgutil.Item             = &loginAttemptsEntry{}
+
+	keyColumnName         = "key"
+	failuresColumnName    = "failures"
+	lastFailureColumnName = "last_failure"
+	lockedUntilColumnName = "locked_until"
+
+	// LoginAttemptsTable holds recent failed logins per throttling key.
+	LoginAttemptsTable = pgutil.Table{
+		Name: "login_attempts",
+		PrimaryKeys: []pgutil.Column{{
+			Name: keyColumnName,
+			Type: "VARCHAR(128)",
+		}},
+		OtherColumns: []pgutil.Column{
+			{
+				Name:    failuresColumnName,
+				Type:    "INTEGER",
+				Default: pgutil.SQL("0"),
+			},
+			{
+				Name:    lastFailureColumnName,
+				Type:    "TIMESTAMPTZ",
+				Default: pgutil.SQL("'epoch'"),
+			},
+			{
+				Name:    lockedUntilColumnName,
+				Type:    "TIMESTAMPTZ",
+				Default: pgutil.SQL("'epoch'"),
+			},
+		},
+		ExistsErr:   types.ErrLoginAttemptsExists,
+		NotFoundErr: types.ErrLoginAttemptsNotFound,
+	}
+)
@@ -0,0 +1,115 @@
+package pgtokenstore
+
+import (
+	"database/sql"
+	"log"
+	"testing"
+	"time"
+
+	"github.com/weberc2/auth/pkg/auth/types"
+)
+
+func TestPGLoginAttemptStore(t *testing.T) {
+	if err := loginAttemptStore.ClearTable(); err != nil {
+		t.Fatalf("preparing postgres table: %v", err)
+	}
+
+	if _, err := loginAttemptStore.Get(
+		"user:adam",
+	); err != types.ErrLoginAttemptsNotFound {
+		t.Fatalf(
+			"wanted `%v`; found `%v`",
+			types.ErrLoginAttemptsNotFound,
+			err,
+		)
+	}
+
+	for i, testCase := range []struct {
+		now    time.Time
+		wanted int
+	}{
+		{now: now, wanted: 1},
+		{now: now.Add(time.Minute), wanted: 2},
+		// more than the window after the previous failure
+		{now: now.Add(time.Hour), wanted: 1},
+	} {
+		found, err := loginAttemptStore.Fail(
+			"user:adam",
+			testCase.now,
+			30*time.Minute,
+		)
+		if err != nil {
+			t.Fatalf("Fail() #%d: unexpected error: %v", i, err)
+		}
+		if err := (&types.LoginAttempts{
+			Key:         "user:adam",
+			Failures:    testCase.wanted,
+			LastFailure: testCase.now,
+			LockedUntil: time.Unix(0, 0),
+		}).Compare(found); err != nil {
+			t.Fatalf("Fail() #%d: %v", i, err)
+		}
+	}
+
+	if err := loginAttemptStore.Lock("user:adam", afterNow); err != nil {
+		t.Fatalf("Lock(): unexpected error: %v", err)
+	}
+	found, err := loginAttemptStore.Get("user:adam")
+	if err != nil {
+		t.Fatalf("Get(): unexpected error: %v", err)
+	}
+	if err := (&types.LoginAttempts{
+		Key:         "user:adam",
+		Failures:    1,
+		LastFailure: now.Add(time.Hour),
+		LockedUntil: afterNow,
+	}).Compare(found); err != nil {
+		t.Fatal(err)
+	}
+
+	// Refunds never take the count below zero.
+	for i := 0; i < 2; i++ {
+		if err := loginAttemptStore.Refund("user:adam"); err != nil {
+			t.Fatalf("Refund() #%d: unexpected error: %v", i, err)
+		}
+	}
+	found, err = loginAttemptStore.Get("user:adam")
+	if err != nil {
+		t.Fatalf("Get(): unexpected error: %v", err)
+	}
+	if err := (&types.LoginAttempts{
+		Key:         "user:adam",
+		Failures:    0,
+		LastFailure: now.Add(time.Hour),
+		LockedUntil: afterNow,
+	}).Compare(found); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := loginAttemptStore.Reset("user:adam"); err != nil {
+			t.Fatalf("Reset() #%d: unexpected error: %v", i, err)
+		}
+	}
+	if _, err := loginAttemptStore.Get(
+		"user:adam",
+	); err != types.ErrLoginAttemptsNotFound {
+		t.Fatalf(
+			"wanted `%v`; found `%v`",
+			types.ErrLoginAttemptsNotFound,
+			err,
+		)
+	}
+}
+
+var loginAttemptStore = func() *PGLoginAttemptStore {
+	s := (*PGLoginAttemptStore)((*sql.DB)(store))
+	if err := s.ResetTable(); err != nil {
+		log.Fatalf(
+			"unexpected error resetting login attempt store postgres "+
+				"table: %v",
+			err,
+		)
+	}
+	return s
+}()
@@ -0,0 +1,248 @@
+package pgtokenstore
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/weberc2/auth/pkg/auth/types"
+	"github.com/weberc2/auth/pkg/pgutil"
+)
+
+// PGOutboxStore is a postgres implementation of `types.OutboxStore`. It can
+// share a database connection with `PGTokenStore`.
+type PGOutboxStore sql.DB
+
+func (pgos *PGOutboxStore) EnsureTable() error {
+	return OutboxTable.Ensure((*sql.DB)(pgos))
+}
+
+func (pgos *PGOutboxStore) DropTable() error {
+	return OutboxTable.Drop((*sql.DB)(pgos))
+}
+
+func (pgos *PGOutboxStore) ClearTable() error {
+	return OutboxTable.Clear((*sql.DB)(pgos))
+}
+
+func (pgos *PGOutboxStore) ResetTable() error {
+	return OutboxTable.Reset((*sql.DB)(pgos))
+}
+
+// Enqueue adds an entry to the outbox. If an entry with the same ID exists,
+// `types.ErrOutboxEntryExists` is returned.
+func (pgos *PGOutboxStore) Enqueue(entry *types.OutboxEntry) error {
+	return OutboxTable.Insert((*sql.DB)(pgos), (*outboxEntry)(entry))
+}
+
+// Claim claims due entries in a single statement. `FOR UPDATE SKIP LOCKED`
+// keeps concurrent workers from blocking on (or claiming) each other's
+// entries.
+func (pgos *PGOutboxStore) Claim(
+	now time.Time,
+	lease time.Duration,
+	limit int,
+) ([]*types.OutboxEntry, error) {
+	rows, err := (*sql.DB)(pgos).Query(
+		fmt.Sprintf(
+			"UPDATE \"%[1]s\" SET \"%[2]s\" = $2 WHERE \"%[3]s\" IN ("+
+				"SELECT \"%[3]s\" FROM \"%[1]s\" WHERE \"%[4]s\" = $3 AND "+
+				"\"%[2]s\" <= $1 ORDER BY \"%[5]s\", \"%[3]s\" LIMIT $4 "+
+				"FOR UPDATE SKIP LOCKED) RETURNING %[6]s",
+			OutboxTable.Name,
+			nextAttemptColumnName,
+			idColumnName,
+			statusColumnName,
+			createdColumnName,
+			outboxColumns(),
+		),
+		now,
+		now.Add(lease),
+		types.OutboxStatusPending,
+		limit,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("claiming outbox entries: %w", err)
+	}
+	entries, err := scanOutboxEntries(rows)
+	if err != nil {
+		return nil, fmt.Errorf("claiming outbox entries: %w", err)
+	}
+
+	// `RETURNING` doesn't preserve the subquery's order.
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Created.Equal(entries[j].Created) {
+			return entries[i].ID < entries[j].ID
+		}
+		return entries[i].Created.Before(entries[j].Created)
+	})
+	return entries, nil
+}
+
+// Update replaces an entry. If the entry doesn't exist,
+// `types.ErrOutboxEntryNotFound` is returned.
+func (pgos *PGOutboxStore) Update(entry *types.OutboxEntry) error {
+	return OutboxTable.Update((*sql.DB)(pgos), (*outboxEntry)(entry))
+}
+
+// Delete removes an entry. If the entry doesn't exist,
+// `types.ErrOutboxEntryNotFound` is returned.
+func (pgos *PGOutboxStore) Delete(id string) error {
+	return OutboxTable.Delete((*sql.DB)(pgos), &outboxEntry{ID: id})
+}
+
+// Dead lists the dead-lettered entries, oldest first.
+func (pgos *PGOutboxStore) Dead() ([]*types.OutboxEntry, error) {
+	rows, err := (*sql.DB)(pgos).Query(
+		fmt.Sprintf(
+			"SELECT %s FROM \"%s\" WHERE \"%s\" = $1 ORDER BY \"%s\", \"%s\"",
+			outboxColumns(),
+			OutboxTable.Name,
+			statusColumnName,
+			createdColumnName,
+			idColumnName,
+		),
+		types.OutboxStatusDead,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("listing dead outbox entries: %w", err)
+	}
+	entries, err := scanOutboxEntries(rows)
+	if err != nil {
+		return nil, fmt.Errorf("listing dead outbox entries: %w", err)
+	}
+	return entries, nil
+}
+
+// Replay makes a dead-lettered entry pending again. If there is no
+// dead-lettered entry with the ID, `types.ErrOutboxEntryNotFound` is
+// returned.
+func (pgos *PGOutboxStore) Replay(id string, now time.Time) error {
+	var dummy string
+	if err := (*sql.DB)(pgos).QueryRow(
+		fmt.Sprintf(
+			"UPDATE \"%[1]s\" SET \"%[2]s\" = $3, \"%[3]s\" = 0, "+
+				"\"%[4]s\" = $4 WHERE \"%[5]s\" = $1 AND \"%[2]s\" = $2 "+
+				"RETURNING \"%[5]s\"",
+			OutboxTable.Name,
+			statusColumnName,
+			attemptsColumnName,
+			nextAttemptColumnName,
+			idColumnName,
+		),
+		id,
+		types.OutboxStatusDead,
+		types.OutboxStatusPending,
+		now,
+	).Scan(&dummy); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return types.ErrOutboxEntryNotFound
+		}
+		return fmt.Errorf("replaying outbox entry: %w", err)
+	}
+	return nil
+}
+
+func outboxColumns() string {
+	columns := OutboxTable.Columns()
+	names := make([]string, len(columns))
+	for i := range columns {
+		names[i] = fmt.Sprintf("\"%s\"", columns[i].Name)
+	}
+	return strings.Join(names, ", ")
+}
+
+func scanOutboxEntries(rows *sql.Rows) ([]*types.OutboxEntry, error) {
+	defer rows.Close()
+	var entries []*types.OutboxEntry
+	pointers := make([]interface{}, len(OutboxTable.Columns()))
+	for rows.Next() {
+		var entry outboxEntry
+		entry.Scan(pointers)
+		if err := rows.Scan(pointers...); err != nil {
+			return nil, fmt.Errorf("scanning outbox entry: %w", err)
+		}
+		entries = append(entries, (*types.OutboxEntry)(&entry))
+	}
+	return entries, rows.Err()
+}
+
+type outboxEntry types.OutboxEntry
+
+func (entry *outboxEntry) Values(values []interface{}) {
+	values[0] = entry.ID
+	values[1] = entry.Notification.Type
+	values[2] = entry.Notification.User
+	values[3] = entry.Notification.Email
+	values[4] = entry.Notification.Token
+	values[5] = entry.Status
+	values[6] = entry.Attempts
+	values[7] = entry.NextAttempt
+	values[8] = entry.LastError
+	values[9] = entry.Created
+	values[10] = entry.Notification.Locale
+}
+
+func (entry *outboxEntry) Scan(pointers []interface{}) {
+	pointers[0] = &entry.ID
+	pointers[1] = &entry.Notification.Type
+	pointers[2] = &entry.Notification.User
+	pointers[3] = &entry.Notification.Email
+	pointers[4] = &entry.Notification.Token
+	pointers[5] = &entry.Status
+	pointers[6] = &entry.Attempts
+	pointers[7] = &entry.NextAttempt
+	pointers[8] = &entry.LastError
+	pointers[9] = &entry.Created
+	pointers[10] = &entry.Notification.Locale
+}
+
+var (
+	_ types.OutboxStore = &PGOutboxStore{}
+	_ pgutil.Item       = &outboxEntry{}
+
+	idColumnName          = "id"
+	typeColumnName        = "type"
+	userColumnName        = "user"
+	emailColumnName       = "email"
+	tokenColumnName       = "token"
+	statusColumnName      = "status"
+	attemptsColumnName    = "attempts"
+	nextAttemptColumnName = "next_attempt"
+	lastErrorColumnName   = "last_error"
+	createdColumnName     = "created"
+	localeColumnName      = "locale"
+
+	// OutboxTable holds notifications until they're delivered. The
+	// notifications' tokens are stored in plaintext, so the table holds
+	// secrets: access to it must be restricted like access to the signing
+	// keys, and dumps of it must be handled accordingly.
+	OutboxTable = pgutil.Table{
+		Name: "notification_outbox",
+		PrimaryKeys: []pgutil.Column{{
+			Name: idColumnName,
+			Type: "VARCHAR(64)",
+		}},
+		OtherColumns: []pgutil.Column{
+			{Name: typeColumnName, Type: "VARCHAR(32)"},
+			{Name: userColumnName, Type: "VARCHAR(32)"},
+			{Name: emailColumnName, Type: "VARCHAR(128)"},
+			{Name: tokenColumnName, Type: "TEXT"},
+			{Name: statusColumnName, Type: "VARCHAR(16)"},
+			{Name: attemptsColumnName, Type: "INTEGER"},
+			{Name: nextAttemptColumnName, Type: "TIMESTAMPTZ"},
+			{Name: lastErrorColumnName, Type: "TEXT"},
+			{Name: createdColumnName, Type: "TIMESTAMPTZ"},
+			{
+				Name:    localeColumnName,
+				Type:    "VARCHAR(35)",
+				Default: pgutil.SQL("''"),
+			},
+		},
+		ExistsErr:   types.ErrOutboxEntryExists,
+		NotFoundErr: types.ErrOutboxEntryNotFound,
+	}
+)
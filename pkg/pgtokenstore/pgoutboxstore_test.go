@@ -0,0 +1,148 @@
+package pgtokenstore
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"testing"
+	"time"
+
+	"github.com/weberc2/auth/pkg/auth/types"
+)
+
+func TestPGOutboxStore(t *testing.T) {
+	if err := outboxStore.ClearTable(); err != nil {
+		t.Fatalf("preparing postgres table: %v", err)
+	}
+
+	entries := []types.OutboxEntry{
+		{
+			ID: "first",
+			Notification: types.Notification{
+				Type:   types.NotificationTypeRegister,
+				User:   "adam",
+				Email:  "adam@example.org",
+				Token:  "token",
+				Locale: "pt-BR",
+			},
+			Status:      types.OutboxStatusPending,
+			NextAttempt: now,
+			Created:     now,
+		},
+		{
+			ID: "second",
+			Notification: types.Notification{
+				Type:  types.NotificationTypeForgotPassword,
+				User:  "beth",
+				Email: "beth@example.org",
+				Token: "token",
+			},
+			Status:      types.OutboxStatusPending,
+			NextAttempt: afterNow,
+			Created:     now,
+		},
+	}
+	for i := range entries {
+		if err := outboxStore.Enqueue(&entries[i]); err != nil {
+			t.Fatalf("Enqueue(): unexpected error: %v", err)
+		}
+	}
+	if err := outboxStore.Enqueue(&entries[0]); !errors.Is(
+		err,
+		types.ErrOutboxEntryExists,
+	) {
+		t.Fatalf(
+			"Enqueue(): wanted `%v`; found `%v`",
+			types.ErrOutboxEntryExists,
+			err,
+		)
+	}
+
+	// Only the first entry is due. Claiming it postpones it by the lease.
+	claimed, err := outboxStore.Claim(now, time.Minute, 10)
+	if err != nil {
+		t.Fatalf("Claim(): unexpected error: %v", err)
+	}
+	if len(claimed) != 1 {
+		t.Fatalf("Claim(): wanted 1 entry; found %d", len(claimed))
+	}
+	wanted := entries[0]
+	wanted.NextAttempt = now.Add(time.Minute)
+	if err := wanted.Compare(claimed[0]); err != nil {
+		t.Fatalf("Claim(): %v", err)
+	}
+	if claimed, err := outboxStore.Claim(now, time.Minute, 10); err != nil {
+		t.Fatalf("Claim(): unexpected error: %v", err)
+	} else if len(claimed) != 0 {
+		t.Fatalf("Claim(): wanted no entries; found %d", len(claimed))
+	}
+
+	wanted.Status = types.OutboxStatusDead
+	wanted.Attempts = 5
+	wanted.LastError = "mail server unavailable"
+	if err := outboxStore.Update(&wanted); err != nil {
+		t.Fatalf("Update(): unexpected error: %v", err)
+	}
+	dead, err := outboxStore.Dead()
+	if err != nil {
+		t.Fatalf("Dead(): unexpected error: %v", err)
+	}
+	if len(dead) != 1 {
+		t.Fatalf("Dead(): wanted 1 entry; found %d", len(dead))
+	}
+	if err := wanted.Compare(dead[0]); err != nil {
+		t.Fatalf("Dead(): %v", err)
+	}
+
+	if err := outboxStore.Replay("second", now); !errors.Is(
+		err,
+		types.ErrOutboxEntryNotFound,
+	) {
+		t.Fatalf(
+			"Replay(): wanted `%v` for a pending entry; found `%v`",
+			types.ErrOutboxEntryNotFound,
+			err,
+		)
+	}
+	if err := outboxStore.Replay("first", afterNow); err != nil {
+		t.Fatalf("Replay(): unexpected error: %v", err)
+	}
+	claimed, err = outboxStore.Claim(afterNow, time.Minute, 10)
+	if err != nil {
+		t.Fatalf("Claim(): unexpected error: %v", err)
+	}
+	wanted.Status = types.OutboxStatusPending
+	wanted.Attempts = 0
+	wanted.NextAttempt = afterNow.Add(time.Minute)
+	if len(claimed) != 2 {
+		t.Fatalf("Claim(): wanted 2 entries; found %d", len(claimed))
+	}
+	if err := wanted.Compare(claimed[0]); err != nil {
+		t.Fatalf("Claim(): %v", err)
+	}
+
+	if err := outboxStore.Delete("first"); err != nil {
+		t.Fatalf("Delete(): unexpected error: %v", err)
+	}
+	if err := outboxStore.Delete("first"); !errors.Is(
+		err,
+		types.ErrOutboxEntryNotFound,
+	) {
+		t.Fatalf(
+			"Delete(): wanted `%v`; found `%v`",
+			types.ErrOutboxEntryNotFound,
+			err,
+		)
+	}
+}
+
+var outboxStore = func() *PGOutboxStore {
+	s := (*PGOutboxStore)((*sql.DB)(store))
+	if err := s.ResetTable(); err != nil {
+		log.Fatalf(
+			"unexpected error resetting outbox store postgres table: %v",
+			err,
+		)
+	}
+	return s
+}()
@@ -0,0 +1,97 @@
+package pgtokenstore
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/weberc2/auth/pkg/auth/types"
+	"github.com/weberc2/auth/pkg/pgutil"
+)
+
+// PGRateLimitStore is a postgres implementation of `types.RateLimitStore`. It
+// can share a database connection with `PGTokenStore`.
+type PGRateLimitStore sql.DB
+
+func (pgrls *PGRateLimitStore) EnsureTable() error {
+	return RateLimitsTable.Ensure((*sql.DB)(pgrls))
+}
+
+func (pgrls *PGRateLimitStore) DropTable() error {
+	return RateLimitsTable.Drop((*sql.DB)(pgrls))
+}
+
+func (pgrls *PGRateLimitStore) ClearTable() error {
+	return RateLimitsTable.Clear((*sql.DB)(pgrls))
+}
+
+func (pgrls *PGRateLimitStore) ResetTable() error {
+	return RateLimitsTable.Reset((*sql.DB)(pgrls))
+}
+
+// Increment counts an event in a single statement so that concurrent events
+// are all counted. (Postgres evaluates each `SET` expression against the
+// existing row, so both `CASE`s see the old window start.)
+func (pgrls *PGRateLimitStore) Increment(
+	key string,
+	now time.Time,
+	window time.Duration,
+) (*types.RateLimitWindow, error) {
+	var entry rateLimitEntry
+	if err := (*sql.DB)(pgrls).QueryRow(
+		fmt.Sprintf(
+			"INSERT INTO \"%[1]s\" (\"%[2]s\", \"%[3]s\", \"%[4]s\") "+
+				"VALUES ($1, 1, $2) ON CONFLICT (\"%[2]s\") DO UPDATE SET "+
+				"\"%[3]s\" = CASE WHEN \"%[1]s\".\"%[4]s\" <= $3 THEN 1 "+
+				"ELSE \"%[1]s\".\"%[3]s\" + 1 END, "+
+				"\"%[4]s\" = CASE WHEN \"%[1]s\".\"%[4]s\" <= $3 THEN $2 "+
+				"ELSE \"%[1]s\".\"%[4]s\" END "+
+				"RETURNING \"%[2]s\", \"%[3]s\", \"%[4]s\"",
+			RateLimitsTable.Name,
+			keyColumnName,
+			countColumnName,
+			startColumnName,
+		),
+		key,
+		now,
+		now.Add(-window),
+	).Scan(&entry.Key, &entry.Count, &entry.Start); err != nil {
+		return nil, fmt.Errorf("counting rate-limited event: %w", err)
+	}
+	return (*types.RateLimitWindow)(&entry), nil
+}
+
+type rateLimitEntry types.RateLimitWindow
+
+func (entry *rateLimitEntry) Scan(pointers []interface{}) {
+	pointers[0] = &entry.Key
+	pointers[1] = &entry.Count
+	pointers[2] = &entry.Start
+}
+
+func (entry *rateLimitEntry) Values(values []interface{}) {
+	values[0] = entry.Key
+	values[1] = entry.Count
+	values[2] = entry.Start
+}
+
+var (
+	_ types.RateLimitStore = &PGRateLimitStore{}
+	_ pgutil.Item          = &rateLimitEntry{}
+
+	countColumnName = "count"
+	startColumnName = "start"
+
+	// RateLimitsTable holds the current window for each rate-limiting key.
+	RateLimitsTable = pgutil.Table{
+		Name: "rate_limits",
+		PrimaryKeys: []pgutil.Column{{
+			Name: keyColumnName,
+			Type: "VARCHAR(320)",
+		}},
+		OtherColumns: []pgutil.Column{
+			{Name: countColumnName, Type: "INTEGER"},
+			{Name: startColumnName, Type: "TIMESTAMPTZ"},
+		},
+	}
+)
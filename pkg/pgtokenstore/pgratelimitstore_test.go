@@ -0,0 +1,75 @@
+package pgtokenstore
+
+import (
+	"database/sql"
+	"log"
+	"testing"
+	"time"
+
+	"github.com/weberc2/auth/pkg/auth/types"
+)
+
+func TestPGRateLimitStore_Increment(t *testing.T) {
+	if err := rateLimitStore.ClearTable(); err != nil {
+		t.Fatalf("preparing postgres table: %v", err)
+	}
+
+	for i, testCase := range []struct {
+		key    string
+		now    time.Time
+		wanted types.RateLimitWindow
+	}{
+		{
+			key:    "global",
+			now:    now,
+			wanted: types.RateLimitWindow{Key: "global", Count: 1, Start: now},
+		},
+		{
+			key:    "global",
+			now:    now.Add(time.Minute),
+			wanted: types.RateLimitWindow{Key: "global", Count: 2, Start: now},
+		},
+		{
+			key: "user:adam",
+			now: now.Add(time.Minute),
+			wanted: types.RateLimitWindow{
+				Key:   "user:adam",
+				Count: 1,
+				Start: now.Add(time.Minute),
+			},
+		},
+		{
+			// the window has passed, so a new one starts
+			key: "global",
+			now: now.Add(time.Hour),
+			wanted: types.RateLimitWindow{
+				Key:   "global",
+				Count: 1,
+				Start: now.Add(time.Hour),
+			},
+		},
+	} {
+		found, err := rateLimitStore.Increment(
+			testCase.key,
+			testCase.now,
+			time.Hour,
+		)
+		if err != nil {
+			t.Fatalf("Increment() #%d: unexpected error: %v", i, err)
+		}
+		if err := testCase.wanted.Compare(found); err != nil {
+			t.Fatalf("Increment() #%d: %v", i, err)
+		}
+	}
+}
+
+var rateLimitStore = func() *PGRateLimitStore {
+	s := (*PGRateLimitStore)((*sql.DB)(store))
+	if err := s.ResetTable(); err != nil {
+		log.Fatalf(
+			"unexpected error resetting rate limit store postgres table: %v",
+			err,
+		)
+	}
+	return s
+}()
@@ -2,6 +2,7 @@ package pgtokenstore
 
 import (
 	"database/sql"
+	"errors"
 	"fmt"
 	"time"
 
@@ -17,8 +18,102 @@ func OpenEnv() (*PGTokenStore, error) {
 	return (*PGTokenStore)(db), err
 }
 
+// EnsureTable creates the token table if it doesn't exist and migrates any
+// tokens from the legacy table (see `MigrateLegacyTable`).
 func (pgts *PGTokenStore) EnsureTable() error {
-	return Table.Ensure((*sql.DB)(pgts))
+	if err := Table.Ensure((*sql.DB)(pgts)); err != nil {
+		return err
+	}
+	return pgts.MigrateLegacyTable()
+}
+
+// MigrateLegacyTable moves the rows from the legacy `tokens` table, which was
+// keyed by the raw refresh tokens, into `Table` (keyed by the tokens' digests)
+// and then drops the legacy table. If there is no legacy table, this is a
+// no-op.
+func (pgts *PGTokenStore) MigrateLegacyTable() error {
+	tx, err := (*sql.DB)(pgts).Begin()
+	if err != nil {
+		return fmt.Errorf("migrating legacy tokens: %w", err)
+	}
+	defer tx.Rollback()
+
+	var exists bool
+	if err := tx.QueryRow(
+		"SELECT to_regclass($1) IS NOT NULL",
+		legacyTableName,
+	).Scan(&exists); err != nil {
+		return fmt.Errorf("migrating legacy tokens: %w", err)
+	}
+	if !exists {
+		return nil
+	}
+
+	// Legacy tables which were created before refresh tokens were rotated
+	// don't have a family column.
+	if _, err := tx.Exec(fmt.Sprintf(
+		"ALTER TABLE \"%s\" ADD COLUMN IF NOT EXISTS \"%s\" "+
+			"VARCHAR(64) NOT NULL DEFAULT ''",
+		legacyTableName,
+		familyColumnName,
+	)); err != nil {
+		return fmt.Errorf("migrating legacy tokens: %w", err)
+	}
+
+	rows, err := tx.Query(fmt.Sprintf(
+		"SELECT \"token\", \"%s\", \"%s\" FROM \"%s\"",
+		expiresColumnName,
+		familyColumnName,
+		legacyTableName,
+	))
+	if err != nil {
+		return fmt.Errorf("migrating legacy tokens: %w", err)
+	}
+	var entries []types.Token
+	for rows.Next() {
+		var entry types.Token
+		if err := rows.Scan(
+			&entry.Token,
+			&entry.Expires,
+			&entry.Family,
+		); err != nil {
+			rows.Close()
+			return fmt.Errorf("migrating legacy tokens: %w", err)
+		}
+		entries = append(entries, entry)
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("migrating legacy tokens: %w", err)
+	}
+
+	for i := range entries {
+		if _, err := tx.Exec(
+			fmt.Sprintf(
+				"INSERT INTO \"%s\" (\"%s\", \"%s\", \"%s\") "+
+					"VALUES ($1, $2, $3) ON CONFLICT DO NOTHING",
+				Table.Name,
+				digestColumnName,
+				expiresColumnName,
+				familyColumnName,
+			),
+			types.TokenDigest(entries[i].Token),
+			entries[i].Expires,
+			entries[i].Family,
+		); err != nil {
+			return fmt.Errorf("migrating legacy tokens: %w", err)
+		}
+	}
+
+	if _, err := tx.Exec(
+		fmt.Sprintf("DROP TABLE \"%s\"", legacyTableName),
+	); err != nil {
+		return fmt.Errorf("migrating legacy tokens: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("migrating legacy tokens: %w", err)
+	}
+	return nil
 }
 
 func (pgts *PGTokenStore) DropTable() error {
@@ -33,16 +128,125 @@ func (pgts *PGTokenStore) ResetTable() error {
 	return Table.Reset((*sql.DB)(pgts))
 }
 
-func (pgts *PGTokenStore) Put(token string, expires time.Time) error {
-	return Table.Insert((*sql.DB)(pgts), &tokenEntry{token, expires})
+func (pgts *PGTokenStore) Put(
+	token string,
+	session *types.Session,
+	expires time.Time,
+) error {
+	return Table.Insert(
+		(*sql.DB)(pgts),
+		&tokenEntry{
+			Digest:  types.TokenDigest(token),
+			Expires: expires,
+			Session: *session,
+		},
+	)
 }
 
 func (pgts *PGTokenStore) Exists(token string) error {
-	return Table.Exists((*sql.DB)(pgts), &tokenEntry{Token: token})
+	return Table.Exists(
+		(*sql.DB)(pgts),
+		&tokenEntry{Digest: types.TokenDigest(token)},
+	)
 }
 
 func (pgts *PGTokenStore) Delete(token string) error {
-	return Table.Delete((*sql.DB)(pgts), &tokenEntry{Token: token})
+	return Table.Delete(
+		(*sql.DB)(pgts),
+		&tokenEntry{Digest: types.TokenDigest(token)},
+	)
+}
+
+// DeleteFamily deletes all tokens in the family.
+func (pgts *PGTokenStore) DeleteFamily(family string) error {
+	if _, err := (*sql.DB)(pgts).Exec(
+		fmt.Sprintf(
+			"DELETE FROM \"%s\" WHERE \"%s\" = $1",
+			Table.Name,
+			familyColumnName,
+		),
+		family,
+	); err != nil {
+		return fmt.Errorf("deleting token family from postgres: %w", err)
+	}
+	return nil
+}
+
+// GetSession returns the session for a token family. If the family has no
+// tokens, `types.ErrSessionNotFound` is returned.
+func (pgts *PGTokenStore) GetSession(family string) (*types.Session, error) {
+	var session types.Session
+	if err := (*sql.DB)(pgts).QueryRow(
+		fmt.Sprintf(
+			"SELECT %s FROM \"%s\" WHERE \"%s\" = $1 LIMIT 1",
+			sessionColumns,
+			Table.Name,
+			familyColumnName,
+		),
+		family,
+	).Scan(sessionPointers(&session)...); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, types.ErrSessionNotFound
+		}
+		return nil, fmt.Errorf("getting session from postgres: %w", err)
+	}
+	return &session, nil
+}
+
+// ListSessions lists the subject's sessions ordered by ID.
+func (pgts *PGTokenStore) ListSessions(
+	subject string,
+) ([]types.Session, error) {
+	// A session normally has exactly one valid token, but `DISTINCT ON`
+	// makes sure each session is listed once regardless.
+	rows, err := (*sql.DB)(pgts).Query(
+		fmt.Sprintf(
+			"SELECT DISTINCT ON (\"%s\") %s FROM \"%s\" WHERE \"%s\" = $1 "+
+				"ORDER BY \"%s\"",
+			familyColumnName,
+			sessionColumns,
+			Table.Name,
+			subjectColumnName,
+			familyColumnName,
+		),
+		subject,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("listing sessions: %w", err)
+	}
+	defer rows.Close()
+
+	// we don't want to return a `nil` slice because that gets JSON-marshaled
+	// to `null` instead of `[]`.
+	sessions := []types.Session{}
+	for rows.Next() {
+		sessions = append(sessions, types.Session{})
+		if err := rows.Scan(
+			sessionPointers(&sessions[len(sessions)-1])...,
+		); err != nil {
+			return nil, fmt.Errorf("listing sessions: %w", err)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("listing sessions: %w", err)
+	}
+
+	return sessions, nil
+}
+
+// DeleteSessions deletes all of the subject's tokens.
+func (pgts *PGTokenStore) DeleteSessions(subject string) error {
+	if _, err := (*sql.DB)(pgts).Exec(
+		fmt.Sprintf(
+			"DELETE FROM \"%s\" WHERE \"%s\" = $1",
+			Table.Name,
+			subjectColumnName,
+		),
+		subject,
+	); err != nil {
+		return fmt.Errorf("deleting sessions from postgres: %w", err)
+	}
+	return nil
 }
 
 // DeleteExpired deletes all tokens that expired before `now`.
@@ -60,6 +264,8 @@ func (pgts *PGTokenStore) DeleteExpired(now time.Time) error {
 	return nil
 }
 
+// List lists the stored tokens. Only the tokens' digests are stored, so each
+// entry's `Token` field holds the digest.
 func (pgts *PGTokenStore) List() ([]types.Token, error) {
 	// we don't want to return a `nil` slice because that gets JSON-marshaled
 	// to `null` instead of `[]`.
@@ -71,41 +277,121 @@ func (pgts *PGTokenStore) List() ([]types.Token, error) {
 	}
 
 	for result.Next() {
-		entries = append(entries, types.Token{})
-		if err := result.Scan(
-			(*tokenEntry)(&entries[len(entries)-1]),
-		); err != nil {
+		var entry tokenEntry
+		if err := result.Scan(&entry); err != nil {
 			return nil, fmt.Errorf("listing tokens: %w", err)
 		}
+		entries = append(entries, types.Token{
+			Token:   entry.Digest,
+			Family:  entry.Session.ID,
+			Expires: entry.Expires,
+		})
 	}
 
 	return entries, err
 }
 
-type tokenEntry types.Token
-
-func (entry *tokenEntry) ID() interface{} { return entry.Token }
+// tokenEntry is a row in the token table. The session's ID is the token's
+// family.
+type tokenEntry struct {
+	Digest  string
+	Expires time.Time
+	Session types.Session
+}
 
 func (entry *tokenEntry) Scan(pointers []interface{}) {
-	pointers[0] = &entry.Token
+	pointers[0] = &entry.Digest
 	pointers[1] = &entry.Expires
+	copy(pointers[2:], sessionPointers(&entry.Session))
 }
 
 func (entry *tokenEntry) Values(values []interface{}) {
-	values[0] = entry.Token
+	values[0] = entry.Digest
 	values[1] = entry.Expires
+	values[2] = entry.Session.ID
+	values[3] = entry.Session.Subject
+	values[4] = entry.Session.IssuedAt
+	values[5] = entry.Session.UserAgent
+	values[6] = entry.Session.IP
+}
+
+// sessionPointers returns pointers to the session's fields in the order of
+// `sessionColumns`.
+func sessionPointers(session *types.Session) []interface{} {
+	return []interface{}{
+		&session.ID,
+		&session.Subject,
+		&session.IssuedAt,
+		&session.UserAgent,
+		&session.IP,
+	}
 }
 
 var (
 	_ types.TokenStore = &PGTokenStore{}
 
-	expiresColumnName = "expires"
+	digestColumnName    = "digest"
+	expiresColumnName   = "expires"
+	familyColumnName    = "family"
+	subjectColumnName   = "subject"
+	issuedAtColumnName  = "issued_at"
+	userAgentColumnName = "user_agent"
+	ipColumnName        = "ip"
+
+	// sessionColumns are the columns which describe a token's session.
+	sessionColumns = fmt.Sprintf(
+		"\"%s\", \"%s\", \"%s\", \"%s\", \"%s\"",
+		familyColumnName,
+		subjectColumnName,
+		issuedAtColumnName,
+		userAgentColumnName,
+		ipColumnName,
+	)
+
+	// legacyTableName is the name of the table which stored the raw tokens
+	// before they were keyed by digest.
+	legacyTableName = "tokens"
 
 	Table = pgutil.Table{
-		Name:        "tokens",
-		PrimaryKeys: []pgutil.Column{{Name: "token", Type: "VARCHAR(9000)"}},
+		Name: "refresh_tokens",
+		PrimaryKeys: []pgutil.Column{{
+			Name: digestColumnName,
+			Type: "VARCHAR(64)",
+		}},
 		OtherColumns: []pgutil.Column{
 			{Name: expiresColumnName, Type: "TIMESTAMPTZ"},
+
+			// Tokens from before refresh tokens were rotated don't have a
+			// family.
+			{
+				Name:    familyColumnName,
+				Type:    "VARCHAR(64)",
+				Default: pgutil.SQL("''"),
+			},
+
+			// The session columns are blank for tokens from before sessions
+			// were tracked. Only the tokens' digests were kept, so those
+			// sessions aren't listed until their tokens are next rotated.
+			{
+				Name:    subjectColumnName,
+				Type:    "VARCHAR(255)",
+				Default: pgutil.SQL("''"),
+			},
+			{
+				Name:    issuedAtColumnName,
+				Type:    "TIMESTAMPTZ",
+				Default: pgutil.SQL("'epoch'"),
+			},
+			{
+				Name:    userAgentColumnName,
+				Type:    "TEXT",
+				Default: pgutil.SQL("''"),
+			},
+			{
+				Name:    ipColumnName,
+				Type:    "VARCHAR(64)",
+				Default: pgutil.SQL("''"),
+			},
 		},
 		ExistsErr:   types.ErrTokenExists,
 		NotFoundErr: types.ErrTokenNotFound,
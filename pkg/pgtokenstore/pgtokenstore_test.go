@@ -1,6 +1,7 @@
 package pgtokenstore
 
 import (
+	"database/sql"
 	"fmt"
 	"log"
 	"testing"
@@ -48,7 +49,7 @@ func TestPGTokenStore_DeleteExpired(t *testing.T) {
 			t.Fatalf("unexpected error listing entries: %v", err)
 		}
 		if err := types.CompareTokens(
-			testCase.wantedState,
+			digests(testCase.wantedState),
 			found,
 		); err != nil {
 			t.Fatal(err)
@@ -93,7 +94,7 @@ func TestPGTokenStore_Delete(t *testing.T) {
 			t.Fatalf("unexpected error listing entries: %v", err)
 		}
 		if err := types.CompareTokens(
-			testCase.wantedState,
+			digests(testCase.wantedState),
 			found,
 		); err != nil {
 			t.Fatal(err)
@@ -176,7 +177,11 @@ func TestPGTokenStore_Put(t *testing.T) {
 				testCase.wantedErr = types.NilError{}
 			}
 			if err := testCase.wantedErr.CompareErr(
-				store.Put(testCase.token, testCase.expires),
+				store.Put(
+					testCase.token,
+					&types.Session{},
+					testCase.expires,
+				),
 			); err != nil {
 				t.Fatal(err)
 			}
@@ -186,7 +191,7 @@ func TestPGTokenStore_Put(t *testing.T) {
 				t.Fatalf("unexpected error listing entries: %v", err)
 			}
 			if err := types.CompareTokens(
-				testCase.wantedState,
+				digests(testCase.wantedState),
 				found,
 			); err != nil {
 				t.Fatal(err)
@@ -195,6 +200,118 @@ func TestPGTokenStore_Put(t *testing.T) {
 	}
 }
 
+func TestPGTokenStore_Sessions(t *testing.T) {
+	if err := prepare(nil); err != nil {
+		t.Fatal(err)
+	}
+
+	session := func(id, subject string) types.Session {
+		return types.Session{
+			ID:       id,
+			Subject:  subject,
+			IssuedAt: now,
+			ClientInfo: types.ClientInfo{
+				UserAgent: "agent",
+				IP:        "192.0.2.1",
+			},
+		}
+	}
+	for _, s := range []types.Session{
+		session("a", "user"),
+		session("b", "user"),
+		session("c", "other"),
+	} {
+		if err := store.Put("token-"+s.ID, &s, afterNow); err != nil {
+			t.Fatalf("preparing postgres table: %v", err)
+		}
+	}
+
+	found, err := store.GetSession("a")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	wanted := session("a", "user")
+	if err := wanted.Compare(found); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := store.GetSession("missing"); err != types.ErrSessionNotFound {
+		t.Fatalf("wanted `%v`; found `%v`", types.ErrSessionNotFound, err)
+	}
+
+	sessions, err := store.ListSessions("user")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := types.CompareSessions(
+		[]types.Session{session("a", "user"), session("b", "user")},
+		sessions,
+	); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := store.DeleteSessions("user"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if sessions, err = store.ListSessions("user"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := types.CompareSessions(nil, sessions); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Exists("token-c"); err != nil {
+		t.Fatalf("other subject's session was deleted: %v", err)
+	}
+}
+
+func TestPGTokenStore_MigrateLegacyTable(t *testing.T) {
+	db := (*sql.DB)(store)
+	if err := prepare(nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(
+		"CREATE TABLE \"tokens\" (" +
+			"\"token\" VARCHAR(9000) PRIMARY KEY, " +
+			"\"expires\" TIMESTAMPTZ NOT NULL)",
+	); err != nil {
+		t.Fatalf("creating legacy table: %v", err)
+	}
+	defer db.Exec("DROP TABLE IF EXISTS \"tokens\"")
+
+	if _, err := db.Exec(
+		"INSERT INTO \"tokens\" (\"token\", \"expires\") VALUES ($1, $2)",
+		"token",
+		afterNow,
+	); err != nil {
+		t.Fatalf("inserting legacy token: %v", err)
+	}
+
+	if err := store.MigrateLegacyTable(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	found, err := store.List()
+	if err != nil {
+		t.Fatalf("unexpected error listing entries: %v", err)
+	}
+	if err := types.CompareTokens(
+		digests([]types.Token{{Token: "token", Expires: afterNow}}),
+		found,
+	); err != nil {
+		t.Fatal(err)
+	}
+
+	// the migrated token must still be usable
+	if err := store.Exists("token"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// the legacy table is dropped, so migrating again is a no-op
+	if err := store.MigrateLegacyTable(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
 var (
 	now       = time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
 	beforeNow = time.Date(2020, 12, 31, 0, 0, 0, 0, time.UTC)
@@ -217,13 +334,28 @@ var (
 	}()
 )
 
+// digests returns copies of the tokens as they are stored, i.e., keyed by
+// their digests.
+func digests(tokens []types.Token) []types.Token {
+	out := make([]types.Token, len(tokens))
+	for i := range tokens {
+		out[i] = tokens[i]
+		out[i].Token = types.TokenDigest(tokens[i].Token)
+	}
+	return out
+}
+
 func prepare(state []types.Token) error {
 	if err := store.ClearTable(); err != nil {
 		return fmt.Errorf("preparing postgres table: %w", err)
 	}
 
 	for i, entry := range state {
-		if err := store.Put(entry.Token, entry.Expires); err != nil {
+		if err := store.Put(
+			entry.Token,
+			&types.Session{ID: entry.Family},
+			entry.Expires,
+		); err != nil {
 			return fmt.Errorf(
 				"preparing postgres table: "+
 					"unexpected error inserting state item at index `%d`: %w",
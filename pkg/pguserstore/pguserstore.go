@@ -1,8 +1,12 @@
 package pguserstore
 
 import (
+	"bytes"
 	"database/sql"
+	"database/sql/driver"
+	"errors"
 	"fmt"
+	"strings"
 
 	_ "github.com/lib/pq"
 	"github.com/weberc2/auth/pkg/auth/types"
@@ -72,6 +76,34 @@ func (pgus *PGUserStore) Get(user types.UserID) (*types.UserEntry, error) {
 	return (*types.UserEntry)(&entry), nil
 }
 
+// GetByEmail returns the record with the provided email address. If no such
+// email address exists, `types.ErrUserNotFound` is returned.
+func (pgus *PGUserStore) GetByEmail(email string) (*types.UserEntry, error) {
+	columns := Table.Columns()
+	names := make([]string, len(columns))
+	for i := range columns {
+		names[i] = fmt.Sprintf("\"%s\"", columns[i].Name)
+	}
+
+	var entry userEntry
+	pointers := make([]interface{}, len(columns))
+	entry.Scan(pointers)
+	if err := (*sql.DB)(pgus).QueryRow(
+		fmt.Sprintf(
+			"SELECT %s FROM \"%s\" WHERE \"email\" = $1",
+			strings.Join(names, ", "),
+			Table.Name,
+		),
+		email,
+	).Scan(pointers...); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, types.ErrUserNotFound
+		}
+		return nil, fmt.Errorf("getting user by email: %w", err)
+	}
+	return (*types.UserEntry)(&entry), nil
+}
+
 // List returns all records in the table.
 func (pgus *PGUserStore) List() ([]*types.UserEntry, error) {
 	result, err := Table.List((*sql.DB)(pgus))
@@ -110,6 +142,12 @@ func (entry *userEntry) Values(values []interface{}) {
 	values[1] = entry.Email
 	values[2] = entry.PasswordHash
 	values[3] = &entry.Created
+	values[4] = entry.TOTPSecret
+	values[5] = entry.TOTPEnabled
+	values[6] = entry.TOTPCounter
+	values[7] = (*recoveryCodes)(&entry.RecoveryCodes)
+	values[8] = (*passwordHistory)(&entry.PasswordHistory)
+	values[9] = entry.Locale
 }
 
 func (entry *userEntry) Scan(pointers []interface{}) {
@@ -117,6 +155,64 @@ func (entry *userEntry) Scan(pointers []interface{}) {
 	pointers[1] = &entry.Email
 	pointers[2] = &entry.PasswordHash
 	pointers[3] = &entry.Created
+	pointers[4] = &entry.TOTPSecret
+	pointers[5] = &entry.TOTPEnabled
+	pointers[6] = &entry.TOTPCounter
+	pointers[7] = (*recoveryCodes)(&entry.RecoveryCodes)
+	pointers[8] = (*passwordHistory)(&entry.PasswordHistory)
+	pointers[9] = &entry.Locale
+}
+
+// recoveryCodes stores recovery code digests as a single space-separated
+// `TEXT` column.
+type recoveryCodes []string
+
+func (codes *recoveryCodes) Value() (driver.Value, error) {
+	return strings.Join(*codes, " "), nil
+}
+
+func (codes *recoveryCodes) Scan(src interface{}) error {
+	var s string
+	switch src := src.(type) {
+	case string:
+		s = src
+	case []byte:
+		s = string(src)
+	case nil:
+	default:
+		return fmt.Errorf("scanning recovery codes: unsupported type %T", src)
+	}
+	*codes = strings.Fields(s)
+	return nil
+}
+
+// passwordHistory stores previous password hashes as a single space-separated
+// `TEXT` column. Bcrypt hashes never contain spaces.
+type passwordHistory [][]byte
+
+func (history *passwordHistory) Value() (driver.Value, error) {
+	return string(bytes.Join(*history, []byte(" "))), nil
+}
+
+func (history *passwordHistory) Scan(src interface{}) error {
+	var s string
+	switch src := src.(type) {
+	case string:
+		s = src
+	case []byte:
+		s = string(src)
+	case nil:
+	default:
+		return fmt.Errorf(
+			"scanning password history: unsupported type %T",
+			src,
+		)
+	}
+	*history = nil
+	for _, hash := range strings.Fields(s) {
+		*history = append(*history, []byte(hash))
+	}
+	return nil
 }
 
 var (
@@ -150,6 +246,42 @@ var (
 				Type: "TIMESTAMPTZ",
 				Null: false,
 			},
+			{
+				Name:    "totp_secret",
+				Type:    "TEXT",
+				Null:    false,
+				Default: pgutil.SQL("''"),
+			},
+			{
+				Name:    "totp_enabled",
+				Type:    "BOOLEAN",
+				Null:    false,
+				Default: pgutil.SQL("false"),
+			},
+			{
+				Name:    "totp_counter",
+				Type:    "INTEGER",
+				Null:    false,
+				Default: pgutil.SQL("0"),
+			},
+			{
+				Name:    "recovery_codes",
+				Type:    "TEXT",
+				Null:    false,
+				Default: pgutil.SQL("''"),
+			},
+			{
+				Name:    "password_history",
+				Type:    "TEXT",
+				Null:    false,
+				Default: pgutil.SQL("''"),
+			},
+			{
+				Name:    "locale",
+				Type:    "VARCHAR(35)",
+				Null:    false,
+				Default: pgutil.SQL("''"),
+			},
 		},
 		ExistsErr:   types.ErrUserExists,
 		NotFoundErr: types.ErrUserNotFound,
@@ -32,6 +32,69 @@ func TestPGUserStore_Upsert(t *testing.T) {
 				Created:      now,
 			}},
 		},
+		{
+			name: "two-factor",
+			input: &types.UserEntry{
+				User:          "user",
+				Email:         "user@example.org",
+				PasswordHash:  []byte("passwordhash"),
+				Created:       now,
+				TOTPSecret:    "secret",
+				TOTPEnabled:   true,
+				TOTPCounter:   1,
+				RecoveryCodes: []string{"digest1", "digest2"},
+			},
+			wantedState: []*types.UserEntry{{
+				User:          "user",
+				Email:         "user@example.org",
+				PasswordHash:  []byte("passwordhash"),
+				Created:       now,
+				TOTPSecret:    "secret",
+				TOTPEnabled:   true,
+				TOTPCounter:   1,
+				RecoveryCodes: []string{"digest1", "digest2"},
+			}},
+		},
+		{
+			name: "password history",
+			input: &types.UserEntry{
+				User:         "user",
+				Email:        "user@example.org",
+				PasswordHash: []byte("passwordhash"),
+				Created:      now,
+				PasswordHistory: [][]byte{
+					[]byte("oldhash1"),
+					[]byte("oldhash2"),
+				},
+			},
+			wantedState: []*types.UserEntry{{
+				User:         "user",
+				Email:        "user@example.org",
+				PasswordHash: []byte("passwordhash"),
+				Created:      now,
+				PasswordHistory: [][]byte{
+					[]byte("oldhash1"),
+					[]byte("oldhash2"),
+				},
+			}},
+		},
+		{
+			name: "locale",
+			input: &types.UserEntry{
+				User:         "user",
+				Email:        "user@example.org",
+				PasswordHash: []byte("passwordhash"),
+				Created:      now,
+				Locale:       "pt-BR",
+			},
+			wantedState: []*types.UserEntry{{
+				User:         "user",
+				Email:        "user@example.org",
+				PasswordHash: []byte("passwordhash"),
+				Created:      now,
+				Locale:       "pt-BR",
+			}},
+		},
 		{
 			name: "username exists",
 			state: []types.UserEntry{{
@@ -202,6 +265,58 @@ func TestPGUserStore_Insert(t *testing.T) {
 	}
 }
 
+func TestPGUserStore_GetByEmail(t *testing.T) {
+	state := []types.UserEntry{
+		{
+			User:         "adam",
+			Email:        "adam@example.org",
+			PasswordHash: []byte("passwordhash"),
+			Created:      now,
+		},
+		{
+			User:         "beth",
+			Email:        "beth@example.org",
+			PasswordHash: []byte("passwordhash"),
+			Created:      now,
+			Locale:       "de",
+		},
+	}
+	for _, testCase := range []struct {
+		name        string
+		email       string
+		wantedEntry *types.UserEntry
+		wantedErr   types.WantedError
+	}{
+		{
+			name:        "found",
+			email:       "beth@example.org",
+			wantedEntry: &state[1],
+		},
+		{
+			name:      "not found",
+			email:     "carl@example.org",
+			wantedErr: types.ErrUserNotFound,
+		},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			if err := prepare(state); err != nil {
+				t.Fatalf("unexpected error preparing test case: %v", err)
+			}
+
+			if testCase.wantedErr == nil {
+				testCase.wantedErr = types.NilError{}
+			}
+			entry, err := store.GetByEmail(testCase.email)
+			if err := testCase.wantedErr.CompareErr(err); err != nil {
+				t.Fatal(err)
+			}
+			if err := testCase.wantedEntry.Compare(entry); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
 var (
 	now   = time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
 	store = func() *PGUserStore {
@@ -0,0 +1,142 @@
+package pguserstore
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"github.com/weberc2/auth/pkg/auth/types"
+	"github.com/weberc2/auth/pkg/pgutil"
+)
+
+// PGWebAuthnCredentialStore is a postgres implementation of
+// `types.WebAuthnCredentialStore`. It can share a database connection with
+// `PGUserStore`.
+type PGWebAuthnCredentialStore sql.DB
+
+// EnsureTable creates the `webauthn_credentials` table if it doesn't already
+// exist.
+func (pgwcs *PGWebAuthnCredentialStore) EnsureTable() error {
+	return WebAuthnCredentialsTable.Ensure((*sql.DB)(pgwcs))
+}
+
+// DropTable drops the `webauthn_credentials` table.
+func (pgwcs *PGWebAuthnCredentialStore) DropTable() error {
+	return WebAuthnCredentialsTable.Drop((*sql.DB)(pgwcs))
+}
+
+// ClearTable truncates the `webauthn_credentials` table.
+func (pgwcs *PGWebAuthnCredentialStore) ClearTable() error {
+	return WebAuthnCredentialsTable.Clear((*sql.DB)(pgwcs))
+}
+
+// ResetTable drops the `webauthn_credentials` table if it exists and creates
+// a new one from scratch.
+func (pgwcs *PGWebAuthnCredentialStore) ResetTable() error {
+	return WebAuthnCredentialsTable.Reset((*sql.DB)(pgwcs))
+}
+
+// Insert adds a credential. If the user already has a credential with the
+// same ID, `types.ErrWebAuthnCredentialExists` is returned.
+func (pgwcs *PGWebAuthnCredentialStore) Insert(
+	credential *types.WebAuthnCredential,
+) error {
+	return WebAuthnCredentialsTable.Insert(
+		(*sql.DB)(pgwcs),
+		(*webAuthnCredentialEntry)(credential),
+	)
+}
+
+// Update replaces a credential. If the user has no credential with the same
+// ID, `types.ErrWebAuthnCredentialNotFound` is returned.
+func (pgwcs *PGWebAuthnCredentialStore) Update(
+	credential *types.WebAuthnCredential,
+) error {
+	return WebAuthnCredentialsTable.Update(
+		(*sql.DB)(pgwcs),
+		(*webAuthnCredentialEntry)(credential),
+	)
+}
+
+// List returns the user's credentials ordered by ID.
+func (pgwcs *PGWebAuthnCredentialStore) List(
+	user types.UserID,
+) ([]types.WebAuthnCredential, error) {
+	columns := WebAuthnCredentialsTable.Columns()
+	names := make([]string, len(columns))
+	for i := range columns {
+		names[i] = fmt.Sprintf("\"%s\"", columns[i].Name)
+	}
+
+	rows, err := (*sql.DB)(pgwcs).Query(
+		fmt.Sprintf(
+			"SELECT %s FROM \"%s\" WHERE \"user\" = $1 ORDER BY \"id\"",
+			strings.Join(names, ", "),
+			WebAuthnCredentialsTable.Name,
+		),
+		user,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("listing webauthn credentials: %w", err)
+	}
+	defer rows.Close()
+
+	// we don't want to return a `nil` slice because that gets JSON-marshaled
+	// to `null` instead of `[]`.
+	credentials := []types.WebAuthnCredential{}
+	pointers := make([]interface{}, len(columns))
+	for rows.Next() {
+		credentials = append(credentials, types.WebAuthnCredential{})
+		(*webAuthnCredentialEntry)(
+			&credentials[len(credentials)-1],
+		).Scan(pointers)
+		if err := rows.Scan(pointers...); err != nil {
+			return nil, fmt.Errorf("listing webauthn credentials: %w", err)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("listing webauthn credentials: %w", err)
+	}
+
+	return credentials, nil
+}
+
+type webAuthnCredentialEntry types.WebAuthnCredential
+
+func (entry *webAuthnCredentialEntry) Values(values []interface{}) {
+	values[0] = entry.User
+	values[1] = entry.ID
+	values[2] = entry.PublicKey
+	values[3] = entry.SignCount
+	values[4] = &entry.Created
+}
+
+func (entry *webAuthnCredentialEntry) Scan(pointers []interface{}) {
+	pointers[0] = &entry.User
+	pointers[1] = &entry.ID
+	pointers[2] = &entry.PublicKey
+	pointers[3] = &entry.SignCount
+	pointers[4] = &entry.Created
+}
+
+var (
+	_ pgutil.Item                   = &webAuthnCredentialEntry{}
+	_ types.WebAuthnCredentialStore = (*PGWebAuthnCredentialStore)(nil)
+
+	// WebAuthnCredentialsTable holds users' WebAuthn credentials, keyed by
+	// user and credential ID.
+	WebAuthnCredentialsTable = pgutil.Table{
+		Name: "webauthn_credentials",
+		PrimaryKeys: []pgutil.Column{
+			{Name: "user", Type: "VARCHAR(32)"},
+			{Name: "id", Type: "TEXT"},
+		},
+		OtherColumns: []pgutil.Column{
+			{Name: "public_key", Type: "TEXT"},
+			{Name: "sign_count", Type: "INTEGER"},
+			{Name: "created", Type: "TIMESTAMPTZ"},
+		},
+		ExistsErr:   types.ErrWebAuthnCredentialExists,
+		NotFoundErr: types.ErrWebAuthnCredentialNotFound,
+	}
+)
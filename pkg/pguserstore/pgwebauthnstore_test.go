@@ -0,0 +1,86 @@
+package pguserstore
+
+import (
+	"database/sql"
+	"log"
+	"testing"
+
+	"github.com/weberc2/auth/pkg/auth/types"
+)
+
+func TestPGWebAuthnCredentialStore(t *testing.T) {
+	if err := credentialStore.ClearTable(); err != nil {
+		t.Fatalf("preparing postgres table: %v", err)
+	}
+
+	credential := func(
+		user types.UserID,
+		id string,
+		signCount int64,
+	) types.WebAuthnCredential {
+		return types.WebAuthnCredential{
+			User:      user,
+			ID:        id,
+			PublicKey: "key-" + id,
+			SignCount: signCount,
+			Created:   now,
+		}
+	}
+	for _, c := range []types.WebAuthnCredential{
+		credential("user", "b", 0),
+		credential("user", "a", 0),
+		credential("other", "a", 0),
+	} {
+		if err := credentialStore.Insert(&c); err != nil {
+			t.Fatalf("preparing postgres table: %v", err)
+		}
+	}
+
+	duplicate := credential("user", "a", 0)
+	if err := types.ErrWebAuthnCredentialExists.CompareErr(
+		credentialStore.Insert(&duplicate),
+	); err != nil {
+		t.Fatal(err)
+	}
+
+	updated := credential("user", "a", 5)
+	if err := credentialStore.Update(&updated); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	missing := credential("user", "missing", 0)
+	if err := types.ErrWebAuthnCredentialNotFound.CompareErr(
+		credentialStore.Update(&missing),
+	); err != nil {
+		t.Fatal(err)
+	}
+
+	found, err := credentialStore.List("user")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := types.CompareWebAuthnCredentials(
+		[]types.WebAuthnCredential{updated, credential("user", "b", 0)},
+		found,
+	); err != nil {
+		t.Fatal(err)
+	}
+
+	if found, err = credentialStore.List("nobody"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := types.CompareWebAuthnCredentials(nil, found); err != nil {
+		t.Fatal(err)
+	}
+}
+
+var credentialStore = func() *PGWebAuthnCredentialStore {
+	s := (*PGWebAuthnCredentialStore)((*sql.DB)(store))
+	if err := s.ResetTable(); err != nil {
+		log.Fatalf(
+			"unexpected error resetting credential store postgres table: %v",
+			err,
+		)
+	}
+	return s
+}()
@@ -333,6 +333,7 @@ func update(db *sql.DB, table *Table, item Item) error {
 			handleErr(table, err),
 		)
 	}
+	defer rows.Close()
 	if !rows.Next() {
 		return fmt.Errorf(
 			"inserting row into postgres table `%s`: %w",
@@ -456,7 +457,9 @@ func (t *Table) setListSQL(columns []Column) string {
 }
 
 // Ensure creates the table if it doesn't already exist. If the table already
-// exists but has a different schema, it will not be changed.
+// exists, any missing non-primary-key columns are added to it (so columns
+// which are added to an existing table must either be nullable or have a
+// default). Other schema differences are not reconciled.
 func (t *Table) Ensure(db *sql.DB) error {
 	if _, err := db.Exec(fmt.Sprintf(
 		"CREATE TABLE IF NOT EXISTS \"%s\" %s",
@@ -465,6 +468,23 @@ func (t *Table) Ensure(db *sql.DB) error {
 	)); err != nil {
 		return fmt.Errorf("creating `%s` postgres table: %w", t.Name, err)
 	}
+
+	for i := range t.OtherColumns {
+		var sb strings.Builder
+		t.OtherColumns[i].createSQL(&sb)
+		if _, err := db.Exec(fmt.Sprintf(
+			"ALTER TABLE \"%s\" ADD COLUMN IF NOT EXISTS %s",
+			t.Name,
+			sb.String(),
+		)); err != nil {
+			return fmt.Errorf(
+				"adding column `%s` to `%s` postgres table: %w",
+				t.OtherColumns[i].Name,
+				t.Name,
+				err,
+			)
+		}
+	}
 	return nil
 }
 